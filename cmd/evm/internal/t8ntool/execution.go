@@ -212,6 +212,10 @@ func (pre *Prestate) Apply(vmConfig vm.Config, chainConfig *params.ChainConfig,
 			receipt.TransactionIndex = uint(txIndex)
 			receipts = append(receipts, receipt)
 		}
+		// Close the standard trace with the state root after the transaction
+		if tracer, ok := tracer.(*vm.JSONLogger); ok {
+			tracer.WriteSummary(statedb.IntermediateRoot(chainConfig.IsEIP158(vmContext.BlockNumber)), !msgResult.Failed(), "")
+		}
 
 		txIndex++
 	}
@@ -42,6 +42,10 @@ var (
 		Name:  "trace.noreturndata",
 		Usage: "Disable return data output in traces",
 	}
+	TraceDisableStorageFlag = cli.BoolFlag{
+		Name:  "trace.nostorage",
+		Usage: "Disable storage output in traces",
+	}
 	OutputBasedir = cli.StringFlag{
 		Name:  "output.basedir",
 		Usage: "Specifies where output files are placed. Will be created if it does not exist.",
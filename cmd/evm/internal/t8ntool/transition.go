@@ -108,6 +108,7 @@ func Transition(ctx *cli.Context) error {
 		// Configure the EVM logger
 		logConfig := &vm.LogConfig{
 			DisableStack:     ctx.Bool(TraceDisableStackFlag.Name),
+			DisableStorage:   ctx.Bool(TraceDisableStorageFlag.Name),
 			EnableMemory:     !ctx.Bool(TraceDisableMemoryFlag.Name),
 			EnableReturnData: !ctx.Bool(TraceDisableReturnDataFlag.Name),
 			Debug:            true,
@@ -23,6 +23,7 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/log"
@@ -67,10 +68,12 @@ func stateTestCmd(ctx *cli.Context) error {
 	var (
 		tracer   vm.Tracer
 		debugger *vm.StructLogger
+		machine  *vm.JSONLogger
 	)
 	switch {
 	case ctx.GlobalBool(MachineFlag.Name):
-		tracer = vm.NewJSONLogger(config, os.Stderr)
+		machine = vm.NewJSONLogger(config, os.Stderr)
+		tracer = machine
 
 	case ctx.GlobalBool(DebugFlag.Name):
 		debugger = vm.NewStructLogger(config)
@@ -99,10 +102,6 @@ func stateTestCmd(ctx *cli.Context) error {
 			// Run the test and aggregate the result
 			result := &StatetestResult{Name: key, Fork: st.Fork, Pass: true}
 			_, s, err := test.Run(st, cfg, false)
-			// print state root for evmlab tracing
-			if ctx.GlobalBool(MachineFlag.Name) && s != nil {
-				fmt.Fprintf(os.Stderr, "{\"stateRoot\": \"%x\"}\n", s.IntermediateRoot(false))
-			}
 			if err != nil {
 				// Test failed, mark as so and dump any state to aid debugging
 				result.Pass, result.Error = false, err.Error()
@@ -111,6 +110,14 @@ func stateTestCmd(ctx *cli.Context) error {
 					result.State = &dump
 				}
 			}
+			// Close the standard trace with the resulting state root
+			if machine != nil {
+				var root common.Hash
+				if s != nil {
+					root = s.IntermediateRoot(false)
+				}
+				machine.WriteSummary(root, result.Pass, st.Fork)
+			}
 
 			results = append(results, *result)
 
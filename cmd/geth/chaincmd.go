@@ -49,6 +49,7 @@ var (
 		ArgsUsage: "<genesisPath>",
 		Flags: []cli.Flag{
 			utils.DataDirFlag,
+			utils.StateSchemeFlag,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
@@ -56,7 +57,9 @@ The init command initializes a new genesis block and definition for the network.
 This is a destructive action and changes the network in which you will be
 participating.
 
-It expects the genesis file as argument.`,
+It expects the genesis file as argument. The storage scheme of the state trie
+nodes can only be chosen here, with --state.scheme, when the database is first
+initialized.`,
 	}
 	dumpGenesisCommand = cli.Command{
 		Action:    utils.MigrateFlags(dumpGenesis),
@@ -127,6 +130,44 @@ Optional second and third arguments control the first and
 last block to write. In this mode, the file will be appended
 if already existing. If the file ends with .gz, the output will
 be gzipped.`,
+	}
+	importHistoryCommand = cli.Command{
+		Action:    utils.MigrateFlags(importHistory),
+		Name:      "import-history",
+		Usage:     "Import the blocks and receipts from era1 history archives",
+		ArgsUsage: "<dir>",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+			utils.TxLookupLimitFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The import-history command imports the blocks, receipts and total difficulties
+from the era1 archives of the network in the given directory, as written by
+export-history. Each archive is checked against the checksums.txt file in the
+directory and against its accumulator root before being imported. The blocks are
+written directly into the ancient store, without executing them, so the state of
+the imported chain must be synced or regenerated separately.`,
+	}
+	exportHistoryCommand = cli.Command{
+		Action:    utils.MigrateFlags(exportHistory),
+		Name:      "export-history",
+		Usage:     "Export the blocks and receipts into era1 history archives",
+		ArgsUsage: "<dir> <blockNumFirst> <blockNumLast>",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The export-history command exports the blocks, receipts and total difficulties of
+the chain between the given blocks into era1 archives in the given directory. Each
+archive holds an epoch of 8192 blocks, along with an accumulator root over the
+block hashes and total difficulties, and an index for random access. The SHA256
+checksums of the archives are written into checksums.txt.`,
 	}
 	importPreimagesCommand = cli.Command{
 		Action:    utils.MigrateFlags(importPreimages),
@@ -196,6 +237,13 @@ func initGenesis(ctx *cli.Context) error {
 	if err := json.NewDecoder(file).Decode(genesis); err != nil {
 		utils.Fatalf("invalid genesis file: %v", err)
 	}
+	scheme := rawdb.HashScheme
+	if ctx.IsSet(utils.StateSchemeFlag.Name) {
+		scheme = ctx.String(utils.StateSchemeFlag.Name)
+		if scheme != rawdb.HashScheme && scheme != rawdb.PathScheme {
+			utils.Fatalf("Invalid state scheme %q, must be %q or %q", scheme, rawdb.HashScheme, rawdb.PathScheme)
+		}
+	}
 	// Open and initialise both full and light databases
 	stack, _ := makeConfigNode(ctx)
 	defer stack.Close()
@@ -205,6 +253,15 @@ func initGenesis(ctx *cli.Context) error {
 		if err != nil {
 			utils.Fatalf("Failed to open database: %v", err)
 		}
+		// The state scheme can't be changed once the database is initialized,
+		// light clients don't store the state at all
+		if name == "chaindata" {
+			if rawdb.ReadCanonicalHash(chaindb, 0) == (common.Hash{}) {
+				rawdb.WriteStateScheme(chaindb, scheme)
+			} else if stored := rawdb.ReadStateScheme(chaindb); ctx.IsSet(utils.StateSchemeFlag.Name) && stored != scheme {
+				utils.Fatalf("Database is already initialized with the %q state scheme", stored)
+			}
+		}
 		_, hash, err := core.SetupGenesisBlock(chaindb, genesis)
 		if err != nil {
 			utils.Fatalf("Failed to write genesis block: %v", err)
@@ -344,6 +401,56 @@ func exportChain(ctx *cli.Context) error {
 	return nil
 }
 
+// importHistory imports the chain history from era1 archives.
+func importHistory(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chain, db := utils.MakeChain(ctx, stack)
+	defer db.Close()
+
+	start := time.Now()
+	err := utils.ImportHistory(chain, db, ctx.Args().First())
+	chain.Stop()
+	if err != nil {
+		utils.Fatalf("Import error: %v\n", err)
+	}
+	fmt.Printf("Import done in %v\n", time.Since(start))
+	return nil
+}
+
+// exportHistory exports the chain history into era1 archives.
+func exportHistory(ctx *cli.Context) error {
+	if len(ctx.Args()) != 3 {
+		utils.Fatalf("This command requires three arguments.")
+	}
+	first, ferr := strconv.ParseUint(ctx.Args().Get(1), 10, 64)
+	last, lerr := strconv.ParseUint(ctx.Args().Get(2), 10, 64)
+	if ferr != nil || lerr != nil {
+		utils.Fatalf("Export error in parsing parameters: block number not an integer\n")
+	}
+	if first > last {
+		utils.Fatalf("Export error: first block %d larger than last block %d\n", first, last)
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chain, db := utils.MakeChain(ctx, stack)
+	defer db.Close()
+
+	start := time.Now()
+	err := utils.ExportHistory(chain, ctx.Args().First(), first, last)
+	chain.Stop()
+	if err != nil {
+		utils.Fatalf("Export error: %v\n", err)
+	}
+	fmt.Printf("Export done in %v\n", time.Since(start))
+	return nil
+}
+
 // importPreimages imports preimage data from the specified file.
 func importPreimages(ctx *cli.Context) error {
 	if len(ctx.Args()) < 1 {
@@ -17,25 +17,53 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/console/prompt"
+	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/ancientrpc"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/trie"
 	"gopkg.in/urfave/cli.v1"
 )
 
 var (
+	pruneHistoryBeforeFlag = cli.Uint64Flag{
+		Name:  "before",
+		Usage: "Number of the first block whose body and receipts are retained",
+	}
+	serveAncientsAddrFlag = cli.StringFlag{
+		Name:  "addr",
+		Usage: "Listening address of the ancient store RPC server",
+		Value: "localhost:8549",
+	}
+	checkRepairFlag = cli.BoolFlag{
+		Name:  "repair",
+		Usage: "Repair the inconsistencies of the ancient store that can be fixed automatically",
+	}
+	checkSamplesFlag = cli.IntFlag{
+		Name:  "samples",
+		Usage: "Number of random positions at which the snapshot is compared with the state trie (0 = full scan)",
+		Value: 1000,
+	}
 	removedbCommand = cli.Command{
 		Action:    utils.MigrateFlags(removeDB),
 		Name:      "removedb",
@@ -62,6 +90,9 @@ Remove blockchain and state databases`,
 			dbPutCmd,
 			dbGetSlotsCmd,
 			dbDumpFreezerIndex,
+			dbPruneHistoryCmd,
+			dbServeAncientsCmd,
+			dbCheckCmd,
 		},
 	}
 	dbInspectCmd = cli.Command{
@@ -187,6 +218,69 @@ WARNING: This is a low-level operation which may cause database corruption!`,
 		},
 		Description: "This command displays information about the freezer index.",
 	}
+	dbPruneHistoryCmd = cli.Command{
+		Action: utils.MigrateFlags(pruneHistory),
+		Name:   "prune-history",
+		Usage:  "Prune the ancient block bodies and receipts below a given block",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.SyncModeFlag,
+			utils.MainnetFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			pruneHistoryBeforeFlag,
+		},
+		Description: `This command deletes the bodies and receipts of the blocks below the
+number given with --before from the ancient store. The headers are retained, so the
+chain can still be verified, but the pruned blocks and receipts can't be served over
+RPC or to peers anymore. Only blocks already moved into the ancient store can be pruned.
+WARNING: The pruned data can only be restored by resyncing the chain.`,
+	}
+	dbServeAncientsCmd = cli.Command{
+		Action: utils.MigrateFlags(serveAncients),
+		Name:   "serve-ancients",
+		Usage:  "Serve the ancient store read-only over HTTP",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.SyncModeFlag,
+			utils.MainnetFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			serveAncientsAddrFlag,
+		},
+		Description: `This command opens the ancient chain segments read-only and serves them
+over HTTP on the address given with --addr, until interrupted. It can run alongside
+the node appending to the ancient store. Other nodes can attach the served store by
+setting --datadir.ancient to its URL, answering queries for historical blocks and
+receipts without a copy of their own.`,
+	}
+	dbCheckCmd = cli.Command{
+		Action: utils.MigrateFlags(checkDB),
+		Name:   "check",
+		Usage:  "Check the consistency of the chain, state and ancient databases",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.SyncModeFlag,
+			utils.MainnetFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			checkRepairFlag,
+			checkSamplesFlag,
+		},
+		Description: `This command verifies the databases of a stopped node and prints a JSON
+report of the inconsistencies found. It checks the index files of the ancient store
+against their data files, the headers, bodies, receipts and number mappings of the
+canonical chain across the key-value and ancient stores, and the snapshot against
+the state trie, at the number of random positions given with --samples, or fully if
+it's zero. With --repair, torn writes at the head of the ancient store are truncated,
+as long as no other inconsistency was found in it. The command fails if any issue
+remains unrepaired.`,
+	}
 )
 
 func removeDB(ctx *cli.Context) error {
@@ -499,3 +593,146 @@ func freezerInspect(ctx *cli.Context) error {
 	}
 	return nil
 }
+
+// pruneHistory deletes the ancient block bodies and receipts below the given
+// block number.
+func pruneHistory(ctx *cli.Context) error {
+	before := ctx.Uint64(pruneHistoryBeforeFlag.Name)
+	if before == 0 {
+		return fmt.Errorf("missing --%s, the first block to retain", pruneHistoryBeforeFlag.Name)
+	}
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	db := utils.MakeChainDatabase(ctx, stack, false)
+	defer db.Close()
+
+	if tail := rawdb.ReadHistoryTail(db); tail >= before {
+		log.Info("Block history already pruned", "tail", tail)
+		return nil
+	}
+	confirm, err := prompt.Stdin.PromptConfirm(fmt.Sprintf("Prune the block bodies and receipts below #%d?", before))
+	if err != nil {
+		return err
+	}
+	if !confirm {
+		log.Info("History pruning skipped")
+		return nil
+	}
+	start := time.Now()
+	if err := rawdb.PruneHistory(db, before); err != nil {
+		return err
+	}
+	log.Info("Pruned block history", "tail", before, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// serveAncients opens the ancient store read-only and serves it over HTTP until
+// the process is interrupted.
+func serveAncients(ctx *cli.Context) error {
+	// Don't create a node, its instance lock would conflict with the one using
+	// the data directory
+	cfg := defaultNodeConfig()
+	utils.SetNodeConfig(ctx, &cfg)
+
+	path := ancientPath(ctx, &cfg)
+	store, err := rawdb.NewChainFreezer(path, "", true)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	server, err := ancientrpc.NewServer(store)
+	if err != nil {
+		return err
+	}
+	defer server.Stop()
+
+	listener, err := net.Listen("tcp", ctx.String(serveAncientsAddrFlag.Name))
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{Handler: server}
+	go httpServer.Serve(listener)
+	defer httpServer.Close()
+
+	log.Info("Serving ancient store", "path", path, "url", fmt.Sprintf("http://%v", listener.Addr()))
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+	<-sigc
+
+	log.Info("Stopping ancient store server")
+	return nil
+}
+
+// ancientPath returns the location of the ancient store configured for the node,
+// either a directory or the URL of a remote store.
+func ancientPath(ctx *cli.Context, cfg *node.Config) string {
+	path := ctx.GlobalString(utils.AncientFlag.Name)
+	switch {
+	case path == "":
+		path = filepath.Join(cfg.ResolvePath("chaindata"), "ancient")
+	case !ancientrpc.IsRemote(path) && !filepath.IsAbs(path):
+		path = cfg.ResolvePath(path)
+	}
+	return path
+}
+
+// checkDB verifies the consistency of the node databases, printing a report of
+// the issues found.
+func checkDB(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	var (
+		checks []*rawdb.CheckResult
+		start  = time.Now()
+	)
+	// The ancient files must be checked, and possibly repaired, before the
+	// freezer is opened
+	if ctx.GlobalString(utils.SyncModeFlag.Name) != "light" {
+		if path := ancientPath(ctx, stack.Config()); ancientrpc.IsRemote(path) {
+			res := rawdb.NewCheckResult("freezer")
+			res.Skipped = "remote ancient store"
+			checks = append(checks, res)
+		} else {
+			log.Info("Checking ancient store", "path", path)
+			res, err := rawdb.CheckFreezer(path, ctx.Bool(checkRepairFlag.Name))
+			if err != nil {
+				return err
+			}
+			checks = append(checks, res)
+		}
+	}
+	db := utils.MakeChainDatabase(ctx, stack, true)
+	defer db.Close()
+
+	log.Info("Checking chain")
+	checks = append(checks, core.CheckChain(db))
+
+	log.Info("Checking snapshot")
+	checks = append(checks, snapshot.Check(db, ctx.Int(checkSamplesFlag.Name)))
+
+	report := struct {
+		Checks     []*rawdb.CheckResult `json:"checks"`
+		Consistent bool                 `json:"consistent"`
+	}{Checks: checks, Consistent: true}
+	for _, check := range checks {
+		if !check.Consistent() {
+			report.Consistent = false
+		}
+	}
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+
+	log.Info("Database check completed", "consistent", report.Consistent, "elapsed", common.PrettyDuration(time.Since(start)))
+	if !report.Consistent {
+		return errors.New("database inconsistencies found")
+	}
+	return nil
+}
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"os"
@@ -34,6 +35,8 @@ import (
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
+	tutils "github.com/ethereum/go-ethereum/trie/utils"
+	"github.com/holiman/uint256"
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -61,6 +64,7 @@ var (
 				Flags: []cli.Flag{
 					utils.DataDirFlag,
 					utils.AncientFlag,
+					utils.DBEngineFlag,
 					utils.RopstenFlag,
 					utils.RinkebyFlag,
 					utils.GoerliFlag,
@@ -91,6 +95,7 @@ the trie clean cache with default directory will be deleted.
 				Flags: []cli.Flag{
 					utils.DataDirFlag,
 					utils.AncientFlag,
+					utils.DBEngineFlag,
 					utils.RopstenFlag,
 					utils.RinkebyFlag,
 					utils.GoerliFlag,
@@ -111,6 +116,7 @@ In other words, this command does the snapshot to trie conversion.
 				Flags: []cli.Flag{
 					utils.DataDirFlag,
 					utils.AncientFlag,
+					utils.DBEngineFlag,
 					utils.RopstenFlag,
 					utils.RinkebyFlag,
 					utils.GoerliFlag,
@@ -133,6 +139,7 @@ It's also usable without snapshot enabled.
 				Flags: []cli.Flag{
 					utils.DataDirFlag,
 					utils.AncientFlag,
+					utils.DBEngineFlag,
 					utils.RopstenFlag,
 					utils.RinkebyFlag,
 					utils.GoerliFlag,
@@ -156,6 +163,7 @@ It's also usable without snapshot enabled.
 				Flags: []cli.Flag{
 					utils.DataDirFlag,
 					utils.AncientFlag,
+					utils.DBEngineFlag,
 					utils.RopstenFlag,
 					utils.RinkebyFlag,
 					utils.GoerliFlag,
@@ -170,6 +178,74 @@ as the backend data source, making this command a lot faster.
 
 The argument is interpreted as block number or hash. If none is provided, the latest
 block is used.
+`,
+			},
+			{
+				Name:      "convert-verkle",
+				Usage:     "Convert the state into a verkle tree for benchmarking",
+				ArgsUsage: "<root>",
+				Action:    utils.MigrateFlags(convertToVerkle),
+				Category:  "MISCELLANEOUS COMMANDS",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.AncientFlag,
+					utils.DBEngineFlag,
+					utils.RopstenFlag,
+					utils.RinkebyFlag,
+					utils.GoerliFlag,
+				},
+				Description: `
+geth snapshot convert-verkle <state-root>
+will iterate the accounts, storage slots and contract codes of the specified
+snapshot and insert them into a verkle tree, stored in a separate "verkle"
+database within the data directory. The default conversion target is the HEAD
+state.
+
+The account addresses and storage slots are recovered from the preimages, the
+entries without a known preimage are skipped and reported.
+`,
+			},
+			{
+				Name:      "export",
+				Usage:     "Export the snapshot into a set of portable flat files",
+				ArgsUsage: "<dir> [<root>]",
+				Action:    utils.MigrateFlags(exportSnapshot),
+				Category:  "MISCELLANEOUS COMMANDS",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.AncientFlag,
+					utils.DBEngineFlag,
+					utils.RopstenFlag,
+					utils.RinkebyFlag,
+					utils.GoerliFlag,
+				},
+				Description: `
+geth snapshot export <dir> [<state-root>]
+will write the accounts, storage slots and contract codes of the specified
+snapshot into the given directory, as a set of snappy compressed chunks and a
+manifest holding their checksums. The default export target is the HEAD state.
+`,
+			},
+			{
+				Name:      "import",
+				Usage:     "Import the snapshot and regenerate the state trie from exported flat files",
+				ArgsUsage: "<dir>",
+				Action:    utils.MigrateFlags(importSnapshot),
+				Category:  "MISCELLANEOUS COMMANDS",
+				Flags: []cli.Flag{
+					utils.DataDirFlag,
+					utils.AncientFlag,
+					utils.DBEngineFlag,
+					utils.RopstenFlag,
+					utils.RinkebyFlag,
+					utils.GoerliFlag,
+				},
+				Description: `
+geth snapshot import <dir>
+will rebuild the snapshot and the state trie from an export created by
+'geth snapshot export', verifying the checksums of the chunks and the root of
+the regenerated trie. The database must not contain a snapshot yet, and it must
+use the hash based state scheme.
 `,
 			},
 		},
@@ -294,7 +370,7 @@ func traverseState(ctx *cli.Context) error {
 			return err
 		}
 		if acc.Root != emptyRoot {
-			storageTrie, err := trie.NewSecure(acc.Root, triedb)
+			storageTrie, err := trie.NewSecureWithOwner(root, common.BytesToHash(accIter.Key), acc.Root, triedb)
 			if err != nil {
 				log.Error("Failed to open storage trie", "root", acc.Root, "err", err)
 				return err
@@ -384,7 +460,7 @@ func traverseRawState(ctx *cli.Context) error {
 		if node != (common.Hash{}) {
 			// Check the present for non-empty hash node(embedded node doesn't
 			// have their own hash).
-			blob := rawdb.ReadTrieNode(chaindb, node)
+			blob := rawdb.ReadTrieNodeByScheme(chaindb, triedb.Scheme(), common.Hash{}, accIter.Path(), node)
 			if len(blob) == 0 {
 				log.Error("Missing trie node(account)", "hash", node)
 				return errors.New("missing account")
@@ -400,7 +476,8 @@ func traverseRawState(ctx *cli.Context) error {
 				return errors.New("invalid account")
 			}
 			if acc.Root != emptyRoot {
-				storageTrie, err := trie.NewSecure(acc.Root, triedb)
+				owner := common.BytesToHash(accIter.LeafKey())
+				storageTrie, err := trie.NewSecureWithOwner(root, owner, acc.Root, triedb)
 				if err != nil {
 					log.Error("Failed to open storage trie", "root", acc.Root, "err", err)
 					return errors.New("missing storage trie")
@@ -413,7 +490,7 @@ func traverseRawState(ctx *cli.Context) error {
 					// Check the present for non-empty hash node(embedded node doesn't
 					// have their own hash).
 					if node != (common.Hash{}) {
-						blob := rawdb.ReadTrieNode(chaindb, node)
+						blob := rawdb.ReadTrieNodeByScheme(chaindb, triedb.Scheme(), owner, storageIter.Path(), node)
 						if len(blob) == 0 {
 							log.Error("Missing trie node(storage)", "hash", node)
 							return errors.New("missing storage")
@@ -528,3 +605,238 @@ func dumpState(ctx *cli.Context) error {
 		"elapsed", common.PrettyDuration(time.Since(start)))
 	return nil
 }
+
+// convertToVerkle inserts the content of the snapshot into a verkle tree, in
+// order to benchmark the tree against the merkle patricia tries.
+func convertToVerkle(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	chaindb := utils.MakeChainDatabase(ctx, stack, true)
+	headBlock := rawdb.ReadHeadBlock(chaindb)
+	if headBlock == nil {
+		log.Error("Failed to load head block")
+		return errors.New("no head block")
+	}
+	if ctx.NArg() > 1 {
+		log.Error("Too many arguments given")
+		return errors.New("too many arguments")
+	}
+	var (
+		root = headBlock.Root()
+		err  error
+	)
+	if ctx.NArg() == 1 {
+		root, err = parseRoot(ctx.Args()[0])
+		if err != nil {
+			log.Error("Failed to resolve state root", "err", err)
+			return err
+		}
+	}
+	snaptree, err := snapshot.New(chaindb, trie.NewDatabase(chaindb), 256, root, false, false, false)
+	if err != nil {
+		log.Error("Failed to open snapshot tree", "err", err)
+		return err
+	}
+	verkledb, err := stack.OpenDatabase("verkle", 1024, 512, "", false)
+	if err != nil {
+		log.Error("Failed to open verkle database", "err", err)
+		return err
+	}
+	defer verkledb.Close()
+
+	var (
+		triedb = trie.NewDatabase(verkledb)
+		tree   *trie.VerkleTrie
+
+		vroot   common.Hash
+		nodes   int
+		leaves  int
+		pending int
+
+		accounts, slots, codes uint64
+		missing                uint64
+
+		start  = time.Now()
+		logged = time.Now()
+	)
+	if tree, err = trie.NewVerkleTrie(common.Hash{}, triedb); err != nil {
+		return err
+	}
+	// Persist the tree and reopen it every now and then to bound the memory
+	// used by the resolved nodes.
+	flush := func() error {
+		root, written, err := tree.Commit(nil)
+		if err != nil {
+			return err
+		}
+		vroot, nodes, pending = root, nodes+written, 0
+		tree, err = trie.NewVerkleTrie(root, triedb)
+		return err
+	}
+	update := func(key, value []byte) error {
+		leaves, pending = leaves+1, pending+1
+		if err := tree.TryUpdate(key, value); err != nil {
+			return err
+		}
+		if pending >= 1000000 {
+			return flush()
+		}
+		return nil
+	}
+	log.Info("Started verkle conversion", "root", root)
+
+	accIt, err := snaptree.AccountIterator(root, common.Hash{})
+	if err != nil {
+		log.Error("Failed to open account iterator", "root", root, "err", err)
+		return err
+	}
+	defer accIt.Release()
+
+	for accIt.Next() {
+		account, err := snapshot.FullAccount(accIt.Account())
+		if err != nil {
+			return err
+		}
+		addr := rawdb.ReadPreimage(chaindb, accIt.Hash())
+		if len(addr) != common.AddressLength {
+			missing++
+			continue
+		}
+		accounts++
+
+		if err := tree.TryUpdateAccount(addr, &types.StateAccount{
+			Nonce:    account.Nonce,
+			Balance:  account.Balance,
+			CodeHash: account.CodeHash,
+		}); err != nil {
+			return err
+		}
+		leaves, pending = leaves+4, pending+4
+
+		if !bytes.Equal(account.CodeHash, emptyCode) {
+			code := rawdb.ReadCode(chaindb, common.BytesToHash(account.CodeHash))
+			if len(code) == 0 {
+				log.Error("Code is missing", "hash", common.BytesToHash(account.CodeHash))
+				return errors.New("missing code")
+			}
+			codes++
+
+			var size [32]byte
+			binary.LittleEndian.PutUint64(size[:], uint64(len(code)))
+			if err := update(tutils.GetTreeKeyCodeSize(addr), size[:]); err != nil {
+				return err
+			}
+			chunks := tutils.ChunkifyCode(code)
+			for i := 0; i < len(chunks)/32; i++ {
+				key := tutils.GetTreeKeyCodeChunk(addr, uint256.NewInt(uint64(i)))
+				if err := update(key, chunks[i*32:(i+1)*32]); err != nil {
+					return err
+				}
+			}
+		}
+		if common.BytesToHash(account.Root) != emptyRoot {
+			stIt, err := snaptree.StorageIterator(root, accIt.Hash(), common.Hash{})
+			if err != nil {
+				return err
+			}
+			for stIt.Next() {
+				slot := rawdb.ReadPreimage(chaindb, stIt.Hash())
+				if len(slot) != common.HashLength {
+					missing++
+					continue
+				}
+				_, content, _, err := rlp.Split(stIt.Slot())
+				if err != nil {
+					stIt.Release()
+					return err
+				}
+				key := tutils.GetTreeKeyStorageSlot(addr, new(uint256.Int).SetBytes(slot))
+				if err := update(key, common.LeftPadBytes(content, 32)); err != nil {
+					stIt.Release()
+					return err
+				}
+				slots++
+			}
+			stIt.Release()
+			if err := stIt.Error(); err != nil {
+				return err
+			}
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Verkle conversion in progress", "at", accIt.Hash(), "accounts", accounts, "slots", slots,
+				"codes", codes, "missing", missing, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	if err := accIt.Error(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	log.Info("Verkle conversion complete", "root", root, "verkle", vroot, "nodes", nodes, "leaves", leaves,
+		"accounts", accounts, "slots", slots, "codes", codes, "missing", missing, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// exportSnapshot writes the snapshot of the given state into a set of portable
+// flat files.
+func exportSnapshot(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	if ctx.NArg() < 1 || ctx.NArg() > 2 {
+		log.Error("Wrong number of arguments given")
+		return errors.New("export directory and optional state root required")
+	}
+	chaindb := utils.MakeChainDatabase(ctx, stack, true)
+	headBlock := rawdb.ReadHeadBlock(chaindb)
+	if headBlock == nil {
+		log.Error("Failed to load head block")
+		return errors.New("no head block")
+	}
+	var (
+		root = headBlock.Root()
+		err  error
+	)
+	if ctx.NArg() == 2 {
+		root, err = parseRoot(ctx.Args()[1])
+		if err != nil {
+			log.Error("Failed to resolve state root", "err", err)
+			return err
+		}
+	}
+	snaptree, err := snapshot.New(chaindb, trie.NewDatabase(chaindb), 256, headBlock.Root(), false, false, false)
+	if err != nil {
+		log.Error("Failed to open snapshot tree", "err", err)
+		return err
+	}
+	if err := snapshot.Export(snaptree, chaindb, root, ctx.Args()[0], snapshot.ExportChunkSize); err != nil {
+		log.Error("Failed to export snapshot", "root", root, "err", err)
+		return err
+	}
+	return nil
+}
+
+// importSnapshot rebuilds the snapshot and the state trie from a set of flat
+// files written by exportSnapshot.
+func importSnapshot(ctx *cli.Context) error {
+	stack, _ := makeConfigNode(ctx)
+	defer stack.Close()
+
+	if ctx.NArg() != 1 {
+		log.Error("Wrong number of arguments given")
+		return errors.New("export directory required")
+	}
+	chaindb := utils.MakeChainDatabase(ctx, stack, false)
+	root, err := snapshot.Import(chaindb, ctx.Args()[0])
+	if err != nil {
+		log.Error("Failed to import snapshot", "err", err)
+		return err
+	}
+	if head := rawdb.ReadHeadBlock(chaindb); head != nil && head.Root() != root {
+		log.Warn("Imported state is not the head state", "root", root, "head", head.Root(), "number", head.NumberU64())
+	}
+	return nil
+}
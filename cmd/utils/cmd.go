@@ -18,11 +18,16 @@
 package utils
 
 import (
+	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -36,9 +41,12 @@ import (
 	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/internal/debug"
+	"github.com/ethereum/go-ethereum/internal/era"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 	"gopkg.in/urfave/cli.v1"
 )
 
@@ -269,6 +277,296 @@ func ExportAppendChain(blockchain *core.BlockChain, fn string, first uint64, las
 	return nil
 }
 
+// historyNetwork returns the name of the network with the given genesis, used to
+// tag the history archives of its chain.
+func historyNetwork(genesis common.Hash) string {
+	switch genesis {
+	case params.MainnetGenesisHash:
+		return "mainnet"
+	case params.RopstenGenesisHash:
+		return "ropsten"
+	case params.RinkebyGenesisHash:
+		return "rinkeby"
+	case params.GoerliGenesisHash:
+		return "goerli"
+	}
+	return genesis.Hex()[2:10]
+}
+
+// ExportHistory exports the blocks, receipts and total difficulties of the chain
+// between first and last into era1 archives of one epoch each, written into the
+// given directory along with a checksums.txt listing their SHA256 hashes.
+func ExportHistory(bc *core.BlockChain, dir string, first, last uint64) error {
+	log.Info("Exporting history", "dir", dir, "first", first, "last", last)
+
+	if head := bc.CurrentFastBlock().NumberU64(); last > head {
+		return fmt.Errorf("last block #%d beyond the head block #%d", last, head)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var (
+		network   = historyNetwork(bc.Genesis().Hash())
+		checksums []string
+		start     = time.Now()
+		logged    = time.Now()
+	)
+	for epoch := first / era.MaxEra1Size; epoch <= last/era.MaxEra1Size; epoch++ {
+		from, to := epoch*era.MaxEra1Size, (epoch+1)*era.MaxEra1Size-1
+		if from < first {
+			from = first
+		}
+		if to > last {
+			to = last
+		}
+		// Write the archive into a temporary file, named after its accumulator
+		// root once complete
+		tmp := filepath.Join(dir, fmt.Sprintf("%s-%05d.era1.tmp", network, epoch))
+		f, err := os.Create(tmp)
+		if err != nil {
+			return err
+		}
+		var (
+			hasher  = sha256.New()
+			buf     = bufio.NewWriter(io.MultiWriter(f, hasher))
+			builder = era.NewBuilder(buf)
+			root    common.Hash
+		)
+		for number := from; number <= to; number++ {
+			block := bc.GetBlockByNumber(number)
+			if block == nil {
+				err = fmt.Errorf("block #%d unavailable", number)
+				break
+			}
+			receipts := bc.GetReceiptsByHash(block.Hash())
+			if receipts == nil && len(block.Transactions()) > 0 {
+				err = fmt.Errorf("receipts of block #%d unavailable", number)
+				break
+			}
+			td := bc.GetTd(block.Hash(), number)
+			if td == nil {
+				err = fmt.Errorf("total difficulty of block #%d unavailable", number)
+				break
+			}
+			if err = builder.Add(block, receipts, td); err != nil {
+				break
+			}
+			if time.Since(logged) > 8*time.Second {
+				log.Info("Exporting history", "epoch", epoch, "number", number, "elapsed", common.PrettyDuration(time.Since(start)))
+				logged = time.Now()
+			}
+		}
+		if err == nil {
+			root, err = builder.Finalize()
+		}
+		if err == nil {
+			err = buf.Flush()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		name := era.Filename(network, int(epoch), root)
+		if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		checksums = append(checksums, fmt.Sprintf("%x  %s", hasher.Sum(nil), name))
+	}
+	if err := os.WriteFile(filepath.Join(dir, "checksums.txt"), []byte(strings.Join(checksums, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+	log.Info("Exported history", "dir", dir, "archives", len(checksums), "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// ImportHistory imports the blocks and receipts from the era1 archives in the
+// given directory into the ancient store. The archives are checked against the
+// checksums.txt in the directory and their accumulator roots, and the blocks
+// against their headers, before anything is imported. The blocks already present
+// are skipped, the others must directly follow the current head.
+func ImportHistory(chain *core.BlockChain, db ethdb.Database, dir string) error {
+	network := historyNetwork(chain.Genesis().Hash())
+	log.Info("Importing history", "dir", dir, "network", network)
+
+	files, err := era.ReadDir(dir, network)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no %s history archives in %s", network, dir)
+	}
+	checksums, err := readHistoryChecksums(filepath.Join(dir, "checksums.txt"))
+	if err != nil {
+		return err
+	}
+	// Blocks are written directly into the ancient store, so no block data may
+	// have been stored after its last item yet
+	if head := chain.CurrentFastBlock().NumberU64(); head > 0 {
+		if frozen, err := db.Ancients(); err != nil || frozen != head+1 {
+			return fmt.Errorf("history can only be imported right after the ancient store, head block #%d", head)
+		}
+	}
+	var (
+		start  = time.Now()
+		logged = time.Now()
+	)
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		if err := verifyHistoryChecksum(path, checksums[name]); err != nil {
+			return err
+		}
+		e, err := era.Open(path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		err = verifyHistory(e)
+		if err == nil {
+			err = importHistory(chain, e, func(number uint64) {
+				if time.Since(logged) > 8*time.Second {
+					log.Info("Importing history", "file", name, "number", number, "elapsed", common.PrettyDuration(time.Since(start)))
+					logged = time.Now()
+				}
+			})
+		}
+		e.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	log.Info("Imported history", "head", chain.CurrentFastBlock().NumberU64(), "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// readHistoryChecksums reads the SHA256 hashes of the archives from the given
+// checksums file.
+func readHistoryChecksums(path string) (map[string]string, error) {
+	blob, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[string]string)
+	for _, line := range strings.Split(string(blob), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed checksum line %q", line)
+		}
+		checksums[fields[1]] = fields[0]
+	}
+	return checksums, nil
+}
+
+// verifyHistoryChecksum ensures the archive at the given path has the expected
+// SHA256 hash.
+func verifyHistoryChecksum(path string, want string) error {
+	if want == "" {
+		return fmt.Errorf("no checksum for %s", filepath.Base(path))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return err
+	}
+	if have := fmt.Sprintf("%x", hasher.Sum(nil)); have != want {
+		return fmt.Errorf("checksum mismatch for %s: have %s, want %s", filepath.Base(path), have, want)
+	}
+	return nil
+}
+
+// verifyHistory ensures the blocks of the archive are linked, match their headers,
+// and produce the accumulator root stored in the archive.
+func verifyHistory(e *era.Era) error {
+	var (
+		hashes = make([]common.Hash, 0, e.Count())
+		tds    = make([]*big.Int, 0, e.Count())
+		parent common.Hash
+	)
+	for number := e.Start(); number < e.Start()+e.Count(); number++ {
+		block, receipts, td, err := e.GetByNumber(number)
+		if err != nil {
+			return err
+		}
+		if block.NumberU64() != number {
+			return fmt.Errorf("block #%d stored as #%d", block.NumberU64(), number)
+		}
+		if number > e.Start() && block.ParentHash() != parent {
+			return fmt.Errorf("block #%d not linked to its parent", number)
+		}
+		if hash := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); hash != block.TxHash() {
+			return fmt.Errorf("block #%d: transaction root mismatch", number)
+		}
+		if hash := types.CalcUncleHash(block.Uncles()); hash != block.UncleHash() {
+			return fmt.Errorf("block #%d: uncle hash mismatch", number)
+		}
+		if hash := types.DeriveSha(receipts, trie.NewStackTrie(nil)); hash != block.ReceiptHash() {
+			return fmt.Errorf("block #%d: receipt root mismatch", number)
+		}
+		parent = block.Hash()
+		hashes, tds = append(hashes, parent), append(tds, td)
+	}
+	want, err := e.Accumulator()
+	if err != nil {
+		return err
+	}
+	if have, err := era.ComputeAccumulator(hashes, tds); err != nil {
+		return err
+	} else if have != want {
+		return fmt.Errorf("accumulator root mismatch: have %x, want %x", have, want)
+	}
+	return nil
+}
+
+// importHistory inserts the blocks of the archive missing from the chain in
+// batches, headers first, then the blocks with their receipts.
+func importHistory(chain *core.BlockChain, e *era.Era, progress func(uint64)) error {
+	head := chain.CurrentFastBlock().NumberU64()
+	for number := e.Start(); number < e.Start()+e.Count(); {
+		if number <= head {
+			number++
+			continue
+		}
+		var (
+			blocks   types.Blocks
+			receipts []types.Receipts
+			headers  []*types.Header
+			tds      []*big.Int
+		)
+		for ; number < e.Start()+e.Count() && len(blocks) < importBatchSize; number++ {
+			block, receipt, td, err := e.GetByNumber(number)
+			if err != nil {
+				return err
+			}
+			blocks, receipts = append(blocks, block), append(receipts, receipt)
+			headers, tds = append(headers, block.Header()), append(tds, td)
+		}
+		// The headers of the archive were verified against its accumulator,
+		// only spot check the seals like the downloader does
+		if _, err := chain.InsertHeaderChain(headers, 100); err != nil {
+			return err
+		}
+		if _, err := chain.InsertReceiptChain(blocks, receipts, math.MaxUint64); err != nil {
+			return err
+		}
+		for i, block := range blocks {
+			if td := chain.GetTd(block.Hash(), block.NumberU64()); td == nil || td.Cmp(tds[i]) != 0 {
+				return fmt.Errorf("block #%d: total difficulty mismatch: have %v, want %v", block.NumberU64(), td, tds[i])
+			}
+		}
+		progress(number - 1)
+	}
+	return nil
+}
+
 // ImportPreimages imports a batch of exported hash preimages into the database.
 func ImportPreimages(db ethdb.Database, fn string) error {
 	log.Info("Importing preimages", "file", fn)
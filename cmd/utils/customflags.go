@@ -40,6 +40,11 @@ func (s *DirectoryString) String() string {
 }
 
 func (s *DirectoryString) Set(value string) error {
+	// Some directories can be substituted by remote URLs, keep them as is
+	if strings.Contains(value, "://") {
+		*s = DirectoryString(value)
+		return nil
+	}
 	*s = DirectoryString(expandPath(value))
 	return nil
 }
@@ -49,6 +49,7 @@ import (
 	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/eth/gasprice"
 	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/eth/tracers/parity"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethstats"
 	"github.com/ethereum/go-ethereum/graphql"
@@ -115,7 +116,15 @@ var (
 	}
 	AncientFlag = DirectoryFlag{
 		Name:  "datadir.ancient",
-		Usage: "Data directory for ancient chain segments (default = inside chaindata)",
+		Usage: "Data directory for ancient chain segments (default = inside chaindata), or the URL of a remote ancient store",
+	}
+	AncientReadOnlyFlag = cli.BoolFlag{
+		Name:  "datadir.ancient.readonly",
+		Usage: "Open the ancient chain segments read-only, sharing them with the node appending to them",
+	}
+	DBEngineFlag = cli.StringFlag{
+		Name:  "db.engine",
+		Usage: "Backing database implementation to use ('leveldb' or 'pebble', default = engine of the existing database or leveldb)",
 	}
 	MinFreeDiskSpaceFlag = DirectoryFlag{
 		Name:  "datadir.minfreedisk",
@@ -213,6 +222,24 @@ var (
 		Usage: `Blockchain garbage collection mode ("full", "archive")`,
 		Value: "full",
 	}
+	StateSchemeFlag = cli.StringFlag{
+		Name:  "state.scheme",
+		Usage: `Scheme to use for storing the state trie nodes ("hash", "path"), only applied when the database is initialized`,
+		Value: rawdb.HashScheme,
+	}
+	StateHistoryFlag = cli.BoolFlag{
+		Name:  "state.history",
+		Usage: "Persist the reverse diffs of the flat state to serve historical state reads without an archive node (requires snapshots)",
+	}
+	StateChangesFlag = cli.BoolFlag{
+		Name:  "state.changes",
+		Usage: "Index the blocks modifying each account and storage slot (requires snapshots)",
+	}
+	StateChangesRetentionFlag = cli.Uint64Flag{
+		Name:  "state.changes.retention",
+		Usage: "Number of recent blocks to maintain the state change index for (0 = entire chain)",
+		Value: ethconfig.Defaults.StateChangesRetention,
+	}
 	SnapshotFlag = cli.BoolTFlag{
 		Name:  "snapshot",
 		Usage: `Enables snapshot-database mode (default = enable)`,
@@ -1205,6 +1232,22 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 	if ctx.GlobalIsSet(KeyStoreDirFlag.Name) {
 		cfg.KeyStoreDir = ctx.GlobalString(KeyStoreDirFlag.Name)
 	}
+	if ctx.GlobalIsSet(AncientReadOnlyFlag.Name) {
+		cfg.AncientsReadOnly = ctx.GlobalBool(AncientReadOnlyFlag.Name)
+	}
+	if ctx.GlobalIsSet(DBEngineFlag.Name) {
+		switch engine := ctx.GlobalString(DBEngineFlag.Name); engine {
+		case rawdb.LevelDBEngine:
+			cfg.DBEngine = engine
+		case rawdb.PebbleEngine:
+			if !rawdb.PebbleEnabled {
+				Fatalf("Invalid choice for db.engine '%s', pebble is not supported on this platform", engine)
+			}
+			cfg.DBEngine = engine
+		default:
+			Fatalf("Invalid choice for db.engine '%s', allowed 'leveldb' or 'pebble'", engine)
+		}
+	}
 	if ctx.GlobalIsSet(DeveloperFlag.Name) {
 		cfg.UseLightweightKDF = true
 	}
@@ -1520,6 +1563,15 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *ethconfig.Config) {
 		cfg.Preimages = true
 		log.Info("Enabling recording of key preimages since archive mode is used")
 	}
+	if ctx.GlobalIsSet(StateHistoryFlag.Name) {
+		cfg.StateHistory = ctx.GlobalBool(StateHistoryFlag.Name)
+	}
+	if ctx.GlobalIsSet(StateChangesFlag.Name) {
+		cfg.StateChanges = ctx.GlobalBool(StateChangesFlag.Name)
+	}
+	if ctx.GlobalIsSet(StateChangesRetentionFlag.Name) {
+		cfg.StateChangesRetention = ctx.GlobalUint64(StateChangesRetentionFlag.Name)
+	}
 	if ctx.GlobalIsSet(TxLookupLimitFlag.Name) {
 		cfg.TxLookupLimit = ctx.GlobalUint64(TxLookupLimitFlag.Name)
 	}
@@ -1682,6 +1734,8 @@ func RegisterEthService(stack *node.Node, cfg *ethconfig.Config) (ethapi.Backend
 			Fatalf("Failed to register the Ethereum service: %v", err)
 		}
 		stack.RegisterAPIs(tracers.APIs(backend.ApiBackend))
+		stack.RegisterAPIs(parity.APIs(backend.ApiBackend))
+		registerTraceStream(stack, backend.ApiBackend)
 		return backend.ApiBackend, nil
 	}
 	backend, err := eth.New(stack, cfg)
@@ -1695,9 +1749,24 @@ func RegisterEthService(stack *node.Node, cfg *ethconfig.Config) (ethapi.Backend
 		}
 	}
 	stack.RegisterAPIs(tracers.APIs(backend.APIBackend))
+	stack.RegisterAPIs(parity.APIs(backend.APIBackend))
+	registerTraceStream(stack, backend.APIBackend)
 	return backend.APIBackend, backend
 }
 
+// registerTraceStream mounts the streaming chain tracer on the HTTP server, if
+// the debug namespace is exposed over HTTP.
+func registerTraceStream(stack *node.Node, backend tracers.Backend) {
+	cfg := stack.Config()
+	for _, module := range cfg.HTTPModules {
+		if module == "debug" {
+			handler := node.NewHTTPHandlerStack(tracers.NewChainStreamHandler(backend), cfg.HTTPCors, cfg.HTTPVirtualHosts)
+			stack.RegisterHandler("Chain trace stream", "/debug/traceChain", handler)
+			return
+		}
+	}
+}
+
 // RegisterEthStatsService configures the Ethereum Stats daemon and adds it to
 // the given node.
 func RegisterEthStatsService(stack *node.Node, backend ethapi.Backend, url string) {
@@ -0,0 +1,113 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of go-ethereum.
+//
+// go-ethereum is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// go-ethereum is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with go-ethereum. If not, see <http://www.gnu.org/licenses/>.
+
+package utils
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that the history exported into era1 archives can be imported into the
+// ancient store of a fresh node, and that tampered archives are rejected.
+func TestHistoryExportImport(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		genesis = &core.Genesis{
+			Config: params.TestChainConfig,
+			Alloc:  core.GenesisAlloc{address: {Balance: big.NewInt(1000000000000000000)}},
+		}
+		signer = types.LatestSigner(genesis.Config)
+		db     = rawdb.NewMemoryDatabase()
+	)
+	gblock := genesis.MustCommit(db)
+	blocks, _ := core.GenerateChain(genesis.Config, gblock, ethash.NewFaker(), db, 40, func(i int, b *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(address), common.Address{0xaa}, big.NewInt(1), params.TxGas, b.BaseFee(), nil), signer, key)
+		b.AddTx(tx)
+	})
+	chain, err := core.NewBlockChain(db, nil, genesis.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	dir := t.TempDir()
+	if err := ExportHistory(chain, dir, 0, 40); err != nil {
+		t.Fatalf("failed to export history: %v", err)
+	}
+	// Import the history into a fresh node
+	importHistoryInto := func(dir string) (*core.BlockChain, error) {
+		db, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), t.TempDir(), "", false)
+		if err != nil {
+			t.Fatalf("failed to create database: %v", err)
+		}
+		genesis.MustCommit(db)
+		imported, err := core.NewBlockChain(db, nil, genesis.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			t.Fatalf("failed to create chain: %v", err)
+		}
+		return imported, ImportHistory(imported, db, dir)
+	}
+	imported, err := importHistoryInto(dir)
+	if err != nil {
+		t.Fatalf("failed to import history: %v", err)
+	}
+	defer imported.Stop()
+
+	if head := imported.CurrentFastBlock(); head.Hash() != blocks[39].Hash() {
+		t.Fatalf("head mismatch: have #%d, want #%d", head.NumberU64(), blocks[39].NumberU64())
+	}
+	for _, block := range blocks {
+		if receipts := imported.GetReceiptsByHash(block.Hash()); len(receipts) != 1 {
+			t.Fatalf("block #%d: receipts missing", block.NumberU64())
+		}
+		if have, want := imported.GetTd(block.Hash(), block.NumberU64()), chain.GetTd(block.Hash(), block.NumberU64()); have.Cmp(want) != 0 {
+			t.Fatalf("block #%d: total difficulty mismatch: have %v, want %v", block.NumberU64(), have, want)
+		}
+	}
+	// Corrupt an archive and ensure it's rejected
+	files, _ := filepath.Glob(filepath.Join(dir, "*.era1"))
+	if len(files) != 1 {
+		t.Fatalf("archive count mismatch: have %d, want 1", len(files))
+	}
+	blob, _ := os.ReadFile(files[0])
+	blob[len(blob)/2] ^= 0xff
+	os.WriteFile(files[0], blob, 0644)
+
+	broken, err := importHistoryInto(dir)
+	defer broken.Stop()
+	if err == nil {
+		t.Fatalf("tampered history imported")
+	}
+	if head := broken.CurrentFastBlock().NumberU64(); head != 0 {
+		t.Fatalf("tampered history partially imported up to #%d", head)
+	}
+}
@@ -71,6 +71,16 @@ func BenchmarkInsertChain_ring1000_diskdb(b *testing.B) {
 	benchInsertChain(b, true, genTxRing(1000))
 }
 
+// The storage benchmarks modify the storage of many contracts in every block,
+// run them with -cpu 1,N to measure the speedup of processing the storage tries
+// concurrently.
+func BenchmarkInsertChain_storage100_memdb(b *testing.B) {
+	benchInsertChainWithAlloc(b, false, genStorageAlloc(100), genStorageTxs(100))
+}
+func BenchmarkInsertChain_storage100_diskdb(b *testing.B) {
+	benchInsertChainWithAlloc(b, true, genStorageAlloc(100), genStorageTxs(100))
+}
+
 var (
 	// This is the content of the genesis block used by the benchmarks.
 	benchRootKey, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
@@ -134,6 +144,44 @@ func genTxRing(naccounts int) func(int, *BlockGen) {
 	}
 }
 
+// storageContracts is the size of the storage of the benchmark contracts, and
+// also the number of slots they cycle through while modifying it.
+const storageContracts = 1000
+
+// storageContract returns the address of the n-th storage benchmark contract.
+func storageContract(n int) common.Address {
+	return common.BigToAddress(big.NewInt(int64(0xc0de0000 + n)))
+}
+
+// genStorageAlloc returns the genesis allocation of n contracts with a filled
+// storage, which overwrite one of their slots when called.
+func genStorageAlloc(n int) GenesisAlloc {
+	// sstore(number % 1000, number)
+	code := []byte{byte(vm.PUSH2), 0x03, 0xe8, byte(vm.NUMBER), byte(vm.MOD), byte(vm.NUMBER), byte(vm.SWAP1), byte(vm.SSTORE)}
+
+	alloc := make(GenesisAlloc)
+	for i := 0; i < n; i++ {
+		storage := make(map[common.Hash]common.Hash)
+		for j := 0; j < storageContracts; j++ {
+			storage[common.BigToHash(big.NewInt(int64(j)))] = common.Hash{0xff}
+		}
+		alloc[storageContract(i)] = GenesisAccount{Balance: common.Big0, Code: code, Storage: storage}
+	}
+	return alloc
+}
+
+// genStorageTxs returns a block generator that calls each of the n storage
+// benchmark contracts in every block.
+func genStorageTxs(n int) func(int, *BlockGen) {
+	return func(i int, gen *BlockGen) {
+		for j := 0; j < n; j++ {
+			tx := types.NewTransaction(gen.TxNonce(benchRootAddr), storageContract(j), common.Big0, 50000, gen.header.BaseFee, nil)
+			tx, _ = types.SignTx(tx, types.HomesteadSigner{}, benchRootKey)
+			gen.AddTx(tx)
+		}
+	}
+}
+
 // genUncles generates blocks with two uncle headers.
 func genUncles(i int, gen *BlockGen) {
 	if i >= 6 {
@@ -147,6 +195,10 @@ func genUncles(i int, gen *BlockGen) {
 }
 
 func benchInsertChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
+	benchInsertChainWithAlloc(b, disk, nil, gen)
+}
+
+func benchInsertChainWithAlloc(b *testing.B, disk bool, alloc GenesisAlloc, gen func(int, *BlockGen)) {
 	// Create the database in memory or in a temporary directory.
 	var db ethdb.Database
 	if !disk {
@@ -170,6 +222,9 @@ func benchInsertChain(b *testing.B, disk bool, gen func(int, *BlockGen)) {
 		Config: params.TestChainConfig,
 		Alloc:  GenesisAlloc{benchRootAddr: {Balance: benchRootFunds}},
 	}
+	for addr, account := range alloc {
+		gspec.Alloc[addr] = account
+	}
 	genesis := gspec.MustCommit(db)
 	chain, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, b.N, gen)
 
@@ -34,7 +34,9 @@ import (
 	"github.com/ethereum/go-ethereum/consensus"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/pruner"
 	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/stateless"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -131,6 +133,8 @@ type CacheConfig struct {
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
 	Preimages           bool          // Whether to store preimage of trie key to the disk
+	StateHistory        string        // Directory to persist the reverse diffs of the flat state into (disabled if empty)
+	StateChanges        bool          // Whether to record the accounts and storage slots modified by each block
 
 	SnapshotWait bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
 }
@@ -163,10 +167,14 @@ type BlockChain struct {
 	chainConfig *params.ChainConfig // Chain & network configuration
 	cacheConfig *CacheConfig        // Cache configuration for pruning
 
-	db     ethdb.Database // Low level persistent database to store final content in
-	snaps  *snapshot.Tree // Snapshot tree for fast trie leaf access
-	triegc *prque.Prque   // Priority queue mapping block numbers to tries to gc
-	gcproc time.Duration  // Accumulates canonical block processing for trie dumping
+	db      ethdb.Database    // Low level persistent database to store final content in
+	snaps   *snapshot.Tree    // Snapshot tree for fast trie leaf access
+	history *snapshot.History // State history serving the flattened snapshot layers
+	triegc  *prque.Prque      // Priority queue mapping block numbers to tries to gc
+	gcproc  time.Duration     // Accumulates canonical block processing for trie dumping
+
+	pruner   *pruner.OnlinePruner // Most recently started online state pruner
+	prunerMu sync.Mutex           // Lock protecting the online state pruner
 
 	// txLookupLimit is the maximum number of blocks from head whose tx indices
 	// are reserved:
@@ -250,6 +258,11 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		engine:         engine,
 		vmConfig:       vmConfig,
 	}
+	// Archive nodes retain all the historical states, which is exactly what
+	// the path scheme avoids by overwriting stale nodes in place.
+	if cacheConfig.TrieDirtyDisabled && bc.stateCache.TrieDB().Scheme() == rawdb.PathScheme {
+		return nil, errors.New("archive mode is not supported by the path-based state scheme")
+	}
 	bc.validator = NewBlockValidator(chainConfig, bc, engine)
 	bc.prefetcher = newStatePrefetcher(chainConfig, bc, engine)
 	bc.processor = NewStateProcessor(chainConfig, bc, engine)
@@ -313,8 +326,10 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		}
 	}
 
-	// Ensure that a previous crash in SetHead doesn't leave extra ancients
-	if frozen, err := bc.db.Ancients(); err == nil && frozen > 0 {
+	// Ensure that a previous crash in SetHead doesn't leave extra ancients. Read-only
+	// ancient stores are appended to by a different node, they are expected to run
+	// ahead of the local chain.
+	if frozen, err := bc.db.Ancients(); err == nil && frozen > 0 && !bc.db.AncientReadOnly() {
 		var (
 			needRewind bool
 			low        uint64
@@ -380,6 +395,21 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		}
 		bc.snaps, _ = snapshot.New(bc.db, bc.stateCache.TrieDB(), bc.cacheConfig.SnapshotLimit, head.Root(), !bc.cacheConfig.SnapshotWait, true, recover)
 	}
+	// Start recording the state history of the flattened snapshot layers
+	if bc.cacheConfig.StateHistory != "" {
+		if bc.snaps == nil {
+			log.Warn("State history requires snapshots, disabling")
+		} else {
+			freezer, err := rawdb.NewStateHistoryFreezer(bc.cacheConfig.StateHistory, false)
+			if err != nil {
+				return nil, err
+			}
+			if bc.history, err = snapshot.NewHistory(bc.snaps, freezer); err != nil {
+				freezer.Close()
+				return nil, err
+			}
+		}
+	}
 
 	// Start future block processor.
 	bc.wg.Add(1)
@@ -393,6 +423,11 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		go bc.maintainTxIndex(txIndexBlock)
 	}
 
+	// If the clean cache was loaded from a journal, make sure it's consistent
+	// with the chain head. Inconsistent caches are dropped.
+	if bc.cacheConfig.TrieCleanJournal != "" {
+		bc.stateCache.TrieDB().ValidateCache(bc.CurrentBlock().Root())
+	}
 	// If periodic cache journal is required, spin it up.
 	if bc.cacheConfig.TrieCleanRejournal > 0 {
 		if bc.cacheConfig.TrieCleanRejournal < time.Minute {
@@ -403,7 +438,9 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		bc.wg.Add(1)
 		go func() {
 			defer bc.wg.Done()
-			triedb.SaveCachePeriodically(bc.cacheConfig.TrieCleanJournal, bc.cacheConfig.TrieCleanRejournal, bc.quit)
+			triedb.SaveCachePeriodically(bc.cacheConfig.TrieCleanJournal, bc.cacheConfig.TrieCleanRejournal, func() common.Hash {
+				return bc.CurrentBlock().Root()
+			}, bc.quit)
 		}()
 	}
 	return bc, nil
@@ -534,7 +571,14 @@ func (bc *BlockChain) SetHeadBeyondRoot(head uint64, root common.Hash) (uint64,
 					if root != (common.Hash{}) && !beyondRoot && newHeadBlock.Root() == root {
 						beyondRoot, rootNumber = true, newHeadBlock.NumberU64()
 					}
-					if _, err := state.New(newHeadBlock.Root(), bc.stateCache, bc.snaps); err != nil {
+					_, err := state.New(newHeadBlock.Root(), bc.stateCache, bc.snaps)
+					if err != nil && bc.stateCache.TrieDB().Recoverable(newHeadBlock.Root()) {
+						// Revert the persisted state in path scheme if possible
+						if err = bc.stateCache.TrieDB().Recover(newHeadBlock.Root()); err == nil {
+							_, err = state.New(newHeadBlock.Root(), bc.stateCache, bc.snaps)
+						}
+					}
+					if err != nil {
 						log.Trace("Block state missing, rewinding further", "number", newHeadBlock.NumberU64(), "hash", newHeadBlock.Hash())
 						if pivot == nil || newHeadBlock.NumberU64() > *pivot {
 							parent := bc.GetBlock(newHeadBlock.ParentHash(), newHeadBlock.NumberU64()-1)
@@ -595,9 +639,10 @@ func (bc *BlockChain) SetHeadBeyondRoot(head uint64, root common.Hash) (uint64,
 	}
 	// Rewind the header chain, deleting all block bodies until then
 	delFn := func(db ethdb.KeyValueWriter, hash common.Hash, num uint64) {
-		// Ignore the error here since light client won't hit this path
+		// Ignore the error here since light client won't hit this path. Read-only
+		// ancient stores are left intact, only the local copies are deleted.
 		frozen, _ := bc.db.Ancients()
-		if num+1 <= frozen {
+		if num+1 <= frozen && !bc.db.AncientReadOnly() {
 			// Truncate all relative data(header, total difficulty, body, receipt
 			// and canonical hash) from ancient store.
 			if err := bc.db.TruncateAncients(num); err != nil {
@@ -708,6 +753,39 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return state.New(root, bc.stateCache, bc.snaps)
 }
 
+// HistoricStateAt returns a state based on a particular point in time, for
+// reading only. If the trie nodes of the state are gone but the state history
+// covers it, the returned state is served from the state history, which can't
+// be hashed, committed or proven.
+func (bc *BlockChain) HistoricStateAt(root common.Hash) (*state.StateDB, error) {
+	statedb, err := state.New(root, bc.stateCache, bc.snaps)
+	if err != nil && bc.history != nil && bc.history.Available(root) {
+		db, herr := state.NewHistoricDatabase(bc.stateCache, bc.history, root)
+		if herr != nil {
+			return nil, herr
+		}
+		return state.New(root, db, nil)
+	}
+	return statedb, err
+}
+
+// ProofStateAt returns a state based on a particular point in time, suitable
+// for proving its accounts and storage slots. If the trie nodes of the state
+// are gone but the snapshot diff layers cover it, the tries are rebuilt in
+// memory from the closest available ancestor.
+func (bc *BlockChain) ProofStateAt(root common.Hash) (*state.StateDB, error) {
+	statedb, err := state.New(root, bc.stateCache, bc.snaps)
+	if err != nil && bc.snaps != nil {
+		db, rerr := state.NewReplayDatabase(bc.stateCache, bc.snaps, root)
+		if rerr != nil {
+			log.Debug("Failed to replay state from snapshot diffs", "root", root, "err", rerr)
+			return nil, err
+		}
+		return state.New(root, db, bc.snaps)
+	}
+	return statedb, err
+}
+
 // StateCache returns the caching database underpinning the blockchain instance.
 func (bc *BlockChain) StateCache() state.Database {
 	return bc.stateCache
@@ -936,6 +1014,12 @@ func (bc *BlockChain) GetBlockByNumber(number uint64) *types.Block {
 	return bc.GetBlock(hash, number)
 }
 
+// HistoryTail retrieves the number of the first block whose body and receipts
+// are retained, the ones below it were pruned from the ancient store.
+func (bc *BlockChain) HistoryTail() uint64 {
+	return rawdb.ReadHistoryTail(bc.db)
+}
+
 // GetReceiptsByHash retrieves the receipts for all transactions in a given block.
 func (bc *BlockChain) GetReceiptsByHash(hash common.Hash) types.Receipts {
 	if receipts, ok := bc.receiptsCache.Get(hash); ok {
@@ -1007,12 +1091,92 @@ func (bc *BlockChain) ContractCodeWithPrefix(hash common.Hash) ([]byte, error) {
 	return bc.stateCache.(codeReader).ContractCodeWithPrefix(common.Hash{}, hash)
 }
 
+// StartStatePruning persists the current head state and starts deleting all the
+// stale state entries not belonging to it or to any of the recent states in the
+// background, while the chain keeps progressing.
+func (bc *BlockChain) StartStatePruning(config pruner.OnlineConfig) (*pruner.OnlinePruner, error) {
+	if bc.cacheConfig.TrieDirtyDisabled {
+		return nil, errors.New("state pruning is not available in archive mode")
+	}
+	if bc.snaps == nil {
+		return nil, errors.New("state pruning requires the state snapshot")
+	}
+	bc.prunerMu.Lock()
+	defer bc.prunerMu.Unlock()
+
+	if bc.pruner != nil && bc.pruner.Running() {
+		return nil, errors.New("state pruning already running")
+	}
+	if !bc.chainmu.TryLock() {
+		return nil, errChainStopped
+	}
+	var (
+		root   = bc.CurrentBlock().Root()
+		triedb = bc.stateCache.TrieDB()
+	)
+	p, err := pruner.NewOnlinePruner(bc.db, triedb, bc.snaps, root, config)
+	if err == nil {
+		err = triedb.Commit(root, true, nil)
+	}
+	bc.chainmu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	p.Start()
+	bc.pruner = p
+	return p, nil
+}
+
+// StatePruner returns the most recently started online state pruner, or nil if
+// no pruning was started yet.
+func (bc *BlockChain) StatePruner() *pruner.OnlinePruner {
+	bc.prunerMu.Lock()
+	defer bc.prunerMu.Unlock()
+
+	return bc.pruner
+}
+
+// ExecutionWitness re-executes the given block on top of its parent state and
+// records all the trie nodes, contract codes and ancestor headers it accesses.
+// The execution is validated against the block, so the returned witness is
+// enough to execute the block statelessly via ExecuteStateless.
+func (bc *BlockChain) ExecutionWitness(block *types.Block) (*stateless.Witness, error) {
+	parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, consensus.ErrUnknownAncestor
+	}
+	// Open the parent state straight from its tries, without any snapshot or
+	// fallback database, so every node needed to execute the block is recorded
+	statedb, err := state.New(parent.Root, bc.stateCache, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parent state %x unavailable: %w", parent.Root, err)
+	}
+	witness, err := stateless.NewWitness(block.Header(), bc)
+	if err != nil {
+		return nil, err
+	}
+	statedb.StartWitness(witness)
+
+	receipts, _, usedGas, err := bc.processor.Process(block, statedb, vm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if err := bc.validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
+		return nil, err
+	}
+	return witness, nil
+}
+
 // Stop stops the blockchain service. If any imports are currently in progress
 // it will abort them using the procInterrupt.
 func (bc *BlockChain) Stop() {
 	if !atomic.CompareAndSwapInt32(&bc.running, 0, 1) {
 		return
 	}
+	// Interrupt the state pruning, it's safe to resume it from scratch anytime
+	if p := bc.StatePruner(); p != nil {
+		p.Abort()
+	}
 
 	// Unsubscribe all subscriptions registered from blockchain.
 	bc.scope.Close()
@@ -1038,14 +1202,28 @@ func (bc *BlockChain) Stop() {
 			log.Error("Failed to journal state snapshot", "err", err)
 		}
 	}
+	if bc.history != nil {
+		if err := bc.history.Close(); err != nil {
+			log.Error("Failed to close state history", "err", err)
+		}
+	}
 
 	// Ensure the state of a recent block is also stored to disk before exiting.
 	// We're writing three different states to catch different restart scenarios:
 	//  - HEAD:     So we don't need to reprocess any blocks in the general case
 	//  - HEAD-1:   So we don't do large reorgs if our HEAD becomes an uncle
 	//  - HEAD-127: So we have a hard limit on the number of blocks reexecuted
-	if !bc.cacheConfig.TrieDirtyDisabled {
-		triedb := bc.stateCache.TrieDB()
+	//
+	// In path scheme, there's only a single persisted state, so the HEAD is
+	// written and the older ones are reachable with the reverse diffs.
+	if triedb := bc.stateCache.TrieDB(); triedb.Scheme() == rawdb.PathScheme {
+		if head := bc.CurrentBlock(); head != nil {
+			log.Info("Writing cached state to disk", "block", head.Number(), "hash", head.Hash(), "root", head.Root())
+			if err := triedb.Commit(head.Root(), true, nil); err != nil {
+				log.Error("Failed to commit recent state trie", "err", err)
+			}
+		}
+	} else if !bc.cacheConfig.TrieDirtyDisabled {
 
 		for _, offset := range []uint64{0, 1, TriesInMemory - 1} {
 			if number := bc.CurrentBlock().NumberU64(); number > offset {
@@ -1074,7 +1252,7 @@ func (bc *BlockChain) Stop() {
 	// cache warmup when node restarts.
 	if bc.cacheConfig.TrieCleanJournal != "" {
 		triedb := bc.stateCache.TrieDB()
-		triedb.SaveCache(bc.cacheConfig.TrieCleanJournal)
+		triedb.SaveCache(bc.cacheConfig.TrieCleanJournal, bc.CurrentBlock().Root())
 	}
 	log.Info("Blockchain stopped")
 }
@@ -1443,6 +1621,33 @@ func (bc *BlockChain) WriteBlockWithState(block *types.Block, receipts []*types.
 	return bc.writeBlockWithState(block, receipts, logs, state, emitHeadEvent)
 }
 
+// writeStateChangeSet records the accounts and storage slots modified by the
+// block, retrieved from the snapshot diff layer of its state.
+func (bc *BlockChain) writeStateChangeSet(block *types.Block, root common.Hash) {
+	parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return
+	}
+	set := new(StateChangeSet)
+	if root != parent.Root {
+		// Without snapshots the changes are left for the indexer to diff
+		if bc.snaps == nil {
+			return
+		}
+		diff, err := bc.snaps.StateDiff(root)
+		if err != nil {
+			log.Debug("State changes unavailable", "number", block.Number(), "hash", block.Hash(), "err", err)
+			return
+		}
+		set = newStateChangeSet(diff)
+	}
+	blob, err := rlp.EncodeToBytes(set)
+	if err != nil {
+		log.Crit("Failed to encode state change set", "err", err)
+	}
+	rawdb.WriteStateChangeSet(bc.db, block.NumberU64(), block.Hash(), blob)
+}
+
 // writeBlockWithState writes the block and all associated state to the database,
 // but is expects the chain mutex to be held.
 func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.Receipt, logs []*types.Log, state *state.StateDB, emitHeadEvent bool) (status WriteStatus, err error) {
@@ -1477,10 +1682,33 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 	if err != nil {
 		return NonStatTy, err
 	}
+	// Record the accounts and storage slots modified by the block if requested
+	if bc.cacheConfig.StateChanges {
+		bc.writeStateChangeSet(block, root)
+	}
 	triedb := bc.stateCache.TrieDB()
 
-	// If we're running an archive node, always flush
-	if bc.cacheConfig.TrieDirtyDisabled {
+	// In path scheme, track the state transition as a diff layer, the database
+	// flushes the old ones by itself
+	if triedb.Scheme() == rawdb.PathScheme {
+		parent := bc.GetHeader(block.ParentHash(), block.NumberU64()-1)
+		if parent == nil {
+			return NonStatTy, consensus.ErrUnknownAncestor
+		}
+		if err := triedb.Update(root, parent.Root); err != nil {
+			return NonStatTy, err
+		}
+		var (
+			nodes, imgs = triedb.Size()
+			limit       = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
+		)
+		if nodes > limit || imgs > 4*1024*1024 {
+			if err := triedb.Cap(limit - ethdb.IdealBatchSize); err != nil {
+				return NonStatTy, err
+			}
+		}
+	} else if bc.cacheConfig.TrieDirtyDisabled {
+		// If we're running an archive node, always flush
 		if err := triedb.Commit(root, false, nil); err != nil {
 			return NonStatTy, err
 		}
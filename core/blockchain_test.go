@@ -32,11 +32,14 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/pruner"
+	"github.com/ethereum/go-ethereum/core/stateless"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -3315,3 +3318,423 @@ func TestEIP1559Transition(t *testing.T) {
 		t.Fatalf("sender balance incorrect: expected %d, got %d", expected, actual)
 	}
 }
+
+// Tests that a chain using the path-based state scheme keeps the recent states
+// available, persists the head state on shutdown and can rewind the persisted
+// state with the reverse diffs.
+func TestPathSchemeChain(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0xc0de")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		engine   = ethash.NewFaker()
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address:  {Balance: big.NewInt(params.Ether)},
+				contract: {Code: []byte{byte(vm.NUMBER), byte(vm.NUMBER), byte(vm.SSTORE)}, Balance: common.Big0}, // sstore(number, number)
+			},
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, gendb, 2*TriesInMemory, func(i int, b *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), contract, common.Big0, 50000, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	rawdb.WriteStateScheme(db, rawdb.PathScheme)
+	gspec.MustCommit(db)
+
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if scheme := chain.stateCache.TrieDB().Scheme(); scheme != rawdb.PathScheme {
+		t.Fatalf("state scheme mismatch: have %s, want %s", scheme, rawdb.PathScheme)
+	}
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	// The states of the recent blocks are in memory, the one below them is
+	// persisted, anything older is gone
+	for i, block := range blocks {
+		if have, want := chain.HasState(block.Root()), i >= len(blocks)-TriesInMemory-1; have != want {
+			t.Fatalf("block %d: state availability mismatch: have %v, want %v", block.NumberU64(), have, want)
+		}
+	}
+	checkStorage := func(number uint64) {
+		t.Helper()
+
+		statedb, err := chain.State()
+		if err != nil {
+			t.Fatalf("failed to open head state: %v", err)
+		}
+		for _, n := range []uint64{1, number, number + 1} {
+			want := common.Hash{}
+			if n <= number {
+				want = common.BigToHash(new(big.Int).SetUint64(n))
+			}
+			if have := statedb.GetState(contract, common.BigToHash(new(big.Int).SetUint64(n))); have != want {
+				t.Fatalf("slot %d mismatch: have %x, want %x", n, have, want)
+			}
+		}
+	}
+	checkStorage(uint64(len(blocks)))
+
+	// Restart the chain, the head state must be persisted
+	chain.Stop()
+	chain, err = NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if head := chain.CurrentBlock().NumberU64(); head != uint64(len(blocks)) {
+		t.Fatalf("head mismatch: have %d, want %d", head, len(blocks))
+	}
+	checkStorage(uint64(len(blocks)))
+
+	// Rewind the chain beyond the persisted state, reverting it
+	if err := chain.SetHead(TriesInMemory / 2); err != nil {
+		t.Fatalf("failed to rewind chain: %v", err)
+	}
+	if head := chain.CurrentBlock().NumberU64(); head != TriesInMemory/2 {
+		t.Fatalf("rewound head mismatch: have %d, want %d", head, TriesInMemory/2)
+	}
+	checkStorage(TriesInMemory / 2)
+}
+
+// Tests that the online state pruning deletes the stale state while the chain
+// keeps importing blocks, without damaging any of the recent states.
+func TestOnlineStatePruning(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0xc0de")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		engine   = ethash.NewFaker()
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// sstore(number, number); sstore(0, number)
+				contract: {Code: []byte{byte(vm.NUMBER), byte(vm.NUMBER), byte(vm.SSTORE), byte(vm.NUMBER), byte(vm.PUSH1), 0, byte(vm.SSTORE)}, Balance: common.Big0},
+			},
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, gendb, 3*TriesInMemory, func(i int, b *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), contract, common.Big0, 100000, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+
+	// Persist a state on every block to accumulate plenty of stale trie nodes
+	config := *defaultCacheConfig
+	config.TrieTimeLimit = time.Nanosecond
+
+	chain, err := NewBlockChain(db, &config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := chain.InsertChain(blocks[:2*TriesInMemory]); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	hadState := chain.HasState(blocks[TriesInMemory/2].Root())
+
+	// Prune in tiny batches while importing the rest of the chain
+	p, err := chain.StartStatePruning(pruner.OnlineConfig{BloomSize: 1, BatchSize: 16})
+	if err != nil {
+		t.Fatalf("failed to start state pruning: %v", err)
+	}
+	if _, err := chain.StartStatePruning(pruner.OnlineConfig{BloomSize: 1}); err == nil {
+		t.Fatalf("concurrent state pruning started")
+	}
+	if _, err := chain.InsertChain(blocks[2*TriesInMemory:]); err != nil {
+		t.Fatalf("failed to insert chain during pruning: %v", err)
+	}
+	if err := p.Wait(); err != nil {
+		t.Fatalf("state pruning failed: %v", err)
+	}
+	progress := p.Progress()
+	if progress.Stage != pruner.StageDone {
+		t.Fatalf("pruning stage mismatch: have %s, want %s", progress.Stage, pruner.StageDone)
+	}
+	if progress.Pruned == 0 {
+		t.Fatalf("no stale state pruned")
+	}
+	// The old states persisted before the pruning must be gone
+	if !hadState {
+		t.Fatalf("stale state missing before pruning")
+	}
+	if chain.HasState(blocks[TriesInMemory/2].Root()) {
+		t.Fatalf("stale state available after pruning")
+	}
+	// All the recent states and the genesis must be intact
+	checkState := func(root common.Hash) {
+		t.Helper()
+
+		triedb := chain.stateCache.TrieDB()
+		accTrie, err := trie.New(root, triedb)
+		if err != nil {
+			t.Fatalf("failed to open state %x: %v", root, err)
+		}
+		accIt := trie.NewIterator(accTrie.NodeIterator(nil))
+		for accIt.Next() {
+			var acc types.StateAccount
+			if err := rlp.DecodeBytes(accIt.Value, &acc); err != nil {
+				t.Fatalf("failed to decode account: %v", err)
+			}
+			storageTrie, err := trie.NewWithOwner(root, common.BytesToHash(accIt.Key), acc.Root, triedb)
+			if err != nil {
+				t.Fatalf("failed to open storage of state %x: %v", root, err)
+			}
+			storageIt := trie.NewIterator(storageTrie.NodeIterator(nil))
+			for storageIt.Next() {
+			}
+			if storageIt.Err != nil {
+				t.Fatalf("failed to iterate storage of state %x: %v", root, storageIt.Err)
+			}
+		}
+		if accIt.Err != nil {
+			t.Fatalf("failed to iterate state %x: %v", root, accIt.Err)
+		}
+	}
+	checkState(genesis.Root())
+	for _, block := range blocks[len(blocks)-TriesInMemory:] {
+		checkState(block.Root())
+	}
+	// Restart the chain, the persisted recent states must be complete
+	chain.Stop()
+	chain, err = NewBlockChain(db, &config, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to recreate tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if head := chain.CurrentBlock().NumberU64(); head != uint64(len(blocks)) {
+		t.Fatalf("head mismatch: have %d, want %d", head, len(blocks))
+	}
+	checkState(chain.CurrentBlock().Root())
+
+	// Abort a pruning halfway through
+	p, err = chain.StartStatePruning(pruner.OnlineConfig{BloomSize: 1, BatchSize: 1, Pause: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to start state pruning: %v", err)
+	}
+	if err := p.Abort(); err != nil {
+		t.Fatalf("failed to abort state pruning: %v", err)
+	}
+	if stage := p.Progress().Stage; stage != pruner.StageAborted {
+		t.Fatalf("pruning stage mismatch: have %s, want %s", stage, pruner.StageAborted)
+	}
+	checkState(chain.CurrentBlock().Root())
+}
+
+// Tests that the execution witness of a block contains all the state needed to
+// execute it statelessly, and nothing more.
+func TestExecutionWitness(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0xc0de")
+		other    = common.HexToAddress("0xc0df")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		engine   = ethash.NewFaker()
+		code     = []byte{
+			// sstore(number, number)
+			byte(vm.NUMBER), byte(vm.NUMBER), byte(vm.SSTORE),
+			// sstore(number-1, 0)
+			byte(vm.PUSH1), 0, byte(vm.PUSH1), 1, byte(vm.NUMBER), byte(vm.SUB), byte(vm.SSTORE),
+			// sstore(0, blockhash(number-3))
+			byte(vm.PUSH1), 3, byte(vm.NUMBER), byte(vm.SUB), byte(vm.BLOCKHASH), byte(vm.PUSH1), 0, byte(vm.SSTORE),
+			// sstore(0xff, extcodesize(0xc0df))
+			byte(vm.PUSH2), 0xc0, 0xdf, byte(vm.EXTCODESIZE), byte(vm.PUSH1), 0xff, byte(vm.SSTORE),
+		}
+		gspec = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address:  {Balance: big.NewInt(params.Ether)},
+				contract: {Code: code, Balance: common.Big0},
+				other:    {Code: []byte{byte(vm.STOP)}, Balance: common.Big0},
+			},
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+
+	chain, err := NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	// Generate and import the blocks one by one, BLOCKHASH needs the ancestors
+	// to be available in the chain
+	block := genesis
+	for i := 0; i < 8; i++ {
+		blocks, _ := GenerateChain(params.TestChainConfig, block, engine, gendb, 1, func(_ int, b *BlockGen) {
+			tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), contract, common.Big0, 100000, b.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			b.AddTxWithChain(chain, tx)
+
+			// Create a new account in every block too
+			tx, err = types.SignTx(types.NewTransaction(b.TxNonce(address), common.BigToAddress(big.NewInt(int64(i+1))), common.Big1, params.TxGas, b.header.BaseFee, nil), signer, key)
+			if err != nil {
+				t.Fatalf("failed to sign tx: %v", err)
+			}
+			b.AddTxWithChain(chain, tx)
+		})
+		if _, err := chain.InsertChain(blocks); err != nil {
+			t.Fatalf("failed to insert block %d: %v", i+1, err)
+		}
+		block = blocks[0]
+	}
+	witness, err := chain.ExecutionWitness(block)
+	if err != nil {
+		t.Fatalf("failed to create witness: %v", err)
+	}
+	if len(witness.Headers) != 3 {
+		t.Fatalf("witness header count mismatch: have %d, want %d", len(witness.Headers), 3)
+	}
+	if _, ok := witness.Codes[string(code)]; !ok {
+		t.Fatalf("executed code missing from witness")
+	}
+	if _, ok := witness.Codes[string([]byte{byte(vm.STOP)})]; !ok {
+		t.Fatalf("sized code missing from witness")
+	}
+	// Execute the block on top of the transmitted witness
+	blob, err := rlp.EncodeToBytes(witness)
+	if err != nil {
+		t.Fatalf("failed to encode witness: %v", err)
+	}
+	decoded := new(stateless.Witness)
+	if err := rlp.DecodeBytes(blob, decoded); err != nil {
+		t.Fatalf("failed to decode witness: %v", err)
+	}
+	root, receiptRoot, err := ExecuteStateless(params.TestChainConfig, engine, block, decoded)
+	if err != nil {
+		t.Fatalf("failed to execute block statelessly: %v", err)
+	}
+	if root != block.Root() {
+		t.Fatalf("state root mismatch: have %x, want %x", root, block.Root())
+	}
+	if receiptRoot != block.ReceiptHash() {
+		t.Fatalf("receipt root mismatch: have %x, want %x", receiptRoot, block.ReceiptHash())
+	}
+	// Every single trie node in the witness must be needed
+	for node := range decoded.State {
+		delete(decoded.State, node)
+		if _, _, err := ExecuteStateless(params.TestChainConfig, engine, block, decoded); err == nil {
+			t.Fatalf("block executed without trie node %x", crypto.Keccak256([]byte(node)))
+		}
+		decoded.State[node] = struct{}{}
+	}
+}
+
+// Tests that the states whose trie nodes were garbage collected are served from
+// the state history.
+func TestStateHistory(t *testing.T) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0xc0de")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		engine   = ethash.NewFaker()
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// sstore(number, number)
+				contract: {Code: []byte{byte(vm.NUMBER), byte(vm.NUMBER), byte(vm.SSTORE)}, Balance: common.Big0},
+			},
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	blocks, _ := GenerateChain(params.TestChainConfig, genesis, engine, gendb, 2*TriesInMemory, func(i int, b *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), contract, common.Big0, 100000, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+
+		tx, err = types.SignTx(types.NewTransaction(b.TxNonce(address), common.BigToAddress(big.NewInt(int64(0x1000+i%4))), big.NewInt(int64(i+1)), params.TxGas, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+
+	cacheConfig := &CacheConfig{
+		TrieCleanLimit: 256,
+		TrieDirtyLimit: 256,
+		TrieTimeLimit:  5 * time.Minute,
+		SnapshotLimit:  256,
+		SnapshotWait:   true,
+		StateHistory:   t.TempDir(),
+	}
+	chain, err := NewBlockChain(db, cacheConfig, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	for _, number := range []int{1, 2, 50, TriesInMemory} {
+		block := blocks[number-1]
+		if chain.HasState(block.Root()) {
+			t.Fatalf("block %d: state trie still present", number)
+		}
+		if _, err := chain.StateAt(block.Root()); err == nil {
+			t.Fatalf("block %d: historic state opened as mutable", number)
+		}
+		statedb, err := chain.HistoricStateAt(block.Root())
+		if err != nil {
+			t.Fatalf("block %d: failed to open historic state: %v", number, err)
+		}
+		for i := 0; i < 4; i++ {
+			want := new(big.Int)
+			for j := i; j < number; j += 4 {
+				want.Add(want, big.NewInt(int64(j+1)))
+			}
+			if have := statedb.GetBalance(common.BigToAddress(big.NewInt(int64(0x1000 + i)))); have.Cmp(want) != 0 {
+				t.Errorf("block %d: balance %d mismatch: have %v, want %v", number, i, have, want)
+			}
+		}
+		for _, slot := range []int{number - 1, number, number + 1} {
+			want := common.Hash{}
+			if slot <= number {
+				want = common.BigToHash(big.NewInt(int64(slot)))
+			}
+			if have := statedb.GetState(contract, common.BigToHash(big.NewInt(int64(slot)))); have != want {
+				t.Errorf("block %d: slot %d mismatch: have %x, want %x", number, slot, have, want)
+			}
+		}
+		if nonce := statedb.GetNonce(address); nonce != uint64(2*number) {
+			t.Errorf("block %d: nonce mismatch: have %d, want %d", number, nonce, 2*number)
+		}
+	}
+	// States not covered by the history must still fail
+	if _, err := chain.HistoricStateAt(common.HexToHash("0xdeadbeef")); err == nil {
+		t.Fatalf("unknown state opened")
+	}
+}
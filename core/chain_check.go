@@ -0,0 +1,152 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// CheckChain verifies the canonical chain stored across the key-value store and
+// the freezer. The head markers must reference canonical blocks, every canonical
+// block up to the head header must have its hash-to-number mapping, a header
+// linking to its parent and a total difficulty. Bodies and receipts are checked
+// up to the head block, apart from the pruned ones, and the state of the head
+// block must be present.
+func CheckChain(db ethdb.Database) *rawdb.CheckResult {
+	res := rawdb.NewCheckResult("chain")
+
+	// Ensure the head markers point into the canonical chain
+	var (
+		heads   = make(map[string]uint64)
+		markers = []struct {
+			name string
+			hash common.Hash
+		}{
+			{"header", rawdb.ReadHeadHeaderHash(db)},
+			{"block", rawdb.ReadHeadBlockHash(db)},
+			{"fast block", rawdb.ReadHeadFastBlockHash(db)},
+		}
+	)
+	for _, marker := range markers {
+		if marker.hash == (common.Hash{}) {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-head", Detail: fmt.Sprintf("head %s marker missing", marker.name)})
+			continue
+		}
+		number := rawdb.ReadHeaderNumber(db, marker.hash)
+		if number == nil {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-head", Detail: fmt.Sprintf("head %s %x unknown", marker.name, marker.hash)})
+			continue
+		}
+		if canon := rawdb.ReadCanonicalHash(db, *number); canon != marker.hash {
+			res.Add(&rawdb.CheckIssue{
+				Kind:   "non-canonical-head",
+				Number: rawdb.CheckNumber(*number),
+				Detail: fmt.Sprintf("head %s %x, canonical %x", marker.name, marker.hash, canon),
+			})
+		}
+		heads[marker.name] = *number
+	}
+	headHeader, ok := heads["header"]
+	if !ok {
+		return res
+	}
+	// Block data is available up to the head block, or the head fast block if
+	// the chain was snap synced
+	headBlock := heads["block"]
+	if heads["fast block"] > headBlock {
+		headBlock = heads["fast block"]
+	}
+	var (
+		frozen, _ = db.Ancients()
+		tail      = rawdb.ReadHistoryTail(db)
+		parent    common.Hash
+		logged    = time.Now()
+	)
+	for number := uint64(0); number <= headHeader; number++ {
+		res.Checked++
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Checking chain", "number", number, "head", headHeader, "issues", len(res.Issues))
+			logged = time.Now()
+		}
+		hash := rawdb.ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			detail := "canonical hash missing"
+			if number == frozen {
+				detail = "canonical hash missing, gap between the ancient and key-value store"
+			}
+			res.Add(&rawdb.CheckIssue{Kind: "missing-canonical-hash", Number: rawdb.CheckNumber(number), Detail: detail})
+			parent = common.Hash{}
+			continue
+		}
+		if n := rawdb.ReadHeaderNumber(db, hash); n == nil || *n != number {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-hash-to-number", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("no number mapping for %x", hash)})
+		}
+		header := rawdb.ReadHeader(db, hash, number)
+		if header == nil {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-header", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("header %x missing", hash)})
+			parent = common.Hash{}
+			continue
+		}
+		if have := header.Hash(); have != hash {
+			res.Add(&rawdb.CheckIssue{Kind: "header-mismatch", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("header hashes to %x, canonical %x", have, hash)})
+		}
+		if number > 0 && parent != (common.Hash{}) && header.ParentHash != parent {
+			res.Add(&rawdb.CheckIssue{Kind: "broken-chain", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("parent %x, canonical %x", header.ParentHash, parent)})
+		}
+		parent = hash
+
+		if rawdb.ReadTd(db, hash, number) == nil {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-td", Number: rawdb.CheckNumber(number), Detail: "total difficulty missing"})
+		}
+		if number > headBlock || (number > 0 && number < tail) {
+			continue
+		}
+		body := rawdb.ReadBody(db, hash, number)
+		if body == nil {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-body", Number: rawdb.CheckNumber(number), Detail: "block body missing"})
+			continue
+		}
+		if txs := types.DeriveSha(types.Transactions(body.Transactions), trie.NewStackTrie(nil)); txs != header.TxHash {
+			res.Add(&rawdb.CheckIssue{Kind: "body-mismatch", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("transaction root %x, header %x", txs, header.TxHash)})
+		} else if uncles := types.CalcUncleHash(body.Uncles); uncles != header.UncleHash {
+			res.Add(&rawdb.CheckIssue{Kind: "body-mismatch", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("uncle hash %x, header %x", uncles, header.UncleHash)})
+		}
+		receipts := rawdb.ReadRawReceipts(db, hash, number)
+		if receipts == nil {
+			res.Add(&rawdb.CheckIssue{Kind: "missing-receipts", Number: rawdb.CheckNumber(number), Detail: "receipts missing"})
+		} else if len(receipts) != len(body.Transactions) {
+			res.Add(&rawdb.CheckIssue{Kind: "receipts-mismatch", Number: rawdb.CheckNumber(number), Detail: fmt.Sprintf("%d receipts for %d transactions", len(receipts), len(body.Transactions))})
+		}
+	}
+	// Ensure the state of the head block is present
+	if number, ok := heads["block"]; ok {
+		if header := rawdb.ReadHeader(db, rawdb.ReadHeadBlockHash(db), number); header != nil {
+			if _, err := trie.New(header.Root, trie.NewDatabase(db)); err != nil {
+				res.Add(&rawdb.CheckIssue{Kind: "missing-head-state", Number: rawdb.CheckNumber(number), Detail: err.Error()})
+			}
+		}
+	}
+	return res
+}
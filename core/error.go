@@ -32,6 +32,10 @@ var (
 	// ErrNoGenesis is returned when there is no Genesis Block.
 	ErrNoGenesis = errors.New("genesis not found in chain")
 
+	// ErrHistoryPruned is returned when the body or receipts of a block were
+	// pruned from the ancient store.
+	ErrHistoryPruned = errors.New("history pruned")
+
 	errSideChainReceipts = errors.New("side blocks can't be accepted as ancient chain data")
 )
 
@@ -449,7 +449,9 @@ func WriteBodyRLP(db ethdb.KeyValueWriter, hash common.Hash, number uint64, rlp
 // HasBody verifies the existence of a block body corresponding to the hash.
 func HasBody(db ethdb.Reader, hash common.Hash, number uint64) bool {
 	if has, err := db.Ancient(freezerHashTable, number); err == nil && common.BytesToHash(has) == hash {
-		return true
+		if ok, _ := db.HasAncient(freezerBodiesTable, number); ok {
+			return true
+		}
 	}
 	if has, err := db.Has(blockBodyKey(number, hash)); !has || err != nil {
 		return false
@@ -554,7 +556,9 @@ func DeleteTd(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
 // to a block.
 func HasReceipts(db ethdb.Reader, hash common.Hash, number uint64) bool {
 	if has, err := db.Ancient(freezerHashTable, number); err == nil && common.BytesToHash(has) == hash {
-		return true
+		if ok, _ := db.HasAncient(freezerReceiptTable, number); ok {
+			return true
+		}
 	}
 	if has, err := db.Has(blockReceiptsKey(number, hash)); !has || err != nil {
 		return false
@@ -830,6 +834,54 @@ func DeleteBlockWithoutNumber(db ethdb.KeyValueWriter, hash common.Hash, number
 	DeleteTd(db, hash, number)
 }
 
+// ReadHistoryTail retrieves the number of the first block whose body and
+// receipts are retained in the ancient store, the ones below it were pruned.
+// Zero is returned if no history was pruned.
+func ReadHistoryTail(db ethdb.AncientReader) uint64 {
+	var tail uint64
+	for _, kind := range []string{freezerBodiesTable, freezerReceiptTable} {
+		if n, err := db.AncientTail(kind); err == nil && n > tail {
+			tail = n
+		}
+	}
+	return tail
+}
+
+// PruneHistory discards the bodies and receipts of the blocks below the given
+// number from the ancient store, only frozen blocks can be pruned. The genesis
+// block is needed to open the chain, so it's moved into the key-value store.
+func PruneHistory(db ethdb.Database, before uint64) error {
+	frozen, err := db.Ancients()
+	if err != nil {
+		return err
+	}
+	if before > frozen {
+		return fmt.Errorf("history above the ancient store can't be pruned: requested %d, frozen %d", before, frozen)
+	}
+	if before == 0 || ReadHistoryTail(db) >= before {
+		return nil
+	}
+	hash := ReadCanonicalHash(db, 0)
+	body, receipts := ReadBodyRLP(db, hash, 0), ReadReceiptsRLP(db, hash, 0)
+	if body == nil || receipts == nil {
+		return errors.New("genesis block missing")
+	}
+	batch := db.NewBatch()
+	WriteBodyRLP(batch, hash, 0, body)
+	if err := batch.Put(blockReceiptsKey(0, hash), receipts); err != nil {
+		return err
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	for _, kind := range []string{freezerBodiesTable, freezerReceiptTable} {
+		if err := db.TruncateAncientTail(kind, before); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 const badBlockToKeep = 10
 
 type badBlock struct {
@@ -501,6 +501,65 @@ func TestAncientStorage(t *testing.T) {
 	}
 }
 
+// Tests that the ancient bodies and receipts are pruned, retaining the headers
+// and the genesis block.
+func TestPruneHistory(t *testing.T) {
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), frdir, "", false)
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	defer db.Close()
+
+	var (
+		blocks   []*types.Block
+		receipts []types.Receipts
+	)
+	for i := 0; i < 10; i++ {
+		blocks = append(blocks, types.NewBlockWithHeader(&types.Header{
+			Number:      big.NewInt(int64(i)),
+			Extra:       []byte("test block"),
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+		}))
+		receipts = append(receipts, nil)
+	}
+	if _, err := WriteAncientBlocks(db, blocks, receipts, big.NewInt(100)); err != nil {
+		t.Fatalf("failed to write ancient blocks: %v", err)
+	}
+	if err := PruneHistory(db, 11); err == nil {
+		t.Fatalf("history above the ancient store pruned")
+	}
+	if err := PruneHistory(db, 5); err != nil {
+		t.Fatalf("failed to prune history: %v", err)
+	}
+	if tail := ReadHistoryTail(db); tail != 5 {
+		t.Fatalf("history tail mismatch: have %d, want %d", tail, 5)
+	}
+	for i, block := range blocks {
+		hash, number := block.Hash(), block.NumberU64()
+		if ReadHeader(db, hash, number) == nil {
+			t.Fatalf("block %d: header missing", i)
+		}
+		pruned := i > 0 && i < 5
+		if have := ReadBody(db, hash, number) == nil; have != pruned {
+			t.Fatalf("block %d: body pruned mismatch: have %v, want %v", i, have, pruned)
+		}
+		if have := ReadReceiptsRLP(db, hash, number) == nil; have != pruned {
+			t.Fatalf("block %d: receipts pruned mismatch: have %v, want %v", i, have, pruned)
+		}
+		if have := !HasBody(db, hash, number); have != pruned {
+			t.Fatalf("block %d: body presence mismatch: have %v, want %v", i, !have, !pruned)
+		}
+	}
+}
+
 func TestCanonicalHashIteration(t *testing.T) {
 	var cases = []struct {
 		from, to uint64
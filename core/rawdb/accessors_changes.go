@@ -0,0 +1,154 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// ReadStateChangeSet retrieves the RLP encoded set of accounts and storage slots
+// modified by the given block.
+func ReadStateChangeSet(db ethdb.KeyValueReader, number uint64, hash common.Hash) []byte {
+	data, _ := db.Get(stateChangeSetKey(number, hash))
+	return data
+}
+
+// WriteStateChangeSet stores the set of accounts and storage slots modified by
+// the given block.
+func WriteStateChangeSet(db ethdb.KeyValueWriter, number uint64, hash common.Hash, blob []byte) {
+	if err := db.Put(stateChangeSetKey(number, hash), blob); err != nil {
+		log.Crit("Failed to store state change set", "err", err)
+	}
+}
+
+// DeleteStateChangeSets removes the change sets of all the blocks, canonical or
+// not, within the given block range (to is exclusive).
+func DeleteStateChangeSets(db ethdb.KeyValueStore, from uint64, to uint64) {
+	deleteRange(db, stateChangeSetPrefix, encodeBlockNumber(from), encodeBlockNumber(to), "state change sets")
+}
+
+// ReadStateChangeIndex retrieves the numbers of the blocks within the given
+// section which modified the account, or its storage slot if one is given.
+func ReadStateChangeIndex(db ethdb.KeyValueReader, section uint64, accountHash common.Hash, storageHash *common.Hash) []uint64 {
+	data, _ := db.Get(stateChangeIndexKey(section, accountHash, storageHash))
+	return decodeBlockNumbers(data)
+}
+
+// WriteStateChangeIndex stores the numbers of the blocks within the given section
+// which modified the account, or its storage slot if one is given.
+func WriteStateChangeIndex(db ethdb.KeyValueWriter, section uint64, accountHash common.Hash, storageHash *common.Hash, numbers []uint64) {
+	if err := db.Put(stateChangeIndexKey(section, accountHash, storageHash), encodeBlockNumbers(numbers)); err != nil {
+		log.Crit("Failed to store state change index", "err", err)
+	}
+}
+
+// ReadStateChangeIndexGaps retrieves the numbers of the blocks within the given
+// section which are missing from the state change index, their change sets
+// being unavailable when the section was indexed.
+func ReadStateChangeIndexGaps(db ethdb.KeyValueReader, section uint64) []uint64 {
+	data, _ := db.Get(stateChangeIndexGapsKey(section))
+	return decodeBlockNumbers(data)
+}
+
+// WriteStateChangeIndexGaps stores the numbers of the blocks within the given
+// section which are missing from the state change index.
+func WriteStateChangeIndexGaps(db ethdb.KeyValueWriter, section uint64, numbers []uint64) {
+	if err := db.Put(stateChangeIndexGapsKey(section), encodeBlockNumbers(numbers)); err != nil {
+		log.Crit("Failed to store state change index gaps", "err", err)
+	}
+}
+
+// DeleteStateChangeIndex removes the state change index of all the sections
+// within the given range (to is exclusive), gaps included.
+func DeleteStateChangeIndex(db ethdb.KeyValueStore, from uint64, to uint64) {
+	deleteRange(db, stateChangeIndexPrefix, encodeBlockNumber(from), encodeBlockNumber(to), "state change index")
+}
+
+// ReadStateChangeIndexTail retrieves the first section of the state change index
+// which has not been pruned.
+func ReadStateChangeIndexTail(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(stateChangeIndexTailKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WriteStateChangeIndexTail stores the first section of the state change index
+// which has not been pruned.
+func WriteStateChangeIndexTail(db ethdb.KeyValueWriter, section uint64) {
+	if err := db.Put(stateChangeIndexTailKey, encodeBlockNumber(section)); err != nil {
+		log.Crit("Failed to store state change index tail", "err", err)
+	}
+}
+
+// deleteRange removes all the entries with the given prefix whose key continues
+// with a value within [from, to).
+func deleteRange(db ethdb.KeyValueStore, prefix []byte, from []byte, to []byte, kind string) {
+	it := db.NewIterator(prefix, from)
+	defer it.Release()
+
+	var (
+		end   = append(append([]byte{}, prefix...), to...)
+		batch = db.NewBatch()
+	)
+	for it.Next() {
+		if bytes.Compare(it.Key(), end) >= 0 {
+			break
+		}
+		batch.Delete(it.Key())
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				log.Crit("Failed to delete "+kind, "err", err)
+			}
+			batch.Reset()
+		}
+	}
+	if it.Error() != nil {
+		log.Crit("Failed to iterate "+kind, "err", it.Error())
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to delete "+kind, "err", err)
+	}
+}
+
+// encodeBlockNumbers encodes a list of block numbers as a concatenation of big
+// endian uint64s.
+func encodeBlockNumbers(numbers []uint64) []byte {
+	data := make([]byte, 0, 8*len(numbers))
+	for _, number := range numbers {
+		data = append(data, encodeBlockNumber(number)...)
+	}
+	return data
+}
+
+// decodeBlockNumbers decodes a list of block numbers encoded by encodeBlockNumbers.
+func decodeBlockNumbers(data []byte) []uint64 {
+	if len(data)%8 != 0 {
+		return nil
+	}
+	numbers := make([]uint64, 0, len(data)/8)
+	for i := 0; i < len(data); i += 8 {
+		numbers = append(numbers, binary.BigEndian.Uint64(data[i:]))
+	}
+	return numbers
+}
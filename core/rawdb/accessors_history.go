@@ -0,0 +1,173 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// NewStateHistoryFreezer initializes the append-only flat file store holding the
+// reverse diffs of the flat state.
+func NewStateHistoryFreezer(datadir string, readonly bool) (ethdb.AncientStore, error) {
+	return newFreezer(datadir, "eth/db/state/", readonly, freezerTableSize, stateHistoryNoSnappy)
+}
+
+// ReadStateHistoryMeta retrieves the metadata of the state history with the
+// given id.
+func ReadStateHistoryMeta(db ethdb.AncientReader, id uint64) []byte {
+	blob, err := db.Ancient(stateHistoryMetaTable, id)
+	if err != nil {
+		return nil
+	}
+	return blob
+}
+
+// ReadStateHistoryAccounts retrieves the previous values of the accounts modified
+// in the state history with the given id.
+func ReadStateHistoryAccounts(db ethdb.AncientReader, id uint64) []byte {
+	blob, err := db.Ancient(stateHistoryAccountTable, id)
+	if err != nil {
+		return nil
+	}
+	return blob
+}
+
+// ReadStateHistoryStorages retrieves the previous values of the storage slots
+// modified in the state history with the given id.
+func ReadStateHistoryStorages(db ethdb.AncientReader, id uint64) []byte {
+	blob, err := db.Ancient(stateHistoryStorageTable, id)
+	if err != nil {
+		return nil
+	}
+	return blob
+}
+
+// WriteStateHistory appends the state history with the given id to the freezer.
+func WriteStateHistory(db ethdb.AncientWriter, id uint64, meta []byte, accounts []byte, storages []byte) error {
+	_, err := db.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+		if err := op.AppendRaw(stateHistoryMetaTable, id, meta); err != nil {
+			return err
+		}
+		if err := op.AppendRaw(stateHistoryAccountTable, id, accounts); err != nil {
+			return err
+		}
+		return op.AppendRaw(stateHistoryStorageTable, id, storages)
+	})
+	return err
+}
+
+// ReadStateHistoryTail retrieves the id of the first state history which can
+// be used to serve historical state. The earlier ones are either pruned or are
+// separated from the live state by a gap.
+func ReadStateHistoryTail(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(stateHistoryTailKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WriteStateHistoryTail stores the id of the first usable state history.
+func WriteStateHistoryTail(db ethdb.KeyValueWriter, id uint64) {
+	if err := db.Put(stateHistoryTailKey, encodeBlockNumber(id)); err != nil {
+		log.Crit("Failed to store the state history tail", "err", err)
+	}
+}
+
+// ReadStateHistoryLookup retrieves the id of the state history reverting the
+// state transition which started from the given state root.
+func ReadStateHistoryLookup(db ethdb.KeyValueReader, root common.Hash) *uint64 {
+	data, _ := db.Get(stateHistoryLookupKey(root))
+	if len(data) != 8 {
+		return nil
+	}
+	id := binary.BigEndian.Uint64(data)
+	return &id
+}
+
+// WriteStateHistoryLookup stores the id of the state history reverting to the
+// given state root.
+func WriteStateHistoryLookup(db ethdb.KeyValueWriter, root common.Hash, id uint64) {
+	if err := db.Put(stateHistoryLookupKey(root), encodeBlockNumber(id)); err != nil {
+		log.Crit("Failed to store the state history lookup", "err", err)
+	}
+}
+
+// ReadStateHistoryAccountIndex retrieves the chunk of the account's state
+// history index ending with the given id.
+func ReadStateHistoryAccountIndex(db ethdb.KeyValueReader, accountHash common.Hash, last uint64) []byte {
+	data, _ := db.Get(stateHistoryAccountIndexKey(accountHash, last))
+	return data
+}
+
+// WriteStateHistoryAccountIndex stores a chunk of the account's state history
+// index, keyed by the last id contained.
+func WriteStateHistoryAccountIndex(db ethdb.KeyValueWriter, accountHash common.Hash, last uint64, blob []byte) {
+	if err := db.Put(stateHistoryAccountIndexKey(accountHash, last), blob); err != nil {
+		log.Crit("Failed to store the account history index", "err", err)
+	}
+}
+
+// DeleteStateHistoryAccountIndex deletes a chunk of the account's state history
+// index.
+func DeleteStateHistoryAccountIndex(db ethdb.KeyValueWriter, accountHash common.Hash, last uint64) {
+	if err := db.Delete(stateHistoryAccountIndexKey(accountHash, last)); err != nil {
+		log.Crit("Failed to delete the account history index", "err", err)
+	}
+}
+
+// IterateStateHistoryAccountIndex returns an iterator over the chunks of the
+// account's state history index, starting with the one containing the ids from
+// the given one onwards.
+func IterateStateHistoryAccountIndex(db ethdb.Iteratee, accountHash common.Hash, from uint64) ethdb.Iterator {
+	return db.NewIterator(append(stateHistoryAccountIndexPrefix, accountHash.Bytes()...), encodeBlockNumber(from))
+}
+
+// ReadStateHistoryStorageIndex retrieves the chunk of the storage slot's state
+// history index ending with the given id.
+func ReadStateHistoryStorageIndex(db ethdb.KeyValueReader, accountHash, storageHash common.Hash, last uint64) []byte {
+	data, _ := db.Get(stateHistoryStorageIndexKey(accountHash, storageHash, last))
+	return data
+}
+
+// WriteStateHistoryStorageIndex stores a chunk of the storage slot's state
+// history index, keyed by the last id contained.
+func WriteStateHistoryStorageIndex(db ethdb.KeyValueWriter, accountHash, storageHash common.Hash, last uint64, blob []byte) {
+	if err := db.Put(stateHistoryStorageIndexKey(accountHash, storageHash, last), blob); err != nil {
+		log.Crit("Failed to store the storage history index", "err", err)
+	}
+}
+
+// DeleteStateHistoryStorageIndex deletes a chunk of the storage slot's state
+// history index.
+func DeleteStateHistoryStorageIndex(db ethdb.KeyValueWriter, accountHash, storageHash common.Hash, last uint64) {
+	if err := db.Delete(stateHistoryStorageIndexKey(accountHash, storageHash, last)); err != nil {
+		log.Crit("Failed to delete the storage history index", "err", err)
+	}
+}
+
+// IterateStateHistoryStorageIndex returns an iterator over the chunks of the
+// storage slot's state history index, starting with the one containing the ids
+// from the given one onwards.
+func IterateStateHistoryStorageIndex(db ethdb.Iteratee, accountHash, storageHash common.Hash, from uint64) ethdb.Iterator {
+	prefix := append(append(stateHistoryStorageIndexPrefix, accountHash.Bytes()...), storageHash.Bytes()...)
+	return db.NewIterator(prefix, encodeBlockNumber(from))
+}
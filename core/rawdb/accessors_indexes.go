@@ -106,7 +106,11 @@ func ReadTransaction(db ethdb.Reader, hash common.Hash) (*types.Transaction, com
 	}
 	body := ReadBody(db, blockHash, *blockNumber)
 	if body == nil {
-		log.Error("Transaction referenced missing", "number", *blockNumber, "hash", blockHash)
+		if *blockNumber < ReadHistoryTail(db) {
+			log.Debug("Transaction referenced pruned block", "number", *blockNumber, "hash", blockHash)
+		} else {
+			log.Error("Transaction referenced missing", "number", *blockNumber, "hash", blockHash)
+		}
 		return nil, common.Hash{}, 0, 0
 	}
 	for txIndex, tx := range body.Transactions {
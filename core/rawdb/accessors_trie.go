@@ -0,0 +1,210 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// The list of supported storage schemes of the trie nodes.
+const (
+	// HashScheme stores trie nodes keyed by their hash. Stale nodes are never
+	// overwritten and need to be garbage collected by offline pruning.
+	HashScheme = "hash"
+
+	// PathScheme stores trie nodes keyed by their path in the trie (and the
+	// owning account for storage tries). Stale nodes are overwritten in place.
+	PathScheme = "path"
+)
+
+// ReadStateScheme retrieves the storage scheme of the trie nodes. Databases
+// predating the path scheme don't have the flag, defaulting to the hash one.
+func ReadStateScheme(db ethdb.KeyValueReader) string {
+	data, _ := db.Get(stateSchemeKey)
+	if len(data) == 0 {
+		return HashScheme
+	}
+	return string(data)
+}
+
+// WriteStateScheme stores the storage scheme of the trie nodes.
+func WriteStateScheme(db ethdb.KeyValueWriter, scheme string) {
+	if err := db.Put(stateSchemeKey, []byte(scheme)); err != nil {
+		log.Crit("Failed to store state scheme", "err", err)
+	}
+}
+
+// isHexPath reports whether the given byte slice is a valid nibble path.
+func isHexPath(path []byte) bool {
+	if len(path) > 2*common.HashLength {
+		return false
+	}
+	for _, nibble := range path {
+		if nibble >= 16 {
+			return false
+		}
+	}
+	return true
+}
+
+// IsAccountTrieNode reports whether the given database key is the key of an
+// account trie node stored in the path scheme.
+func IsAccountTrieNode(key []byte) bool {
+	return bytes.HasPrefix(key, TrieNodeAccountPrefix) && isHexPath(key[len(TrieNodeAccountPrefix):])
+}
+
+// IsStorageTrieNode reports whether the given database key is the key of a
+// storage trie node stored in the path scheme.
+func IsStorageTrieNode(key []byte) bool {
+	if !bytes.HasPrefix(key, TrieNodeStoragePrefix) || len(key) < len(TrieNodeStoragePrefix)+common.HashLength {
+		return false
+	}
+	return isHexPath(key[len(TrieNodeStoragePrefix)+common.HashLength:])
+}
+
+// ReadAccountTrieNode retrieves the account trie node at the given path.
+func ReadAccountTrieNode(db ethdb.KeyValueReader, path []byte) []byte {
+	data, _ := db.Get(accountTrieNodeKey(path))
+	return data
+}
+
+// WriteAccountTrieNode writes the account trie node at the given path.
+func WriteAccountTrieNode(db ethdb.KeyValueWriter, path []byte, node []byte) {
+	if err := db.Put(accountTrieNodeKey(path), node); err != nil {
+		log.Crit("Failed to store account trie node", "err", err)
+	}
+}
+
+// DeleteAccountTrieNode deletes the account trie node at the given path.
+func DeleteAccountTrieNode(db ethdb.KeyValueWriter, path []byte) {
+	if err := db.Delete(accountTrieNodeKey(path)); err != nil {
+		log.Crit("Failed to delete account trie node", "err", err)
+	}
+}
+
+// ReadStorageTrieNode retrieves the storage trie node of the given account at
+// the given path.
+func ReadStorageTrieNode(db ethdb.KeyValueReader, accountHash common.Hash, path []byte) []byte {
+	data, _ := db.Get(storageTrieNodeKey(accountHash, path))
+	return data
+}
+
+// WriteStorageTrieNode writes the storage trie node of the given account at
+// the given path.
+func WriteStorageTrieNode(db ethdb.KeyValueWriter, accountHash common.Hash, path []byte, node []byte) {
+	if err := db.Put(storageTrieNodeKey(accountHash, path), node); err != nil {
+		log.Crit("Failed to store storage trie node", "err", err)
+	}
+}
+
+// DeleteStorageTrieNode deletes the storage trie node of the given account at
+// the given path.
+func DeleteStorageTrieNode(db ethdb.KeyValueWriter, accountHash common.Hash, path []byte) {
+	if err := db.Delete(storageTrieNodeKey(accountHash, path)); err != nil {
+		log.Crit("Failed to delete storage trie node", "err", err)
+	}
+}
+
+// ReadTrieNodeByScheme retrieves the persisted trie node with the given hash. In
+// the path scheme, the node is looked up by the owner of the trie (zero for the
+// account trie) and its path, and it's only returned if the hash matches.
+func ReadTrieNodeByScheme(db ethdb.KeyValueReader, scheme string, owner common.Hash, path []byte, hash common.Hash) []byte {
+	if scheme != PathScheme {
+		return ReadTrieNode(db, hash)
+	}
+	var blob []byte
+	if owner == (common.Hash{}) {
+		blob = ReadAccountTrieNode(db, path)
+	} else {
+		blob = ReadStorageTrieNode(db, owner, path)
+	}
+	if len(blob) == 0 || crypto.Keccak256Hash(blob) != hash {
+		return nil
+	}
+	return blob
+}
+
+// ReadPersistentStateID retrieves the id of the state persisted by the
+// path-based trie database, zero if nothing was persisted yet.
+func ReadPersistentStateID(db ethdb.KeyValueReader) uint64 {
+	data, _ := db.Get(persistentStateIDKey)
+	if len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// WritePersistentStateID stores the id of the state persisted by the path-based
+// trie database.
+func WritePersistentStateID(db ethdb.KeyValueWriter, id uint64) {
+	if err := db.Put(persistentStateIDKey, encodeBlockNumber(id)); err != nil {
+		log.Crit("Failed to store the persistent state ID", "err", err)
+	}
+}
+
+// ReadReverseDiff retrieves the RLP-encoded reverse diff which reverts the
+// persisted state with the given id to its parent.
+func ReadReverseDiff(db ethdb.KeyValueReader, id uint64) []byte {
+	data, _ := db.Get(reverseDiffKey(id))
+	return data
+}
+
+// WriteReverseDiff stores the RLP-encoded reverse diff of the given state id.
+func WriteReverseDiff(db ethdb.KeyValueWriter, id uint64, blob []byte) {
+	if err := db.Put(reverseDiffKey(id), blob); err != nil {
+		log.Crit("Failed to store reverse diff", "err", err)
+	}
+}
+
+// DeleteReverseDiff deletes the reverse diff of the given state id.
+func DeleteReverseDiff(db ethdb.KeyValueWriter, id uint64) {
+	if err := db.Delete(reverseDiffKey(id)); err != nil {
+		log.Crit("Failed to delete reverse diff", "err", err)
+	}
+}
+
+// ReadReverseDiffLookup retrieves the id of the persisted state with the given
+// state root.
+func ReadReverseDiffLookup(db ethdb.KeyValueReader, root common.Hash) *uint64 {
+	data, _ := db.Get(reverseDiffLookupKey(root))
+	if len(data) != 8 {
+		return nil
+	}
+	id := binary.BigEndian.Uint64(data)
+	return &id
+}
+
+// WriteReverseDiffLookup stores the id of the persisted state with the given
+// state root.
+func WriteReverseDiffLookup(db ethdb.KeyValueWriter, root common.Hash, id uint64) {
+	if err := db.Put(reverseDiffLookupKey(root), encodeBlockNumber(id)); err != nil {
+		log.Crit("Failed to store reverse diff lookup", "err", err)
+	}
+}
+
+// DeleteReverseDiffLookup deletes the state id lookup of the given state root.
+func DeleteReverseDiffLookup(db ethdb.KeyValueWriter, root common.Hash) {
+	if err := db.Delete(reverseDiffLookupKey(root)); err != nil {
+		log.Crit("Failed to delete reverse diff lookup", "err", err)
+	}
+}
@@ -103,6 +103,7 @@ func iterateTransactions(db ethdb.Database, from uint64, to uint64, reverse bool
 	var (
 		rlpCh    = make(chan *numberRlp, threads*2)     // we send raw rlp over this channel
 		hashesCh = make(chan *blockTxHashes, threads*2) // send hashes over hashesCh
+		tail     = ReadHistoryTail(db)                  // first block with an available body
 	)
 	// lookup runs in one instance
 	lookup := func() {
@@ -136,14 +137,18 @@ func iterateTransactions(db ethdb.Database, from uint64, to uint64, reverse bool
 			}
 		}()
 		for data := range rlpCh {
-			var body types.Body
-			if err := rlp.DecodeBytes(data.rlp, &body); err != nil {
-				log.Warn("Failed to decode block body", "block", data.number, "error", err)
-				return
-			}
+			// The bodies of the pruned blocks are not available anymore, skip
+			// them without any transactions
 			var hashes []common.Hash
-			for _, tx := range body.Transactions {
-				hashes = append(hashes, tx.Hash())
+			if len(data.rlp) > 0 || data.number >= tail {
+				var body types.Body
+				if err := rlp.DecodeBytes(data.rlp, &body); err != nil {
+					log.Warn("Failed to decode block body", "block", data.number, "error", err)
+					return
+				}
+				for _, tx := range body.Transactions {
+					hashes = append(hashes, tx.Hash())
+				}
 			}
 			result := &blockTxHashes{
 				hashes: hashes,
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sync/atomic"
 	"time"
 
@@ -58,7 +59,7 @@ func (frdb *freezerdb) Close() error {
 // a freeze cycle completes, without having to sleep for a minute to trigger the
 // automatic background run.
 func (frdb *freezerdb) Freeze(threshold uint64) error {
-	if frdb.AncientStore.(*freezer).readonly {
+	if frdb.AncientStore.AncientReadOnly() {
 		return errReadOnly
 	}
 	// Set the freezer threshold to a temporary value
@@ -104,6 +105,16 @@ func (db *nofreezedb) AncientSize(kind string) (uint64, error) {
 	return 0, errNotSupported
 }
 
+// AncientTail returns an error as we don't have a backing chain freezer.
+func (db *nofreezedb) AncientTail(kind string) (uint64, error) {
+	return 0, errNotSupported
+}
+
+// AncientReadOnly returns false as we don't have a backing chain freezer.
+func (db *nofreezedb) AncientReadOnly() bool {
+	return false
+}
+
 // ModifyAncients is not supported.
 func (db *nofreezedb) ModifyAncients(func(ethdb.AncientWriteOp) error) (int64, error) {
 	return 0, errNotSupported
@@ -114,6 +125,11 @@ func (db *nofreezedb) TruncateAncients(items uint64) error {
 	return errNotSupported
 }
 
+// TruncateAncientTail returns an error as we don't have a backing chain freezer.
+func (db *nofreezedb) TruncateAncientTail(kind string, items uint64) error {
+	return errNotSupported
+}
+
 // Sync returns an error as we don't have a backing chain freezer.
 func (db *nofreezedb) Sync() error {
 	return errNotSupported
@@ -134,6 +150,47 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 	if err != nil {
 		return nil, err
 	}
+	if err := validateFreezer(db, frdb); err != nil {
+		frdb.Close()
+		return nil, err
+	}
+	// Freezer is consistent with the key-value database, permit combining the two
+	if !frdb.readonly {
+		frdb.wg.Add(1)
+		go func() {
+			frdb.freeze(db)
+			frdb.wg.Done()
+		}()
+	}
+	return &freezerdb{
+		KeyValueStore: db,
+		AncientStore:  frdb,
+	}, nil
+}
+
+// NewDatabaseWithAncientStore creates a high level database on top of a given
+// key-value data store, serving the immutable chain segments from an externally
+// opened ancient store. Nothing is moved into the ancient store, it is expected
+// to be filled by a different process.
+func NewDatabaseWithAncientStore(db ethdb.KeyValueStore, ancients ethdb.AncientStore) (ethdb.Database, error) {
+	if err := validateFreezer(db, ancients); err != nil {
+		return nil, err
+	}
+	return &freezerdb{
+		KeyValueStore: db,
+		AncientStore:  ancients,
+	}, nil
+}
+
+// NewChainFreezer opens the freezer holding the ancient chain segments on its
+// own, without a key-value store attached.
+func NewChainFreezer(datadir string, namespace string, readonly bool) (ethdb.AncientStore, error) {
+	return newFreezer(datadir, namespace, readonly, freezerTableSize, FreezerNoSnappy)
+}
+
+// validateFreezer checks whether the ancient store can be combined with the key-
+// value store without serving conflicting data.
+func validateFreezer(db ethdb.KeyValueStore, frdb ethdb.AncientReader) error {
 	// Since the freezer can be stored separately from the user's key-value database,
 	// there's a fairly high probability that the user requests invalid combinations
 	// of the freezer and database. Ensure that we don't shoot ourselves in the foot
@@ -163,9 +220,9 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 			// the freezer and the key-value store.
 			frgenesis, err := frdb.Ancient(freezerHashTable, 0)
 			if err != nil {
-				return nil, fmt.Errorf("failed to retrieve genesis from ancient %v", err)
+				return fmt.Errorf("failed to retrieve genesis from ancient %v", err)
 			} else if !bytes.Equal(kvgenesis, frgenesis) {
-				return nil, fmt.Errorf("genesis mismatch: %#x (leveldb) != %#x (ancients)", kvgenesis, frgenesis)
+				return fmt.Errorf("genesis mismatch: %#x (leveldb) != %#x (ancients)", kvgenesis, frgenesis)
 			}
 			// Key-value store and freezer belong to the same network. Ensure that they
 			// are contiguous, otherwise we might end up with a non-functional freezer.
@@ -173,7 +230,7 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 				// Subsequent header after the freezer limit is missing from the database.
 				// Reject startup is the database has a more recent head.
 				if *ReadHeaderNumber(db, ReadHeadHeaderHash(db)) > frozen-1 {
-					return nil, fmt.Errorf("gap (#%d) in the chain between ancients and leveldb", frozen)
+					return fmt.Errorf("gap (#%d) in the chain between ancients and leveldb", frozen)
 				}
 				// Database contains only older data than the freezer, this happens if the
 				// state was wiped and reinited from an existing freezer.
@@ -190,7 +247,7 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 				// Key-value store contains more data than the genesis block, make sure we
 				// didn't freeze anything yet.
 				if kvblob, _ := db.Get(headerHashKey(1)); len(kvblob) == 0 {
-					return nil, errors.New("ancient chain segments already extracted, please set --datadir.ancient to the correct path")
+					return errors.New("ancient chain segments already extracted, please set --datadir.ancient to the correct path")
 				}
 				// Block #1 is still in the database, we're allowed to init a new feezer
 			}
@@ -198,18 +255,7 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 			// feezer.
 		}
 	}
-	// Freezer is consistent with the key-value database, permit combining the two
-	if !frdb.readonly {
-		frdb.wg.Add(1)
-		go func() {
-			frdb.freeze(db)
-			frdb.wg.Done()
-		}()
-	}
-	return &freezerdb{
-		KeyValueStore: db,
-		AncientStore:  frdb,
-	}, nil
+	return nil
 }
 
 // NewMemoryDatabase creates an ephemeral in-memory key-value database without a
@@ -250,6 +296,124 @@ func NewLevelDBDatabaseWithFreezer(file string, cache int, handles int, freezer
 	return frdb, nil
 }
 
+const (
+	// LevelDBEngine is the name of the leveldb backed key-value store.
+	LevelDBEngine = "leveldb"
+
+	// PebbleEngine is the name of the pebble backed key-value store.
+	PebbleEngine = "pebble"
+)
+
+// PreexistingDatabase checks whether a database is already instantiated in the
+// given directory, and if so, returns the name of the engine it was created
+// with. An empty string is returned if no database exists yet.
+func PreexistingDatabase(path string) string {
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); err != nil {
+		return "" // No pre-existing db
+	}
+	// Pebble persists its options along with the data, leveldb does not
+	if matches, _ := filepath.Glob(filepath.Join(path, "OPTIONS*")); len(matches) > 0 {
+		return PebbleEngine
+	}
+	return LevelDBEngine
+}
+
+// OpenOptions contains the options to apply when opening a database.
+type OpenOptions struct {
+	Type              string // Engine backing the key-value store, empty to use the pre-existing one or leveldb
+	Directory         string // The directory of the key-value store
+	AncientsDirectory string // The directory of the freezer, empty to not attach one
+	Namespace         string // The prefix for the metrics reporting of the database
+	Cache             int    // Megabytes of memory to allocate to caching
+	Handles           int    // Number of file handles to allocate to the database
+	ReadOnly          bool   // Whether the database is opened in read only mode
+
+	// AncientsReadOnly opens the freezer read-only even if the key-value store is
+	// writable, sharing it with the single process appending to it.
+	AncientsReadOnly bool
+
+	// Ancients is an externally opened ancient store to attach instead of the
+	// freezer in AncientsDirectory, e.g. a remote one. It is closed along with
+	// the database.
+	Ancients ethdb.AncientStore
+}
+
+// openKeyValueDatabase opens a disk-based key-value database with the engine
+// requested in the options. If a database already exists in the directory,
+// it must have been created with the same engine.
+func openKeyValueDatabase(o OpenOptions) (ethdb.Database, error) {
+	existing := PreexistingDatabase(o.Directory)
+	if o.Type != "" && existing != "" && o.Type != existing {
+		return nil, fmt.Errorf("db.engine choice was %v but found pre-existing %v database in specified data directory", o.Type, existing)
+	}
+	engine := o.Type
+	if engine == "" {
+		engine = existing
+	}
+	if engine == "" {
+		engine = LevelDBEngine
+	}
+	var (
+		db  ethdb.Database
+		err error
+	)
+	switch engine {
+	case LevelDBEngine:
+		log.Info("Using leveldb as the backing database")
+		db, err = NewLevelDBDatabase(o.Directory, o.Cache, o.Handles, o.Namespace, o.ReadOnly)
+	case PebbleEngine:
+		log.Info("Using pebble as the backing database")
+		db, err = NewPebbleDBDatabase(o.Directory, o.Cache, o.Handles, o.Namespace, o.ReadOnly)
+	default:
+		return nil, fmt.Errorf("unknown db.engine %v", engine)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Record the engine in the database itself, refusing to continue if a
+	// different one was recorded before
+	switch recorded := ReadDatabaseEngine(db); {
+	case recorded == "":
+		if !o.ReadOnly {
+			WriteDatabaseEngine(db, engine)
+		}
+	case recorded != engine:
+		db.Close()
+		return nil, fmt.Errorf("database was created with %v, cannot open it with %v", recorded, engine)
+	}
+	return db, nil
+}
+
+// Open opens both a disk-based key-value database such as leveldb or pebble,
+// and, if an ancients directory is specified, a freezer moving immutable chain
+// segments into cold storage.
+func Open(o OpenOptions) (ethdb.Database, error) {
+	kvdb, err := openKeyValueDatabase(o)
+	if err != nil {
+		if o.Ancients != nil {
+			o.Ancients.Close()
+		}
+		return nil, err
+	}
+	var frdb ethdb.Database
+	switch {
+	case o.Ancients != nil:
+		frdb, err = NewDatabaseWithAncientStore(kvdb, o.Ancients)
+	case len(o.AncientsDirectory) != 0:
+		frdb, err = NewDatabaseWithFreezer(kvdb, o.AncientsDirectory, o.Namespace, o.ReadOnly || o.AncientsReadOnly)
+	default:
+		return kvdb, nil
+	}
+	if err != nil {
+		if o.Ancients != nil {
+			o.Ancients.Close()
+		}
+		kvdb.Close()
+		return nil, err
+	}
+	return frdb, nil
+}
+
 type counter uint64
 
 func (c counter) String() string {
@@ -299,6 +463,10 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		numHashPairings stat
 		hashNumPairings stat
 		tries           stat
+		pathTries       stat
+		reverseDiffs    stat
+		stateHistory    stat
+		stateChanges    stat
 		codes           stat
 		txLookups       stat
 		accountSnaps    stat
@@ -347,6 +515,28 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 			hashNumPairings.Add(size)
 		case len(key) == common.HashLength:
 			tries.Add(size)
+		case IsAccountTrieNode(key) || IsStorageTrieNode(key):
+			pathTries.Add(size)
+		case bytes.HasPrefix(key, reverseDiffPrefix) && len(key) == len(reverseDiffPrefix)+8:
+			reverseDiffs.Add(size)
+		case bytes.HasPrefix(key, reverseDiffLookupPrefix) && len(key) == len(reverseDiffLookupPrefix)+common.HashLength:
+			reverseDiffs.Add(size)
+		case bytes.HasPrefix(key, stateHistoryLookupPrefix) && len(key) == len(stateHistoryLookupPrefix)+common.HashLength:
+			stateHistory.Add(size)
+		case bytes.HasPrefix(key, stateHistoryAccountIndexPrefix) && len(key) == len(stateHistoryAccountIndexPrefix)+common.HashLength+8:
+			stateHistory.Add(size)
+		case bytes.HasPrefix(key, stateHistoryStorageIndexPrefix) && len(key) == len(stateHistoryStorageIndexPrefix)+2*common.HashLength+8:
+			stateHistory.Add(size)
+		case bytes.HasPrefix(key, stateChangeSetPrefix) && len(key) == len(stateChangeSetPrefix)+8+common.HashLength:
+			stateChanges.Add(size)
+		case bytes.HasPrefix(key, stateChangeIndexPrefix) && len(key) == len(stateChangeIndexPrefix)+8:
+			stateChanges.Add(size)
+		case bytes.HasPrefix(key, stateChangeIndexPrefix) && len(key) == len(stateChangeIndexPrefix)+8+common.HashLength:
+			stateChanges.Add(size)
+		case bytes.HasPrefix(key, stateChangeIndexPrefix) && len(key) == len(stateChangeIndexPrefix)+8+2*common.HashLength:
+			stateChanges.Add(size)
+		case bytes.HasPrefix(key, StateChangeIndexPrefix):
+			stateChanges.Add(size)
 		case bytes.HasPrefix(key, CodePrefix) && len(key) == len(CodePrefix)+common.HashLength:
 			codes.Add(size)
 		case bytes.HasPrefix(key, txLookupPrefix) && len(key) == (len(txLookupPrefix)+common.HashLength):
@@ -376,10 +566,11 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		default:
 			var accounted bool
 			for _, meta := range [][]byte{
-				databaseVersionKey, headHeaderKey, headBlockKey, headFastBlockKey, lastPivotKey,
+				databaseVersionKey, databaseEngineKey, headHeaderKey, headBlockKey, headFastBlockKey, lastPivotKey,
 				fastTrieProgressKey, snapshotDisabledKey, snapshotRootKey, snapshotJournalKey,
 				snapshotGeneratorKey, snapshotRecoveryKey, txIndexTailKey, fastTxLookupLimitKey,
-				uncleanShutdownKey, badBlockKey,
+				uncleanShutdownKey, badBlockKey, stateSchemeKey, persistentStateIDKey,
+				stateHistoryTailKey, stateChangeIndexTailKey,
 			} {
 				if bytes.Equal(key, meta) {
 					metadata.Add(size)
@@ -422,6 +613,10 @@ func InspectDatabase(db ethdb.Database, keyPrefix, keyStart []byte) error {
 		{"Key-Value store", "Bloombit index", bloomBits.Size(), bloomBits.Count()},
 		{"Key-Value store", "Contract codes", codes.Size(), codes.Count()},
 		{"Key-Value store", "Trie nodes", tries.Size(), tries.Count()},
+		{"Key-Value store", "Path trie nodes", pathTries.Size(), pathTries.Count()},
+		{"Key-Value store", "Trie reverse diffs", reverseDiffs.Size(), reverseDiffs.Count()},
+		{"Key-Value store", "State history index", stateHistory.Size(), stateHistory.Count()},
+		{"Key-Value store", "State change index", stateChanges.Size(), stateChanges.Count()},
 		{"Key-Value store", "Trie preimages", preimages.Size(), preimages.Count()},
 		{"Key-Value store", "Account snapshot", accountSnaps.Size(), accountSnaps.Count()},
 		{"Key-Value store", "Storage snapshot", storageSnaps.Size(), storageSnaps.Count()},
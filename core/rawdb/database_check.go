@@ -0,0 +1,285 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// maxCheckIssues is the maximum number of issues recorded by a single integrity
+// check, any further ones are only counted.
+const maxCheckIssues = 1000
+
+// CheckIssue is an inconsistency found by a database integrity check.
+type CheckIssue struct {
+	Kind       string  `json:"kind"`                 // Short identifier of the inconsistency
+	Table      string  `json:"table,omitempty"`      // Freezer table affected, if any
+	Number     *uint64 `json:"number,omitempty"`     // Block or item number affected, if any
+	Detail     string  `json:"detail"`               // Human readable description
+	Repairable bool    `json:"repairable,omitempty"` // Whether the issue can be fixed automatically
+	Repaired   bool    `json:"repaired,omitempty"`   // Whether the issue was fixed
+}
+
+// CheckResult is the outcome of a single database integrity check.
+type CheckResult struct {
+	Name    string        `json:"name"`
+	Skipped string        `json:"skipped,omitempty"` // Reason the check was not run, if any
+	Checked uint64        `json:"checked"`           // Number of items verified
+	Issues  []*CheckIssue `json:"issues"`
+	Omitted uint64        `json:"omitted,omitempty"` // Number of issues beyond the recorded ones
+}
+
+// NewCheckResult creates an empty result for the named integrity check.
+func NewCheckResult(name string) *CheckResult {
+	return &CheckResult{Name: name, Issues: []*CheckIssue{}}
+}
+
+// Add records an issue found by the check.
+func (r *CheckResult) Add(issue *CheckIssue) {
+	if len(r.Issues) >= maxCheckIssues {
+		r.Omitted++
+		return
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// Consistent reports whether all the issues found by the check were repaired.
+func (r *CheckResult) Consistent() bool {
+	if r.Omitted > 0 {
+		return false
+	}
+	for _, issue := range r.Issues {
+		if !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckNumber returns a reference to the given number, for use in issues.
+func CheckNumber(n uint64) *uint64 {
+	return &n
+}
+
+// CheckFreezer verifies the index files of the chain freezer tables against the
+// data files they point into, as well as the lengths of the tables against each
+// other. The freezer must not be open while being checked.
+//
+// If repair is set and only repairable issues were found, i.e. torn writes at
+// the head of the tables and tables of different lengths, the freezer is opened
+// for writing, truncating the tables to their last consistent item.
+func CheckFreezer(datadir string, repair bool) (*CheckResult, error) {
+	res := NewCheckResult("freezer")
+	if _, err := os.Stat(datadir); os.IsNotExist(err) {
+		res.Skipped = "no ancient store"
+		return res, nil
+	}
+	names := make([]string, 0, len(FreezerNoSnappy))
+	for name := range FreezerNoSnappy {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var (
+		lengths = make(map[string]uint64)
+		min     = ^uint64(0)
+	)
+	for _, name := range names {
+		items, err := checkFreezerTable(res, datadir, name, FreezerNoSnappy[name])
+		if err != nil {
+			return nil, err
+		}
+		lengths[name] = items
+		if items < min {
+			min = items
+		}
+	}
+	for _, name := range names {
+		if lengths[name] > min {
+			res.Add(&CheckIssue{
+				Kind:       "table-length-mismatch",
+				Table:      name,
+				Number:     CheckNumber(min),
+				Detail:     fmt.Sprintf("table has %d items, others only %d", lengths[name], min),
+				Repairable: true,
+			})
+		}
+	}
+	if !repair || len(res.Issues) == 0 {
+		return res, nil
+	}
+	for _, issue := range res.Issues {
+		if !issue.Repairable {
+			return res, nil
+		}
+	}
+	// Only repairable issues were found, opening the freezer for writing
+	// truncates the tables to their last consistent item
+	f, err := newFreezer(datadir, "", false, freezerTableSize, FreezerNoSnappy)
+	if err != nil {
+		return res, err
+	}
+	if err := f.Close(); err != nil {
+		return res, err
+	}
+	for _, issue := range res.Issues {
+		issue.Repaired = true
+	}
+	return res, nil
+}
+
+// checkFreezerTable verifies the index of a single freezer table, returning the
+// number of items up to which it is consistent with the data files.
+func checkFreezerTable(res *CheckResult, datadir, name string, noCompression bool) (uint64, error) {
+	idxName, dataFormat := name+".cidx", "%s.%04d.cdat"
+	if noCompression {
+		idxName, dataFormat = name+".ridx", "%s.%04d.rdat"
+	}
+	index, err := os.Open(filepath.Join(datadir, idxName))
+	if os.IsNotExist(err) {
+		res.Add(&CheckIssue{Kind: "missing-index", Table: name, Detail: "index file missing"})
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+
+	stat, err := index.Stat()
+	if err != nil {
+		return 0, err
+	}
+	entries := stat.Size() / indexEntrySize
+	if entries == 0 {
+		return 0, nil
+	}
+	var (
+		reader = bufio.NewReaderSize(index, 1024*1024)
+		buffer = make([]byte, indexEntrySize)
+		first  indexEntry
+	)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return 0, err
+	}
+	first.unmarshalBinary(buffer)
+	offset := uint64(first.offset)
+
+	if overflow := stat.Size() % indexEntrySize; overflow != 0 {
+		res.Add(&CheckIssue{
+			Kind:       "torn-index",
+			Table:      name,
+			Number:     CheckNumber(offset + uint64(entries) - 1),
+			Detail:     fmt.Sprintf("index ends with a partial entry of %d bytes", overflow),
+			Repairable: true,
+		})
+	}
+	// Check the virtual tail against the items actually removed
+	if meta, err := os.Open(filepath.Join(datadir, name+".meta")); err == nil {
+		if stat, err := meta.Stat(); err == nil && stat.Size() > 0 {
+			m, err := readMetadata(meta)
+			switch {
+			case err != nil:
+				res.Add(&CheckIssue{Kind: "corrupt-metadata", Table: name, Detail: err.Error()})
+			case m.VirtualTail < offset:
+				res.Add(&CheckIssue{
+					Kind:       "invalid-tail",
+					Table:      name,
+					Number:     CheckNumber(m.VirtualTail),
+					Detail:     fmt.Sprintf("virtual tail below the %d removed items", offset),
+					Repairable: true,
+				})
+			}
+		}
+		meta.Close()
+	}
+	// Verify every entry against the previous one and its data file
+	var (
+		sizes = make(map[uint32]int64)
+		prev  = indexEntry{filenum: first.filenum, offset: 0}
+		last  = prev // Last entry consistent with the data
+
+		good     int64 // Position of the last consistent entry
+		firstBad int64 // Position of the first inconsistent entry
+		bad      int64 // Number of inconsistent entries
+		badIssue *CheckIssue
+	)
+	size := func(filenum uint32) int64 {
+		if size, ok := sizes[filenum]; ok {
+			return size
+		}
+		size := int64(-1)
+		if stat, err := os.Stat(filepath.Join(datadir, fmt.Sprintf(dataFormat, name, filenum))); err == nil {
+			size = stat.Size()
+		}
+		sizes[filenum] = size
+		return size
+	}
+	for i := int64(1); i < entries; i++ {
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			return 0, err
+		}
+		var entry indexEntry
+		entry.unmarshalBinary(buffer)
+		res.Checked++
+
+		var problem string
+		switch {
+		case entry.filenum != prev.filenum && entry.filenum != prev.filenum+1:
+			problem = fmt.Sprintf("data file %d follows file %d", entry.filenum, prev.filenum)
+		case entry.filenum == prev.filenum && entry.offset < prev.offset:
+			problem = fmt.Sprintf("offset %d precedes %d", entry.offset, prev.offset)
+		case size(entry.filenum) < 0:
+			problem = fmt.Sprintf("data file %d missing", entry.filenum)
+		case int64(entry.offset) > size(entry.filenum):
+			problem = fmt.Sprintf("offset %d beyond the %d bytes of data file %d", entry.offset, size(entry.filenum), entry.filenum)
+		}
+		if problem == "" {
+			good, last = i, entry
+		} else {
+			if bad == 0 {
+				firstBad = i
+				badIssue = &CheckIssue{Kind: "index-corruption", Table: name, Number: CheckNumber(offset + uint64(i) - 1), Detail: problem}
+				res.Add(badIssue)
+			}
+			bad++
+		}
+		prev = entry
+	}
+	// Inconsistent entries at the end of the index are torn writes, which are
+	// dropped when the table is opened for writing
+	if bad > 0 && firstBad > good {
+		badIssue.Kind = "torn-head"
+		badIssue.Detail = fmt.Sprintf("last %d index entries are inconsistent: %s", bad, badIssue.Detail)
+		badIssue.Repairable = true
+	} else if bad > 0 {
+		return offset + uint64(firstBad) - 1, nil
+	}
+	if stored := size(last.filenum); stored > int64(last.offset) {
+		res.Add(&CheckIssue{
+			Kind:       "dangling-data",
+			Table:      name,
+			Number:     CheckNumber(offset + uint64(good)),
+			Detail:     fmt.Sprintf("%d bytes of data file %d not indexed", stored-int64(last.offset), last.filenum),
+			Repairable: true,
+		})
+	}
+	return offset + uint64(good), nil
+}
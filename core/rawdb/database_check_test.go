@@ -0,0 +1,122 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Tests that the freezer check detects torn writes at the head of the tables and
+// repairs them, but refuses to touch tables corrupted elsewhere.
+func TestCheckFreezer(t *testing.T) {
+	dir := t.TempDir()
+	f, err := NewChainFreezer(dir, "", false)
+	if err != nil {
+		t.Fatalf("failed to open freezer: %v", err)
+	}
+	_, err = f.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+		for i := uint64(0); i < 10; i++ {
+			for kind := range FreezerNoSnappy {
+				if err := op.AppendRaw(kind, i, []byte(fmt.Sprintf("%s-%d", kind, i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write ancients: %v", err)
+	}
+	f.Close()
+
+	if res, err := CheckFreezer(dir, false); err != nil || !res.Consistent() {
+		t.Fatalf("consistent freezer reported broken: %v, %+v", err, res.Issues)
+	}
+	// Append unindexed data to one table and an entry beyond the data to another
+	appendFile(t, filepath.Join(dir, "headers.0000.cdat"), []byte("garbage"))
+	entry := indexEntry{filenum: 0, offset: 1 << 20}
+	appendFile(t, filepath.Join(dir, "bodies.cidx"), entry.append(nil))
+
+	res, err := CheckFreezer(dir, false)
+	if err != nil {
+		t.Fatalf("failed to check freezer: %v", err)
+	}
+	kinds := make(map[string]string)
+	for _, issue := range res.Issues {
+		if !issue.Repairable || issue.Repaired {
+			t.Errorf("issue %s: unexpected repair state: %+v", issue.Kind, issue)
+		}
+		kinds[issue.Kind] = issue.Table
+	}
+	if kinds["dangling-data"] != "headers" || kinds["torn-head"] != "bodies" {
+		t.Fatalf("issues mismatch: %v", kinds)
+	}
+	if res, err = CheckFreezer(dir, true); err != nil || !res.Consistent() {
+		t.Fatalf("failed to repair freezer: %v, %+v", err, res.Issues)
+	}
+	if res, err = CheckFreezer(dir, false); err != nil || len(res.Issues) != 0 {
+		t.Fatalf("repaired freezer reported broken: %v, %+v", err, res.Issues)
+	}
+	// Corrupt an entry in the middle of an index, which can't be repaired
+	index, err := os.OpenFile(filepath.Join(dir, "hashes.ridx"), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("failed to open index: %v", err)
+	}
+	if _, err := index.WriteAt(entry.append(nil), 3*indexEntrySize); err != nil {
+		t.Fatalf("failed to corrupt index: %v", err)
+	}
+	index.Close()
+
+	if res, err = CheckFreezer(dir, true); err != nil {
+		t.Fatalf("failed to check freezer: %v", err)
+	}
+	if res.Consistent() {
+		t.Fatalf("corrupted freezer reported consistent")
+	}
+	var corrupted bool
+	for _, issue := range res.Issues {
+		if issue.Repaired {
+			t.Errorf("issue %s: repaired despite corruption", issue.Kind)
+		}
+		if issue.Kind == "index-corruption" && issue.Table == "hashes" && !issue.Repairable {
+			corrupted = true
+		}
+	}
+	if !corrupted {
+		t.Fatalf("corruption not reported")
+	}
+	if stat, _ := os.Stat(filepath.Join(dir, "hashes.ridx")); stat.Size() != 11*indexEntrySize {
+		t.Fatalf("corrupted index modified: size %d", stat.Size())
+	}
+}
+
+func appendFile(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		t.Fatalf("failed to append to %s: %v", path, err)
+	}
+}
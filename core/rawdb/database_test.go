@@ -15,3 +15,42 @@
 // along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
 
 package rawdb
+
+import (
+	"testing"
+)
+
+// Tests that a database is reopened with the engine it was created with and
+// that opening it with a different one is refused.
+func TestOpenDatabaseEngine(t *testing.T) {
+	if !PebbleEnabled {
+		t.Skip("pebble not supported")
+	}
+	for _, engine := range []string{LevelDBEngine, PebbleEngine} {
+		dir := t.TempDir()
+		db, err := Open(OpenOptions{Type: engine, Directory: dir})
+		if err != nil {
+			t.Fatalf("%s: failed to create database: %v", engine, err)
+		}
+		if have := ReadDatabaseEngine(db); have != engine {
+			t.Fatalf("%s: recorded engine mismatch: have %q", engine, have)
+		}
+		db.Close()
+
+		if have := PreexistingDatabase(dir); have != engine {
+			t.Fatalf("%s: detected engine mismatch: have %q", engine, have)
+		}
+		other := PebbleEngine
+		if engine == PebbleEngine {
+			other = LevelDBEngine
+		}
+		if _, err := Open(OpenOptions{Type: other, Directory: dir}); err == nil {
+			t.Fatalf("%s: database opened with %s", engine, other)
+		}
+		db, err = Open(OpenOptions{Directory: dir})
+		if err != nil {
+			t.Fatalf("%s: failed to reopen database: %v", engine, err)
+		}
+		db.Close()
+	}
+}
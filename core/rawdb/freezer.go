@@ -64,6 +64,10 @@ const (
 
 	// freezerTableSize defines the maximum size of freezer data files.
 	freezerTableSize = 2 * 1000 * 1000 * 1000
+
+	// freezerReloadInterval is the frequency at which a read-only freezer picks
+	// up the changes made to its tables by the process writing them.
+	freezerReloadInterval = 5 * time.Second
 )
 
 // freezer is an memory mapped append-only database to store immutable chain data
@@ -100,6 +104,10 @@ type freezer struct {
 //
 // The 'tables' argument defines the data tables. If the value of a map
 // entry is true, snappy compression is disabled for the table.
+//
+// Only a single process can open the freezer for writing. Read-only freezers
+// don't take the file-system lock, so any number of them can share the files
+// with the writer, periodically reloading the tables to follow its changes.
 func newFreezer(datadir string, namespace string, readonly bool, maxTableSize uint32, tables map[string]bool) (*freezer, error) {
 	// Create the initial freezer object
 	var (
@@ -116,9 +124,12 @@ func newFreezer(datadir string, namespace string, readonly bool, maxTableSize ui
 	}
 	// Leveldb uses LOCK as the filelock filename. To prevent the
 	// name collision, we use FLOCK as the lock name.
-	lock, _, err := fileutil.Flock(filepath.Join(datadir, "FLOCK"))
-	if err != nil {
-		return nil, err
+	var lock fileutil.Releaser
+	if !readonly {
+		var err error
+		if lock, _, err = fileutil.Flock(filepath.Join(datadir, "FLOCK")); err != nil {
+			return nil, err
+		}
 	}
 	// Open all the supported data tables
 	freezer := &freezer{
@@ -132,12 +143,14 @@ func newFreezer(datadir string, namespace string, readonly bool, maxTableSize ui
 
 	// Create the tables.
 	for name, disableSnappy := range tables {
-		table, err := newTable(datadir, name, readMeter, writeMeter, sizeGauge, maxTableSize, disableSnappy)
+		table, err := newTable(datadir, name, readMeter, writeMeter, sizeGauge, maxTableSize, disableSnappy, readonly)
 		if err != nil {
 			for _, table := range freezer.tables {
 				table.Close()
 			}
-			lock.Release()
+			if lock != nil {
+				lock.Release()
+			}
 			return nil, err
 		}
 		freezer.tables[name] = table
@@ -148,13 +161,24 @@ func newFreezer(datadir string, namespace string, readonly bool, maxTableSize ui
 		for _, table := range freezer.tables {
 			table.Close()
 		}
-		lock.Release()
+		if lock != nil {
+			lock.Release()
+		}
 		return nil, err
 	}
 
 	// Create the write batch.
 	freezer.writeBatch = newFreezerBatch(freezer)
 
+	// Follow the changes of the writer if the files are shared
+	if readonly {
+		freezer.wg.Add(1)
+		go func() {
+			freezer.reload()
+			freezer.wg.Done()
+		}()
+	}
+
 	log.Info("Opened ancient database", "database", datadir, "readonly", readonly)
 	return freezer, nil
 }
@@ -174,8 +198,10 @@ func (f *freezer) Close() error {
 				errs = append(errs, err)
 			}
 		}
-		if err := f.instanceLock.Release(); err != nil {
-			errs = append(errs, err)
+		if f.instanceLock != nil {
+			if err := f.instanceLock.Release(); err != nil {
+				errs = append(errs, err)
+			}
 		}
 	})
 	if errs != nil {
@@ -231,6 +257,20 @@ func (f *freezer) AncientSize(kind string) (uint64, error) {
 	return 0, errUnknownTable
 }
 
+// AncientTail returns the number of the first accessible item of the specified
+// category.
+func (f *freezer) AncientTail(kind string) (uint64, error) {
+	if table := f.tables[kind]; table != nil {
+		return table.tail(), nil
+	}
+	return 0, errUnknownTable
+}
+
+// AncientReadOnly returns whether the freezer is opened in read only mode.
+func (f *freezer) AncientReadOnly() bool {
+	return f.readonly
+}
+
 // ModifyAncients runs the given write operation.
 func (f *freezer) ModifyAncients(fn func(ethdb.AncientWriteOp) error) (writeSize int64, err error) {
 	if f.readonly {
@@ -285,6 +325,22 @@ func (f *freezer) TruncateAncients(items uint64) error {
 	return nil
 }
 
+// TruncateAncientTail discards any data of the specified category below the
+// provided threshold number.
+func (f *freezer) TruncateAncientTail(kind string, items uint64) error {
+	if f.readonly {
+		return errReadOnly
+	}
+	f.writeLock.Lock()
+	defer f.writeLock.Unlock()
+
+	table := f.tables[kind]
+	if table == nil {
+		return errUnknownTable
+	}
+	return table.truncateTail(items)
+}
+
 // Sync flushes all data tables to disk.
 func (f *freezer) Sync() error {
 	var errs []error
@@ -299,7 +355,8 @@ func (f *freezer) Sync() error {
 	return nil
 }
 
-// repair truncates all data tables to the same length.
+// repair truncates all data tables to the same length. Read-only freezers leave
+// the tables untouched, only serving items up to their common length.
 func (f *freezer) repair() error {
 	min := uint64(math.MaxUint64)
 	for _, table := range f.tables {
@@ -308,15 +365,45 @@ func (f *freezer) repair() error {
 			min = items
 		}
 	}
-	for _, table := range f.tables {
-		if err := table.truncate(min); err != nil {
-			return err
+	if !f.readonly {
+		for _, table := range f.tables {
+			if err := table.truncate(min); err != nil {
+				return err
+			}
 		}
 	}
 	atomic.StoreUint64(&f.frozen, min)
 	return nil
 }
 
+// reload is a background thread of read-only freezers that periodically syncs
+// the tables with the changes made by the process writing them.
+func (f *freezer) reload() {
+	ticker := time.NewTicker(freezerReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := f.reloadTables(); err != nil {
+				log.Warn("Failed to reload ancient tables", "err", err)
+			}
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+// reloadTables syncs all data tables of a read-only freezer with their files.
+func (f *freezer) reloadTables() error {
+	for _, table := range f.tables {
+		if err := table.reload(); err != nil {
+			return err
+		}
+	}
+	return f.repair()
+}
+
 // freeze is a background thread that periodically checks the blockchain for any
 // import progress and moves ancient data from the fast database into the freezer.
 //
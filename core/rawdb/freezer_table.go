@@ -44,6 +44,14 @@ var (
 
 	// errNotSupported is returned if the database doesn't support the required operation.
 	errNotSupported = errors.New("this operation is not supported")
+
+	// errTruncationBelowTail is returned if the head of the table is truncated
+	// below the items already removed from its tail.
+	errTruncationBelowTail = errors.New("truncation below tail")
+
+	// errTruncationAboveHead is returned if the tail of the table is truncated
+	// above its head.
+	errTruncationAboveHead = errors.New("truncation above head")
 )
 
 // indexEntry contains the number/id of the file that the data resides in, aswell as the
@@ -92,9 +100,12 @@ type freezerTable struct {
 	// WARNING: The `items` field is accessed atomically. On 32 bit platforms, only
 	// 64-bit aligned fields can be atomic. The struct is guaranteed to be so aligned,
 	// so take advantage of that (https://golang.org/pkg/sync/atomic/#pkg-note-BUG).
-	items uint64 // Number of items stored in the table (including items removed from tail)
+	items      uint64 // Number of items stored in the table (including items removed from tail)
+	itemOffset uint64 // Number of items removed from the table
+	itemHidden uint64 // Number of items hidden in the table, including the removed ones
 
 	noCompression bool   // if true, disables snappy compression. Note: does not work retroactively
+	readonly      bool   // if true, the files are only read, the table is synced through reload
 	maxFileSize   uint32 // Max file size for data-files
 	name          string
 	path          string
@@ -104,10 +115,7 @@ type freezerTable struct {
 	headId uint32              // number of the currently active head file
 	tailId uint32              // number of the earliest file
 	index  *os.File            // File descriptor for the indexEntry file of the table
-
-	// In the case that old items are deleted (from the tail), we use itemOffset
-	// to count how many historic items have gone missing.
-	itemOffset uint32 // Offset (number of discarded items)
+	meta   *os.File            // File descriptor for metadata of the table
 
 	headBytes  int64         // Number of bytes written to the head file
 	readMeter  metrics.Meter // Meter for measuring the effective amount of data read
@@ -120,7 +128,7 @@ type freezerTable struct {
 
 // NewFreezerTable opens the given path as a freezer table.
 func NewFreezerTable(path, name string, disableSnappy bool) (*freezerTable, error) {
-	return newTable(path, name, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, freezerTableSize, disableSnappy)
+	return newTable(path, name, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, freezerTableSize, disableSnappy, false)
 }
 
 // openFreezerFileForAppend opens a freezer table file and seeks to the end
@@ -164,11 +172,11 @@ func truncateFreezerFile(file *os.File, size int64) error {
 // newTable opens a freezer table, creating the data and index files if they are
 // non existent. Both files are truncated to the shortest common length to ensure
 // they don't go out of sync.
-func newTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFilesize uint32, noCompression bool) (*freezerTable, error) {
-	// Ensure the containing directory exists and open the indexEntry file
-	if err := os.MkdirAll(path, 0755); err != nil {
-		return nil, err
-	}
+//
+// A read-only table never creates or modifies its files, they are expected to be
+// maintained by a different process. Any items not completely written out yet
+// are ignored instead of truncated.
+func newTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFilesize uint32, noCompression bool, readonly bool) (*freezerTable, error) {
 	var idxName string
 	if noCompression {
 		// Raw idx
@@ -177,13 +185,34 @@ func newTable(path string, name string, readMeter metrics.Meter, writeMeter metr
 		// Compressed idx
 		idxName = fmt.Sprintf("%s.cidx", name)
 	}
-	offsets, err := openFreezerFileForAppend(filepath.Join(path, idxName))
-	if err != nil {
-		return nil, err
+	var (
+		offsets *os.File
+		meta    *os.File
+		err     error
+	)
+	if readonly {
+		if offsets, err = openFreezerFileForReadOnly(filepath.Join(path, idxName)); err != nil {
+			return nil, err
+		}
+		if meta, err = openFreezerFileForReadOnly(filepath.Join(path, fmt.Sprintf("%s.meta", name))); err != nil {
+			offsets.Close()
+			return nil, err
+		}
+	} else {
+		// Ensure the containing directory exists and open the indexEntry file
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		if offsets, err = openFreezerFileForAppend(filepath.Join(path, idxName)); err != nil {
+			return nil, err
+		}
+		if meta, err = openFreezerFileForAppend(filepath.Join(path, fmt.Sprintf("%s.meta", name))); err != nil {
+			offsets.Close()
+			return nil, err
+		}
 	}
 	// Create the table and repair any past inconsistency
 	tab := &freezerTable{
-		index:         offsets,
 		files:         make(map[uint32]*os.File),
 		readMeter:     readMeter,
 		writeMeter:    writeMeter,
@@ -192,11 +221,24 @@ func newTable(path string, name string, readMeter metrics.Meter, writeMeter metr
 		path:          path,
 		logger:        log.New("database", path, "table", name),
 		noCompression: noCompression,
+		readonly:      readonly,
 		maxFileSize:   maxFilesize,
 	}
-	if err := tab.repair(); err != nil {
-		tab.Close()
-		return nil, err
+	if readonly {
+		if err := tab.load(offsets, meta); err != nil {
+			offsets.Close()
+			meta.Close()
+			for _, f := range tab.files {
+				f.Close()
+			}
+			return nil, err
+		}
+	} else {
+		tab.index, tab.meta = offsets, meta
+		if err := tab.repair(); err != nil {
+			tab.Close()
+			return nil, err
+		}
 	}
 	// Initialize the starting size counter
 	size, err := tab.sizeNolock()
@@ -248,10 +290,23 @@ func (t *freezerTable) repair() error {
 	firstIndex.unmarshalBinary(buffer)
 
 	t.tailId = firstIndex.filenum
-	t.itemOffset = firstIndex.offset
+	t.itemOffset = uint64(firstIndex.offset)
+
+	// Load the virtual tail from the metadata file, items below it are
+	// hidden even if they are still stored in the tail data file
+	meta, err := loadMetadata(t.meta, t.itemOffset)
+	if err != nil {
+		return err
+	}
+	t.itemHidden = meta.VirtualTail
 
-	t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
-	lastIndex.unmarshalBinary(buffer)
+	// Read the last index, use the default value in case the table is empty
+	if offsetsSize == indexEntrySize {
+		lastIndex = indexEntry{filenum: t.tailId, offset: 0}
+	} else {
+		t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
+		lastIndex.unmarshalBinary(buffer)
+	}
 	t.head, err = t.openFile(lastIndex.filenum, openFreezerFileForAppend)
 	if err != nil {
 		return err
@@ -280,9 +335,16 @@ func (t *freezerTable) repair() error {
 				return err
 			}
 			offsetsSize -= indexEntrySize
-			t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
+
+			// Read the new head index, use the default value in case the
+			// table is already empty
 			var newLastIndex indexEntry
-			newLastIndex.unmarshalBinary(buffer)
+			if offsetsSize == indexEntrySize {
+				newLastIndex = indexEntry{filenum: t.tailId, offset: 0}
+			} else {
+				t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
+				newLastIndex.unmarshalBinary(buffer)
+			}
 			// We might have slipped back into an earlier head-file here
 			if newLastIndex.filenum != lastIndex.filenum {
 				// Release earlier opened file
@@ -308,8 +370,11 @@ func (t *freezerTable) repair() error {
 	if err := t.head.Sync(); err != nil {
 		return err
 	}
+	if err := t.meta.Sync(); err != nil {
+		return err
+	}
 	// Update the item and byte counters and return
-	t.items = uint64(t.itemOffset) + uint64(offsetsSize/indexEntrySize-1) // last indexEntry points to the end of the data file
+	t.items = t.itemOffset + uint64(offsetsSize/indexEntrySize-1) // last indexEntry points to the end of the data file
 	t.headBytes = contentSize
 	t.headId = lastIndex.filenum
 
@@ -317,7 +382,7 @@ func (t *freezerTable) repair() error {
 	if err := t.preopen(); err != nil {
 		return err
 	}
-	t.logger.Debug("Chain freezer table opened", "items", t.items, "size", common.StorageSize(t.headBytes))
+	t.logger.Debug("Chain freezer table opened", "items", t.items, "hidden", t.itemHidden, "size", common.StorageSize(t.headBytes))
 	return nil
 }
 
@@ -339,6 +404,108 @@ func (t *freezerTable) preopen() (err error) {
 	return err
 }
 
+// reload synchronizes a read-only table with its files, picking up the items
+// appended and removed by the process writing them. The index and metadata files
+// are reopened as removing items from the tail replaces them.
+func (t *freezerTable) reload() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil {
+		return errClosed
+	}
+	index, err := openFreezerFileForReadOnly(t.index.Name())
+	if err != nil {
+		return err
+	}
+	meta, err := openFreezerFileForReadOnly(t.meta.Name())
+	if err != nil {
+		index.Close()
+		return err
+	}
+	if err := t.load(index, meta); err != nil {
+		index.Close()
+		meta.Close()
+		return err
+	}
+	return nil
+}
+
+// load reads the bounds of a read-only table from the given index and metadata
+// files, and swaps them in place of the current ones. Index entries pointing to
+// data not yet written out are ignored, so the files can be appended to while
+// being loaded. The caller must hold the write lock.
+func (t *freezerTable) load(index, meta *os.File) error {
+	stat, err := index.Stat()
+	if err != nil {
+		return err
+	}
+	// Ignore a partially written last entry
+	offsetsSize := stat.Size() - stat.Size()%indexEntrySize
+	if offsetsSize == 0 {
+		return fmt.Errorf("table %s not initialized", t.name)
+	}
+	var (
+		buffer     = make([]byte, indexEntrySize)
+		firstIndex indexEntry
+		lastIndex  indexEntry
+	)
+	if _, err := index.ReadAt(buffer, 0); err != nil {
+		return err
+	}
+	firstIndex.unmarshalBinary(buffer)
+	itemOffset := uint64(firstIndex.offset)
+
+	// The metadata might be read while being rewritten, fall back to the actual
+	// tail then, it's picked up on the next reload
+	hidden := itemOffset
+	if m, err := readMetadata(meta); err == nil && m.VirtualTail > hidden {
+		hidden = m.VirtualTail
+	}
+	// Find the last index entry with all of its data stored
+	for {
+		if offsetsSize == indexEntrySize {
+			lastIndex = indexEntry{filenum: firstIndex.filenum, offset: 0}
+			break
+		}
+		if _, err := index.ReadAt(buffer, offsetsSize-indexEntrySize); err != nil {
+			return err
+		}
+		lastIndex.unmarshalBinary(buffer)
+
+		if f, err := t.openFile(lastIndex.filenum, openFreezerFileForReadOnly); err == nil {
+			if stat, err := f.Stat(); err == nil && stat.Size() >= int64(lastIndex.offset) {
+				break
+			}
+		}
+		offsetsSize -= indexEntrySize
+	}
+	// Open all the data files up to the head
+	for i := firstIndex.filenum; i <= lastIndex.filenum; i++ {
+		if _, err := t.openFile(i, openFreezerFileForReadOnly); err != nil {
+			return err
+		}
+	}
+	// Everything is loaded, swap out the files and update the counters
+	if t.index != nil {
+		t.index.Close()
+	}
+	if t.meta != nil {
+		t.meta.Close()
+	}
+	t.index, t.meta = index, meta
+	t.tailId, t.headId = firstIndex.filenum, lastIndex.filenum
+	t.releaseFilesBefore(t.tailId, false)
+	t.releaseFilesAfter(t.headId, false)
+	t.head = t.files[t.headId]
+	t.headBytes = int64(lastIndex.offset)
+
+	atomic.StoreUint64(&t.itemOffset, itemOffset)
+	atomic.StoreUint64(&t.itemHidden, hidden)
+	atomic.StoreUint64(&t.items, itemOffset+uint64(offsetsSize/indexEntrySize-1))
+	return nil
+}
+
 // truncate discards any recent data above the provided threshold number.
 func (t *freezerTable) truncate(items uint64) error {
 	t.lock.Lock()
@@ -349,6 +516,9 @@ func (t *freezerTable) truncate(items uint64) error {
 	if existing <= items {
 		return nil
 	}
+	if items < atomic.LoadUint64(&t.itemOffset) {
+		return errTruncationBelowTail
+	}
 	// We need to truncate, save the old size for metrics tracking
 	oldSize, err := t.sizeNolock()
 	if err != nil {
@@ -360,16 +530,24 @@ func (t *freezerTable) truncate(items uint64) error {
 		log = t.logger.Warn // Only loud warn if we delete multiple items
 	}
 	log("Truncating freezer table", "items", existing, "limit", items)
-	if err := truncateFreezerFile(t.index, int64(items+1)*indexEntrySize); err != nil {
+
+	// Truncate the index file, the items removed from the tail are not
+	// stored in it anymore
+	length := items - atomic.LoadUint64(&t.itemOffset)
+	if err := truncateFreezerFile(t.index, int64(length+1)*indexEntrySize); err != nil {
 		return err
 	}
 	// Calculate the new expected size of the data file and truncate it
-	buffer := make([]byte, indexEntrySize)
-	if _, err := t.index.ReadAt(buffer, int64(items*indexEntrySize)); err != nil {
-		return err
-	}
 	var expected indexEntry
-	expected.unmarshalBinary(buffer)
+	if length == 0 {
+		expected = indexEntry{filenum: t.tailId, offset: 0}
+	} else {
+		buffer := make([]byte, indexEntrySize)
+		if _, err := t.index.ReadAt(buffer, int64(length*indexEntrySize)); err != nil {
+			return err
+		}
+		expected.unmarshalBinary(buffer)
+	}
 
 	// We might need to truncate back to older files
 	if expected.filenum != t.headId {
@@ -393,6 +571,14 @@ func (t *freezerTable) truncate(items uint64) error {
 	t.headBytes = int64(expected.offset)
 	atomic.StoreUint64(&t.items, items)
 
+	// Lower the virtual tail if it's beyond the new head
+	if atomic.LoadUint64(&t.itemHidden) > items {
+		atomic.StoreUint64(&t.itemHidden, items)
+		if err := writeMetadata(t.meta, newMetadata(items)); err != nil {
+			return err
+		}
+	}
+
 	// Retrieve the new size and update the total size counter
 	newSize, err := t.sizeNolock()
 	if err != nil {
@@ -403,6 +589,119 @@ func (t *freezerTable) truncate(items uint64) error {
 	return nil
 }
 
+// truncateTail discards any data below the provided threshold number. The
+// items are hidden first by persisting the new virtual tail, then the data
+// files containing only hidden items are deleted along with their indices.
+func (t *freezerTable) truncateTail(items uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Ensure the given truncate target falls in the correct range
+	if atomic.LoadUint64(&t.itemHidden) >= items {
+		return nil
+	}
+	if atomic.LoadUint64(&t.items) < items {
+		return errTruncationAboveHead
+	}
+	// Load the data file number containing the new tail item, or the head
+	// file if everything is truncated
+	var (
+		newTailId uint32
+		buffer    = make([]byte, indexEntrySize)
+	)
+	if atomic.LoadUint64(&t.items) == items {
+		newTailId = t.headId
+	} else {
+		offset := items - atomic.LoadUint64(&t.itemOffset)
+		if _, err := t.index.ReadAt(buffer, int64((offset+1)*indexEntrySize)); err != nil {
+			return err
+		}
+		var newTail indexEntry
+		newTail.unmarshalBinary(buffer)
+		newTailId = newTail.filenum
+	}
+	// Update the virtual tail marker, hiding the items in the table. It is
+	// flushed before any data is deleted, so the deletion can't be observed
+	// without it after a crash.
+	if err := writeMetadata(t.meta, newMetadata(items)); err != nil {
+		return err
+	}
+	if err := t.meta.Sync(); err != nil {
+		return err
+	}
+	atomic.StoreUint64(&t.itemHidden, items)
+
+	// If the hidden items still fall in the current tail file, no data file
+	// can be dropped
+	if t.tailId == newTailId {
+		return nil
+	}
+	if t.tailId > newTailId {
+		return fmt.Errorf("invalid index, tail-file %d, item-file %d", t.tailId, newTailId)
+	}
+	// Some data files contain hidden items only, drop them. Save the old size
+	// for metrics tracking first.
+	oldSize, err := t.sizeNolock()
+	if err != nil {
+		return err
+	}
+	// Count how many items are stored in the deleted files, searching back
+	// from the new tail for the first item of the new tail file
+	var (
+		newDeleted = items
+		deleted    = atomic.LoadUint64(&t.itemOffset)
+	)
+	for current := items; current > deleted; current-- {
+		if _, err := t.index.ReadAt(buffer, int64((current-deleted)*indexEntrySize)); err != nil {
+			return err
+		}
+		var pre indexEntry
+		pre.unmarshalBinary(buffer)
+		if pre.filenum != newTailId {
+			break
+		}
+		newDeleted = current - 1
+	}
+	// Drop the index entries of the deleted items, replacing them with a new
+	// first entry referencing the tail file and the number of deleted items
+	err = copyFrom(t.index.Name(), t.index.Name(), indexEntrySize*(newDeleted-deleted+1), func(f *os.File) error {
+		tailIndex := indexEntry{
+			filenum: newTailId,
+			offset:  uint32(newDeleted),
+		}
+		_, err := f.Write(tailIndex.append(nil))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// Reopen the modified index file to load the changes
+	if err := t.index.Close(); err != nil {
+		return err
+	}
+	t.index, err = openFreezerFileForAppend(t.index.Name())
+	if err != nil {
+		return err
+	}
+	// Release and delete the files before the new tail
+	t.tailId = newTailId
+	atomic.StoreUint64(&t.itemOffset, newDeleted)
+	t.releaseFilesBefore(t.tailId, true)
+
+	// Retrieve the new size and update the total size counter
+	newSize, err := t.sizeNolock()
+	if err != nil {
+		return err
+	}
+	t.sizeGauge.Dec(int64(oldSize - newSize))
+	return nil
+}
+
+// tail returns the number of the first accessible item in the table.
+func (t *freezerTable) tail() uint64 {
+	return atomic.LoadUint64(&t.itemHidden)
+}
+
 // Close closes all opened files.
 func (t *freezerTable) Close() error {
 	t.lock.Lock()
@@ -414,6 +713,11 @@ func (t *freezerTable) Close() error {
 	}
 	t.index = nil
 
+	if err := t.meta.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	t.meta = nil
+
 	for _, f := range t.files {
 		if err := f.Close(); err != nil {
 			errs = append(errs, err)
@@ -468,6 +772,19 @@ func (t *freezerTable) releaseFilesAfter(num uint32, remove bool) {
 	}
 }
 
+// releaseFilesBefore closes all open files with a lower number, and optionally also deletes the files
+func (t *freezerTable) releaseFilesBefore(num uint32, remove bool) {
+	for fnum, f := range t.files {
+		if fnum < num {
+			delete(t.files, fnum)
+			f.Close()
+			if remove {
+				os.Remove(f.Name())
+			}
+		}
+	}
+}
+
 // getIndices returns the index entries for the given from-item, covering 'count' items.
 // N.B: The actual number of returned indices for N items will always be N+1 (unless an
 // error is returned).
@@ -476,7 +793,7 @@ func (t *freezerTable) releaseFilesAfter(num uint32, remove bool) {
 // it will return error.
 func (t *freezerTable) getIndices(from, count uint64) ([]*indexEntry, error) {
 	// Apply the table-offset
-	from = from - uint64(t.itemOffset)
+	from = from - atomic.LoadUint64(&t.itemOffset)
 	// For reading N items, we need N+1 indices.
 	buffer := make([]byte, (count+1)*indexEntrySize)
 	if _, err := t.index.ReadAt(buffer, int64(from*indexEntrySize)); err != nil {
@@ -566,9 +883,9 @@ func (t *freezerTable) retrieveItems(start, count, maxBytes uint64) ([]byte, []i
 		return nil, nil, errClosed
 	}
 	itemCount := atomic.LoadUint64(&t.items) // max number
-	// Ensure the start is written, not deleted from the tail, and that the
-	// caller actually wants something
-	if itemCount <= start || uint64(t.itemOffset) > start || count == 0 {
+	// Ensure the start is written, not deleted or hidden from the tail, and
+	// that the caller actually wants something
+	if itemCount <= start || atomic.LoadUint64(&t.itemHidden) > start || count == 0 {
 		return nil, nil, errOutOfBounds
 	}
 	if start+count > itemCount {
@@ -651,7 +968,7 @@ func (t *freezerTable) retrieveItems(start, count, maxBytes uint64) ([]byte, []i
 // has returns an indicator whether the specified number data
 // exists in the freezer table.
 func (t *freezerTable) has(number uint64) bool {
-	return atomic.LoadUint64(&t.items) > number
+	return atomic.LoadUint64(&t.items) > number && atomic.LoadUint64(&t.itemHidden) <= number
 }
 
 // size returns the total data size in the freezer table.
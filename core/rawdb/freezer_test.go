@@ -253,6 +253,82 @@ func TestFreezerConcurrentModifyTruncate(t *testing.T) {
 	}
 }
 
+// Tests that a freezer can be opened read-only while being written by a
+// different instance, following its changes on reload.
+func TestFreezerReadonlyShared(t *testing.T) {
+	t.Parallel()
+
+	f, dir := newFreezerForTesting(t, freezerTestTableDef)
+	defer os.RemoveAll(dir)
+	defer f.Close()
+
+	write := func(from, to int) {
+		_, err := f.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+			for i := from; i < to; i++ {
+				if err := op.AppendRaw("test", uint64(i), getChunk(1024, i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal("ModifyAncients failed:", err)
+		}
+	}
+	write(0, 10)
+
+	// Open the same files read-only while the writer holds the lock
+	ro, err := newFreezer(dir, "", true, 2049, freezerTestTableDef)
+	if err != nil {
+		t.Fatal("can't open read-only freezer:", err)
+	}
+	defer ro.Close()
+
+	checkAncientCount(t, ro, "test", 10)
+	for i := 0; i < 10; i++ {
+		if blob, err := ro.Ancient("test", uint64(i)); err != nil || !bytes.Equal(blob, getChunk(1024, i)) {
+			t.Fatalf("item %d: wrong value: %x, %v", i, blob, err)
+		}
+	}
+	// Modifications must be rejected by the read-only instance
+	if _, err := ro.ModifyAncients(func(op ethdb.AncientWriteOp) error { return nil }); err != errReadOnly {
+		t.Fatalf("read-only freezer modified: %v", err)
+	}
+	if err := ro.TruncateAncients(5); err != errReadOnly {
+		t.Fatalf("read-only freezer truncated: %v", err)
+	}
+	// Append new items, they show up only after a reload
+	write(10, 20)
+	checkAncientCount(t, ro, "test", 10)
+
+	if err := ro.reloadTables(); err != nil {
+		t.Fatal("failed to reload tables:", err)
+	}
+	checkAncientCount(t, ro, "test", 20)
+	if blob, err := ro.Ancient("test", 15); err != nil || !bytes.Equal(blob, getChunk(1024, 15)) {
+		t.Fatalf("item 15: wrong value: %x, %v", blob, err)
+	}
+	// Remove items from the tail, deleting some of the data files
+	if err := f.TruncateAncientTail("test", 9); err != nil {
+		t.Fatal("failed to truncate tail:", err)
+	}
+	if err := ro.reloadTables(); err != nil {
+		t.Fatal("failed to reload tables:", err)
+	}
+	if tail, _ := ro.AncientTail("test"); tail != 9 {
+		t.Fatalf("tail mismatch: have %d, want 9", tail)
+	}
+	if _, err := ro.Ancient("test", 8); err == nil {
+		t.Fatal("retrieved item below the tail")
+	}
+	for i := 9; i < 20; i++ {
+		if blob, err := ro.Ancient("test", uint64(i)); err != nil || !bytes.Equal(blob, getChunk(1024, i)) {
+			t.Fatalf("item %d: wrong value: %x, %v", i, blob, err)
+		}
+	}
+	checkAncientCount(t, ro, "test", 20)
+}
+
 func newFreezerForTesting(t *testing.T, tables map[string]bool) (*freezer, string) {
 	t.Helper()
 
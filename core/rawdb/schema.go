@@ -30,6 +30,9 @@ var (
 	// databaseVersionKey tracks the current database version.
 	databaseVersionKey = []byte("DatabaseVersion")
 
+	// databaseEngineKey tracks the key-value store implementation backing the database.
+	databaseEngineKey = []byte("DatabaseEngine")
+
 	// headHeaderKey tracks the latest known header's hash.
 	headHeaderKey = []byte("LastHeader")
 
@@ -75,6 +78,13 @@ var (
 	// uncleanShutdownKey tracks the list of local crashes
 	uncleanShutdownKey = []byte("unclean-shutdown") // config prefix for the db
 
+	// stateSchemeKey tracks the storage scheme of the trie nodes in the database.
+	stateSchemeKey = []byte("StateScheme")
+
+	// persistentStateIDKey tracks the id of the latest state flushed to disk
+	// by the path-based trie database.
+	persistentStateIDKey = []byte("LastStateID")
+
 	// Data item prefixes (use single byte to avoid mixing data types, avoid `i`, used for indexes).
 	headerPrefix       = []byte("h") // headerPrefix + num (uint64 big endian) + hash -> header
 	headerTDSuffix     = []byte("t") // headerPrefix + num (uint64 big endian) + hash + headerTDSuffix -> td
@@ -90,11 +100,27 @@ var (
 	SnapshotStoragePrefix = []byte("o") // SnapshotStoragePrefix + account hash + storage hash -> storage trie value
 	CodePrefix            = []byte("c") // CodePrefix + code hash -> account code
 
+	TrieNodeAccountPrefix = []byte("A") // TrieNodeAccountPrefix + hex path -> account trie node (path scheme)
+	TrieNodeStoragePrefix = []byte("O") // TrieNodeStoragePrefix + account hash + hex path -> storage trie node (path scheme)
+
+	reverseDiffPrefix       = []byte("ReverseDiff-")       // reverseDiffPrefix + state id (uint64 big endian) -> reverse diff
+	reverseDiffLookupPrefix = []byte("ReverseDiffLookup-") // reverseDiffLookupPrefix + state root -> state id
+
+	stateHistoryTailKey            = []byte("StateHistoryTail")          // Id of the first usable state history
+	stateHistoryLookupPrefix       = []byte("StateHistoryLookup-")       // stateHistoryLookupPrefix + state root -> id of the state history reverting to it
+	stateHistoryAccountIndexPrefix = []byte("StateHistoryAccountIndex-") // stateHistoryAccountIndexPrefix + account hash + last id -> state history ids
+	stateHistoryStorageIndexPrefix = []byte("StateHistoryStorageIndex-") // stateHistoryStorageIndexPrefix + account hash + storage hash + last id -> state history ids
+
+	stateChangeIndexTailKey = []byte("StateChangeIndexTail") // First section of the state change index which is not pruned
+	stateChangeSetPrefix    = []byte("StateChangeSet-")      // stateChangeSetPrefix + num (uint64 big endian) + hash -> accounts and slots modified by the block
+	stateChangeIndexPrefix  = []byte("StateChangeIndex-")    // stateChangeIndexPrefix + section (uint64 big endian) [+ account hash [+ storage hash]] -> modifying blocks, or blocks missing from the section
+
 	preimagePrefix = []byte("secure-key-")      // preimagePrefix + hash -> preimage
 	configPrefix   = []byte("ethereum-config-") // config prefix for the db
 
 	// Chain index prefixes (use `i` + single byte to avoid mixing data types).
-	BloomBitsIndexPrefix = []byte("iB") // BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
+	BloomBitsIndexPrefix   = []byte("iB") // BloomBitsIndexPrefix is the data table of a chain indexer to track its progress
+	StateChangeIndexPrefix = []byte("iS") // StateChangeIndexPrefix is the data table of the state change indexer to track its progress
 
 	preimageCounter    = metrics.NewRegisteredCounter("db/preimage/total", nil)
 	preimageHitCounter = metrics.NewRegisteredCounter("db/preimage/hits", nil)
@@ -127,6 +153,28 @@ var FreezerNoSnappy = map[string]bool{
 	freezerDifficultyTable: true,
 }
 
+const (
+	// stateHistoryMetaTable indicates the name of the state history table storing
+	// the roots of the reverted state transitions.
+	stateHistoryMetaTable = "history.meta"
+
+	// stateHistoryAccountTable indicates the name of the state history table
+	// storing the previous values of the modified accounts.
+	stateHistoryAccountTable = "account.data"
+
+	// stateHistoryStorageTable indicates the name of the state history table
+	// storing the previous values of the modified storage slots.
+	stateHistoryStorageTable = "storage.data"
+)
+
+// stateHistoryNoSnappy configures whether compression is disabled for the state
+// history tables. The metadata consists of hashes only, which don't compress well.
+var stateHistoryNoSnappy = map[string]bool{
+	stateHistoryMetaTable:    true,
+	stateHistoryAccountTable: false,
+	stateHistoryStorageTable: false,
+}
+
 // LegacyTxLookupEntry is the legacy TxLookupEntry definition with some unnecessary
 // fields.
 type LegacyTxLookupEntry struct {
@@ -197,6 +245,61 @@ func storageSnapshotsKey(accountHash common.Hash) []byte {
 	return append(SnapshotStoragePrefix, accountHash.Bytes()...)
 }
 
+// accountTrieNodeKey = TrieNodeAccountPrefix + hex path
+func accountTrieNodeKey(path []byte) []byte {
+	return append(TrieNodeAccountPrefix, path...)
+}
+
+// storageTrieNodeKey = TrieNodeStoragePrefix + account hash + hex path
+func storageTrieNodeKey(accountHash common.Hash, path []byte) []byte {
+	return append(append(TrieNodeStoragePrefix, accountHash.Bytes()...), path...)
+}
+
+// reverseDiffKey = reverseDiffPrefix + state id (uint64 big endian)
+func reverseDiffKey(id uint64) []byte {
+	return append(reverseDiffPrefix, encodeBlockNumber(id)...)
+}
+
+// stateHistoryLookupKey = stateHistoryLookupPrefix + state root
+func stateHistoryLookupKey(root common.Hash) []byte {
+	return append(stateHistoryLookupPrefix, root.Bytes()...)
+}
+
+// stateHistoryAccountIndexKey = stateHistoryAccountIndexPrefix + account hash + last id (uint64 big endian)
+func stateHistoryAccountIndexKey(accountHash common.Hash, last uint64) []byte {
+	return append(append(stateHistoryAccountIndexPrefix, accountHash.Bytes()...), encodeBlockNumber(last)...)
+}
+
+// stateHistoryStorageIndexKey = stateHistoryStorageIndexPrefix + account hash + storage hash + last id (uint64 big endian)
+func stateHistoryStorageIndexKey(accountHash, storageHash common.Hash, last uint64) []byte {
+	key := append(append(stateHistoryStorageIndexPrefix, accountHash.Bytes()...), storageHash.Bytes()...)
+	return append(key, encodeBlockNumber(last)...)
+}
+
+// stateChangeSetKey = stateChangeSetPrefix + num (uint64 big endian) + hash
+func stateChangeSetKey(number uint64, hash common.Hash) []byte {
+	return append(append(stateChangeSetPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
+// stateChangeIndexKey = stateChangeIndexPrefix + section (uint64 big endian) + account hash [+ storage hash]
+func stateChangeIndexKey(section uint64, accountHash common.Hash, storageHash *common.Hash) []byte {
+	key := append(append(stateChangeIndexPrefix, encodeBlockNumber(section)...), accountHash.Bytes()...)
+	if storageHash != nil {
+		key = append(key, storageHash.Bytes()...)
+	}
+	return key
+}
+
+// stateChangeIndexGapsKey = stateChangeIndexPrefix + section (uint64 big endian)
+func stateChangeIndexGapsKey(section uint64) []byte {
+	return append(stateChangeIndexPrefix, encodeBlockNumber(section)...)
+}
+
+// reverseDiffLookupKey = reverseDiffLookupPrefix + state root
+func reverseDiffLookupKey(root common.Hash) []byte {
+	return append(reverseDiffLookupPrefix, root.Bytes()...)
+}
+
 // bloomBitsKey = bloomBitsPrefix + bit (uint16 big endian) + section (uint64 big endian) + hash
 func bloomBitsKey(bit uint, section uint64, hash common.Hash) []byte {
 	key := append(append(bloomBitsPrefix, make([]byte, 10)...), hash.Bytes()...)
@@ -0,0 +1,165 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	// errHistoricWrite is returned if a historic state is attempted to be
+	// modified, there are no trie nodes to apply the changes on.
+	errHistoricWrite = errors.New("historic state is read-only")
+
+	// errHistoricNodes is returned when iterating or proving a historic state,
+	// which can only be accessed by keys.
+	errHistoricNodes = errors.New("historic state has no trie nodes")
+)
+
+// historicDatabase is a read-only state database serving a historical state
+// from the flat state history instead of the trie nodes.
+type historicDatabase struct {
+	Database // Underlying database to retrieve contract codes from
+
+	history *snapshot.History
+	root    common.Hash
+}
+
+// NewHistoricDatabase creates a state database serving the state with the given
+// root from the state history, without any of its trie nodes. The contract codes
+// are retrieved from the given database.
+//
+// Only the flat state can be accessed, hashing, committing, iterating and
+// proving are not supported.
+func NewHistoricDatabase(db Database, history *snapshot.History, root common.Hash) (Database, error) {
+	if !history.Available(root) {
+		return nil, fmt.Errorf("state %x: %w", root, snapshot.ErrHistoryUnavailable)
+	}
+	return &historicDatabase{
+		Database: db,
+		history:  history,
+		root:     root,
+	}, nil
+}
+
+// OpenTrie opens the account trie of the historic state.
+func (db *historicDatabase) OpenTrie(root common.Hash) (Trie, error) {
+	if root != db.root {
+		return nil, fmt.Errorf("state %x: %w", root, snapshot.ErrHistoryUnavailable)
+	}
+	return &historicTrie{history: db.history, state: db.root, root: root}, nil
+}
+
+// OpenStorageTrie opens the storage trie of an account in the historic state.
+func (db *historicDatabase) OpenStorageTrie(stateRoot, addrHash, root common.Hash) (Trie, error) {
+	return &historicTrie{history: db.history, state: db.root, owner: addrHash, root: root}, nil
+}
+
+// CopyTrie returns an independent copy of the given trie.
+func (db *historicDatabase) CopyTrie(t Trie) Trie {
+	switch t := t.(type) {
+	case *historicTrie:
+		cpy := *t
+		return &cpy
+	default:
+		return db.Database.CopyTrie(t)
+	}
+}
+
+// historicTrie is a read-only view of an account or storage trie of a historic
+// state, answering the lookups from the state history.
+type historicTrie struct {
+	history *snapshot.History
+	state   common.Hash // Root of the historic state
+	owner   common.Hash // Hash of the account owning the storage trie, empty for the account trie
+	root    common.Hash // Root of the trie
+}
+
+// GetKey returns nil, the key preimages are not tracked by the state history.
+func (t *historicTrie) GetKey([]byte) []byte {
+	return nil
+}
+
+// TryGet returns the value for key stored in the historic trie.
+func (t *historicTrie) TryGet(key []byte) ([]byte, error) {
+	hash := crypto.Keccak256Hash(key)
+	if t.owner != (common.Hash{}) {
+		return t.history.Storage(t.state, t.owner, hash)
+	}
+	blob, err := t.history.AccountRLP(t.state, hash)
+	if err != nil || blob == nil {
+		return nil, err
+	}
+	return snapshot.FullAccountRLP(blob)
+}
+
+// TryUpdateAccount always fails, historic states are read-only.
+func (t *historicTrie) TryUpdateAccount(key []byte, account *types.StateAccount) error {
+	return errHistoricWrite
+}
+
+// TryUpdate always fails, historic states are read-only.
+func (t *historicTrie) TryUpdate(key, value []byte) error {
+	return errHistoricWrite
+}
+
+// TryDelete always fails, historic states are read-only.
+func (t *historicTrie) TryDelete(key []byte) error {
+	return errHistoricWrite
+}
+
+// Hash returns the root hash of the historic trie.
+func (t *historicTrie) Hash() common.Hash {
+	return t.root
+}
+
+// Commit always fails, historic states are read-only.
+func (t *historicTrie) Commit(onleaf trie.LeafCallback) (common.Hash, int, error) {
+	return t.root, 0, errHistoricWrite
+}
+
+// NodeIterator returns an iterator which fails right away, there are no trie
+// nodes to iterate over.
+func (t *historicTrie) NodeIterator(startKey []byte) trie.NodeIterator {
+	return historicIterator{new(trie.Trie).NodeIterator(nil)}
+}
+
+// Prove always fails, there are no trie nodes to prove the key with.
+func (t *historicTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error {
+	return errHistoricNodes
+}
+
+// Witness returns an empty set, no trie nodes are accessed.
+func (t *historicTrie) Witness() map[string]struct{} {
+	return make(map[string]struct{})
+}
+
+// historicIterator is a node iterator over a historic trie, failing right away.
+type historicIterator struct {
+	trie.NodeIterator
+}
+
+func (it historicIterator) Next(bool) bool { return false }
+func (it historicIterator) Error() error   { return errHistoricNodes }
@@ -0,0 +1,608 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pruner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// The stages an online pruning run goes through.
+const (
+	StageMarking = "marking" // Collecting the live state into the bloom filter
+	StagePruning = "pruning" // Deleting the stale entries from the database
+	StageDone    = "done"    // Pruning finished successfully
+	StageAborted = "aborted" // Pruning was aborted by the user or a shutdown
+	StageFailed  = "failed"  // Pruning stopped because of an error
+)
+
+var (
+	// errPruningAborted is returned if the online pruning is interrupted.
+	errPruningAborted = errors.New("state pruning aborted")
+
+	// errPruningNotRunning is returned when aborting an already finished pruning.
+	errPruningNotRunning = errors.New("state pruning not running")
+
+	// errStateGone is returned if a recent state being marked is dropped from
+	// the snapshot tree, or its trie nodes are released.
+	errStateGone = errors.New("state gone")
+)
+
+// OnlineConfig contains the settings of the online state pruning.
+type OnlineConfig struct {
+	BloomSize uint64        // Megabytes of memory allocated to the bloom filter of the live state
+	BatchSize int           // Maximum number of stale entries deleted in one go
+	Pause     time.Duration // Time to wait between two deletion batches
+}
+
+// DefaultOnlineConfig contains the default settings of the online state pruning.
+var DefaultOnlineConfig = OnlineConfig{
+	BloomSize: 2048,
+	BatchSize: 10000,
+	Pause:     100 * time.Millisecond,
+}
+
+// OnlineProgress is a snapshot of the state of an online pruning run.
+type OnlineProgress struct {
+	Root       common.Hash        // State root the pruning is anchored to
+	Stage      string             // Current stage of the pruning
+	Elapsed    time.Duration      // Time spent pruning so far
+	Marked     uint64             // Number of live trie nodes and codes marked
+	Scanned    uint64             // Number of state entries checked for liveness
+	Pruned     uint64             // Number of stale state entries deleted
+	PrunedSize common.StorageSize // Total size of the stale state entries deleted
+	Swept      float64            // Fraction of the key space already swept
+	Err        error              // Error the pruning stopped with, if any
+}
+
+// OnlinePruner deletes the stale state from the database while the node keeps
+// following the chain. Opposed to the offline Pruner, the live state is not a
+// single version, but the current head along with every recent state tracked
+// by the snapshot tree. The workflow is:
+//
+// - persist the head state and mark all of its trie nodes and codes live
+// - mark the nodes of the recent states by walking only the paths touched by
+//   their snapshot diff layers, the rest is shared with an already marked state
+// - iterate the database, deleting the unmarked entries in throttled batches
+//
+// Every batch is deleted with the trie node flushes blocked and only after the
+// diff layers added in the meantime are marked, so the nodes of the states the
+// chain is building on are never removed. As the deleted nodes are all dead,
+// interrupting the pruning at any point leaves a consistent database behind.
+type OnlinePruner struct {
+	db       ethdb.Database
+	triedb   *trie.Database
+	snaptree *snapshot.Tree
+	root     common.Hash
+	config   OnlineConfig
+	bloom    *stateBloom
+
+	marked   map[common.Hash]struct{}                 // Roots of the states already marked
+	accounts map[common.Hash]struct{}                 // Accounts touched by any diff layer seen
+	storage  map[common.Hash]map[common.Hash]struct{} // Storage slots touched by any diff layer seen
+
+	markedNodes  uint64 // Number of live entries marked (atomic)
+	scannedNodes uint64 // Number of entries checked for liveness (atomic)
+	prunedNodes  uint64 // Number of stale entries deleted (atomic)
+	prunedSize   uint64 // Size of the stale entries deleted (atomic)
+	swept        uint64 // Leading 8 bytes of the last key swept (atomic)
+
+	start time.Time
+	end   time.Time
+	stage string
+	err   error
+	lock  sync.RWMutex // Protects the stage, the error and the end time
+
+	abort chan struct{}
+	done  chan struct{}
+}
+
+// NewOnlinePruner creates an online pruner anchored to the given state root. The
+// state must be fully persisted and tracked by the snapshot tree.
+func NewOnlinePruner(db ethdb.Database, triedb *trie.Database, snaptree *snapshot.Tree, root common.Hash, config OnlineConfig) (*OnlinePruner, error) {
+	if triedb.Scheme() == rawdb.PathScheme {
+		return nil, errors.New("online pruning is not supported by the path-based state scheme")
+	}
+	if snaptree == nil || snaptree.Snapshot(root) == nil {
+		return nil, errors.New("state snapshot is not available")
+	}
+	if config.BloomSize == 0 {
+		config.BloomSize = DefaultOnlineConfig.BloomSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultOnlineConfig.BatchSize
+	}
+	bloom, err := newStateBloomWithSize(config.BloomSize)
+	if err != nil {
+		return nil, err
+	}
+	return &OnlinePruner{
+		db:       db,
+		triedb:   triedb,
+		snaptree: snaptree,
+		root:     root,
+		config:   config,
+		bloom:    bloom,
+		marked:   make(map[common.Hash]struct{}),
+		accounts: make(map[common.Hash]struct{}),
+		storage:  make(map[common.Hash]map[common.Hash]struct{}),
+		stage:    StageMarking,
+		abort:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start launches the pruning in the background.
+func (p *OnlinePruner) Start() {
+	p.start = time.Now()
+	go p.run()
+}
+
+// Running reports whether the pruning is still in progress.
+func (p *OnlinePruner) Running() bool {
+	select {
+	case <-p.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Abort interrupts the pruning and waits until it stops.
+func (p *OnlinePruner) Abort() error {
+	select {
+	case <-p.done:
+		return errPruningNotRunning
+	case p.abort <- struct{}{}:
+	}
+	<-p.done
+	return nil
+}
+
+// Wait blocks until the pruning stops and returns the error it stopped with.
+func (p *OnlinePruner) Wait() error {
+	<-p.done
+
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.err
+}
+
+// Progress returns the current state of the pruning.
+func (p *OnlinePruner) Progress() OnlineProgress {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	elapsed := time.Since(p.start)
+	if !p.end.IsZero() {
+		elapsed = p.end.Sub(p.start)
+	}
+	return OnlineProgress{
+		Root:       p.root,
+		Stage:      p.stage,
+		Elapsed:    elapsed,
+		Marked:     atomic.LoadUint64(&p.markedNodes),
+		Scanned:    atomic.LoadUint64(&p.scannedNodes),
+		Pruned:     atomic.LoadUint64(&p.prunedNodes),
+		PrunedSize: common.StorageSize(atomic.LoadUint64(&p.prunedSize)),
+		Swept:      float64(atomic.LoadUint64(&p.swept)) / math.MaxUint64,
+		Err:        p.err,
+	}
+}
+
+// setStage switches the pruning to a new stage.
+func (p *OnlinePruner) setStage(stage string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.stage, p.err = stage, err
+	if stage != StageMarking && stage != StagePruning {
+		p.end = time.Now()
+	}
+}
+
+// run is the main loop of the pruning, marking the live state and sweeping the
+// database afterwards.
+func (p *OnlinePruner) run() {
+	defer close(p.done)
+
+	err := p.prune()
+	switch {
+	case err == nil:
+		p.setStage(StageDone, nil)
+		log.Info("Online state pruning finished", "nodes", atomic.LoadUint64(&p.prunedNodes),
+			"size", common.StorageSize(atomic.LoadUint64(&p.prunedSize)), "elapsed", common.PrettyDuration(time.Since(p.start)))
+	case errors.Is(err, errPruningAborted):
+		p.setStage(StageAborted, err)
+		log.Warn("Online state pruning aborted", "nodes", atomic.LoadUint64(&p.prunedNodes),
+			"size", common.StorageSize(atomic.LoadUint64(&p.prunedSize)), "elapsed", common.PrettyDuration(time.Since(p.start)))
+	default:
+		p.setStage(StageFailed, err)
+		log.Error("Online state pruning failed", "err", err)
+	}
+}
+
+func (p *OnlinePruner) prune() error {
+	log.Info("Started online state pruning", "root", p.root)
+
+	// Mark the recent states first, while they are still around, then the
+	// entire anchor state along with the genesis, both are persisted
+	if err := p.markRecent(); err != nil {
+		return err
+	}
+	if err := p.markState(); err != nil {
+		return err
+	}
+	if err := extractGenesis(p.db, p.bloom); err != nil {
+		return err
+	}
+	p.setStage(StagePruning, nil)
+	return p.sweep()
+}
+
+// markRecent marks the states tracked by the snapshot tree when the pruning
+// starts. None of the diff layers can be marked incrementally yet, the paths
+// touched by all of them have to be walked in each one.
+func (p *OnlinePruner) markRecent() error {
+	diffs := p.snaptree.DiffKeys()
+	for _, diff := range diffs {
+		p.touch(diff)
+	}
+	roots := []common.Hash{p.snaptree.DiskRoot()}
+	for root := range diffs {
+		roots = append(roots, root)
+	}
+	touched := p.touched()
+	for _, root := range roots {
+		if root != p.root {
+			switch err := p.markPaths(root, touched); {
+			case errors.Is(err, errStateGone):
+				continue // Dropped in the meantime, nothing to keep
+			case err != nil:
+				return err
+			}
+		}
+		p.marked[root] = struct{}{}
+	}
+	return nil
+}
+
+// touch accumulates the keys modified by a diff layer.
+func (p *OnlinePruner) touch(diff *snapshot.DiffKeys) {
+	for _, hash := range diff.Accounts {
+		p.accounts[hash] = struct{}{}
+	}
+	for hash, slots := range diff.Storage {
+		if p.storage[hash] == nil {
+			p.storage[hash] = make(map[common.Hash]struct{})
+		}
+		for _, slot := range slots {
+			p.storage[hash][slot] = struct{}{}
+		}
+	}
+}
+
+// touched returns all the keys modified by the diff layers seen so far.
+func (p *OnlinePruner) touched() *snapshot.DiffKeys {
+	keys := &snapshot.DiffKeys{
+		Storage: make(map[common.Hash][]common.Hash, len(p.storage)),
+	}
+	for hash := range p.accounts {
+		keys.Accounts = append(keys.Accounts, hash)
+	}
+	for hash, slots := range p.storage {
+		for slot := range slots {
+			keys.Storage[hash] = append(keys.Storage[hash], slot)
+		}
+	}
+	return keys
+}
+
+// markLayers marks the states of the diff layers created since the last call.
+// A trie node of a layer is either shared with its parent state, or it's on the
+// path of a key modified by the layer itself, so having the parent marked, it's
+// enough to walk those paths. Layers whose parent was never seen fall back to
+// walking all the paths touched since the pruning started.
+func (p *OnlinePruner) markLayers() error {
+	// The snapshot disk layer only ever advances to already marked layers,
+	// anything else means the snapshot was reset and the recent states can't
+	// be tracked any more.
+	if _, ok := p.marked[p.snaptree.DiskRoot()]; !ok {
+		return errors.New("state snapshot was reset")
+	}
+	diffs := p.snaptree.DiffKeys()
+	for root, diff := range diffs {
+		if _, ok := p.marked[root]; !ok {
+			p.touch(diff)
+		}
+	}
+	for {
+		var progressed bool
+		for root, diff := range diffs {
+			if _, ok := p.marked[root]; ok {
+				continue
+			}
+			keys := diff
+			if _, ok := p.marked[diff.Parent]; !ok {
+				if _, ok := diffs[diff.Parent]; ok {
+					continue // Parent gets marked first
+				}
+				keys = p.touched()
+			}
+			switch err := p.markPaths(root, keys); {
+			case errors.Is(err, errStateGone):
+				// Children of the dropped state fall back to the touched paths
+				delete(diffs, root)
+			case err != nil:
+				return err
+			default:
+				p.marked[root] = struct{}{}
+			}
+			progressed = true
+		}
+		if !progressed {
+			return nil
+		}
+	}
+}
+
+// markPaths marks all the trie nodes along the paths of the given accounts and
+// storage slots in the state with the given root, along with the codes of the
+// accounts.
+//
+// Missing trie nodes are only tolerated if the state is provably gone: either
+// dropped from the snapshot tree, or released from the trie database (e.g. the
+// recent states journalled by the snapshot tree over a restart), in which case
+// errStateGone is returned and the state must not be considered marked. Any
+// other failure aborts the pruning, as the nodes of a live state would get
+// deleted otherwise.
+func (p *OnlinePruner) markPaths(root common.Hash, keys *snapshot.DiffKeys) error {
+	check := func(err error) error {
+		var missing *trie.MissingNodeError
+		if !errors.As(err, &missing) {
+			return err
+		}
+		if p.snaptree.Snapshot(root) == nil {
+			return errStateGone
+		}
+		if _, err := p.triedb.Node(root); err != nil {
+			return errStateGone
+		}
+		return err
+	}
+	accTrie, err := trie.New(root, p.triedb)
+	if err != nil {
+		return check(err)
+	}
+	writer := &liveMarker{pruner: p}
+	mark := func(t *trie.Trie, key common.Hash) ([]byte, error) {
+		if err := t.Prove(key.Bytes(), 0, writer); err != nil {
+			return nil, check(err)
+		}
+		blob, err := t.TryGet(key.Bytes())
+		return blob, check(err)
+	}
+	accounts := make(map[common.Hash]struct{}, len(keys.Accounts)+len(keys.Storage))
+	for _, hash := range keys.Accounts {
+		accounts[hash] = struct{}{}
+	}
+	for hash := range keys.Storage {
+		accounts[hash] = struct{}{}
+	}
+	for hash := range accounts {
+		blob, err := mark(accTrie, hash)
+		if err != nil {
+			return err
+		}
+		if len(blob) == 0 {
+			continue
+		}
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(blob, &acc); err != nil {
+			return err
+		}
+		if !bytes.Equal(acc.CodeHash, emptyCode) {
+			writer.Put(acc.CodeHash, nil)
+		}
+		if acc.Root == emptyRoot || len(keys.Storage[hash]) == 0 {
+			continue
+		}
+		storageTrie, err := trie.NewWithOwner(root, hash, acc.Root, p.triedb)
+		if err != nil {
+			return check(err)
+		}
+		for _, slot := range keys.Storage[hash] {
+			if _, err := mark(storageTrie, slot); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// markState marks all the trie nodes and codes of the anchor state. The diff
+// layers are marked periodically while the traversal is running, so none of
+// them is missed, however long it takes.
+func (p *OnlinePruner) markState() error {
+	accTrie, err := trie.New(p.root, p.triedb)
+	if err != nil {
+		return err
+	}
+	var (
+		writer = &liveMarker{pruner: p}
+		logged = time.Now()
+		accIt  = accTrie.NodeIterator(nil)
+	)
+	for accIt.Next(true) {
+		select {
+		case <-p.abort:
+			return errPruningAborted
+		default:
+		}
+		if time.Since(logged) > 8*time.Second {
+			if err := p.markLayers(); err != nil {
+				return err
+			}
+			log.Info("Marking live state", "nodes", atomic.LoadUint64(&p.markedNodes),
+				"elapsed", common.PrettyDuration(time.Since(p.start)))
+			logged = time.Now()
+		}
+		// Embedded nodes don't have hash.
+		if hash := accIt.Hash(); hash != (common.Hash{}) {
+			writer.Put(hash.Bytes(), nil)
+		}
+		if !accIt.Leaf() {
+			continue
+		}
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(accIt.LeafBlob(), &acc); err != nil {
+			return err
+		}
+		if !bytes.Equal(acc.CodeHash, emptyCode) {
+			writer.Put(acc.CodeHash, nil)
+		}
+		if acc.Root == emptyRoot {
+			continue
+		}
+		storageTrie, err := trie.NewWithOwner(p.root, common.BytesToHash(accIt.LeafKey()), acc.Root, p.triedb)
+		if err != nil {
+			return err
+		}
+		storageIt := storageTrie.NodeIterator(nil)
+		for storageIt.Next(true) {
+			if hash := storageIt.Hash(); hash != (common.Hash{}) {
+				writer.Put(hash.Bytes(), nil)
+			}
+		}
+		if storageIt.Error() != nil {
+			return storageIt.Error()
+		}
+	}
+	if accIt.Error() != nil {
+		return accIt.Error()
+	}
+	return p.markLayers()
+}
+
+// sweep iterates the database and deletes all the hash-keyed state entries not
+// marked live. The deletions are done in batches, each one with the trie node
+// flushes blocked, after marking any diff layers created in the meantime.
+func (p *OnlinePruner) sweep() error {
+	var (
+		next   []byte
+		logged = time.Now()
+	)
+	for {
+		var (
+			stale []common.Hash
+			sizes = make(map[common.Hash]int)
+			iter  = p.db.NewIterator(nil, next)
+			done  = true
+		)
+		for iter.Next() {
+			key := iter.Key()
+			if len(key) != common.HashLength {
+				continue
+			}
+			atomic.AddUint64(&p.scannedNodes, 1)
+			if ok, _ := p.bloom.Contain(key); ok {
+				continue
+			}
+			hash := common.BytesToHash(key)
+			stale = append(stale, hash)
+			sizes[hash] = len(key) + len(iter.Value())
+
+			if len(stale) >= p.config.BatchSize {
+				next, done = append(common.CopyBytes(key), 0), false
+				break
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		// Nodes flushed since the iteration belong to diff layers not marked yet,
+		// mark them and recheck the candidates before deleting.
+		p.triedb.LockFlush()
+		err := p.markLayers()
+		if err == nil {
+			deletes := stale[:0]
+			for _, hash := range stale {
+				if ok, _ := p.bloom.Contain(hash.Bytes()); !ok {
+					deletes = append(deletes, hash)
+				}
+			}
+			if err = p.triedb.DeleteNodes(deletes); err == nil {
+				for _, hash := range deletes {
+					atomic.AddUint64(&p.prunedSize, uint64(sizes[hash]))
+				}
+				atomic.AddUint64(&p.prunedNodes, uint64(len(deletes)))
+			}
+		}
+		p.triedb.UnlockFlush()
+		if err != nil {
+			return err
+		}
+		if done {
+			atomic.StoreUint64(&p.swept, math.MaxUint64)
+			return nil
+		}
+		atomic.StoreUint64(&p.swept, binary.BigEndian.Uint64(next[:8]))
+
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Pruning state data", "nodes", atomic.LoadUint64(&p.prunedNodes),
+				"size", common.StorageSize(atomic.LoadUint64(&p.prunedSize)), "elapsed", common.PrettyDuration(time.Since(p.start)))
+			logged = time.Now()
+		}
+		select {
+		case <-p.abort:
+			return errPruningAborted
+		case <-time.After(p.config.Pause):
+		}
+	}
+}
+
+// liveMarker is a database writer marking the keys written into it live.
+type liveMarker struct {
+	pruner *OnlinePruner
+}
+
+// Put implements the KeyValueWriter interface, only the key is needed.
+func (m *liveMarker) Put(key []byte, value []byte) error {
+	if err := m.pruner.bloom.Put(key, value); err != nil {
+		return err
+	}
+	atomic.AddUint64(&m.pruner.markedNodes, 1)
+	return nil
+}
+
+// Delete implements the KeyValueWriter interface.
+func (m *liveMarker) Delete(key []byte) error { panic("not supported") }
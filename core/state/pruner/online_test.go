@@ -0,0 +1,284 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package pruner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// pruningTester is a test environment for the online pruning, with a state
+// database and a snapshot tree on top of it.
+type pruningTester struct {
+	t       *testing.T
+	diskdb  ethdb.Database
+	statedb state.Database
+	snaps   *snapshot.Tree
+	genesis common.Hash
+}
+
+// newPruningTester creates a tester with a persisted genesis state.
+func newPruningTester(t *testing.T) *pruningTester {
+	diskdb := rawdb.NewMemoryDatabase()
+	tester := &pruningTester{
+		t:       t,
+		diskdb:  diskdb,
+		statedb: state.NewDatabase(diskdb),
+	}
+	tester.genesis = tester.commit(common.Hash{}, 0)
+	if err := tester.statedb.TrieDB().Commit(tester.genesis, false, nil); err != nil {
+		t.Fatalf("failed to persist genesis state: %v", err)
+	}
+	block := types.NewBlockWithHeader(&types.Header{Number: new(big.Int), Root: tester.genesis})
+	rawdb.WriteBlock(diskdb, block)
+	rawdb.WriteCanonicalHash(diskdb, block.Hash(), 0)
+
+	snaps, err := snapshot.New(diskdb, tester.statedb.TrieDB(), 16, tester.genesis, false, true, false)
+	if err != nil {
+		t.Fatalf("failed to create snapshot tree: %v", err)
+	}
+	tester.snaps = snaps
+	return tester
+}
+
+// commit creates a new state on top of the given parent, with the balance and
+// the storage of a set of accounts depending on the seed. The state is added
+// to the snapshot tree if there's any, its trie nodes are kept in memory.
+func (tester *pruningTester) commit(parent common.Hash, seed int) common.Hash {
+	statedb, err := state.New(parent, tester.statedb, tester.snaps)
+	if err != nil {
+		tester.t.Fatalf("failed to open state %x: %v", parent, err)
+	}
+	for i := 0; i < 16; i++ {
+		addr := common.BytesToAddress([]byte{byte(i + 1)})
+		statedb.SetBalance(addr, big.NewInt(int64(seed*100+i+1)))
+		statedb.SetState(addr, common.Hash{byte(i)}, common.BigToHash(big.NewInt(int64(seed+1))))
+		statedb.SetState(addr, common.Hash{byte(seed % 4)}, common.BigToHash(big.NewInt(int64(seed*100+i+1))))
+		if i%4 == 0 {
+			statedb.SetCode(addr, []byte{byte(seed), byte(i)})
+		}
+	}
+	root, err := statedb.Commit(true)
+	if err != nil {
+		tester.t.Fatalf("failed to commit state: %v", err)
+	}
+	return root
+}
+
+// persist flushes the state with the given root into disk.
+func (tester *pruningTester) persist(root common.Hash) {
+	if err := tester.statedb.TrieDB().Commit(root, false, nil); err != nil {
+		tester.t.Fatalf("failed to persist state %x: %v", root, err)
+	}
+}
+
+// pruner creates an online pruner anchored to the given persisted state.
+func (tester *pruningTester) pruner(root common.Hash) *OnlinePruner {
+	p, err := NewOnlinePruner(tester.diskdb, tester.statedb.TrieDB(), tester.snaps, root, OnlineConfig{BloomSize: 16, BatchSize: 16})
+	if err != nil {
+		tester.t.Fatalf("failed to create pruner: %v", err)
+	}
+	return p
+}
+
+// checkState verifies that all the trie nodes and codes of the state with the
+// given root are available.
+func checkState(triedb *trie.Database, diskdb ethdb.Database, root common.Hash) error {
+	accTrie, err := trie.New(root, triedb)
+	if err != nil {
+		return err
+	}
+	accIt := accTrie.NodeIterator(nil)
+	for accIt.Next(true) {
+		if !accIt.Leaf() {
+			continue
+		}
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(accIt.LeafBlob(), &acc); err != nil {
+			return err
+		}
+		if !bytes.Equal(acc.CodeHash, emptyCode) && len(rawdb.ReadCode(diskdb, common.BytesToHash(acc.CodeHash))) == 0 {
+			return fmt.Errorf("missing code %x", acc.CodeHash)
+		}
+		if acc.Root == emptyRoot {
+			continue
+		}
+		storageTrie, err := trie.NewWithOwner(root, common.BytesToHash(accIt.LeafKey()), acc.Root, triedb)
+		if err != nil {
+			return err
+		}
+		storageIt := storageTrie.NodeIterator(nil)
+		for storageIt.Next(true) {
+		}
+		if err := storageIt.Error(); err != nil {
+			return err
+		}
+	}
+	return accIt.Error()
+}
+
+// Tests that the online pruning deletes the persisted states not tracked by the
+// snapshot tree, keeping the anchor state, the recent states and the genesis.
+func TestOnlinePruning(t *testing.T) {
+	tester := newPruningTester(t)
+
+	// Persist a state which becomes stale, along with the anchor state
+	stale := tester.commit(tester.genesis, 1)
+	tester.persist(stale)
+	anchor := tester.commit(stale, 2)
+	tester.persist(anchor)
+	if err := tester.snaps.Cap(anchor, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	// Create a few recent states, kept in memory only
+	recent := []common.Hash{tester.commit(anchor, 3)}
+	recent = append(recent, tester.commit(recent[0], 4))
+
+	p := tester.pruner(anchor)
+	p.Start()
+	if err := p.Wait(); err != nil {
+		t.Fatalf("pruning failed: %v", err)
+	}
+	if progress := p.Progress(); progress.Stage != StageDone || progress.Pruned == 0 {
+		t.Fatalf("pruning progress mismatch: stage %s, pruned %d", progress.Stage, progress.Pruned)
+	}
+	triedb := tester.statedb.TrieDB()
+	for _, root := range append([]common.Hash{tester.genesis, anchor}, recent...) {
+		if err := checkState(triedb, tester.diskdb, root); err != nil {
+			t.Fatalf("live state %x corrupted: %v", root, err)
+		}
+	}
+	// The stale state must be gone, check it on a fresh database, the clean
+	// cache may still hold some of its nodes
+	if err := checkState(trie.NewDatabase(tester.diskdb), tester.diskdb, stale); err == nil {
+		t.Fatalf("stale state not pruned")
+	}
+}
+
+// Tests that the diff layers created and flushed while the database is being
+// swept are marked before deleting anything, even if their parents are not
+// marked yet either.
+func TestOnlinePruningFlushDuringSweep(t *testing.T) {
+	tester := newPruningTester(t)
+
+	anchor := tester.commit(tester.genesis, 1)
+	tester.persist(anchor)
+	if err := tester.snaps.Cap(anchor, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	head := tester.commit(anchor, 2)
+
+	p := tester.pruner(anchor)
+	if err := p.markRecent(); err != nil {
+		t.Fatalf("failed to mark recent states: %v", err)
+	}
+	if err := p.markState(); err != nil {
+		t.Fatalf("failed to mark anchor state: %v", err)
+	}
+	if err := extractGenesis(p.db, p.bloom); err != nil {
+		t.Fatalf("failed to mark genesis: %v", err)
+	}
+	// Extend the chain with two new states and flush them into disk before the
+	// sweep, neither of them is marked
+	var roots []common.Hash
+	for i := 0; i < 2; i++ {
+		head = tester.commit(head, 3+i)
+		roots = append(roots, head)
+	}
+	tester.persist(head)
+
+	if err := p.sweep(); err != nil {
+		t.Fatalf("failed to sweep database: %v", err)
+	}
+	for _, root := range roots {
+		if _, ok := p.marked[root]; !ok {
+			t.Errorf("state %x not marked", root)
+		}
+	}
+	triedb := tester.statedb.TrieDB()
+	for _, root := range append([]common.Hash{anchor}, roots...) {
+		if err := checkState(triedb, tester.diskdb, root); err != nil {
+			t.Fatalf("live state %x corrupted: %v", root, err)
+		}
+	}
+}
+
+// Tests that missing trie nodes of a state still available abort the pruning,
+// while the states already dropped from the snapshot tree or released from the
+// trie database are skipped without being considered marked.
+func TestOnlinePruningMissingNodes(t *testing.T) {
+	tester := newPruningTester(t)
+
+	anchor := tester.commit(tester.genesis, 1)
+	tester.persist(anchor)
+	if err := tester.snaps.Cap(anchor, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	p := tester.pruner(anchor)
+	if err := p.markRecent(); err != nil {
+		t.Fatalf("failed to mark recent states: %v", err)
+	}
+	// Release the trie nodes of a state still tracked by the snapshot tree
+	released := tester.commit(anchor, 2)
+	tester.statedb.TrieDB().Dereference(released)
+
+	if err := p.markLayers(); err != nil {
+		t.Fatalf("failed to mark layers: %v", err)
+	}
+	if _, ok := p.marked[released]; ok {
+		t.Fatalf("released state marked")
+	}
+	// Delete an inner trie node of a persisted state
+	corrupt := tester.commit(anchor, 3)
+	tester.persist(corrupt)
+
+	accTrie, err := trie.New(corrupt, tester.statedb.TrieDB())
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	for it := accTrie.NodeIterator(nil); it.Next(true); {
+		if len(it.Path()) > 0 && it.Hash() != (common.Hash{}) {
+			rawdb.DeleteTrieNode(tester.diskdb, it.Hash())
+			break
+		}
+	}
+	err = p.markLayers()
+	var missing *trie.MissingNodeError
+	if !errors.As(err, &missing) {
+		t.Fatalf("corrupted state marking error mismatch: have %v, want missing trie node", err)
+	}
+	if _, ok := p.marked[corrupt]; ok {
+		t.Fatalf("corrupted state marked")
+	}
+	// A state which is not in the snapshot tree anymore is skipped
+	gone := common.HexToHash("0xdeadbeef")
+	if err := p.markPaths(gone, p.touched()); !errors.Is(err, errStateGone) {
+		t.Fatalf("dropped state marking error mismatch: have %v, want %v", err, errStateGone)
+	}
+}
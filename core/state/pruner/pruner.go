@@ -89,6 +89,11 @@ func NewPruner(db ethdb.Database, datadir, trieCachePath string, bloomSize uint6
 	if headBlock == nil {
 		return nil, errors.New("Failed to load head block")
 	}
+	// Stale trie nodes are overwritten in place in the path scheme, there's
+	// nothing to prune offline.
+	if rawdb.ReadStateScheme(db) == rawdb.PathScheme {
+		return nil, errors.New("offline pruning is not supported by the path-based state scheme")
+	}
 	snaptree, err := snapshot.New(db, trie.NewDatabase(db), 256, headBlock.Root(), false, false, false)
 	if err != nil {
 		return nil, err // The relevant snapshot(s) might not exist
@@ -497,6 +502,9 @@ Check the command description "geth snapshot prune-state --help" for more detail
 `
 
 func deleteCleanTrieCache(path string) {
+	// Drop the journal left behind by an interrupted save too
+	os.RemoveAll(path + ".tmp")
+
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		log.Warn(warningLog)
 		return
@@ -0,0 +1,246 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// replayDatabase is a state database serving a state whose trie nodes are not
+// available, with its tries rebuilt in memory by replaying the snapshot diff
+// layers on top of the tries of an ancestor state.
+type replayDatabase struct {
+	Database // Underlying database holding the tries of the ancestor state
+
+	root    common.Hash                 // Root of the replayed state
+	base    common.Hash                 // Root of the ancestor state the tries are rebuilt from
+	account *trie.Trie                  // Replayed account trie
+	storage map[common.Hash]*trie.Trie  // Replayed storage tries of the modified accounts
+	roots   map[common.Hash]common.Hash // Roots of the replayed storage tries
+}
+
+// NewReplayDatabase creates a state database serving the state with the given
+// root, which has to be covered by the snapshot diff layers. The tries of the
+// state are rebuilt in memory from the closest ancestor state whose tries are
+// still available, so they can be proven even if their nodes were never flushed
+// or were already garbage collected.
+func NewReplayDatabase(db Database, snaps *snapshot.Tree, root common.Hash) (Database, error) {
+	diffs, err := snaps.StateDiffs(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(diffs) == 0 {
+		return nil, fmt.Errorf("state %x is not covered by diff layers", root)
+	}
+	// Find the most recent ancestor with its tries available, starting from
+	// the disk layer if none of the diff layers have one
+	start := 0
+	for i := len(diffs) - 1; i > 0; i-- {
+		if _, err := db.OpenTrie(diffs[i].Parent); err == nil {
+			start = i
+			break
+		}
+	}
+	base := diffs[start].Parent
+	account, err := trie.New(base, db.TrieDB())
+	if err != nil {
+		return nil, err
+	}
+	rdb := &replayDatabase{
+		Database: db,
+		root:     root,
+		base:     base,
+		account:  account,
+		storage:  make(map[common.Hash]*trie.Trie),
+		roots:    make(map[common.Hash]common.Hash),
+	}
+	for _, diff := range diffs[start:] {
+		if err := rdb.apply(diff); err != nil {
+			return nil, err
+		}
+	}
+	if hash := rdb.account.Hash(); hash != root {
+		return nil, fmt.Errorf("replayed state root mismatch: have %x, want %x", hash, root)
+	}
+	log.Debug("Replayed state from snapshot diffs", "root", root, "base", base, "diffs", len(diffs)-start)
+	return rdb, nil
+}
+
+// apply replays the changes of a single diff layer onto the tries.
+func (db *replayDatabase) apply(diff *snapshot.StateDiff) error {
+	// Wipe the storage of the destructed accounts, they may only be recreated
+	// with fresh storage
+	for hash := range diff.Destructs {
+		st, err := trie.NewWithOwner(db.base, hash, common.Hash{}, db.TrieDB())
+		if err != nil {
+			return err
+		}
+		db.storage[hash] = st
+		if _, ok := diff.Accounts[hash]; !ok {
+			if err := db.account.TryDelete(hash[:]); err != nil {
+				return err
+			}
+		}
+	}
+	for hash, slots := range diff.Storage {
+		st := db.storage[hash]
+		if st == nil {
+			root := emptyRoot
+			blob, err := db.account.TryGet(hash[:])
+			if err != nil {
+				return err
+			}
+			if len(blob) > 0 {
+				var acc types.StateAccount
+				if err := rlp.DecodeBytes(blob, &acc); err != nil {
+					return err
+				}
+				root = acc.Root
+			}
+			if st, err = trie.NewWithOwner(db.base, hash, root, db.TrieDB()); err != nil {
+				return err
+			}
+			db.storage[hash] = st
+		}
+		for slot, blob := range slots {
+			var err error
+			if len(blob) == 0 {
+				err = st.TryDelete(slot[:])
+			} else {
+				err = st.TryUpdate(slot[:], blob)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for hash, blob := range diff.Accounts {
+		if len(blob) == 0 {
+			delete(db.storage, hash)
+			if err := db.account.TryDelete(hash[:]); err != nil {
+				return err
+			}
+			continue
+		}
+		acc, err := snapshot.FullAccount(blob)
+		if err != nil {
+			return err
+		}
+		root := common.BytesToHash(acc.Root)
+		if st := db.storage[hash]; st != nil {
+			if have := st.Hash(); have != root {
+				return fmt.Errorf("replayed storage root mismatch: have %x, want %x", have, root)
+			}
+			db.roots[hash] = root
+		}
+		full, err := snapshot.FullAccountRLP(blob)
+		if err != nil {
+			return err
+		}
+		if err := db.account.TryUpdate(hash[:], full); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenTrie opens the replayed account trie.
+func (db *replayDatabase) OpenTrie(root common.Hash) (Trie, error) {
+	if root != db.root {
+		return db.Database.OpenTrie(root)
+	}
+	return &replayTrie{db.account.Copy()}, nil
+}
+
+// OpenStorageTrie opens the replayed storage trie of an account if it was
+// modified by the diffs, or the original one from the underlying database.
+func (db *replayDatabase) OpenStorageTrie(stateRoot, addrHash, root common.Hash) (Trie, error) {
+	if st := db.storage[addrHash]; st != nil && db.roots[addrHash] == root {
+		return &replayTrie{st.Copy()}, nil
+	}
+	return db.Database.OpenStorageTrie(stateRoot, addrHash, root)
+}
+
+// CopyTrie returns an independent copy of the given trie.
+func (db *replayDatabase) CopyTrie(t Trie) Trie {
+	switch t := t.(type) {
+	case *replayTrie:
+		return &replayTrie{t.trie.Copy()}
+	default:
+		return db.Database.CopyTrie(t)
+	}
+}
+
+// replayTrie wraps a replayed trie, hashing the keys like the secure trie does.
+// The preimages of the keys are not tracked and the keys to prove are expected
+// to be hashed already.
+type replayTrie struct {
+	trie *trie.Trie
+}
+
+func (t *replayTrie) GetKey([]byte) []byte {
+	return nil
+}
+
+func (t *replayTrie) TryGet(key []byte) ([]byte, error) {
+	return t.trie.TryGet(crypto.Keccak256(key))
+}
+
+func (t *replayTrie) TryUpdateAccount(key []byte, account *types.StateAccount) error {
+	data, err := rlp.EncodeToBytes(account)
+	if err != nil {
+		return err
+	}
+	return t.trie.TryUpdate(crypto.Keccak256(key), data)
+}
+
+func (t *replayTrie) TryUpdate(key, value []byte) error {
+	return t.trie.TryUpdate(crypto.Keccak256(key), value)
+}
+
+func (t *replayTrie) TryDelete(key []byte) error {
+	return t.trie.TryDelete(crypto.Keccak256(key))
+}
+
+func (t *replayTrie) Hash() common.Hash {
+	return t.trie.Hash()
+}
+
+func (t *replayTrie) Commit(onleaf trie.LeafCallback) (common.Hash, int, error) {
+	return t.trie.Commit(onleaf)
+}
+
+func (t *replayTrie) NodeIterator(startKey []byte) trie.NodeIterator {
+	return t.trie.NodeIterator(startKey)
+}
+
+func (t *replayTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error {
+	return t.trie.Prove(key, fromLevel, proofDb)
+}
+
+func (t *replayTrie) Witness() map[string]struct{} {
+	return t.trie.Witness()
+}
@@ -0,0 +1,161 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// Tests that states whose trie nodes were never flushed can be proven from the
+// snapshot diff layers, both from the disk layer and from an intermediate state
+// which was flushed.
+func TestReplayDatabase(t *testing.T) {
+	var (
+		diskdb = rawdb.NewMemoryDatabase()
+		sdb    = NewDatabase(diskdb)
+		addrs  = make([]common.Address, 8)
+	)
+	for i := range addrs {
+		addrs[i] = common.BigToAddress(big.NewInt(int64(0x100 + i)))
+	}
+	// Create the base state and flush it to disk
+	state, _ := New(common.Hash{}, sdb, nil)
+	for i, addr := range addrs {
+		state.SetBalance(addr, big.NewInt(int64(i+1)))
+		state.SetState(addr, common.Hash{0x01}, common.Hash{byte(i + 1)})
+	}
+	base, _ := state.Commit(false)
+	if err := sdb.TrieDB().Commit(base, false, nil); err != nil {
+		t.Fatalf("failed to flush base state: %v", err)
+	}
+	snaps, err := snapshot.New(diskdb, sdb.TrieDB(), 16, base, false, true, false)
+	if err != nil {
+		t.Fatalf("failed to create snapshot tree: %v", err)
+	}
+	// Create a few states on top, keeping their trie nodes in memory only
+	roots := []common.Hash{base}
+	for i := 0; i < 6; i++ {
+		state, _ := New(roots[len(roots)-1], sdb, snaps)
+		addr := addrs[i]
+		switch i {
+		case 2:
+			state.Suicide(addr)
+		case 4:
+			state.Suicide(addrs[2])
+			state.Finalise(true)
+			state.SetBalance(addrs[2], big.NewInt(100))
+			state.SetState(addrs[2], common.Hash{0x02}, common.Hash{0xff})
+		default:
+			state.AddBalance(addr, big.NewInt(1000))
+			state.SetState(addr, common.Hash{0x01}, common.Hash{})
+			state.SetState(addr, common.Hash{byte(i + 2)}, common.Hash{byte(i + 2)})
+		}
+		root, err := state.Commit(true)
+		if err != nil {
+			t.Fatalf("block %d: failed to commit state: %v", i, err)
+		}
+		roots = append(roots, root)
+	}
+	// Flush one of the intermediate states as well
+	if err := sdb.TrieDB().Commit(roots[3], false, nil); err != nil {
+		t.Fatalf("failed to flush intermediate state: %v", err)
+	}
+	for i, root := range roots[1:] {
+		// Reference state served from the trie nodes in memory
+		want, _ := New(root, sdb, nil)
+
+		// Replayed state only having access to the flushed nodes
+		if _, err := New(root, NewDatabase(diskdb), nil); err == nil && i != 2 {
+			t.Fatalf("state %d: trie nodes unexpectedly flushed", i)
+		}
+		db, err := NewReplayDatabase(NewDatabase(diskdb), snaps, root)
+		if err != nil {
+			t.Fatalf("state %d: failed to replay: %v", i, err)
+		}
+		have, err := New(root, db, snaps)
+		if err != nil {
+			t.Fatalf("state %d: failed to open replayed state: %v", i, err)
+		}
+		for _, addr := range addrs {
+			proof, err := have.GetProof(addr)
+			if err != nil {
+				t.Fatalf("state %d: failed to prove %x: %v", i, addr, err)
+			}
+			blob, err := trie.VerifyProof(root, crypto.Keccak256(addr.Bytes()), proofDB(proof))
+			if err != nil {
+				t.Fatalf("state %d: invalid proof of %x: %v", i, addr, err)
+			}
+			if !want.Exist(addr) {
+				if blob != nil {
+					t.Fatalf("state %d: unexpected proof of existence of %x", i, addr)
+				}
+				continue
+			}
+			var acc types.StateAccount
+			if err := rlp.DecodeBytes(blob, &acc); err != nil {
+				t.Fatalf("state %d: invalid account %x: %v", i, addr, err)
+			}
+			if acc.Balance.Cmp(want.GetBalance(addr)) != 0 {
+				t.Fatalf("state %d: balance mismatch of %x: have %v, want %v", i, addr, acc.Balance, want.GetBalance(addr))
+			}
+			for j := 0; j < 8; j++ {
+				slot := common.Hash{byte(j)}
+				proof, err := have.GetStorageProof(addr, slot)
+				if err != nil {
+					t.Fatalf("state %d: failed to prove slot %x of %x: %v", i, slot, addr, err)
+				}
+				blob, err := trie.VerifyProof(acc.Root, crypto.Keccak256(slot.Bytes()), proofDB(proof))
+				if err != nil {
+					t.Fatalf("state %d: invalid proof of slot %x of %x: %v", i, slot, addr, err)
+				}
+				var value []byte
+				if len(blob) > 0 {
+					if _, value, _, err = rlp.Split(blob); err != nil {
+						t.Fatalf("state %d: invalid slot %x of %x: %v", i, slot, addr, err)
+					}
+				}
+				if !bytes.Equal(common.BytesToHash(value).Bytes(), want.GetState(addr, slot).Bytes()) {
+					t.Fatalf("state %d: slot %x of %x mismatch: have %x, want %x", i, slot, addr, value, want.GetState(addr, slot))
+				}
+			}
+		}
+	}
+	// States not covered by the diff layers can't be replayed
+	if _, err := NewReplayDatabase(NewDatabase(diskdb), snaps, base); err == nil {
+		t.Fatalf("replayed the disk layer")
+	}
+}
+
+// proofDB collects the nodes of a proof into a database to verify it against.
+func proofDB(proof [][]byte) *memorydb.Database {
+	db := memorydb.New()
+	for _, node := range proof {
+		db.Put(crypto.Keccak256(node), node)
+	}
+	return db
+}
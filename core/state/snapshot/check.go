@@ -0,0 +1,205 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const (
+	// checkSampleAccounts is the number of consecutive accounts compared at each
+	// randomly placed sample when checking the snapshot.
+	checkSampleAccounts = 16
+
+	// checkSampleSlots is the maximum number of storage slots compared for each
+	// account visited when sampling the snapshot.
+	checkSampleSlots = 1024
+)
+
+// checker compares the persistent snapshot with the state trie.
+type checker struct {
+	db     ethdb.KeyValueStore
+	triedb *trie.Database
+	root   common.Hash // State root the snapshot belongs to
+	marker []byte      // Generation progress, nil if the snapshot is complete
+	slots  int         // Maximum number of slots to compare per account, 0 for all
+	result *rawdb.CheckResult
+	logged time.Time
+}
+
+// Check compares the persistent snapshot layer with the state trie it belongs
+// to, reporting the entries missing from either side or differing between them,
+// as well as the trie nodes missing from the database. The accounts are checked
+// at the given number of randomly placed samples, or all of them if samples is
+// zero, along with the storage slots of the accounts visited. Only the part of
+// the snapshot already generated is checked.
+func Check(db ethdb.KeyValueStore, samples int) *rawdb.CheckResult {
+	res := rawdb.NewCheckResult("snapshot")
+
+	root := rawdb.ReadSnapshotRoot(db)
+	if root == (common.Hash{}) {
+		res.Skipped = "no snapshot"
+		return res
+	}
+	c := &checker{db: db, triedb: trie.NewDatabase(db), root: root, result: res, logged: time.Now()}
+	if blob := rawdb.ReadSnapshotGenerator(db); len(blob) > 0 {
+		var generator journalGenerator
+		if err := rlp.DecodeBytes(blob, &generator); err != nil {
+			res.Add(&rawdb.CheckIssue{Kind: "corrupt-generator", Detail: err.Error()})
+			return res
+		}
+		if !generator.Done {
+			if len(generator.Marker) == 0 {
+				res.Skipped = "snapshot generation not started"
+				return res
+			}
+			c.marker = generator.Marker
+		}
+	}
+	accTrie, err := trie.New(root, c.triedb)
+	if err != nil {
+		res.Add(&rawdb.CheckIssue{Kind: "missing-trie-node", Detail: fmt.Sprintf("state root %x: %v", root, err)})
+		return res
+	}
+	if samples == 0 {
+		c.checkRange("account", accTrie, rawdb.SnapshotAccountPrefix, nil, 0, c.checkAccount)
+		return res
+	}
+	c.slots = checkSampleSlots
+	for i := 0; i < samples; i++ {
+		start := make([]byte, common.HashLength)
+		rand.Read(start)
+		c.checkRange("account", accTrie, rawdb.SnapshotAccountPrefix, start, checkSampleAccounts, c.checkAccount)
+	}
+	return res
+}
+
+// checkAccount compares the storage of an account present both in the trie and
+// in the snapshot.
+func (c *checker) checkAccount(hash common.Hash, slim []byte) {
+	account, err := FullAccount(slim)
+	if err != nil || common.BytesToHash(account.Root) == emptyRoot {
+		return
+	}
+	storageTrie, err := trie.NewWithOwner(c.root, hash, common.BytesToHash(account.Root), c.triedb)
+	if err != nil {
+		c.result.Add(&rawdb.CheckIssue{Kind: "missing-trie-node", Detail: fmt.Sprintf("storage root %x of account %x: %v", account.Root, hash, err)})
+		return
+	}
+	c.checkRange("slot", storageTrie, append(common.CopyBytes(rawdb.SnapshotStoragePrefix), hash.Bytes()...), nil, c.slots, nil)
+}
+
+// checkRange compares at most limit entries of the trie with the flat entries
+// stored under the given prefix, starting at the given key, or all of them if
+// limit is zero. The visit callback is invoked for every entry found on both
+// sides.
+func (c *checker) checkRange(kind string, tr *trie.Trie, prefix []byte, start []byte, limit int, visit func(common.Hash, []byte)) {
+	var (
+		tit = trie.NewIterator(tr.NodeIterator(start))
+		sit = c.db.NewIterator(prefix, start)
+	)
+	defer sit.Release()
+
+	// nextFlat advances the snapshot iterator to the next entry of the range,
+	// skipping any unrelated keys sharing the prefix
+	nextFlat := func() bool {
+		for sit.Next() {
+			if len(sit.Key()) == len(prefix)+common.HashLength {
+				return true
+			}
+		}
+		return false
+	}
+	var (
+		tok = tit.Next()
+		sok = nextFlat()
+	)
+	// Accounts beyond the generation marker are not in the snapshot yet, and
+	// the storage of the one at the marker may be incomplete
+	ended := func(key []byte) bool {
+		if kind != "account" || c.marker == nil {
+			return false
+		}
+		cmp := bytes.Compare(key, c.marker[:common.HashLength])
+		return cmp > 0 || (cmp == 0 && len(c.marker) > common.HashLength)
+	}
+	for n := 0; limit == 0 || n < limit; n++ {
+		if tok && ended(tit.Key) {
+			tok = false
+		}
+		if sok && ended(sit.Key()[len(prefix):]) {
+			sok = false
+		}
+		if !tok && !sok {
+			break
+		}
+		if kind == "account" && time.Since(c.logged) > 8*time.Second {
+			log.Info("Checking snapshot", "at", common.BytesToHash(tit.Key), "checked", c.result.Checked, "issues", len(c.result.Issues))
+			c.logged = time.Now()
+		}
+		var flat []byte
+		if sok {
+			flat = sit.Key()[len(prefix):]
+		}
+		switch {
+		case tok && sok && bytes.Equal(tit.Key, flat):
+			c.result.Checked++
+			value := sit.Value()
+			if kind == "account" {
+				full, err := FullAccountRLP(value)
+				if err != nil {
+					c.result.Add(&rawdb.CheckIssue{Kind: "corrupt-snapshot-account", Detail: fmt.Sprintf("%x: %v", flat, err)})
+					tok, sok = tit.Next(), nextFlat()
+					continue
+				}
+				value = full
+			}
+			if !bytes.Equal(tit.Value, value) {
+				c.result.Add(&rawdb.CheckIssue{Kind: kind + "-mismatch", Detail: fmt.Sprintf("%x%x: snapshot %x, trie %x", prefix[1:], flat, value, tit.Value)})
+			} else if visit != nil {
+				visit(common.BytesToHash(flat), sit.Value())
+			}
+			tok, sok = tit.Next(), nextFlat()
+
+		case tok && (!sok || bytes.Compare(tit.Key, flat) < 0):
+			c.result.Checked++
+			c.result.Add(&rawdb.CheckIssue{Kind: "missing-snapshot-" + kind, Detail: fmt.Sprintf("%x%x only in the trie", prefix[1:], tit.Key)})
+			tok = tit.Next()
+
+		default:
+			c.result.Checked++
+			c.result.Add(&rawdb.CheckIssue{Kind: "dangling-snapshot-" + kind, Detail: fmt.Sprintf("%x%x only in the snapshot", prefix[1:], flat)})
+			sok = nextFlat()
+		}
+	}
+	if tit.Err != nil {
+		c.result.Add(&rawdb.CheckIssue{Kind: "missing-trie-node", Detail: tit.Err.Error()})
+	}
+	if err := sit.Error(); err != nil {
+		c.result.Add(&rawdb.CheckIssue{Kind: "snapshot-read-error", Detail: err.Error()})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// Tests that the snapshot check reports the accounts and slots differing between
+// the snapshot and the state trie.
+func TestCheck(t *testing.T) {
+	helper := newHelper()
+	stRoot := helper.makeStorageTrie([]string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"})
+
+	helper.addAccount("acc-1", &Account{Balance: big.NewInt(1), Root: stRoot, CodeHash: emptyCode.Bytes()})
+	helper.addAccount("acc-2", &Account{Balance: big.NewInt(2), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()})
+	helper.addAccount("acc-3", &Account{Balance: big.NewInt(3), Root: stRoot, CodeHash: emptyCode.Bytes()})
+	helper.addSnapStorage("acc-1", []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"})
+	helper.addSnapStorage("acc-3", []string{"key-1", "key-2", "key-3"}, []string{"val-1", "val-2", "val-3"})
+
+	root, _, _ := helper.accTrie.Commit(nil)
+	helper.triedb.Commit(root, false, nil)
+	helper.triedb.Commit(common.BytesToHash(stRoot), false, nil)
+
+	if res := Check(helper.diskdb, 0); res.Skipped == "" {
+		t.Fatalf("missing snapshot checked")
+	}
+	rawdb.WriteSnapshotRoot(helper.diskdb, root)
+
+	res := Check(helper.diskdb, 0)
+	if !res.Consistent() {
+		t.Fatalf("consistent snapshot reported broken: %+v", res.Issues)
+	}
+	if res.Checked != 9 {
+		t.Fatalf("checked items mismatch: have %d, want 9", res.Checked)
+	}
+	if res := Check(helper.diskdb, 8); !res.Consistent() {
+		t.Fatalf("consistent snapshot sample reported broken: %+v", res.Issues)
+	}
+	// Break the snapshot in a few ways and ensure all are reported
+	helper.addSnapAccount("acc-2", &Account{Balance: big.NewInt(5), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()})
+	helper.addSnapAccount("acc-4", &Account{Balance: big.NewInt(4), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()})
+	rawdb.DeleteStorageSnapshot(helper.diskdb, hashData([]byte("acc-3")), hashData([]byte("key-2")))
+
+	kinds := make(map[string]int)
+	for _, issue := range Check(helper.diskdb, 0).Issues {
+		kinds[issue.Kind]++
+	}
+	want := map[string]int{"account-mismatch": 1, "dangling-snapshot-account": 1, "missing-snapshot-slot": 1}
+	if len(kinds) != len(want) {
+		t.Fatalf("issues mismatch: have %v, want %v", kinds, want)
+	}
+	for kind, n := range want {
+		if kinds[kind] != n {
+			t.Fatalf("issues mismatch: have %v, want %v", kinds, want)
+		}
+	}
+	// Accounts beyond the generation marker must be ignored, acc-2 being the
+	// only broken one hashing above acc-3
+	journalProgress(helper.diskdb, hashData([]byte("acc-3")).Bytes(), nil)
+
+	kinds = make(map[string]int)
+	for _, issue := range Check(helper.diskdb, 0).Issues {
+		kinds[issue.Kind]++
+	}
+	if len(kinds) != 2 || kinds["dangling-snapshot-account"] != 1 || kinds["missing-snapshot-slot"] != 1 {
+		t.Fatalf("issues mismatch with generation marker: %v", kinds)
+	}
+}
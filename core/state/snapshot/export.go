@@ -0,0 +1,390 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/golang/snappy"
+)
+
+const (
+	// exportVersion is the version of the snapshot export format.
+	exportVersion = 1
+
+	// exportManifest is the name of the file describing an export, written last
+	// so that an interrupted export is never mistaken for a complete one.
+	exportManifest = "manifest.json"
+
+	// ExportChunkSize is the default uncompressed size of an export chunk.
+	ExportChunkSize = 64 * 1024 * 1024
+)
+
+// Kinds of the entries in an export chunk.
+const (
+	exportAccount = iota // Account in slim format, followed by its storage slots
+	exportStorage        // Storage slot of the last preceding account
+	exportCode           // Contract code, included once before its first user
+)
+
+// exportEntry is a single item of the exported state. The entries are ordered
+// by account hash, with the storage slots of an account ordered by slot hash.
+type exportEntry struct {
+	Kind uint8
+	Hash common.Hash
+	Blob []byte
+}
+
+// exportChunk describes a single compressed file of an export.
+type exportChunk struct {
+	Name     string      `json:"name"`
+	Checksum common.Hash `json:"checksum"` // Keccak256 hash of the compressed file
+	Accounts uint64      `json:"accounts"`
+	Slots    uint64      `json:"slots"`
+	Codes    uint64      `json:"codes"`
+}
+
+// exportMeta is the manifest of an export, listing the chunks in order.
+type exportMeta struct {
+	Version uint64        `json:"version"`
+	Root    common.Hash   `json:"root"`
+	Chunks  []exportChunk `json:"chunks"`
+}
+
+// exportWriter splits the exported entries into compressed chunk files.
+type exportWriter struct {
+	dir   string
+	size  int
+	buf   bytes.Buffer
+	chunk exportChunk
+	meta  exportMeta
+}
+
+// write appends an entry to the current chunk, flushing it if it grows large.
+func (w *exportWriter) write(kind uint8, hash common.Hash, blob []byte) error {
+	if err := rlp.Encode(&w.buf, &exportEntry{Kind: kind, Hash: hash, Blob: blob}); err != nil {
+		return err
+	}
+	switch kind {
+	case exportAccount:
+		w.chunk.Accounts++
+	case exportStorage:
+		w.chunk.Slots++
+	case exportCode:
+		w.chunk.Codes++
+	}
+	if w.buf.Len() >= w.size {
+		return w.flush()
+	}
+	return nil
+}
+
+// flush compresses the current chunk and writes it to disk.
+func (w *exportWriter) flush() error {
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	data := snappy.Encode(nil, w.buf.Bytes())
+
+	w.chunk.Name = fmt.Sprintf("chunk-%06d.snappy", len(w.meta.Chunks))
+	w.chunk.Checksum = crypto.Keccak256Hash(data)
+	if err := os.WriteFile(filepath.Join(w.dir, w.chunk.Name), data, 0644); err != nil {
+		return err
+	}
+	w.meta.Chunks = append(w.meta.Chunks, w.chunk)
+	w.chunk = exportChunk{}
+	w.buf.Reset()
+	return nil
+}
+
+// Export writes the accounts, storage slots and contract codes of the state
+// with the given root into the directory, as a set of compressed chunks of
+// roughly the given uncompressed size and a manifest holding their checksums.
+// The contract codes are read from the given database.
+func Export(t *Tree, codedb ethdb.KeyValueReader, root common.Hash, dir string, chunkSize int) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(dir, exportManifest)); err == nil {
+		return fmt.Errorf("export already exists in %s", dir)
+	}
+	accIt, err := t.AccountIterator(root, common.Hash{})
+	if err != nil {
+		return err
+	}
+	defer accIt.Release()
+
+	var (
+		w = &exportWriter{
+			dir:  dir,
+			size: chunkSize,
+			meta: exportMeta{Version: exportVersion, Root: root},
+		}
+		codes = make(map[common.Hash]struct{})
+
+		accounts, slots uint64
+		start           = time.Now()
+		logged          = time.Now()
+	)
+	for accIt.Next() {
+		account, err := FullAccount(accIt.Account())
+		if err != nil {
+			return err
+		}
+		// Export the code ahead of its first user, so that the importer can
+		// rely on having it once the account is in place
+		if codeHash := common.BytesToHash(account.CodeHash); codeHash != emptyCode {
+			if _, ok := codes[codeHash]; !ok {
+				code := rawdb.ReadCode(codedb, codeHash)
+				if len(code) == 0 {
+					return fmt.Errorf("missing code %x", codeHash)
+				}
+				if err := w.write(exportCode, codeHash, code); err != nil {
+					return err
+				}
+				codes[codeHash] = struct{}{}
+			}
+		}
+		if err := w.write(exportAccount, accIt.Hash(), accIt.Account()); err != nil {
+			return err
+		}
+		accounts++
+
+		if common.BytesToHash(account.Root) != emptyRoot {
+			stIt, err := t.StorageIterator(root, accIt.Hash(), common.Hash{})
+			if err != nil {
+				return err
+			}
+			for stIt.Next() {
+				if err := w.write(exportStorage, stIt.Hash(), stIt.Slot()); err != nil {
+					stIt.Release()
+					return err
+				}
+				slots++
+			}
+			stIt.Release()
+			if err := stIt.Error(); err != nil {
+				return err
+			}
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Snapshot export in progress", "at", accIt.Hash(), "accounts", accounts, "slots", slots,
+				"codes", len(codes), "chunks", len(w.meta.Chunks), "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	if err := accIt.Error(); err != nil {
+		return err
+	}
+	if err := w.flush(); err != nil {
+		return err
+	}
+	blob, err := json.MarshalIndent(&w.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, exportManifest), blob, 0644); err != nil {
+		return err
+	}
+	log.Info("Snapshot export complete", "root", root, "accounts", accounts, "slots", slots,
+		"codes", len(codes), "chunks", len(w.meta.Chunks), "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// importer rebuilds the snapshot and the tries from the exported entries.
+type importer struct {
+	batch ethdb.Batch
+	trie  *trie.StackTrie // Account trie being regenerated
+
+	account  common.Hash     // Hash of the account being imported
+	blob     []byte          // Slim account being imported, nil before the first one
+	storage  *trie.StackTrie // Storage trie of the account being imported
+	lastSlot *common.Hash    // Hash of the last imported slot of the account
+
+	accounts, slots, codes uint64
+}
+
+// importEntry processes a single exported entry.
+func (imp *importer) importEntry(entry *exportEntry) error {
+	switch entry.Kind {
+	case exportCode:
+		if crypto.Keccak256Hash(entry.Blob) != entry.Hash {
+			return fmt.Errorf("code hash mismatch %x", entry.Hash)
+		}
+		rawdb.WriteCode(imp.batch, entry.Hash, entry.Blob)
+		imp.codes++
+
+	case exportAccount:
+		if imp.blob != nil && bytes.Compare(entry.Hash[:], imp.account[:]) <= 0 {
+			return fmt.Errorf("account %x out of order", entry.Hash)
+		}
+		if err := imp.finishAccount(); err != nil {
+			return err
+		}
+		if _, err := FullAccount(entry.Blob); err != nil {
+			return fmt.Errorf("invalid account %x: %v", entry.Hash, err)
+		}
+		rawdb.WriteAccountSnapshot(imp.batch, entry.Hash, entry.Blob)
+		imp.account, imp.blob, imp.lastSlot = entry.Hash, entry.Blob, nil
+		imp.storage = trie.NewStackTrie(imp.batch)
+		imp.accounts++
+
+	case exportStorage:
+		if imp.blob == nil {
+			return fmt.Errorf("storage slot %x without account", entry.Hash)
+		}
+		if imp.lastSlot != nil && bytes.Compare(entry.Hash[:], imp.lastSlot[:]) <= 0 {
+			return fmt.Errorf("storage slot %x of %x out of order", entry.Hash, imp.account)
+		}
+		rawdb.WriteStorageSnapshot(imp.batch, imp.account, entry.Hash, entry.Blob)
+		if err := imp.storage.TryUpdate(entry.Hash[:], entry.Blob); err != nil {
+			return err
+		}
+		slot := entry.Hash
+		imp.lastSlot = &slot
+		imp.slots++
+
+	default:
+		return fmt.Errorf("unknown entry kind %d", entry.Kind)
+	}
+	return nil
+}
+
+// finishAccount commits the storage trie of the account being imported, checks
+// it against the account and inserts the account into the account trie.
+func (imp *importer) finishAccount() error {
+	if imp.blob == nil {
+		return nil
+	}
+	account, err := FullAccount(imp.blob)
+	if err != nil {
+		return err
+	}
+	root, err := imp.storage.Commit()
+	if err != nil {
+		return err
+	}
+	if want := common.BytesToHash(account.Root); root != want {
+		return fmt.Errorf("storage root mismatch of %x: have %x, want %x", imp.account, root, want)
+	}
+	full, err := FullAccountRLP(imp.blob)
+	if err != nil {
+		return err
+	}
+	return imp.trie.TryUpdate(imp.account[:], full)
+}
+
+// Import rebuilds the snapshot and the state trie from the export in the given
+// directory, returning the root of the imported state. The checksums of the
+// chunks and the root of the regenerated trie are verified against the manifest.
+//
+// The database must not contain a snapshot, the imported one is only marked as
+// complete once all of the state has been written.
+func Import(db ethdb.KeyValueStore, dir string) (common.Hash, error) {
+	if rawdb.ReadStateScheme(db) == rawdb.PathScheme {
+		return common.Hash{}, errors.New("snapshot import is only supported in hash scheme")
+	}
+	if root := rawdb.ReadSnapshotRoot(db); root != (common.Hash{}) {
+		return common.Hash{}, fmt.Errorf("database already contains snapshot %x", root)
+	}
+	blob, err := os.ReadFile(filepath.Join(dir, exportManifest))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var meta exportMeta
+	if err := json.Unmarshal(blob, &meta); err != nil {
+		return common.Hash{}, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if meta.Version != exportVersion {
+		return common.Hash{}, fmt.Errorf("unsupported export version %d, want %d", meta.Version, exportVersion)
+	}
+	var (
+		batch = db.NewBatch()
+		imp   = &importer{batch: batch, trie: trie.NewStackTrie(batch)}
+
+		start  = time.Now()
+		logged = time.Now()
+	)
+	for i, chunk := range meta.Chunks {
+		data, err := os.ReadFile(filepath.Join(dir, chunk.Name))
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if hash := crypto.Keccak256Hash(data); hash != chunk.Checksum {
+			return common.Hash{}, fmt.Errorf("chunk %s checksum mismatch: have %x, want %x", chunk.Name, hash, chunk.Checksum)
+		}
+		if data, err = snappy.Decode(nil, data); err != nil {
+			return common.Hash{}, fmt.Errorf("chunk %s: %v", chunk.Name, err)
+		}
+		stream := rlp.NewStream(bytes.NewReader(data), 0)
+		for {
+			var entry exportEntry
+			if err := stream.Decode(&entry); err == io.EOF {
+				break
+			} else if err != nil {
+				return common.Hash{}, fmt.Errorf("chunk %s: %v", chunk.Name, err)
+			}
+			if err := imp.importEntry(&entry); err != nil {
+				return common.Hash{}, err
+			}
+			if batch.ValueSize() > ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					return common.Hash{}, err
+				}
+				batch.Reset()
+			}
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Snapshot import in progress", "chunk", i, "chunks", len(meta.Chunks), "accounts", imp.accounts,
+				"slots", imp.slots, "codes", imp.codes, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	if err := imp.finishAccount(); err != nil {
+		return common.Hash{}, err
+	}
+	root, err := imp.trie.Commit()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if root != meta.Root {
+		return common.Hash{}, fmt.Errorf("state root mismatch: have %x, want %x", root, meta.Root)
+	}
+	// Everything imported, mark the snapshot as complete
+	rawdb.WriteSnapshotRoot(batch, root)
+	journalProgress(batch, nil, nil)
+	if err := batch.Write(); err != nil {
+		return common.Hash{}, err
+	}
+	log.Info("Snapshot import complete", "root", root, "accounts", imp.accounts, "slots", imp.slots,
+		"codes", imp.codes, "elapsed", common.PrettyDuration(time.Since(start)))
+	return root, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// newExportTestTree creates a snapshot tree with a handful of accounts, some of
+// them with storage and code.
+func newExportTestTree(t *testing.T) (*Tree, *testHelper, common.Hash) {
+	helper := newHelper()
+	code := []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	rawdb.WriteCode(helper.diskdb, crypto.Keccak256Hash(code), code)
+
+	for i := 0; i < 32; i++ {
+		acc := &Account{Balance: big.NewInt(int64(i)), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()}
+		if i%3 == 0 {
+			var keys, vals []string
+			for j := 0; j < i+1; j++ {
+				keys = append(keys, fmt.Sprintf("key-%d", j))
+				vals = append(vals, fmt.Sprintf("val-%d-%d", i, j))
+			}
+			acc.Root = helper.makeStorageTrie(keys, vals)
+			acc.CodeHash = crypto.Keccak256(code)
+		}
+		helper.addTrieAccount(fmt.Sprintf("acc-%d", i), acc)
+	}
+	root, snap := helper.Generate()
+	select {
+	case <-snap.genPending:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("snapshot generation failed")
+	}
+	stop := make(chan *generatorStats)
+	snap.genAbort <- stop
+	<-stop
+
+	tree := &Tree{
+		diskdb: helper.diskdb,
+		triedb: helper.triedb,
+		layers: map[common.Hash]snapshot{root: snap},
+	}
+	return tree, helper, root
+}
+
+// Tests that an exported snapshot can be imported into an empty database,
+// rebuilding both the flat state and the tries.
+func TestExportImport(t *testing.T) {
+	tree, helper, root := newExportTestTree(t)
+
+	dir := t.TempDir()
+	if err := Export(tree, helper.diskdb, root, dir, 256); err != nil {
+		t.Fatalf("failed to export snapshot: %v", err)
+	}
+	chunks, _ := filepath.Glob(filepath.Join(dir, "chunk-*"))
+	if len(chunks) < 2 {
+		t.Fatalf("export not chunked: %d chunks", len(chunks))
+	}
+	db := memorydb.New()
+	imported, err := Import(db, dir)
+	if err != nil {
+		t.Fatalf("failed to import snapshot: %v", err)
+	}
+	if imported != root {
+		t.Fatalf("imported root mismatch: have %x, want %x", imported, root)
+	}
+	// The imported snapshot and tries must be complete and consistent
+	snaps, err := New(db, trie.NewDatabase(db), 16, root, false, false, false)
+	if err != nil {
+		t.Fatalf("failed to open imported snapshot: %v", err)
+	}
+	if err := snaps.Verify(root); err != nil {
+		t.Fatalf("failed to verify imported snapshot: %v", err)
+	}
+	// All the trie nodes, codes and snapshot entries of the source must have
+	// been recreated. The generator statistics differ and the preimages are
+	// not exported.
+	it := helper.diskdb.NewIterator(nil, nil)
+	defer it.Release()
+	for it.Next() {
+		if string(it.Key()) == "SnapshotGenerator" || bytes.HasPrefix(it.Key(), []byte("secure-key-")) {
+			continue
+		}
+		if have, _ := db.Get(it.Key()); !bytes.Equal(have, it.Value()) {
+			t.Fatalf("entry %x mismatch: have %x, want %x", it.Key(), have, it.Value())
+		}
+	}
+	// Importing on top of an existing snapshot is rejected
+	if _, err := Import(db, dir); err == nil {
+		t.Fatalf("imported over an existing snapshot")
+	}
+}
+
+// Tests that corrupted exports are rejected.
+func TestImportCorrupted(t *testing.T) {
+	tree, helper, root := newExportTestTree(t)
+
+	dir := t.TempDir()
+	if err := Export(tree, helper.diskdb, root, dir, 256); err != nil {
+		t.Fatalf("failed to export snapshot: %v", err)
+	}
+	name := filepath.Join(dir, "chunk-000001.snappy")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("failed to read chunk: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatalf("failed to write chunk: %v", err)
+	}
+	db := memorydb.New()
+	if _, err := Import(db, dir); err == nil {
+		t.Fatalf("imported corrupted chunk")
+	}
+	if rawdb.ReadSnapshotRoot(db) != (common.Hash{}) {
+		t.Fatalf("corrupted import marked as complete")
+	}
+}
@@ -319,12 +319,15 @@ func (dl *diskLayer) proveRange(stats *generatorStats, root common.Hash, prefix
 		}
 		return &proofResult{keys: keys, vals: vals}, nil
 	}
-	// Snap state is chunked, generate edge proofs for verification.
-	tr, err := trie.New(root, dl.triedb)
+	// Snap state is chunked, generate edge proofs for verification. The trie
+	// is swept through once, don't evict the live nodes from the clean cache
+	// with it, but use the ones already cached.
+	tr, err := trie.NewWithOwner(dl.root, trieOwner(prefix), root, dl.triedb)
 	if err != nil {
 		stats.Log("Trie missing, state snapshotting paused", dl.root, dl.genMarker)
 		return nil, errMissingTrie
 	}
+	tr.SetCold()
 	// Firstly find out the key of last iterated element.
 	var last []byte
 	if len(keys) > 0 {
@@ -441,11 +444,12 @@ func (dl *diskLayer) generateRange(root common.Hash, prefix []byte, kind string,
 	}
 	tr := result.tr
 	if tr == nil {
-		tr, err = trie.New(root, dl.triedb)
+		tr, err = trie.NewWithOwner(dl.root, trieOwner(prefix), root, dl.triedb)
 		if err != nil {
 			stats.Log("Trie missing, state snapshotting paused", dl.root, dl.genMarker)
 			return false, nil, errMissingTrie
 		}
+		tr.SetCold()
 	}
 
 	var (
@@ -749,6 +753,15 @@ func (dl *diskLayer) generate(stats *generatorStats) {
 	abort <- nil
 }
 
+// trieOwner returns the owner of the trie whose snapshot entries are stored
+// with the given prefix: the account hash for storage tries, zero otherwise.
+func trieOwner(prefix []byte) common.Hash {
+	if len(prefix) != len(rawdb.SnapshotStoragePrefix)+common.HashLength {
+		return common.Hash{}
+	}
+	return common.BytesToHash(prefix[len(rawdb.SnapshotStoragePrefix):])
+}
+
 // increaseKey increase the input key by one bit. Return nil if the entire
 // addition operation overflows,
 func increaseKey(key []byte) []byte {
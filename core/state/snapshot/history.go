@@ -0,0 +1,481 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// historyIndexChunk is the maximum number of state history ids stored in
+	// a single chunk of the history index of an account or storage slot.
+	historyIndexChunk = 256
+
+	// historyIndexOpen is the key suffix of the index chunk being appended to.
+	// It sorts after all the sealed chunks, which are keyed by their last id.
+	historyIndexOpen = math.MaxUint64
+)
+
+// ErrHistoryUnavailable is returned if a state is requested which is not covered
+// by the retained state history.
+var ErrHistoryUnavailable = errors.New("state history unavailable")
+
+// historyMeta is the metadata of a state history, the roots of the state
+// transition it reverts.
+type historyMeta struct {
+	Parent common.Hash // Root of the state the history reverts to
+	Root   common.Hash // Root of the state the history reverts from
+}
+
+// historyAccount is the value of an account before a state transition, in the
+// slim snapshot format. An empty blob means the account didn't exist.
+type historyAccount struct {
+	Hash common.Hash
+	Blob []byte
+}
+
+// historySlot is the value of a storage slot before a state transition. An
+// empty blob means the slot didn't exist.
+type historySlot struct {
+	Account common.Hash
+	Hash    common.Hash
+	Blob    []byte
+}
+
+// History maintains the reverse diffs of the flat state, allowing to serve the
+// accounts and storage slots of historical states long after their diff layers
+// were flattened, without retaining historical trie nodes.
+//
+// Every diff layer is recorded with the values it overwrote right before it is
+// merged into the layer below. A historical value is taken from the first state
+// history modifying it after the requested state, or from the most recently
+// recorded layer if no state history modified it since.
+type History struct {
+	tree    *Tree               // Snapshot tree whose diff layers are recorded
+	diskdb  ethdb.KeyValueStore // Key-value store holding the lookups and the indexes
+	freezer ethdb.AncientStore  // Append-only store holding the reverse diffs
+}
+
+// NewHistory creates the state history on top of the given freezer and starts
+// recording the diff layers of the snapshot tree into it.
+func NewHistory(tree *Tree, freezer ethdb.AncientStore) (*History, error) {
+	h := &History{
+		tree:    tree,
+		diskdb:  tree.diskdb,
+		freezer: freezer,
+	}
+	// Drop the reverse diffs whose lookups and indexes didn't make it to disk
+	// due to a crash, their ids will be reused.
+	items, err := freezer.Ancients()
+	if err != nil {
+		return nil, err
+	}
+	for items > 0 {
+		meta, err := h.readMeta(items - 1)
+		if err == nil {
+			if id := rawdb.ReadStateHistoryLookup(h.diskdb, meta.Parent); id != nil && *id == items-1 {
+				break
+			}
+		}
+		log.Warn("Dropping dangling state history", "id", items-1)
+		items--
+		if err := freezer.TruncateAncients(items); err != nil {
+			return nil, err
+		}
+	}
+	tree.lock.Lock()
+	tree.history = h
+	tree.lock.Unlock()
+
+	log.Info("Enabled state history", "items", items, "tail", rawdb.ReadStateHistoryTail(h.diskdb))
+	return h, nil
+}
+
+// Close stops recording the state history and closes the underlying freezer.
+func (h *History) Close() error {
+	h.tree.lock.Lock()
+	if h.tree.history == h {
+		h.tree.history = nil
+	}
+	h.tree.lock.Unlock()
+
+	return h.freezer.Close()
+}
+
+// readMeta retrieves the metadata of the state history with the given id.
+func (h *History) readMeta(id uint64) (*historyMeta, error) {
+	blob := rawdb.ReadStateHistoryMeta(h.freezer, id)
+	if len(blob) == 0 {
+		return nil, fmt.Errorf("state history #%d missing", id)
+	}
+	meta := new(historyMeta)
+	if err := rlp.DecodeBytes(blob, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// head returns the number of state histories and the root of the last state
+// recorded, or an empty root if nothing was recorded yet.
+func (h *History) head() (uint64, common.Hash, error) {
+	items, err := h.freezer.Ancients()
+	if err != nil || items == 0 {
+		return 0, common.Hash{}, err
+	}
+	meta, err := h.readMeta(items - 1)
+	if err != nil {
+		return 0, common.Hash{}, err
+	}
+	return items, meta.Root, nil
+}
+
+// recordUpTo records the given diff layer and all the ones below it which are
+// not yet part of the state history, bottom-most first.
+//
+// The method assumes the tree lock is held by the caller.
+func (h *History) recordUpTo(layer *diffLayer) {
+	_, root, err := h.head()
+	if err != nil {
+		log.Error("Failed to retrieve state history head", "err", err)
+		return
+	}
+	var layers []*diffLayer
+	for layer != nil && layer.root != root {
+		layers = append(layers, layer)
+		layer, _ = layer.Parent().(*diffLayer)
+	}
+	for i := len(layers) - 1; i >= 0; i-- {
+		if err := h.record(layers[i]); err != nil {
+			log.Error("Failed to record state history", "root", layers[i].root, "err", err)
+			return
+		}
+	}
+}
+
+// record appends the values overwritten by the given diff layer to the state
+// history and indexes them.
+func (h *History) record(layer *diffLayer) error {
+	// The overwritten values can't be resolved while the snapshot is generating,
+	// leave a gap in the history in that case.
+	layer.origin.lock.RLock()
+	generating := layer.origin.genMarker != nil
+	layer.origin.lock.RUnlock()
+
+	if generating {
+		return nil
+	}
+	items, root, err := h.head()
+	if err != nil {
+		return err
+	}
+	parent := layer.Parent()
+
+	layer.lock.RLock()
+	defer layer.lock.RUnlock()
+
+	// Resolve the previous values of all the modified accounts and slots
+	var (
+		accounts []historyAccount
+		slots    []historySlot
+		touched  = make(map[common.Hash]struct{})
+	)
+	for hash := range layer.destructSet {
+		touched[hash] = struct{}{}
+	}
+	for hash := range layer.accountData {
+		touched[hash] = struct{}{}
+	}
+	for hash := range touched {
+		blob, err := parent.AccountRLP(hash)
+		if err != nil {
+			return err
+		}
+		accounts = append(accounts, historyAccount{Hash: hash, Blob: blob})
+	}
+	for hash := range layer.destructSet {
+		storage, err := storageSlots(parent, hash)
+		if err != nil {
+			return err
+		}
+		for slot, blob := range storage {
+			if _, ok := layer.storageData[hash][slot]; !ok {
+				slots = append(slots, historySlot{Account: hash, Hash: slot, Blob: blob})
+			}
+		}
+	}
+	for hash, storage := range layer.storageData {
+		for slot := range storage {
+			blob, err := parent.Storage(hash, slot)
+			if err != nil {
+				return err
+			}
+			slots = append(slots, historySlot{Account: hash, Hash: slot, Blob: blob})
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i].Hash[:], accounts[j].Hash[:]) < 0
+	})
+	sort.Slice(slots, func(i, j int) bool {
+		if slots[i].Account != slots[j].Account {
+			return bytes.Compare(slots[i].Account[:], slots[j].Account[:]) < 0
+		}
+		return bytes.Compare(slots[i].Hash[:], slots[j].Hash[:]) < 0
+	})
+	meta, err := rlp.EncodeToBytes(&historyMeta{Parent: parent.Root(), Root: layer.root})
+	if err != nil {
+		return err
+	}
+	accountBlob, err := rlp.EncodeToBytes(accounts)
+	if err != nil {
+		return err
+	}
+	slotBlob, err := rlp.EncodeToBytes(slots)
+	if err != nil {
+		return err
+	}
+	// Append the reverse diff first, the lookup and the indexes make it visible
+	if err := rawdb.WriteStateHistory(h.freezer, items, meta, accountBlob, slotBlob); err != nil {
+		return err
+	}
+	batch := h.diskdb.NewBatch()
+	if items > 0 && root != parent.Root() {
+		// The history doesn't link up with the layer, the earlier histories
+		// can't be used to reconstruct the historical states any more
+		log.Warn("Gap in the state history", "id", items, "last", root, "parent", parent.Root())
+		rawdb.WriteStateHistoryTail(batch, items)
+	}
+	rawdb.WriteStateHistoryLookup(batch, parent.Root(), items)
+	for _, account := range accounts {
+		blob, sealed := appendIndex(rawdb.ReadStateHistoryAccountIndex(h.diskdb, account.Hash, historyIndexOpen), items)
+		if sealed {
+			rawdb.WriteStateHistoryAccountIndex(batch, account.Hash, items, blob)
+			rawdb.DeleteStateHistoryAccountIndex(batch, account.Hash, historyIndexOpen)
+		} else {
+			rawdb.WriteStateHistoryAccountIndex(batch, account.Hash, historyIndexOpen, blob)
+		}
+	}
+	for _, slot := range slots {
+		blob, sealed := appendIndex(rawdb.ReadStateHistoryStorageIndex(h.diskdb, slot.Account, slot.Hash, historyIndexOpen), items)
+		if sealed {
+			rawdb.WriteStateHistoryStorageIndex(batch, slot.Account, slot.Hash, items, blob)
+			rawdb.DeleteStateHistoryStorageIndex(batch, slot.Account, slot.Hash, historyIndexOpen)
+		} else {
+			rawdb.WriteStateHistoryStorageIndex(batch, slot.Account, slot.Hash, historyIndexOpen, blob)
+		}
+	}
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed to write state history index", "err", err)
+	}
+	log.Debug("Recorded state history", "id", items, "root", layer.root, "accounts", len(accounts), "slots", len(slots))
+	return nil
+}
+
+// storageSlots collects all the storage slots of an account in the given layer.
+func storageSlots(layer snapshot, account common.Hash) (map[common.Hash][]byte, error) {
+	slots := make(map[common.Hash][]byte)
+	for {
+		switch layer := layer.(type) {
+		case *diffLayer:
+			layer.lock.RLock()
+			for hash, blob := range layer.storageData[account] {
+				if _, ok := slots[hash]; !ok {
+					slots[hash] = blob
+				}
+			}
+			_, destructed := layer.destructSet[account]
+			layer.lock.RUnlock()
+
+			if destructed {
+				return nonEmpty(slots), nil
+			}
+		case *diskLayer:
+			it := rawdb.IterateStorageSnapshots(layer.diskdb, account)
+			for it.Next() {
+				if key := it.Key(); len(key) == 1+2*common.HashLength {
+					hash := common.BytesToHash(key[1+common.HashLength:])
+					if _, ok := slots[hash]; !ok {
+						slots[hash] = common.CopyBytes(it.Value())
+					}
+				}
+			}
+			it.Release()
+			return nonEmpty(slots), it.Error()
+
+		default:
+			panic(fmt.Sprintf("unknown data layer: %T", layer))
+		}
+		layer = layer.Parent()
+	}
+}
+
+// nonEmpty drops the deleted slots from a set of storage slots.
+func nonEmpty(slots map[common.Hash][]byte) map[common.Hash][]byte {
+	for hash, blob := range slots {
+		if len(blob) == 0 {
+			delete(slots, hash)
+		}
+	}
+	return slots
+}
+
+// appendIndex appends an id to the open chunk of a history index, reporting
+// whether the chunk is full and needs to be sealed.
+func appendIndex(chunk []byte, id uint64) ([]byte, bool) {
+	blob := make([]byte, len(chunk)+8)
+	copy(blob, chunk)
+	binary.BigEndian.PutUint64(blob[len(chunk):], id)
+	return blob, len(blob)/8 >= historyIndexChunk
+}
+
+// searchIndex returns the first id in a history index not smaller than the
+// given one, iterating the index chunks from the one which may contain it.
+func searchIndex(it ethdb.Iterator, from uint64) (uint64, bool) {
+	defer it.Release()
+
+	for it.Next() {
+		chunk := it.Value()
+		n := len(chunk) / 8
+		i := sort.Search(n, func(i int) bool {
+			return binary.BigEndian.Uint64(chunk[i*8:]) >= from
+		})
+		if i < n {
+			return binary.BigEndian.Uint64(chunk[i*8:]), true
+		}
+	}
+	return 0, false
+}
+
+// locate returns the id of the first state history reverting a transition from
+// the state with the given root, along with the layer of the most recently
+// recorded state to read the values which weren't modified since from.
+func (h *History) locate(root common.Hash) (uint64, Snapshot, error) {
+	items, last, err := h.head()
+	if err != nil {
+		return 0, nil, err
+	}
+	if items == 0 {
+		return 0, nil, ErrHistoryUnavailable
+	}
+	layer := h.tree.Snapshot(last)
+	if layer == nil {
+		return 0, nil, ErrHistoryUnavailable
+	}
+	if root == last {
+		return items, layer, nil
+	}
+	id := rawdb.ReadStateHistoryLookup(h.diskdb, root)
+	if id == nil || *id >= items || *id < rawdb.ReadStateHistoryTail(h.diskdb) {
+		return 0, nil, ErrHistoryUnavailable
+	}
+	return *id, layer, nil
+}
+
+// Available reports whether the state with the given root can be served from
+// the state history.
+func (h *History) Available(root common.Hash) bool {
+	_, _, err := h.locate(root)
+	return err == nil
+}
+
+// AccountRLP retrieves the slim RLP encoded account with the given hash from
+// the state with the given root. Nil is returned if the account didn't exist.
+func (h *History) AccountRLP(root common.Hash, hash common.Hash) ([]byte, error) {
+	for {
+		id, layer, err := h.locate(root)
+		if err != nil {
+			return nil, err
+		}
+		// Read the latest value before the index. Any history recorded in
+		// between reverts to this same value.
+		latest, err := layer.AccountRLP(hash)
+		if err == ErrSnapshotStale {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		next, ok := searchIndex(rawdb.IterateStateHistoryAccountIndex(h.diskdb, hash, id), id)
+		if !ok {
+			return latest, nil
+		}
+		var accounts []historyAccount
+		if err := rlp.DecodeBytes(rawdb.ReadStateHistoryAccounts(h.freezer, next), &accounts); err != nil {
+			return nil, fmt.Errorf("corrupted state history #%d: %v", next, err)
+		}
+		i := sort.Search(len(accounts), func(i int) bool {
+			return bytes.Compare(accounts[i].Hash[:], hash[:]) >= 0
+		})
+		if i == len(accounts) || accounts[i].Hash != hash {
+			return nil, fmt.Errorf("account %x missing from state history #%d", hash, next)
+		}
+		if len(accounts[i].Blob) == 0 {
+			return nil, nil
+		}
+		return accounts[i].Blob, nil
+	}
+}
+
+// Storage retrieves the RLP encoded storage slot with the given hash of the
+// account from the state with the given root. Nil is returned if the slot
+// didn't exist.
+func (h *History) Storage(root common.Hash, accountHash, storageHash common.Hash) ([]byte, error) {
+	for {
+		id, layer, err := h.locate(root)
+		if err != nil {
+			return nil, err
+		}
+		latest, err := layer.Storage(accountHash, storageHash)
+		if err == ErrSnapshotStale {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		next, ok := searchIndex(rawdb.IterateStateHistoryStorageIndex(h.diskdb, accountHash, storageHash, id), id)
+		if !ok {
+			return latest, nil
+		}
+		var slots []historySlot
+		if err := rlp.DecodeBytes(rawdb.ReadStateHistoryStorages(h.freezer, next), &slots); err != nil {
+			return nil, fmt.Errorf("corrupted state history #%d: %v", next, err)
+		}
+		i := sort.Search(len(slots), func(i int) bool {
+			if slots[i].Account != accountHash {
+				return bytes.Compare(slots[i].Account[:], accountHash[:]) >= 0
+			}
+			return bytes.Compare(slots[i].Hash[:], storageHash[:]) >= 0
+		})
+		if i == len(slots) || slots[i].Account != accountHash || slots[i].Hash != storageHash {
+			return nil, fmt.Errorf("slot %x of account %x missing from state history #%d", storageHash, accountHash, next)
+		}
+		if len(slots[i].Blob) == 0 {
+			return nil, nil
+		}
+		return slots[i].Blob, nil
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+)
+
+// historyState is a flat state used as the reference for the state history.
+type historyState struct {
+	accounts map[common.Hash][]byte
+	storage  map[common.Hash]map[common.Hash][]byte
+}
+
+func (s *historyState) copy() *historyState {
+	cpy := &historyState{
+		accounts: make(map[common.Hash][]byte),
+		storage:  make(map[common.Hash]map[common.Hash][]byte),
+	}
+	for hash, blob := range s.accounts {
+		cpy.accounts[hash] = blob
+	}
+	for hash, slots := range s.storage {
+		cpy.storage[hash] = make(map[common.Hash][]byte)
+		for slot, blob := range slots {
+			cpy.storage[hash][slot] = blob
+		}
+	}
+	return cpy
+}
+
+// Tests that the states of flattened diff layers, including the ones merged in
+// the accumulator and the ones persisted to disk, are served from the history.
+func TestStateHistory(t *testing.T) {
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	tree := &Tree{
+		diskdb: base.diskdb,
+		layers: map[common.Hash]snapshot{base.root: base},
+	}
+	freezer, err := rawdb.NewStateHistoryFreezer(t.TempDir(), false)
+	if err != nil {
+		t.Fatalf("failed to create state history freezer: %v", err)
+	}
+	history, err := NewHistory(tree, freezer)
+	if err != nil {
+		t.Fatalf("failed to create state history: %v", err)
+	}
+	defer history.Close()
+
+	var (
+		accounts = make([]common.Hash, 8)
+		slots    = make([]common.Hash, 4)
+		roots    = []common.Hash{base.root}
+		states   = []*historyState{{
+			accounts: make(map[common.Hash][]byte),
+			storage:  make(map[common.Hash]map[common.Hash][]byte),
+		}}
+	)
+	for i := range accounts {
+		accounts[i] = common.BigToHash(big.NewInt(int64(0xa0 + i)))
+	}
+	for i := range slots {
+		slots[i] = common.BigToHash(big.NewInt(int64(0xb0 + i)))
+	}
+	for i := 0; i < 64; i++ {
+		var (
+			state    = states[len(states)-1].copy()
+			destruct = make(map[common.Hash]struct{})
+			updates  = make(map[common.Hash][]byte)
+			storage  = make(map[common.Hash]map[common.Hash][]byte)
+		)
+		for j := 0; j < 3; j++ {
+			account := accounts[rand.Intn(len(accounts))]
+			if _, ok := updates[account]; ok {
+				continue
+			}
+			if _, ok := destruct[account]; ok {
+				continue
+			}
+			// Occasionally destruct the account, recreating it half of the time
+			if rand.Intn(4) == 0 {
+				destruct[account] = struct{}{}
+				delete(state.accounts, account)
+				delete(state.storage, account)
+				if rand.Intn(2) == 0 {
+					continue
+				}
+			}
+			updates[account] = randomAccount()
+			state.accounts[account] = updates[account]
+
+			storage[account] = make(map[common.Hash][]byte)
+			if state.storage[account] == nil {
+				state.storage[account] = make(map[common.Hash][]byte)
+			}
+			for k := 0; k < 2; k++ {
+				slot := slots[rand.Intn(len(slots))]
+				if rand.Intn(3) == 0 {
+					storage[account][slot] = nil
+					delete(state.storage[account], slot)
+				} else {
+					storage[account][slot] = randomHash().Bytes()
+					state.storage[account][slot] = storage[account][slot]
+				}
+			}
+		}
+		root := common.BigToHash(big.NewInt(int64(i + 2)))
+		if err := tree.Update(root, roots[len(roots)-1], destruct, updates, storage); err != nil {
+			t.Fatalf("block %d: failed to update snapshot tree: %v", i, err)
+		}
+		if err := tree.Cap(root, 4); err != nil {
+			t.Fatalf("block %d: failed to cap snapshot tree: %v", i, err)
+		}
+		roots = append(roots, root)
+		states = append(states, state)
+
+		// Push everything to disk midway to check histories read through it
+		if i == 32 {
+			if err := tree.Cap(root, 0); err != nil {
+				t.Fatalf("block %d: failed to flatten snapshot tree: %v", i, err)
+			}
+		}
+	}
+	if err := tree.Cap(roots[len(roots)-1], 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	for i, root := range roots {
+		if !history.Available(root) {
+			t.Fatalf("state %d: unavailable", i)
+		}
+		for _, account := range accounts {
+			blob, err := history.AccountRLP(root, account)
+			if err != nil {
+				t.Fatalf("state %d: failed to retrieve account %x: %v", i, account, err)
+			}
+			if want := states[i].accounts[account]; !bytes.Equal(blob, want) {
+				t.Fatalf("state %d: account %x mismatch: have %x, want %x", i, account, blob, want)
+			}
+			for _, slot := range slots {
+				blob, err := history.Storage(root, account, slot)
+				if err != nil {
+					t.Fatalf("state %d: failed to retrieve slot %x of %x: %v", i, slot, account, err)
+				}
+				if want := states[i].storage[account][slot]; !bytes.Equal(blob, want) {
+					t.Fatalf("state %d: slot %x of %x mismatch: have %x, want %x", i, slot, account, blob, want)
+				}
+			}
+		}
+	}
+	if history.Available(common.HexToHash("0xdeadbeef")) {
+		t.Fatalf("unknown state available")
+	}
+}
@@ -163,6 +163,8 @@ type Tree struct {
 	cache  int                      // Megabytes permitted to use for read caches
 	layers map[common.Hash]snapshot // Collection of all known layers
 	lock   sync.RWMutex
+
+	history *History // State history recording the flattened layers, nil if disabled
 }
 
 // New attempts to load an already existing snapshot from a persistent key-value
@@ -325,6 +327,133 @@ func (t *Tree) Snapshots(root common.Hash, limits int, nodisk bool) []Snapshot {
 	return ret
 }
 
+// DiffKeys is the set of state entries modified by a single diff layer.
+type DiffKeys struct {
+	Parent   common.Hash                   // Root of the layer the diff is applied on
+	Accounts []common.Hash                 // Accounts created, updated or destructed
+	Storage  map[common.Hash][]common.Hash // Storage slots updated, grouped by account
+}
+
+// DiffKeys returns the keys of the state entries modified by each of the diff
+// layers currently maintained, keyed by the root of the layer.
+func (t *Tree) DiffKeys() map[common.Hash]*DiffKeys {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	diffs := make(map[common.Hash]*DiffKeys)
+	for root, layer := range t.layers {
+		diff, ok := layer.(*diffLayer)
+		if !ok {
+			continue
+		}
+		diff.lock.RLock()
+		keys := &DiffKeys{
+			Parent:  diff.parent.Root(),
+			Storage: make(map[common.Hash][]common.Hash, len(diff.storageData)),
+		}
+		for hash := range diff.destructSet {
+			keys.Accounts = append(keys.Accounts, hash)
+		}
+		for hash := range diff.accountData {
+			if _, ok := diff.destructSet[hash]; !ok {
+				keys.Accounts = append(keys.Accounts, hash)
+			}
+		}
+		for hash, slots := range diff.storageData {
+			for slot := range slots {
+				keys.Storage[hash] = append(keys.Storage[hash], slot)
+			}
+		}
+		diff.lock.RUnlock()
+
+		diffs[root] = keys
+	}
+	return diffs
+}
+
+// StateDiff is the set of state changes applied by a single diff layer, with
+// the accounts in the slim snapshot format.
+type StateDiff struct {
+	Parent    common.Hash                            // Root of the layer the diff is applied on
+	Root      common.Hash                            // Root of the layer after the diff is applied
+	Destructs map[common.Hash]struct{}               // Accounts deleted, potentially recreated afterwards
+	Accounts  map[common.Hash][]byte                 // Accounts created or updated (nil means deleted)
+	Storage   map[common.Hash]map[common.Hash][]byte // Storage slots updated, grouped by account (nil means deleted)
+}
+
+// StateDiffs returns the state changes of the diff layers leading from the disk
+// layer up to the one with the given root, bottom-most first.
+func (t *Tree) StateDiffs(root common.Hash) ([]*StateDiff, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	layer := t.layers[root]
+	if layer == nil {
+		return nil, fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	var diffs []*StateDiff
+	for {
+		diff, ok := layer.(*diffLayer)
+		if !ok {
+			break
+		}
+		sd, parent := diff.stateDiff()
+		diffs = append(diffs, sd)
+		layer = parent
+	}
+	for i, j := 0, len(diffs)-1; i < j; i, j = i+1, j-1 {
+		diffs[i], diffs[j] = diffs[j], diffs[i]
+	}
+	return diffs, nil
+}
+
+// StateDiff returns the state changes of the diff layer with the given root.
+func (t *Tree) StateDiff(root common.Hash) (*StateDiff, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	layer := t.layers[root]
+	if layer == nil {
+		return nil, fmt.Errorf("snapshot [%#x] missing", root)
+	}
+	diff, ok := layer.(*diffLayer)
+	if !ok {
+		return nil, fmt.Errorf("snapshot [%#x] is not a diff layer", root)
+	}
+	sd, _ := diff.stateDiff()
+	return sd, nil
+}
+
+// stateDiff copies out the state changes of the diff layer, along with its
+// parent at the time of copying.
+func (dl *diffLayer) stateDiff() (*StateDiff, snapshot) {
+	// The maps of the bottom-most layer are merged into in place when
+	// flattening, copy them out
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	sd := &StateDiff{
+		Parent:    dl.parent.Root(),
+		Root:      dl.root,
+		Destructs: make(map[common.Hash]struct{}, len(dl.destructSet)),
+		Accounts:  make(map[common.Hash][]byte, len(dl.accountData)),
+		Storage:   make(map[common.Hash]map[common.Hash][]byte, len(dl.storageData)),
+	}
+	for hash := range dl.destructSet {
+		sd.Destructs[hash] = struct{}{}
+	}
+	for hash, blob := range dl.accountData {
+		sd.Accounts[hash] = blob
+	}
+	for hash, slots := range dl.storageData {
+		sd.Storage[hash] = make(map[common.Hash][]byte, len(slots))
+		for slot, blob := range slots {
+			sd.Storage[hash][slot] = blob
+		}
+	}
+	return sd, dl.parent
+}
+
 // Update adds a new snapshot into the tree, if that can be linked to an existing
 // old parent. It is disallowed to insert a disk layer (the origin of all).
 func (t *Tree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
@@ -387,6 +516,9 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	// child for the capping and then remove it.
 	if layers == 0 {
 		// If full commit was requested, flatten the diffs and merge onto disk
+		if t.history != nil {
+			t.history.recordUpTo(diff)
+		}
 		diff.lock.RLock()
 		base := diffToDisk(diff.flatten().(*diffLayer))
 		diff.lock.RUnlock()
@@ -463,6 +595,11 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 		return nil
 
 	case *diffLayer:
+		// Record the parent into the state history before its data is merged
+		// with the grandparent's, losing the intermediate state.
+		if t.history != nil {
+			t.history.recordUpTo(parent)
+		}
 		// Flatten the parent into the grandparent. The flattening internally obtains a
 		// write lock on grandparent.
 		flattened := parent.flatten().(*diffLayer)
@@ -130,6 +130,9 @@ func (s *stateObject) setError(err error) {
 	if s.dbErr == nil {
 		s.dbErr = err
 	}
+	// Surface the failure on the state too, otherwise the errors of objects
+	// which are only read would be silently lost
+	s.db.setError(err)
 }
 
 func (s *stateObject) markSuicided() {
@@ -154,15 +157,22 @@ func (s *stateObject) getTrie(db Database) Trie {
 		if s.data.Root != emptyRoot && s.db.prefetcher != nil {
 			// When the miner is creating the pending state, there is no
 			// prefetcher
+			s.db.lock.Lock()
 			s.trie = s.db.prefetcher.trie(s.data.Root)
+			s.db.lock.Unlock()
 		}
 		if s.trie == nil {
 			var err error
-			s.trie, err = db.OpenStorageTrie(s.addrHash, s.data.Root)
+			s.trie, err = db.OpenStorageTrie(s.db.originalRoot, s.addrHash, s.data.Root)
 			if err != nil {
-				s.trie, _ = db.OpenStorageTrie(s.addrHash, common.Hash{})
+				s.trie, _ = db.OpenStorageTrie(s.db.originalRoot, s.addrHash, common.Hash{})
 				s.setError(fmt.Errorf("can't create storage trie: %v", err))
 			}
+			if s.db.witness != nil {
+				s.db.lock.Lock()
+				s.db.witnessTries = append(s.db.witnessTries, s.trie)
+				s.db.lock.Unlock()
+			}
 		}
 	}
 	return s.trie
@@ -213,7 +223,7 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 			}
 		}()
 	}
-	if s.db.snap != nil {
+	if s.db.snap != nil && s.db.witness == nil {
 		if metrics.EnabledExpensive {
 			meter = &s.db.SnapshotStorageReads
 		}
@@ -229,7 +239,7 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 		enc, err = s.db.snap.Storage(s.addrHash, crypto.Keccak256Hash(key.Bytes()))
 	}
 	// If the snapshot is unavailable or reading from it fails, load from the database.
-	if s.db.snap == nil || err != nil {
+	if s.db.snap == nil || s.db.witness != nil || err != nil {
 		if meter != nil {
 			// If we already spent time checking the snapshot, account for it
 			// and reset the readStart
@@ -318,23 +328,29 @@ func (s *stateObject) finalise(prefetch bool) {
 }
 
 // updateTrie writes cached storage modifications into the object's storage trie.
-// It will return nil if the trie has not been loaded and no changes have been made
+// It will return nil if the trie has not been loaded and no changes have been made.
+//
+// The storage tries of different objects may be updated concurrently, the fields
+// of the state shared between them are only modified under its lock.
 func (s *stateObject) updateTrie(db Database) Trie {
 	// Make sure all dirty slots are finalized into the pending storage area
 	s.finalise(false) // Don't prefetch anymore, pull directly if need be
 	if len(s.pendingStorage) == 0 {
 		return s.trie
 	}
-	// Track the amount of time wasted on updating the storage trie
-	if metrics.EnabledExpensive {
-		defer func(start time.Time) { s.db.StorageUpdates += time.Since(start) }(time.Now())
-	}
 	// The snapshot storage map for the object
-	var storage map[common.Hash][]byte
+	var (
+		storage map[common.Hash][]byte
+		hasher  crypto.KeccakState
+	)
+	if s.db.snap != nil {
+		storage = make(map[common.Hash][]byte)
+		hasher = crypto.NewKeccakState()
+	}
 	// Insert all the pending updates into the trie
 	tr := s.getTrie(db)
-	hasher := s.db.hasher
 
+	var updated, deleted int
 	usedStorage := make([][]byte, 0, len(s.pendingStorage))
 	for key, value := range s.pendingStorage {
 		// Skip noop changes, persist actual changes
@@ -346,29 +362,37 @@ func (s *stateObject) updateTrie(db Database) Trie {
 		var v []byte
 		if (value == common.Hash{}) {
 			s.setError(tr.TryDelete(key[:]))
-			s.db.StorageDeleted += 1
+			deleted += 1
 		} else {
 			// Encoding []byte cannot fail, ok to ignore the error.
 			v, _ = rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
 			s.setError(tr.TryUpdate(key[:], v))
-			s.db.StorageUpdated += 1
+			updated += 1
 		}
 		// If state snapshotting is active, cache the data til commit
-		if s.db.snap != nil {
-			if storage == nil {
-				// Retrieve the old storage map, if available, create a new one otherwise
-				if storage = s.db.snapStorage[s.addrHash]; storage == nil {
-					storage = make(map[common.Hash][]byte)
-					s.db.snapStorage[s.addrHash] = storage
-				}
-			}
+		if storage != nil {
 			storage[crypto.HashData(hasher, key[:])] = v // v will be nil if it's deleted
 		}
 		usedStorage = append(usedStorage, common.CopyBytes(key[:])) // Copy needed for closure
 	}
+	s.db.lock.Lock()
+	s.db.StorageUpdated += updated
+	s.db.StorageDeleted += deleted
+	if len(storage) > 0 {
+		// Merge into the old storage map, if available
+		if old := s.db.snapStorage[s.addrHash]; old != nil {
+			for hash, v := range storage {
+				old[hash] = v
+			}
+		} else {
+			s.db.snapStorage[s.addrHash] = storage
+		}
+	}
 	if s.db.prefetcher != nil {
 		s.db.prefetcher.used(s.data.Root, usedStorage)
 	}
+	s.db.lock.Unlock()
+
 	if len(s.pendingStorage) > 0 {
 		s.pendingStorage = make(Storage)
 	}
@@ -381,10 +405,6 @@ func (s *stateObject) updateRoot(db Database) {
 	if s.updateTrie(db) == nil {
 		return
 	}
-	// Track the amount of time wasted on hashing the storage trie
-	if metrics.EnabledExpensive {
-		defer func(start time.Time) { s.db.StorageHashes += time.Since(start) }(time.Now())
-	}
 	s.data.Root = s.trie.Hash()
 }
 
@@ -398,10 +418,6 @@ func (s *stateObject) CommitTrie(db Database) (int, error) {
 	if s.dbErr != nil {
 		return 0, s.dbErr
 	}
-	// Track the amount of time wasted on committing the storage trie
-	if metrics.EnabledExpensive {
-		defer func(start time.Time) { s.db.StorageCommits += time.Since(start) }(time.Now())
-	}
 	root, committed, err := s.trie.Commit(nil)
 	if err == nil {
 		s.data.Root = root
@@ -480,6 +496,9 @@ func (s *stateObject) Code(db Database) []byte {
 	if err != nil {
 		s.setError(fmt.Errorf("can't load code hash %x: %v", s.CodeHash(), err))
 	}
+	if s.db.witness != nil {
+		s.db.witness.AddCode(code)
+	}
 	s.code = code
 	return code
 }
@@ -494,6 +513,10 @@ func (s *stateObject) CodeSize(db Database) int {
 	if bytes.Equal(s.CodeHash(), emptyCodeHash) {
 		return 0
 	}
+	// The size can't be proven without the code itself, load it into the witness
+	if s.db.witness != nil {
+		return len(s.Code(db))
+	}
 	size, err := db.ContractCodeSize(s.addrHash, common.BytesToHash(s.CodeHash()))
 	if err != nil {
 		s.setError(fmt.Errorf("can't load code size %x: %v", s.CodeHash(), err))
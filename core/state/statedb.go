@@ -21,12 +21,16 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"runtime"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/stateless"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
@@ -62,6 +66,7 @@ func (n *proofList) Delete(key []byte) error {
 // * Contracts
 // * Accounts
 type StateDB struct {
+	lock         sync.Mutex // Lock protecting the fields shared by the storage tries updated concurrently
 	db           Database
 	prefetcher   *triePrefetcher
 	originalRoot common.Hash // The pre-state root, before any changes were made
@@ -99,6 +104,11 @@ type StateDB struct {
 	// Per-transaction access list
 	accessList *accessList
 
+	// Execution witness being recorded, along with all the tries opened since
+	// the recording started
+	witness      *stateless.Witness
+	witnessTries []Trie
+
 	// Journal of state modifications. This is the backbone of
 	// Snapshot and RevertToSnapshot.
 	journal        *journal
@@ -162,7 +172,7 @@ func (s *StateDB) StartPrefetcher(namespace string) {
 		s.prefetcher.close()
 		s.prefetcher = nil
 	}
-	if s.snap != nil {
+	if s.snap != nil && s.witness == nil {
 		s.prefetcher = newTriePrefetcher(s.db, s.originalRoot, namespace)
 	}
 }
@@ -176,8 +186,27 @@ func (s *StateDB) StopPrefetcher() {
 	}
 }
 
+// StartWitness starts recording all the trie nodes and contract codes accessed
+// into the given witness. The recording has to start before any state is read.
+//
+// All the reads are served from the tries while recording, bypassing both the
+// snapshot and the prefetcher. The recording is not carried over into copies.
+func (s *StateDB) StartWitness(witness *stateless.Witness) {
+	s.StopPrefetcher()
+	s.witness = witness
+	s.witnessTries = []Trie{s.trie}
+}
+
+// Witness returns the execution witness being recorded, if any.
+func (s *StateDB) Witness() *stateless.Witness {
+	return s.witness
+}
+
 // setError remembers the first non-nil error it is called with.
 func (s *StateDB) setError(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
 	if s.dbErr == nil {
 		s.dbErr = err
 	}
@@ -510,7 +539,7 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		data *types.StateAccount
 		err  error
 	)
-	if s.snap != nil {
+	if s.snap != nil && s.witness == nil {
 		if metrics.EnabledExpensive {
 			defer func(start time.Time) { s.SnapshotAccountReads += time.Since(start) }(time.Now())
 		}
@@ -534,7 +563,7 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		}
 	}
 	// If snapshot unavailable or reading from it failed, load from the database
-	if s.snap == nil || err != nil {
+	if s.snap == nil || s.witness != nil || err != nil {
 		if metrics.EnabledExpensive {
 			defer func(start time.Time) { s.AccountReads += time.Since(start) }(time.Now())
 		}
@@ -842,12 +871,16 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	// the contract storage and account updates sequentially, that short circuits
 	// the account prefetcher. Instead, let's process all the storage updates
 	// first, giving the account prefeches just a few more milliseconds of time
-	// to pull useful data from disk.
+	// to pull useful data from disk. The storage tries are independent of each
+	// other, so they are updated and hashed concurrently.
+	objs := make([]*stateObject, 0, len(s.stateObjectsPending))
 	for addr := range s.stateObjectsPending {
 		if obj := s.stateObjects[addr]; !obj.deleted {
-			obj.updateRoot(s.db)
+			objs = append(objs, obj)
 		}
 	}
+	s.updateStorageRoots(objs)
+
 	// Now we're about to start to write changes to the trie. The trie is so far
 	// _untouched_. We can check with the prefetcher, if it can give us a trie
 	// which has the same root, but also has some content loaded into it.
@@ -873,6 +906,13 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	if len(s.stateObjectsPending) > 0 {
 		s.stateObjectsPending = make(map[common.Address]struct{})
 	}
+	// All the trie nodes needed for the updates are resolved by now, gather
+	// them into the witness if one is recorded.
+	if s.witness != nil {
+		for _, tr := range s.witnessTries {
+			s.witness.AddState(tr.Witness())
+		}
+	}
 	// Track the amount of time wasted on hashing the account trie
 	if metrics.EnabledExpensive {
 		defer func(start time.Time) { s.AccountHashes += time.Since(start) }(time.Now())
@@ -880,6 +920,90 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	return s.trie.Hash()
 }
 
+// updateStorageRoots writes the pending storage changes of the given objects into
+// their storage tries and rehashes them, processing the tries concurrently.
+func (s *StateDB) updateStorageRoots(objs []*stateObject) {
+	// Insert the changes first and hash the tries afterwards, so the time spent
+	// on the two can be tracked separately.
+	start := time.Now()
+	forEachObject(objs, func(obj *stateObject) error {
+		obj.updateTrie(s.db)
+		return nil
+	})
+	if metrics.EnabledExpensive {
+		s.StorageUpdates += time.Since(start)
+		start = time.Now()
+	}
+	forEachObject(objs, func(obj *stateObject) error {
+		obj.updateRoot(s.db)
+		return nil
+	})
+	if metrics.EnabledExpensive {
+		s.StorageHashes += time.Since(start)
+	}
+}
+
+// commitStorageTries writes the storage tries of the given objects into the trie
+// database, committing the tries concurrently. It returns the number of nodes
+// committed in total.
+func (s *StateDB) commitStorageTries(objs []*stateObject) (int, error) {
+	if metrics.EnabledExpensive {
+		defer func(start time.Time) { s.StorageCommits += time.Since(start) }(time.Now())
+	}
+	var committed int64
+	err := forEachObject(objs, func(obj *stateObject) error {
+		n, err := obj.CommitTrie(s.db)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&committed, int64(n))
+		return nil
+	})
+	return int(committed), err
+}
+
+// forEachObject runs fn on every given state object on a pool of GOMAXPROCS
+// worker goroutines, returning the error of the first failed object in slice
+// order. The objects must be distinct, fn may only touch the fields of the state
+// shared by them under its lock.
+func forEachObject(objs []*stateObject, fn func(obj *stateObject) error) error {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(objs) {
+		workers = len(objs)
+	}
+	errs := make([]error, len(objs))
+	if workers <= 1 {
+		for i, obj := range objs {
+			errs[i] = fn(obj)
+		}
+	} else {
+		var (
+			next int64 = -1
+			wg   sync.WaitGroup
+		)
+		wg.Add(workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				defer wg.Done()
+				for {
+					j := atomic.AddInt64(&next, 1)
+					if j >= int64(len(objs)) {
+						return
+					}
+					errs[j] = fn(objs[j])
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Prepare sets the current transaction hash and index which are
 // used when the EVM emits new state logs.
 func (s *StateDB) Prepare(thash common.Hash, ti int) {
@@ -905,8 +1029,8 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	s.IntermediateRoot(deleteEmptyObjects)
 
 	// Commit objects to the trie, measuring the elapsed time
-	var storageCommitted int
 	codeWriter := s.db.TrieDB().DiskDB().NewBatch()
+	objs := make([]*stateObject, 0, len(s.stateObjectsDirty))
 	for addr := range s.stateObjectsDirty {
 		if obj := s.stateObjects[addr]; !obj.deleted {
 			// Write any contract code associated with the state object
@@ -914,14 +1038,14 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 				rawdb.WriteCode(codeWriter, common.BytesToHash(obj.CodeHash()), obj.code)
 				obj.dirtyCode = false
 			}
-			// Write any storage changes in the state object to its storage trie
-			committed, err := obj.CommitTrie(s.db)
-			if err != nil {
-				return common.Hash{}, err
-			}
-			storageCommitted += committed
+			objs = append(objs, obj)
 		}
 	}
+	// Write any storage changes in the state objects to their storage tries
+	storageCommitted, err := s.commitStorageTries(objs)
+	if err != nil {
+		return common.Hash{}, err
+	}
 	if len(s.stateObjectsDirty) > 0 {
 		s.stateObjectsDirty = make(map[common.Address]struct{})
 	}
@@ -24,6 +24,7 @@ import (
 	"math/big"
 	"math/rand"
 	"reflect"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
@@ -31,6 +32,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
 )
 
@@ -915,3 +917,75 @@ func TestStateDBAccessList(t *testing.T) {
 		t.Fatalf("expected empty, got %d", got)
 	}
 }
+
+// Tests that hashing and committing the storage tries concurrently produces the
+// same state as processing them one by one.
+func TestConcurrentStorageCommit(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+
+	type result struct {
+		intermediate common.Hash
+		root         common.Hash
+		diff         *snapshot.StateDiff
+		nodes        map[string][]byte
+	}
+	run := func(workers int) *result {
+		runtime.GOMAXPROCS(workers)
+
+		// Create a base state with many contracts and flush it with a snapshot
+		diskdb := rawdb.NewMemoryDatabase()
+		sdb := NewDatabase(diskdb)
+		state, _ := New(common.Hash{}, sdb, nil)
+		for i := 0; i < 64; i++ {
+			addr := common.BigToAddress(big.NewInt(int64(0x100 + i)))
+			state.SetBalance(addr, big.NewInt(int64(i+1)))
+			for j := 0; j < 32; j++ {
+				state.SetState(addr, common.BigToHash(big.NewInt(int64(j))), common.BigToHash(big.NewInt(int64(i*j+1))))
+			}
+		}
+		base, _ := state.Commit(false)
+		if err := sdb.TrieDB().Commit(base, false, nil); err != nil {
+			t.Fatalf("failed to flush base state: %v", err)
+		}
+		snaps, err := snapshot.New(diskdb, sdb.TrieDB(), 16, base, false, true, false)
+		if err != nil {
+			t.Fatalf("failed to create snapshot tree: %v", err)
+		}
+		// Update, delete and create storage slots across the contracts
+		state, _ = New(base, sdb, snaps)
+		for i := 0; i < 64; i++ {
+			addr := common.BigToAddress(big.NewInt(int64(0x100 + i)))
+			switch i % 4 {
+			case 0:
+				continue
+			case 1:
+				state.Suicide(addr)
+			default:
+				for j := i % 3; j < 48; j += 3 {
+					state.SetState(addr, common.BigToHash(big.NewInt(int64(j))), common.BigToHash(big.NewInt(int64(j%(i%4)))))
+				}
+			}
+		}
+		res := &result{intermediate: state.IntermediateRoot(true)}
+		if res.root, err = state.Commit(true); err != nil {
+			t.Fatalf("failed to commit state: %v", err)
+		}
+		if res.diff, err = snaps.StateDiff(res.root); err != nil {
+			t.Fatalf("failed to retrieve state diff: %v", err)
+		}
+		if err := sdb.TrieDB().Commit(res.root, false, nil); err != nil {
+			t.Fatalf("failed to flush state: %v", err)
+		}
+		res.nodes = make(map[string][]byte)
+		it := diskdb.NewIterator(nil, nil)
+		for it.Next() {
+			res.nodes[string(it.Key())] = common.CopyBytes(it.Value())
+		}
+		it.Release()
+		return res
+	}
+	want := run(1)
+	if have := run(8); !reflect.DeepEqual(have, want) {
+		t.Fatalf("concurrent commit mismatch: root %x, want %x", have.root, want.root)
+	}
+}
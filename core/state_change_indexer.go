@@ -0,0 +1,444 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const (
+	// StateChangeSectionSize is the number of blocks in a section of the state
+	// change index.
+	StateChangeSectionSize = 4096
+
+	// StateChangeConfirms is the number of confirmation blocks before a state
+	// change index section is considered probably final.
+	StateChangeConfirms = 256
+
+	// stateChangeThrottling is the time to wait between processing two consecutive
+	// index sections. It's useful during chain upgrades to prevent disk overload.
+	stateChangeThrottling = 100 * time.Millisecond
+)
+
+// StateChangeSet is the set of accounts and storage slots modified by a block,
+// identified by the hashes of the addresses and slot keys. Destructed accounts
+// are listed among the modified accounts, the storage slots they lose may not be
+// listed one by one.
+type StateChangeSet struct {
+	Accounts []common.Hash        // Accounts created, updated or deleted, sorted
+	Storage  []StateStorageChange // Modified storage of the accounts, sorted by account
+}
+
+// StateStorageChange is the set of modified storage slots of an account.
+type StateStorageChange struct {
+	Account common.Hash
+	Slots   []common.Hash // Storage slots created, updated or deleted, sorted
+}
+
+// newStateChangeSet creates the change set of a block from its snapshot diff.
+func newStateChangeSet(diff *snapshot.StateDiff) *StateChangeSet {
+	accounts := make(map[common.Hash]struct{}, len(diff.Accounts)+len(diff.Destructs))
+	for hash := range diff.Destructs {
+		accounts[hash] = struct{}{}
+	}
+	for hash := range diff.Accounts {
+		accounts[hash] = struct{}{}
+	}
+	set := new(StateChangeSet)
+	for hash := range accounts {
+		set.Accounts = append(set.Accounts, hash)
+	}
+	sortHashes(set.Accounts)
+
+	for account, slots := range diff.Storage {
+		if len(slots) == 0 {
+			continue
+		}
+		change := StateStorageChange{Account: account}
+		for slot := range slots {
+			change.Slots = append(change.Slots, slot)
+		}
+		sortHashes(change.Slots)
+		set.Storage = append(set.Storage, change)
+	}
+	sort.Slice(set.Storage, func(i, j int) bool {
+		return bytes.Compare(set.Storage[i].Account[:], set.Storage[j].Account[:]) < 0
+	})
+	return set
+}
+
+// diffStateChangeSet creates the change set of a block by diffing the tries of
+// its state and of its parent's, both of which need to be available.
+func diffStateChangeSet(triedb *trie.Database, parent common.Hash, root common.Hash) (*StateChangeSet, error) {
+	prevTrie, err := trie.New(parent, triedb)
+	if err != nil {
+		return nil, err
+	}
+	postTrie, err := trie.New(root, triedb)
+	if err != nil {
+		return nil, err
+	}
+	set := new(StateChangeSet)
+
+	// Collect the accounts created or updated, along with their storage changes
+	it, _ := trie.NewDifferenceIterator(prevTrie.NodeIterator(nil), postTrie.NodeIterator(nil))
+	iter := trie.NewIterator(it)
+	for iter.Next() {
+		hash := common.BytesToHash(iter.Key)
+		set.Accounts = append(set.Accounts, hash)
+
+		var post types.StateAccount
+		if err := rlp.DecodeBytes(iter.Value, &post); err != nil {
+			return nil, err
+		}
+		prevRoot := types.EmptyRootHash
+		blob, err := prevTrie.TryGet(iter.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(blob) > 0 {
+			var prev types.StateAccount
+			if err := rlp.DecodeBytes(blob, &prev); err != nil {
+				return nil, err
+			}
+			prevRoot = prev.Root
+		}
+		if prevRoot == post.Root {
+			continue
+		}
+		slots, err := diffStorageTries(triedb, parent, root, hash, prevRoot, post.Root)
+		if err != nil {
+			return nil, err
+		}
+		if len(slots) > 0 {
+			set.Storage = append(set.Storage, StateStorageChange{Account: hash, Slots: slots})
+		}
+	}
+	if iter.Err != nil {
+		return nil, iter.Err
+	}
+	// Collect the deleted accounts
+	it, _ = trie.NewDifferenceIterator(postTrie.NodeIterator(nil), prevTrie.NodeIterator(nil))
+	iter = trie.NewIterator(it)
+	for iter.Next() {
+		if blob, err := postTrie.TryGet(iter.Key); err != nil {
+			return nil, err
+		} else if len(blob) == 0 {
+			set.Accounts = append(set.Accounts, common.BytesToHash(iter.Key))
+		}
+	}
+	if iter.Err != nil {
+		return nil, iter.Err
+	}
+	sortHashes(set.Accounts)
+	return set, nil
+}
+
+// diffStorageTries returns the sorted hashes of the storage slots differing
+// between the two storage tries of an account in the parent and child states.
+func diffStorageTries(triedb *trie.Database, parent, root common.Hash, owner common.Hash, prevRoot, postRoot common.Hash) ([]common.Hash, error) {
+	prevTrie, err := trie.NewWithOwner(parent, owner, prevRoot, triedb)
+	if err != nil {
+		return nil, err
+	}
+	postTrie, err := trie.NewWithOwner(root, owner, postRoot, triedb)
+	if err != nil {
+		return nil, err
+	}
+	slots := make(map[common.Hash]struct{})
+	for _, pair := range [][2]*trie.Trie{{prevTrie, postTrie}, {postTrie, prevTrie}} {
+		it, _ := trie.NewDifferenceIterator(pair[0].NodeIterator(nil), pair[1].NodeIterator(nil))
+		iter := trie.NewIterator(it)
+		for iter.Next() {
+			slots[common.BytesToHash(iter.Key)] = struct{}{}
+		}
+		if iter.Err != nil {
+			return nil, iter.Err
+		}
+	}
+	list := make([]common.Hash, 0, len(slots))
+	for slot := range slots {
+		list = append(list, slot)
+	}
+	sortHashes(list)
+	return list, nil
+}
+
+// sortHashes sorts a list of hashes in ascending order.
+func sortHashes(hashes []common.Hash) {
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+}
+
+// containsHash reports whether the hash is in the sorted list.
+func containsHash(hashes []common.Hash, hash common.Hash) bool {
+	i := sort.Search(len(hashes), func(i int) bool {
+		return bytes.Compare(hashes[i][:], hash[:]) >= 0
+	})
+	return i < len(hashes) && hashes[i] == hash
+}
+
+// contains reports whether the change set modifies the account, or its storage
+// slot if one is given.
+func (set *StateChangeSet) contains(account common.Hash, slot *common.Hash) bool {
+	if slot == nil {
+		return containsHash(set.Accounts, account)
+	}
+	i := sort.Search(len(set.Storage), func(i int) bool {
+		return bytes.Compare(set.Storage[i].Account[:], account[:]) >= 0
+	})
+	return i < len(set.Storage) && set.Storage[i].Account == account && containsHash(set.Storage[i].Slots, *slot)
+}
+
+// readStateChangeSet retrieves and decodes the change set of a block.
+func readStateChangeSet(db ethdb.KeyValueReader, number uint64, hash common.Hash) (*StateChangeSet, error) {
+	blob := rawdb.ReadStateChangeSet(db, number, hash)
+	if len(blob) == 0 {
+		return nil, nil
+	}
+	set := new(StateChangeSet)
+	if err := rlp.DecodeBytes(blob, set); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+// loadStateChangeSet retrieves the change set of a block. If it was never
+// recorded, it's generated by diffing the states of the block and its parent,
+// if both are still available. Nil is returned if neither succeeds.
+func loadStateChangeSet(db ethdb.Reader, triedb *trie.Database, header *types.Header, parent *types.Header) (*StateChangeSet, error) {
+	number := header.Number.Uint64()
+	set, err := readStateChangeSet(db, number, header.Hash())
+	if set != nil || err != nil {
+		return set, err
+	}
+	// The genesis block has no parent to modify
+	if number == 0 {
+		return new(StateChangeSet), nil
+	}
+	if parent == nil || parent.Hash() != header.ParentHash {
+		parent = rawdb.ReadHeader(db, header.ParentHash, number-1)
+	}
+	if parent == nil {
+		return nil, nil
+	}
+	if set, err = diffStateChangeSet(triedb, parent.Root, header.Root); err != nil {
+		log.Debug("Failed to diff block states", "number", number, "hash", header.Hash(), "err", err)
+		return nil, nil
+	}
+	return set, nil
+}
+
+// StateChangeIndexer implements a core.ChainIndexer, building up an index of the
+// blocks modifying each account and storage slot from the change sets recorded
+// during block processing.
+type StateChangeIndexer struct {
+	db        ethdb.Database
+	triedb    *trie.Database // Trie database to diff the states of the blocks lacking a change set
+	size      uint64         // Section size to generate the index for
+	retention uint64         // Number of recent blocks to retain the index for, 0 retains all
+
+	section  uint64                                   // Section number being processed currently
+	parent   *types.Header                            // Last header processed
+	accounts map[common.Hash][]uint64                 // Blocks modifying the accounts in the section
+	storage  map[common.Hash]map[common.Hash][]uint64 // Blocks modifying the storage slots in the section
+	missing  []uint64                                 // Blocks without a change set in the section
+}
+
+// NewStateChangeIndexer returns a chain indexer that generates the index of the
+// blocks modifying each account and storage slot for the canonical chain. The
+// index and the change sets are pruned below the given number of recent blocks,
+// unless the retention is zero.
+func NewStateChangeIndexer(db ethdb.Database, triedb *trie.Database, size, confirms, retention uint64) *ChainIndexer {
+	backend := &StateChangeIndexer{
+		db:        db,
+		triedb:    triedb,
+		size:      size,
+		retention: retention,
+	}
+	table := rawdb.NewTable(db, string(rawdb.StateChangeIndexPrefix))
+
+	return NewChainIndexer(db, table, backend, size, confirms, stateChangeThrottling, "statechanges")
+}
+
+// Reset implements core.ChainIndexerBackend, starting a new state change index
+// section. Any previous index of the section is dropped, so the accounts only
+// modified by a reorged chain don't linger.
+func (c *StateChangeIndexer) Reset(ctx context.Context, section uint64, lastSectionHead common.Hash) error {
+	rawdb.DeleteStateChangeIndex(c.db, section, section+1)
+
+	c.section, c.parent, c.missing = section, nil, nil
+	c.accounts = make(map[common.Hash][]uint64)
+	c.storage = make(map[common.Hash]map[common.Hash][]uint64)
+	return nil
+}
+
+// Process implements core.ChainIndexerBackend, adding the changes of a new block
+// into the index.
+func (c *StateChangeIndexer) Process(ctx context.Context, header *types.Header) error {
+	number := header.Number.Uint64()
+	set, err := loadStateChangeSet(c.db, c.triedb, header, c.parent)
+	if err != nil {
+		return err
+	}
+	c.parent = header
+	if set == nil {
+		c.missing = append(c.missing, number)
+		return nil
+	}
+	for _, account := range set.Accounts {
+		c.accounts[account] = append(c.accounts[account], number)
+	}
+	for _, change := range set.Storage {
+		slots := c.storage[change.Account]
+		if slots == nil {
+			slots = make(map[common.Hash][]uint64)
+			c.storage[change.Account] = slots
+		}
+		for _, slot := range change.Slots {
+			slots[slot] = append(slots[slot], number)
+		}
+	}
+	return nil
+}
+
+// Commit implements core.ChainIndexerBackend, finalizing the state change index
+// section and writing it out into the database.
+func (c *StateChangeIndexer) Commit() error {
+	batch := c.db.NewBatch()
+	if len(c.missing) > 0 {
+		log.Warn("State changes unavailable for some blocks", "section", c.section, "missing", len(c.missing))
+		rawdb.WriteStateChangeIndexGaps(batch, c.section, c.missing)
+	}
+	for account, numbers := range c.accounts {
+		rawdb.WriteStateChangeIndex(batch, c.section, account, nil, numbers)
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	for account, slots := range c.storage {
+		for slot, numbers := range slots {
+			slot := slot
+			rawdb.WriteStateChangeIndex(batch, c.section, account, &slot, numbers)
+			if batch.ValueSize() > ethdb.IdealBatchSize {
+				if err := batch.Write(); err != nil {
+					return err
+				}
+				batch.Reset()
+			}
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	// Prune the sections which fell out of the retention window
+	if head := (c.section + 1) * c.size; c.retention > 0 && head > c.retention {
+		return c.Prune((head - c.retention) / c.size)
+	}
+	return nil
+}
+
+// Prune implements core.ChainIndexerBackend, deleting the index sections and
+// the change sets of the blocks below the given section.
+func (c *StateChangeIndexer) Prune(threshold uint64) error {
+	tail := rawdb.ReadStateChangeIndexTail(c.db)
+	if threshold <= tail {
+		return nil
+	}
+	start := time.Now()
+	rawdb.DeleteStateChangeIndex(c.db, tail, threshold)
+	rawdb.DeleteStateChangeSets(c.db, tail*c.size, threshold*c.size)
+	rawdb.WriteStateChangeIndexTail(c.db, threshold)
+	log.Debug("Pruned state change index", "from", tail, "to", threshold, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// ReadStateChanges returns the numbers of the canonical blocks within [from, to]
+// which modified the given account, or its storage slot if one is given. The
+// indexed sections are served from the index, the blocks after them from the
+// change sets, or the state tries if the change sets are missing. An error is
+// returned if the changes of any block in the range are unknown.
+func ReadStateChanges(db ethdb.Database, triedb *trie.Database, indexer *ChainIndexer, account common.Hash, slot *common.Hash, from, to uint64) ([]uint64, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid block range %d-%d", from, to)
+	}
+	var (
+		size    = indexer.sectionSize
+		tail    = rawdb.ReadStateChangeIndexTail(db)
+		numbers []uint64
+	)
+	sections, _, _ := indexer.Sections()
+	if from < tail*size {
+		return nil, fmt.Errorf("state changes before block %d are pruned", tail*size)
+	}
+	for section := from / size; section < sections && section <= to/size; section++ {
+		for _, number := range rawdb.ReadStateChangeIndexGaps(db, section) {
+			if number >= from && number <= to {
+				return nil, fmt.Errorf("state changes of block %d unavailable", number)
+			}
+		}
+		for _, number := range rawdb.ReadStateChangeIndex(db, section, account, slot) {
+			if number >= from && number <= to {
+				numbers = append(numbers, number)
+			}
+		}
+	}
+	start := from
+	if indexed := sections * size; start < indexed {
+		start = indexed
+	}
+	var parent *types.Header
+	for number := start; number <= to; number++ {
+		hash := rawdb.ReadCanonicalHash(db, number)
+		if hash == (common.Hash{}) {
+			break
+		}
+		header := rawdb.ReadHeader(db, hash, number)
+		if header == nil {
+			break
+		}
+		set, err := loadStateChangeSet(db, triedb, header, parent)
+		if err != nil {
+			return nil, err
+		}
+		if set == nil {
+			return nil, fmt.Errorf("state changes of block %d unavailable", number)
+		}
+		if set.contains(account, slot) {
+			numbers = append(numbers, number)
+		}
+		parent = header
+	}
+	return numbers, nil
+}
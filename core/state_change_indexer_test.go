@@ -0,0 +1,232 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// newStateChangeTestChain creates a chain recording the state changes, where
+// block n writes slot n%3 of a contract and sends ether to 0x1000+(n-1)%4.
+func newStateChangeTestChain(t *testing.T, blocks int) (*BlockChain, common.Address) {
+	var (
+		key, _   = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address  = crypto.PubkeyToAddress(key.PublicKey)
+		contract = common.HexToAddress("0xc0de")
+		signer   = types.LatestSigner(params.TestChainConfig)
+		engine   = ethash.NewFaker()
+		gspec    = &Genesis{
+			Config: params.TestChainConfig,
+			Alloc: GenesisAlloc{
+				address: {Balance: big.NewInt(params.Ether)},
+				// sstore(number % 3, number)
+				contract: {Code: []byte{byte(vm.NUMBER), byte(vm.PUSH1), 3, byte(vm.NUMBER), byte(vm.MOD), byte(vm.SSTORE)}, Balance: common.Big0},
+			},
+		}
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	chain, _ := GenerateChain(params.TestChainConfig, genesis, engine, gendb, blocks, func(i int, b *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(b.TxNonce(address), contract, common.Big0, 100000, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+
+		tx, err = types.SignTx(types.NewTransaction(b.TxNonce(address), common.BigToAddress(big.NewInt(int64(0x1000+i%4))), big.NewInt(int64(i+1)), params.TxGas, b.header.BaseFee, nil), signer, key)
+		if err != nil {
+			t.Fatalf("failed to sign tx: %v", err)
+		}
+		b.AddTx(tx)
+	})
+	db := rawdb.NewMemoryDatabase()
+	gspec.MustCommit(db)
+
+	cacheConfig := &CacheConfig{
+		TrieCleanLimit: 256,
+		TrieDirtyLimit: 256,
+		TrieTimeLimit:  5 * time.Minute,
+		SnapshotLimit:  256,
+		SnapshotWait:   true,
+		StateChanges:   true,
+	}
+	bc, err := NewBlockChain(db, cacheConfig, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if _, err := bc.InsertChain(chain); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	return bc, contract
+}
+
+// waitStateChangeSections waits until the indexer processes the given number of
+// sections.
+func waitStateChangeSections(t *testing.T, indexer *ChainIndexer, sections uint64) {
+	for i := 0; i < 100; i++ {
+		if have, _, _ := indexer.Sections(); have >= sections {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("state change index not generated")
+}
+
+// Tests that the blocks modifying accounts and storage slots are served from
+// both the indexed sections and the recent change sets.
+func TestStateChangeIndex(t *testing.T) {
+	chain, contract := newStateChangeTestChain(t, 40)
+	defer chain.Stop()
+
+	indexer := NewStateChangeIndexer(chain.db, chain.stateCache.TrieDB(), 16, 0, 0)
+	defer indexer.Close()
+	indexer.Start(chain)
+	waitStateChangeSections(t, indexer, 2)
+
+	// Check the modifications of the recipients and of the contract slots
+	for i := 0; i < 4; i++ {
+		var want []uint64
+		for n := uint64(1); n <= 40; n++ {
+			if (n-1)%4 == uint64(i) {
+				want = append(want, n)
+			}
+		}
+		account := crypto.Keccak256Hash(common.BigToAddress(big.NewInt(int64(0x1000 + i))).Bytes())
+		have, err := ReadStateChanges(chain.db, chain.stateCache.TrieDB(), indexer, account, nil, 0, 40)
+		if err != nil {
+			t.Fatalf("recipient %d: failed to read changes: %v", i, err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("recipient %d: changes mismatch: have %v, want %v", i, have, want)
+		}
+	}
+	account := crypto.Keccak256Hash(contract.Bytes())
+	for i := 0; i < 3; i++ {
+		var want []uint64
+		for n := uint64(10); n <= 35; n++ {
+			if n%3 == uint64(i) {
+				want = append(want, n)
+			}
+		}
+		slot := crypto.Keccak256Hash(common.BigToHash(big.NewInt(int64(i))).Bytes())
+		have, err := ReadStateChanges(chain.db, chain.stateCache.TrieDB(), indexer, account, &slot, 10, 35)
+		if err != nil {
+			t.Fatalf("slot %d: failed to read changes: %v", i, err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("slot %d: changes mismatch: have %v, want %v", i, have, want)
+		}
+	}
+	// The change sets must match the tries of the states still in memory
+	for n := uint64(30); n <= 40; n++ {
+		header := chain.GetHeaderByNumber(n)
+		parent := chain.GetHeaderByNumber(n - 1)
+
+		want, err := readStateChangeSet(chain.db, n, header.Hash())
+		if err != nil || want == nil {
+			t.Fatalf("block %d: change set missing: %v", n, err)
+		}
+		have, err := diffStateChangeSet(chain.stateCache.TrieDB(), parent.Root, header.Root)
+		if err != nil {
+			t.Fatalf("block %d: failed to diff states: %v", n, err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Fatalf("block %d: change set mismatch: have %v, want %v", n, have, want)
+		}
+	}
+}
+
+// Tests that the state change index is pruned below the retention window.
+func TestStateChangeIndexPruning(t *testing.T) {
+	chain, contract := newStateChangeTestChain(t, 40)
+	defer chain.Stop()
+
+	indexer := NewStateChangeIndexer(chain.db, chain.stateCache.TrieDB(), 16, 0, 10)
+	defer indexer.Close()
+	indexer.Start(chain)
+	waitStateChangeSections(t, indexer, 2)
+
+	account := crypto.Keccak256Hash(contract.Bytes())
+	if _, err := ReadStateChanges(chain.db, chain.stateCache.TrieDB(), indexer, account, nil, 0, 40); err == nil {
+		t.Fatalf("pruned changes served")
+	}
+	have, err := ReadStateChanges(chain.db, chain.stateCache.TrieDB(), indexer, account, nil, 16, 20)
+	if err != nil {
+		t.Fatalf("failed to read changes: %v", err)
+	}
+	if want := []uint64{16, 17, 18, 19, 20}; !reflect.DeepEqual(have, want) {
+		t.Fatalf("changes mismatch: have %v, want %v", have, want)
+	}
+	if blob := rawdb.ReadStateChangeSet(chain.db, 15, chain.GetHeaderByNumber(15).Hash()); blob != nil {
+		t.Fatalf("pruned change set retained")
+	}
+}
+
+// Tests that the blocks whose changes are unknown are not silently left out of
+// the results, and that stale entries of a reindexed section are dropped.
+func TestStateChangeIndexGaps(t *testing.T) {
+	chain, contract := newStateChangeTestChain(t, 40)
+	defer chain.Stop()
+
+	// Drop the change sets of a block in the first section and of a block after
+	// the indexed sections, without any state to diff them from
+	rawdb.DeleteStateChangeSets(chain.db, 5, 6)
+	rawdb.DeleteStateChangeSets(chain.db, 36, 37)
+	triedb := trie.NewDatabase(rawdb.NewMemoryDatabase())
+
+	// Index an account modified only by some previously indexed fork
+	stale := common.HexToHash("0xdead")
+	rawdb.WriteStateChangeIndex(chain.db, 1, stale, nil, []uint64{20})
+
+	indexer := NewStateChangeIndexer(chain.db, triedb, 16, 0, 0)
+	defer indexer.Close()
+	indexer.Start(chain)
+	waitStateChangeSections(t, indexer, 2)
+
+	account := crypto.Keccak256Hash(contract.Bytes())
+	for _, span := range [][2]uint64{{0, 10}, {5, 5}, {30, 40}, {36, 36}} {
+		if have, err := ReadStateChanges(chain.db, triedb, indexer, account, nil, span[0], span[1]); err == nil {
+			t.Errorf("range %d-%d: incomplete changes served: %v", span[0], span[1], have)
+		}
+	}
+	have, err := ReadStateChanges(chain.db, triedb, indexer, account, nil, 6, 35)
+	if err != nil {
+		t.Fatalf("failed to read changes: %v", err)
+	}
+	var want []uint64
+	for n := uint64(6); n <= 35; n++ {
+		want = append(want, n)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("changes mismatch: have %v, want %v", have, want)
+	}
+	if have, err := ReadStateChanges(chain.db, triedb, indexer, stale, nil, 16, 31); err != nil || len(have) != 0 {
+		t.Fatalf("stale changes served: %v, err %v", have, err)
+	}
+}
@@ -284,6 +284,12 @@ func (st *StateTransition) TransitionDb() (*ExecutionResult, error) {
 	if err := st.preCheck(); err != nil {
 		return nil, err
 	}
+	// Tell tracers interested in it the gas limit of the transaction
+	if st.evm.Config.Debug {
+		if tracer, ok := st.evm.Config.Tracer.(interface{ CaptureTxStart(uint64) }); ok {
+			tracer.CaptureTxStart(st.initialGas)
+		}
+	}
 	msg := st.msg
 	sender := vm.AccountRef(msg.From())
 	homestead := st.evm.ChainConfig().IsHomestead(st.evm.Context.BlockNumber)
@@ -0,0 +1,118 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/stateless"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// NewStatelessStateProcessor creates a state processor executing blocks on top
+// of a witness, with the ancestor headers embedded in it standing in for the
+// chain.
+func NewStatelessStateProcessor(config *params.ChainConfig, engine consensus.Engine, witness *stateless.Witness) *StateProcessor {
+	return &StateProcessor{
+		config: config,
+		chain:  newWitnessChain(config, engine, witness),
+		engine: engine,
+	}
+}
+
+// ExecuteStateless executes the block on top of the state embedded in the given
+// witness and returns the resulting state and receipt roots. The witness has to
+// contain the parent header of the block.
+//
+// The roots are not checked against the ones in the block header, that's up to
+// the caller. An error is returned if the execution needed any state missing
+// from the witness.
+func ExecuteStateless(config *params.ChainConfig, engine consensus.Engine, block *types.Block, witness *stateless.Witness) (common.Hash, common.Hash, error) {
+	if len(witness.Headers) == 0 || witness.Headers[0].Hash() != block.ParentHash() {
+		return common.Hash{}, common.Hash{}, errors.New("witness doesn't contain the parent header")
+	}
+	statedb, err := state.New(witness.Root(), state.NewDatabase(witness.MakeHashDB()), nil)
+	if err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("incomplete witness: %w", err)
+	}
+	receipts, _, _, err := NewStatelessStateProcessor(config, engine, witness).Process(block, statedb, vm.Config{})
+	if err != nil {
+		return common.Hash{}, common.Hash{}, err
+	}
+	root := statedb.IntermediateRoot(config.IsEIP158(block.Number()))
+	if err := statedb.Error(); err != nil {
+		return common.Hash{}, common.Hash{}, fmt.Errorf("incomplete witness: %w", err)
+	}
+	return root, types.DeriveSha(receipts, trie.NewStackTrie(nil)), nil
+}
+
+// witnessChain is a chain reader serving the ancestor headers embedded in a
+// witness.
+type witnessChain struct {
+	config  *params.ChainConfig
+	engine  consensus.Engine
+	headers []*types.Header
+	hashes  map[common.Hash]*types.Header
+}
+
+func newWitnessChain(config *params.ChainConfig, engine consensus.Engine, witness *stateless.Witness) *witnessChain {
+	chain := &witnessChain{
+		config:  config,
+		engine:  engine,
+		headers: witness.Headers,
+		hashes:  make(map[common.Hash]*types.Header, len(witness.Headers)),
+	}
+	for _, header := range witness.Headers {
+		chain.hashes[header.Hash()] = header
+	}
+	return chain
+}
+
+func (c *witnessChain) Config() *params.ChainConfig { return c.config }
+func (c *witnessChain) Engine() consensus.Engine    { return c.engine }
+
+// CurrentHeader returns the parent of the block being executed.
+func (c *witnessChain) CurrentHeader() *types.Header {
+	return c.headers[0]
+}
+
+func (c *witnessChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := c.hashes[hash]; header != nil && header.Number.Uint64() == number {
+		return header
+	}
+	return nil
+}
+
+func (c *witnessChain) GetHeaderByNumber(number uint64) *types.Header {
+	for _, header := range c.headers {
+		if header.Number.Uint64() == number {
+			return header
+		}
+	}
+	return nil
+}
+
+func (c *witnessChain) GetHeaderByHash(hash common.Hash) *types.Header {
+	return c.hashes[hash]
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package stateless
+
+import (
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// extWitness is the RLP encoding of a witness, with the sets flattened into
+// sorted lists for a deterministic encoding.
+type extWitness struct {
+	Headers []*types.Header
+	Codes   [][]byte
+	State   [][]byte
+}
+
+// EncodeRLP implements rlp.Encoder.
+func (w *Witness) EncodeRLP(out io.Writer) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	ext := &extWitness{
+		Headers: w.Headers,
+		Codes:   sortedBlobs(w.Codes),
+		State:   sortedBlobs(w.State),
+	}
+	return rlp.Encode(out, ext)
+}
+
+// DecodeRLP implements rlp.Decoder.
+func (w *Witness) DecodeRLP(s *rlp.Stream) error {
+	var ext extWitness
+	if err := s.Decode(&ext); err != nil {
+		return err
+	}
+	if len(ext.Headers) == 0 {
+		return errors.New("witness without parent header")
+	}
+	w.Headers = ext.Headers
+	w.Codes = make(map[string]struct{}, len(ext.Codes))
+	for _, code := range ext.Codes {
+		w.Codes[string(code)] = struct{}{}
+	}
+	w.State = make(map[string]struct{}, len(ext.State))
+	for _, node := range ext.State {
+		w.State[string(node)] = struct{}{}
+	}
+	return nil
+}
+
+// sortedBlobs flattens a set of blobs into a sorted list.
+func sortedBlobs(set map[string]struct{}) [][]byte {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	blobs := make([][]byte, len(keys))
+	for i, key := range keys {
+		blobs[i] = []byte(key)
+	}
+	return blobs
+}
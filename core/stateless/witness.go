@@ -0,0 +1,133 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package stateless implements the execution witnesses, containing all the state
+// needed to execute a block without access to a database.
+package stateless
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// HeaderReader is the chain access needed to embed the headers of the ancestor
+// blocks accessed by the BLOCKHASH opcode into the witness.
+type HeaderReader interface {
+	// GetHeader retrieves a block header from the database by hash and number.
+	GetHeader(hash common.Hash, number uint64) *types.Header
+}
+
+// Witness encompasses the state required to execute a block and to derive its
+// post state and receipt roots.
+type Witness struct {
+	context *types.Header // Header of the block the witness belongs to
+
+	Headers []*types.Header     // Ancestor headers in reverse order, the parent is always present
+	Codes   map[string]struct{} // Set of contract codes loaded during execution
+	State   map[string]struct{} // Set of account and storage trie nodes resolved during execution
+
+	chain HeaderReader // Chain reader to pull in the ancestors accessed by BLOCKHASH
+	lock  sync.Mutex   // Lock protecting the sets from concurrent insertions
+}
+
+// NewWitness creates an empty witness for executing the block with the given
+// header, with only its parent header embedded.
+func NewWitness(context *types.Header, chain HeaderReader) (*Witness, error) {
+	if context.Number.Sign() == 0 {
+		return nil, errors.New("genesis block has no witness")
+	}
+	parent := chain.GetHeader(context.ParentHash, context.Number.Uint64()-1)
+	if parent == nil {
+		return nil, errors.New("failed to retrieve parent header")
+	}
+	return &Witness{
+		context: context,
+		Headers: []*types.Header{parent},
+		Codes:   make(map[string]struct{}),
+		State:   make(map[string]struct{}),
+		chain:   chain,
+	}, nil
+}
+
+// AddBlockHash embeds all the ancestor headers down to the one with the given
+// number, so that its hash can be proven by the chain of parent hashes.
+func (w *Witness) AddBlockHash(number uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for number < w.context.Number.Uint64() && w.context.Number.Uint64()-number > uint64(len(w.Headers)) {
+		tail := w.Headers[len(w.Headers)-1]
+		if tail.Number.Sign() == 0 {
+			return
+		}
+		header := w.chain.GetHeader(tail.ParentHash, tail.Number.Uint64()-1)
+		if header == nil {
+			return
+		}
+		w.Headers = append(w.Headers, header)
+	}
+}
+
+// AddCode adds a contract code to the witness.
+func (w *Witness) AddCode(code []byte) {
+	if len(code) == 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.Codes[string(code)] = struct{}{}
+}
+
+// AddState adds a set of encoded trie nodes to the witness.
+func (w *Witness) AddState(nodes map[string]struct{}) {
+	if len(nodes) == 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for node := range nodes {
+		w.State[node] = struct{}{}
+	}
+}
+
+// Root returns the pre-state root the witness belongs to, the state root of the
+// parent block.
+func (w *Witness) Root() common.Hash {
+	return w.Headers[0].Root
+}
+
+// MakeHashDB imports the codes and the trie nodes of the witness into a new
+// in-memory database, keyed by their hashes.
+func (w *Witness) MakeHashDB() ethdb.Database {
+	db := rawdb.NewMemoryDatabase()
+	for code := range w.Codes {
+		blob := []byte(code)
+		rawdb.WriteCode(db, crypto.Keccak256Hash(blob), blob)
+	}
+	for node := range w.State {
+		blob := []byte(node)
+		rawdb.WriteTrieNode(db, crypto.Keccak256Hash(blob), blob)
+	}
+	return db
+}
@@ -23,72 +23,171 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/holiman/uint256"
 )
 
+// jsonStep is a single execution step in the EIP-3155 standard trace format. The
+// optional fields are omitted altogether if disabled, so traces can be compared
+// line by line with the ones of other clients.
+type jsonStep struct {
+	Pc         uint64              `json:"pc"`
+	Op         OpCode              `json:"op"`
+	Gas        math.HexOrDecimal64 `json:"gas"`
+	GasCost    math.HexOrDecimal64 `json:"gasCost"`
+	Memory     *hexutil.Bytes      `json:"memory,omitempty"`
+	MemorySize int                 `json:"memSize"`
+	Stack      *[]uint256.Int      `json:"stack,omitempty"`
+	ReturnData *hexutil.Bytes      `json:"returnData,omitempty"`
+	Storage    Storage             `json:"storage,omitempty"`
+	Depth      int                 `json:"depth"`
+	Refund     math.HexOrDecimal64 `json:"refund"`
+	OpName     string              `json:"opName"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// jsonSummary is the closing line of an EIP-3155 standard trace, reporting the
+// outcome of the execution.
+type jsonSummary struct {
+	StateRoot common.Hash         `json:"stateRoot"`
+	Output    hexutil.Bytes       `json:"output"`
+	GasUsed   math.HexOrDecimal64 `json:"gasUsed"`
+	Pass      bool                `json:"pass"`
+	Time      time.Duration       `json:"time"`
+	Fork      string              `json:"fork,omitempty"`
+	Error     string              `json:"error,omitempty"`
+}
+
+// JSONLogger is an EVM tracer writing the executed steps into a stream in the
+// EIP-3155 standard trace format, one JSON object per line. The trace is closed
+// by a summary line, which needs to be written by the caller via WriteSummary,
+// as only it knows the resulting state.
+//
+// Memory, stack, storage and return data are reported as requested by the
+// config. Same as with the StructLogger, the storage slots of the executing
+// contract accessed so far are reported on every SLOAD and SSTORE step.
 type JSONLogger struct {
 	encoder *json.Encoder
 	cfg     *LogConfig
+	storage map[common.Address]Storage // Storage slots accessed in the current execution
+
+	output  []byte        // Output of the last finished execution
+	gasUsed uint64        // Gas used by the last finished execution
+	elapsed time.Duration // Duration of the last finished execution
+	err     error         // Error of the last finished execution
 }
 
 // NewJSONLogger creates a new EVM tracer that prints execution steps as JSON objects
 // into the provided stream.
 func NewJSONLogger(cfg *LogConfig, writer io.Writer) *JSONLogger {
-	l := &JSONLogger{json.NewEncoder(writer), cfg}
+	l := &JSONLogger{encoder: json.NewEncoder(writer), cfg: cfg}
 	if l.cfg == nil {
 		l.cfg = &LogConfig{}
 	}
+	// Error messages are written verbatim, as other clients do
+	l.encoder.SetEscapeHTML(false)
 	return l
 }
 
+// CaptureStart implements the Tracer interface, resetting the storage slots
+// accessed by the previous execution.
 func (l *JSONLogger) CaptureStart(env *EVM, from, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	l.storage = make(map[common.Address]Storage)
 }
 
 func (l *JSONLogger) CaptureFault(*EVM, uint64, OpCode, uint64, uint64, *ScopeContext, int, error) {}
 
 // CaptureState outputs state information on the logger.
 func (l *JSONLogger) CaptureState(env *EVM, pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
-	memory := scope.Memory
-	stack := scope.Stack
-
-	log := StructLog{
-		Pc:            pc,
-		Op:            op,
-		Gas:           gas,
-		GasCost:       cost,
-		MemorySize:    memory.Len(),
-		Depth:         depth,
-		RefundCounter: env.StateDB.GetRefund(),
-		Err:           err,
+	step := jsonStep{
+		Pc:         pc,
+		Op:         op,
+		Gas:        math.HexOrDecimal64(gas),
+		GasCost:    math.HexOrDecimal64(cost),
+		MemorySize: scope.Memory.Len(),
+		Depth:      depth,
+		Refund:     math.HexOrDecimal64(env.StateDB.GetRefund()),
+		OpName:     op.String(),
 	}
 	if l.cfg.EnableMemory {
-		log.Memory = memory.Data()
+		memory := hexutil.Bytes(scope.Memory.Data())
+		step.Memory = &memory
 	}
 	if !l.cfg.DisableStack {
-		log.Stack = stack.data
+		stack := scope.Stack.data
+		if stack == nil {
+			stack = []uint256.Int{}
+		}
+		step.Stack = &stack
 	}
 	if l.cfg.EnableReturnData {
-		log.ReturnData = rData
+		returnData := hexutil.Bytes(rData)
+		step.ReturnData = &returnData
+	}
+	if !l.cfg.DisableStorage && (op == SLOAD || op == SSTORE) {
+		step.Storage = l.captureStorage(env, op, scope)
 	}
-	l.encoder.Encode(log)
+	if err != nil {
+		step.Error = err.Error()
+	}
+	l.encoder.Encode(step)
 }
 
-// CaptureEnd is triggered at end of execution.
-func (l *JSONLogger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) {
-	type endLog struct {
-		Output  string              `json:"output"`
-		GasUsed math.HexOrDecimal64 `json:"gasUsed"`
-		Time    time.Duration       `json:"time"`
-		Err     string              `json:"error,omitempty"`
+// captureStorage records the storage slot accessed by an SLOAD or SSTORE step,
+// returning a copy of all the slots of the contract accessed so far.
+func (l *JSONLogger) captureStorage(env *EVM, op OpCode, scope *ScopeContext) Storage {
+	if l.storage == nil {
+		l.storage = make(map[common.Address]Storage)
 	}
-	var errMsg string
-	if err != nil {
-		errMsg = err.Error()
+	var (
+		stack   = scope.Stack
+		address = scope.Contract.Address()
+	)
+	if l.storage[address] == nil {
+		l.storage[address] = make(Storage)
+	}
+	switch {
+	case op == SLOAD && stack.len() >= 1:
+		slot := common.Hash(stack.data[stack.len()-1].Bytes32())
+		l.storage[address][slot] = env.StateDB.GetState(address, slot)
+	case op == SSTORE && stack.len() >= 2:
+		slot := common.Hash(stack.data[stack.len()-1].Bytes32())
+		l.storage[address][slot] = common.Hash(stack.data[stack.len()-2].Bytes32())
 	}
-	l.encoder.Encode(endLog{common.Bytes2Hex(output), math.HexOrDecimal64(gasUsed), t, errMsg})
+	return l.storage[address].Copy()
+}
+
+// CaptureEnd is triggered at end of execution, recording its outcome to report
+// in the summary.
+func (l *JSONLogger) CaptureEnd(output []byte, gasUsed uint64, t time.Duration, err error) {
+	l.output = common.CopyBytes(output)
+	l.gasUsed = gasUsed
+	l.elapsed = t
+	l.err = err
 }
 
 func (l *JSONLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
 }
 
 func (l *JSONLogger) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+// WriteSummary closes the trace of the last execution with the summary line of
+// the standard trace format, which contains the resulting state root and whether
+// the execution passed. The fork name is optional. The recorded outcome is reset
+// afterwards, so the logger can be reused to trace the next execution.
+func (l *JSONLogger) WriteSummary(root common.Hash, pass bool, fork string) error {
+	summary := jsonSummary{
+		StateRoot: root,
+		Output:    l.output,
+		GasUsed:   math.HexOrDecimal64(l.gasUsed),
+		Pass:      pass,
+		Time:      l.elapsed,
+		Fork:      fork,
+	}
+	if l.err != nil {
+		summary.Error = l.err.Error()
+	}
+	l.output, l.gasUsed, l.elapsed, l.err = nil, 0, 0, nil
+	return l.encoder.Encode(summary)
+}
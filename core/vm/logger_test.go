@@ -17,8 +17,10 @@
 package vm
 
 import (
+	"bytes"
 	"math/big"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/state"
@@ -72,3 +74,102 @@ func TestStoreCapture(t *testing.T) {
 		t.Errorf("expected %x, got %x", exp, logger.storage[contract.Address()][index])
 	}
 }
+
+func TestJSONLogger(t *testing.T) {
+	var (
+		env      = NewEVM(BlockContext{}, TxContext{}, &dummyStatedb{}, params.TestChainConfig, Config{})
+		contract = NewContract(&dummyContractRef{}, &dummyContractRef{}, new(big.Int), 0)
+		scope    = &ScopeContext{
+			Memory:   NewMemory(),
+			Stack:    newstack(),
+			Contract: contract,
+		}
+	)
+	scope.Memory.Resize(32)
+	scope.Memory.Set(31, 1, []byte{0xff})
+	scope.Stack.push(uint256.NewInt(0x20))
+
+	tests := []struct {
+		config *LogConfig
+		want   string
+	}{
+		{
+			config: nil,
+			want: `{"pc":3,"op":96,"gas":"0x2710","gasCost":"0x3","memSize":32,"stack":["0x20"],"depth":1,"refund":"0x539","opName":"PUSH1"}
+{"pc":5,"op":1,"gas":"0x270d","gasCost":"0x3","memSize":32,"stack":["0x20"],"depth":1,"refund":"0x539","opName":"ADD","error":"stack underflow (1 <=> 2)"}
+{"stateRoot":"0x0000000000000000000000000000000000000000000000000000000000000001","output":"0xc0de","gasUsed":"0x6","pass":false,"time":1000,"fork":"London","error":"execution reverted"}
+`,
+		},
+		{
+			config: &LogConfig{EnableMemory: true, DisableStack: true, DisableStorage: true, EnableReturnData: true},
+			want: `{"pc":3,"op":96,"gas":"0x2710","gasCost":"0x3","memory":"0x00000000000000000000000000000000000000000000000000000000000000ff","memSize":32,"returnData":"0xbeef","depth":1,"refund":"0x539","opName":"PUSH1"}
+{"pc":5,"op":1,"gas":"0x270d","gasCost":"0x3","memory":"0x00000000000000000000000000000000000000000000000000000000000000ff","memSize":32,"returnData":"0xbeef","depth":1,"refund":"0x539","opName":"ADD","error":"stack underflow (1 <=> 2)"}
+{"stateRoot":"0x0000000000000000000000000000000000000000000000000000000000000001","output":"0xc0de","gasUsed":"0x6","pass":false,"time":1000,"fork":"London","error":"execution reverted"}
+`,
+		},
+	}
+	for i, tt := range tests {
+		buf := new(bytes.Buffer)
+		logger := NewJSONLogger(tt.config, buf)
+
+		logger.CaptureState(env, 3, PUSH1, 10000, 3, scope, []byte{0xbe, 0xef}, 1, nil)
+		logger.CaptureState(env, 5, ADD, 9997, 3, scope, []byte{0xbe, 0xef}, 1, &ErrStackUnderflow{stackLen: 1, required: 2})
+		logger.CaptureEnd([]byte{0xc0, 0xde}, 6, time.Microsecond, ErrExecutionReverted)
+		if err := logger.WriteSummary(common.BigToHash(big.NewInt(1)), false, "London"); err != nil {
+			t.Fatalf("test %d: failed to write summary: %v", i, err)
+		}
+		if have := buf.String(); have != tt.want {
+			t.Errorf("test %d: trace mismatch:\nhave:\n%s\nwant:\n%s", i, have, tt.want)
+		}
+		// The summary of the next execution must not leak the previous outcome
+		buf.Reset()
+		if err := logger.WriteSummary(common.Hash{}, true, ""); err != nil {
+			t.Fatalf("test %d: failed to write summary: %v", i, err)
+		}
+		if have, want := buf.String(), `{"stateRoot":"0x0000000000000000000000000000000000000000000000000000000000000000","output":"0x","gasUsed":"0x0","pass":true,"time":0}`+"\n"; have != want {
+			t.Errorf("test %d: summary mismatch: have %s, want %s", i, have, want)
+		}
+	}
+}
+
+func TestJSONLoggerStorage(t *testing.T) {
+	var (
+		env      = NewEVM(BlockContext{}, TxContext{}, &dummyStatedb{}, params.TestChainConfig, Config{})
+		contract = NewContract(&dummyContractRef{}, &dummyContractRef{}, new(big.Int), 0)
+		scope    = &ScopeContext{
+			Memory:   NewMemory(),
+			Stack:    newstack(),
+			Contract: contract,
+		}
+	)
+	scope.Stack.push(uint256.NewInt(1))
+	scope.Stack.push(new(uint256.Int))
+
+	tests := []struct {
+		config *LogConfig
+		want   string
+	}{
+		{
+			config: &LogConfig{DisableStack: true},
+			want: `{"pc":0,"op":85,"gas":"0x4e20","gasCost":"0x4e20","memSize":0,"storage":{"0x0000000000000000000000000000000000000000000000000000000000000000":"0x0000000000000000000000000000000000000000000000000000000000000001"},"depth":1,"refund":"0x539","opName":"SSTORE"}
+{"pc":1,"op":0,"gas":"0x0","gasCost":"0x0","memSize":0,"depth":1,"refund":"0x539","opName":"STOP"}
+`,
+		},
+		{
+			config: &LogConfig{DisableStack: true, DisableStorage: true},
+			want: `{"pc":0,"op":85,"gas":"0x4e20","gasCost":"0x4e20","memSize":0,"depth":1,"refund":"0x539","opName":"SSTORE"}
+{"pc":1,"op":0,"gas":"0x0","gasCost":"0x0","memSize":0,"depth":1,"refund":"0x539","opName":"STOP"}
+`,
+		},
+	}
+	for i, tt := range tests {
+		buf := new(bytes.Buffer)
+		logger := NewJSONLogger(tt.config, buf)
+
+		logger.CaptureState(env, 0, SSTORE, 20000, 20000, scope, nil, 1, nil)
+		logger.CaptureState(env, 1, STOP, 0, 0, scope, nil, 1, nil)
+		if have := buf.String(); have != tt.want {
+			t.Errorf("test %d: trace mismatch:\nhave:\n%s\nwant:\n%s", i, have, tt.want)
+		}
+	}
+}
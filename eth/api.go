@@ -26,6 +26,7 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -33,7 +34,9 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/pruner"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/internal/ethapi"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -607,3 +610,136 @@ func (api *PrivateDebugAPI) GetAccessibleState(from, to rpc.BlockNumber) (uint64
 	}
 	return 0, fmt.Errorf("No state found")
 }
+
+// GetAccountChanges returns the numbers of the blocks within [from, to] which
+// modified the given account. It requires the state change index (--state.changes).
+func (api *PrivateDebugAPI) GetAccountChanges(address common.Address, from, to rpc.BlockNumber) ([]hexutil.Uint64, error) {
+	return api.getStateChanges(crypto.Keccak256Hash(address.Bytes()), nil, from, to)
+}
+
+// GetStorageChanges returns the numbers of the blocks within [from, to] which
+// modified the given storage slot. It requires the state change index (--state.changes).
+func (api *PrivateDebugAPI) GetStorageChanges(address common.Address, key common.Hash, from, to rpc.BlockNumber) ([]hexutil.Uint64, error) {
+	slot := crypto.Keccak256Hash(key.Bytes())
+	return api.getStateChanges(crypto.Keccak256Hash(address.Bytes()), &slot, from, to)
+}
+
+// getStateChanges looks up the blocks modifying an account or a storage slot in
+// the state change index.
+func (api *PrivateDebugAPI) getStateChanges(account common.Hash, slot *common.Hash, from, to rpc.BlockNumber) ([]hexutil.Uint64, error) {
+	indexer := api.eth.ChangeIndexer()
+	if indexer == nil {
+		return nil, errors.New("state change index not enabled")
+	}
+	var resolveNum = func(num rpc.BlockNumber) uint64 {
+		// Pending and latest are both resolved to the current head
+		if num.Int64() < 0 {
+			return api.eth.blockchain.CurrentBlock().NumberU64()
+		}
+		return uint64(num.Int64())
+	}
+	start, end := resolveNum(from), resolveNum(to)
+	if start > end {
+		return nil, fmt.Errorf("start block (%d) after end block (%d)", start, end)
+	}
+	numbers, err := core.ReadStateChanges(api.eth.ChainDb(), api.eth.blockchain.StateCache().TrieDB(), indexer, account, slot, start, end)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]hexutil.Uint64, len(numbers))
+	for i, number := range numbers {
+		result[i] = hexutil.Uint64(number)
+	}
+	return result, nil
+}
+
+// StatePruningConfig are the optional settings of the online state pruning.
+type StatePruningConfig struct {
+	BloomSize *uint64 `json:"bloomSize"` // Megabytes of memory for the bloom filter of the live state
+	BatchSize *int    `json:"batchSize"` // Maximum number of stale entries deleted in one go
+	Pause     *string `json:"pause"`     // Time to wait between two deletion batches
+}
+
+// StartStatePruning starts deleting the stale state in the background, while
+// the node keeps following the chain.
+func (api *PrivateDebugAPI) StartStatePruning(config *StatePruningConfig) error {
+	if atomic.LoadUint32(&api.eth.handler.fastSync) == 1 {
+		return errors.New("state pruning is not available during fast sync")
+	}
+	settings := pruner.DefaultOnlineConfig
+	if config != nil {
+		if config.BloomSize != nil {
+			settings.BloomSize = *config.BloomSize
+		}
+		if config.BatchSize != nil {
+			settings.BatchSize = *config.BatchSize
+		}
+		if config.Pause != nil {
+			pause, err := time.ParseDuration(*config.Pause)
+			if err != nil {
+				return err
+			}
+			settings.Pause = pause
+		}
+	}
+	_, err := api.eth.blockchain.StartStatePruning(settings)
+	return err
+}
+
+// StatePruningProgress returns the progress of the most recent state pruning,
+// or nil if no pruning was started yet.
+func (api *PrivateDebugAPI) StatePruningProgress() map[string]interface{} {
+	p := api.eth.blockchain.StatePruner()
+	if p == nil {
+		return nil
+	}
+	progress := p.Progress()
+	result := map[string]interface{}{
+		"root":       progress.Root,
+		"stage":      progress.Stage,
+		"elapsed":    common.PrettyDuration(progress.Elapsed).String(),
+		"marked":     hexutil.Uint64(progress.Marked),
+		"scanned":    hexutil.Uint64(progress.Scanned),
+		"pruned":     hexutil.Uint64(progress.Pruned),
+		"prunedSize": hexutil.Uint64(progress.PrunedSize),
+		"swept":      fmt.Sprintf("%.2f%%", progress.Swept*100),
+	}
+	if progress.Err != nil {
+		result["error"] = progress.Err.Error()
+	}
+	return result
+}
+
+// AbortStatePruning interrupts the running state pruning. The state entries
+// deleted so far are all stale, the pruning can be restarted anytime.
+func (api *PrivateDebugAPI) AbortStatePruning() error {
+	p := api.eth.blockchain.StatePruner()
+	if p == nil {
+		return errors.New("state pruning not running")
+	}
+	return p.Abort()
+}
+
+// ExecutionWitness re-executes the given block and returns the RLP encoded
+// witness of all the state it accessed, which is enough to execute the block
+// without access to the database.
+func (api *PrivateDebugAPI) ExecutionWitness(blockNrOrHash rpc.BlockNumberOrHash) (hexutil.Bytes, error) {
+	var block *types.Block
+	if number, ok := blockNrOrHash.Number(); ok {
+		if number < 0 {
+			block = api.eth.blockchain.CurrentBlock()
+		} else {
+			block = api.eth.blockchain.GetBlockByNumber(uint64(number))
+		}
+	} else if hash, ok := blockNrOrHash.Hash(); ok {
+		block = api.eth.blockchain.GetBlockByHash(hash)
+	}
+	if block == nil {
+		return nil, errors.New("block not found")
+	}
+	witness, err := api.eth.blockchain.ExecutionWitness(block)
+	if err != nil {
+		return nil, err
+	}
+	return rlp.EncodeToBytes(witness)
+}
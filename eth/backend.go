@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"path/filepath"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -81,6 +82,7 @@ type Ethereum struct {
 
 	bloomRequests     chan chan *bloombits.Retrieval // Channel receiving bloom data retrieval requests
 	bloomIndexer      *core.ChainIndexer             // Bloom indexer operating during block imports
+	changeIndexer     *core.ChainIndexer             // State change indexer operating during block imports (optional)
 	closeBloomHandler chan struct{}
 
 	APIBackend *EthAPIBackend
@@ -137,6 +139,13 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 	}
 	log.Info("Initialised chain configuration", "config", chainConfig)
 
+	// The state syncers write hash keyed trie nodes, the path scheme can only
+	// be populated by executing the chain.
+	if config.SyncMode != downloader.FullSync && rawdb.ReadStateScheme(chainDb) == rawdb.PathScheme {
+		log.Warn("Switching to full sync, state sync is not supported by the path-based state scheme", "mode", config.SyncMode)
+		config.SyncMode = downloader.FullSync
+	}
+
 	if err := pruner.RecoverPruning(stack.ResolvePath(""), chainDb, stack.ResolvePath(config.TrieCleanCacheJournal)); err != nil {
 		log.Error("Failed to recover state", "error", err)
 	}
@@ -186,8 +195,25 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 			TrieTimeLimit:       config.TrieTimeout,
 			SnapshotLimit:       config.SnapshotCache,
 			Preimages:           config.Preimages,
+			StateChanges:        config.StateChanges,
 		}
 	)
+	if config.StateHistory {
+		// The state history lives next to the chain freezer, resolve it the
+		// same way the node does.
+		if stack.Config().DataDir == "" {
+			log.Warn("State history requires a persistent data directory, disabling")
+		} else {
+			ancient := config.DatabaseFreezer
+			switch {
+			case ancient == "":
+				ancient = filepath.Join(stack.ResolvePath("chaindata"), "ancient")
+			case !filepath.IsAbs(ancient):
+				ancient = stack.ResolvePath(ancient)
+			}
+			cacheConfig.StateHistory = filepath.Join(ancient, "state")
+		}
+	}
 	eth.blockchain, err = core.NewBlockChain(chainDb, cacheConfig, chainConfig, eth.engine, vmConfig, eth.shouldPreserve, &config.TxLookupLimit)
 	if err != nil {
 		return nil, err
@@ -200,6 +226,11 @@ func New(stack *node.Node, config *ethconfig.Config) (*Ethereum, error) {
 	}
 	eth.bloomIndexer.Start(eth.blockchain)
 
+	if config.StateChanges {
+		eth.changeIndexer = core.NewStateChangeIndexer(chainDb, eth.blockchain.StateCache().TrieDB(), core.StateChangeSectionSize, core.StateChangeConfirms, config.StateChangesRetention)
+		eth.changeIndexer.Start(eth.blockchain)
+	}
+
 	if config.TxPool.Journal != "" {
 		config.TxPool.Journal = stack.ResolvePath(config.TxPool.Journal)
 	}
@@ -510,6 +541,7 @@ func (s *Ethereum) Downloader() *downloader.Downloader { return s.handler.downlo
 func (s *Ethereum) Synced() bool                       { return atomic.LoadUint32(&s.handler.acceptTxs) == 1 }
 func (s *Ethereum) ArchiveMode() bool                  { return s.config.NoPruning }
 func (s *Ethereum) BloomIndexer() *core.ChainIndexer   { return s.bloomIndexer }
+func (s *Ethereum) ChangeIndexer() *core.ChainIndexer  { return s.changeIndexer }
 
 // Protocols returns all the currently configured
 // network protocols to start.
@@ -552,6 +584,9 @@ func (s *Ethereum) Stop() error {
 
 	// Then stop everything else.
 	s.bloomIndexer.Close()
+	if s.changeIndexer != nil {
+		s.changeIndexer.Close()
+	}
 	close(s.closeBloomHandler)
 	s.txPool.Stop()
 	s.miner.Close()
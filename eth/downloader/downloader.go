@@ -526,10 +526,14 @@ func (d *Downloader) syncWithPeer(p *peerConnection, hash common.Hash, td *big.I
 		frozen, _ := d.stateDB.Ancients() // Ignore the error here since light client can also hit here.
 
 		// If a part of blockchain data has already been written into active store,
-		// disable the ancient style insertion explicitly.
+		// disable the ancient style insertion explicitly. The same goes for ancient
+		// stores shared read-only with a different node appending to them.
 		if origin >= frozen && frozen != 0 {
 			d.ancientLimit = 0
 			log.Info("Disabling direct-ancient mode", "origin", origin, "ancient", frozen-1)
+		} else if d.stateDB.AncientReadOnly() {
+			d.ancientLimit = 0
+			log.Info("Disabling direct-ancient mode, ancient store is read only")
 		} else if d.ancientLimit > 0 {
 			log.Debug("Enabling direct-ancient mode", "ancient", d.ancientLimit)
 		}
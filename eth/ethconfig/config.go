@@ -166,6 +166,11 @@ type Config struct {
 	TrieTimeout             time.Duration
 	SnapshotCache           int
 	Preimages               bool
+	StateHistory            bool // Whether to persist the reverse diffs of the flat state for historical reads
+
+	// State change index options
+	StateChanges          bool   // Whether to index the blocks modifying each account and storage slot
+	StateChangesRetention uint64 `toml:",omitempty"` // Number of recent blocks to keep the state change index for (0 = entire chain)
 
 	// Mining options
 	Miner miner.Config
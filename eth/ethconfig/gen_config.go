@@ -48,6 +48,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		TrieTimeout             time.Duration
 		SnapshotCache           int
 		Preimages               bool
+		StateHistory            bool
+		StateChanges            bool
+		StateChangesRetention   uint64 `toml:",omitempty"`
 		Miner                   miner.Config
 		Ethash                  ethash.Config
 		TxPool                  core.TxPoolConfig
@@ -91,6 +94,9 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.TrieTimeout = c.TrieTimeout
 	enc.SnapshotCache = c.SnapshotCache
 	enc.Preimages = c.Preimages
+	enc.StateHistory = c.StateHistory
+	enc.StateChanges = c.StateChanges
+	enc.StateChangesRetention = c.StateChangesRetention
 	enc.Miner = c.Miner
 	enc.Ethash = c.Ethash
 	enc.TxPool = c.TxPool
@@ -138,6 +144,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		TrieTimeout             *time.Duration
 		SnapshotCache           *int
 		Preimages               *bool
+		StateHistory            *bool
+		StateChanges            *bool
+		StateChangesRetention   *uint64 `toml:",omitempty"`
 		Miner                   *miner.Config
 		Ethash                  *ethash.Config
 		TxPool                  *core.TxPoolConfig
@@ -244,6 +253,15 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.Preimages != nil {
 		c.Preimages = *dec.Preimages
 	}
+	if dec.StateHistory != nil {
+		c.StateHistory = *dec.StateHistory
+	}
+	if dec.StateChanges != nil {
+		c.StateChanges = *dec.StateChanges
+	}
+	if dec.StateChangesRetention != nil {
+		c.StateChangesRetention = *dec.StateChangesRetention
+	}
 	if dec.Miner != nil {
 		c.Miner = *dec.Miner
 	}
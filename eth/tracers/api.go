@@ -20,12 +20,14 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -53,6 +55,16 @@ const (
 	// and reexecute to produce missing historical state necessary to run a specific
 	// trace.
 	defaultTraceReexec = uint64(128)
+
+	// defaultTraceChainInflight is the number of blocks chain tracing is allowed
+	// to have in flight (being traced or waiting for delivery) by default, before
+	// waiting for the consumer to catch up.
+	defaultTraceChainInflight = uint64(64)
+
+	// defaultTraceChainCheckpoint is the number of blocks between the state
+	// checkpoints chain tracing regenerates by default. The segments between
+	// checkpoints are traced concurrently.
+	defaultTraceChainCheckpoint = uint64(16)
 )
 
 // Backend interface provides the common API services (that are provided by
@@ -153,22 +165,73 @@ func (api *API) blockByNumberAndHash(ctx context.Context, number rpc.BlockNumber
 	return api.blockByHash(ctx, hash)
 }
 
+// blockByNumberOrHash is the wrapper of the chain access function offered by the
+// backend, resolving the block either by hash or by number, whichever is given.
+// It will return an error if the block is not found.
+func (api *API) blockByNumberOrHash(ctx context.Context, blockNrOrHash rpc.BlockNumberOrHash) (*types.Block, error) {
+	if hash, ok := blockNrOrHash.Hash(); ok {
+		return api.blockByHash(ctx, hash)
+	}
+	if number, ok := blockNrOrHash.Number(); ok {
+		return api.blockByNumber(ctx, number)
+	}
+	return nil, errors.New("invalid arguments; neither block nor hash specified")
+}
+
 // TraceConfig holds extra parameters to trace functions.
 type TraceConfig struct {
 	*vm.LogConfig
 	Tracer  *string
 	Timeout *string
 	Reexec  *uint64
+	// Config specific to given tracer. Note struct logger
+	// config are historically embedded in main object.
+	TracerConfig json.RawMessage
 }
 
-// TraceCallConfig is the config for traceCall API. It holds one more
-// field to override the state for tracing.
+// TraceCallConfig is the config for traceCall API. It holds two more
+// fields to override the state and the block context for tracing.
 type TraceCallConfig struct {
 	*vm.LogConfig
 	Tracer         *string
 	Timeout        *string
 	Reexec         *uint64
+	TracerConfig   json.RawMessage
 	StateOverrides *ethapi.StateOverride
+	BlockOverrides *ethapi.BlockOverrides
+}
+
+// traceConfig returns the config of the individual call traces.
+func (config *TraceCallConfig) traceConfig() *TraceConfig {
+	if config == nil {
+		return nil
+	}
+	return &TraceConfig{
+		LogConfig:    config.LogConfig,
+		Tracer:       config.Tracer,
+		Timeout:      config.Timeout,
+		Reexec:       config.Reexec,
+		TracerConfig: config.TracerConfig,
+	}
+}
+
+// Bundle is a list of calls executed in order within the same block context,
+// which can be customized by overriding the fields of the traced block.
+type Bundle struct {
+	Transactions   []ethapi.TransactionArgs
+	BlockOverrides *ethapi.BlockOverrides
+}
+
+// TraceChainConfig holds extra parameters to the chain tracing functions.
+type TraceChainConfig struct {
+	TraceConfig
+	// InflightBlocks is the maximum number of blocks being traced or waiting to
+	// be delivered at any point in time. It bounds the memory used on behalf of
+	// slow consumers.
+	InflightBlocks *uint64
+	// CheckpointInterval is the number of blocks between state checkpoints. The
+	// segments between them are re-executed and traced concurrently.
+	CheckpointInterval *uint64
 }
 
 // StdTraceConfig holds extra parameters to standard-json trace functions.
@@ -184,21 +247,47 @@ type txTraceResult struct {
 	Error  string      `json:"error,omitempty"`  // Trace failure produced by the tracer
 }
 
-// blockTraceTask represents a single block trace task when an entire chain is
-// being traced.
-type blockTraceTask struct {
-	statedb *state.StateDB   // Intermediate state prepped for tracing
-	block   *types.Block     // Block to trace the transactions from
-	rootref common.Hash      // Trie root reference held for this task
-	results []*txTraceResult // Trace results procudes by the task
+// chainSegment represents a range of blocks to re-execute and trace from a
+// checkpoint when an entire chain is being traced.
+type chainSegment struct {
+	statedb *state.StateDB // State checkpointed at the start of the segment
+	block   *types.Block   // Block the checkpoint belongs to, excluded from tracing
+	last    uint64         // Number of the last block to trace
 }
 
 // blockTraceResult represets the results of tracing a single block when an entire
 // chain is being traced.
 type blockTraceResult struct {
-	Block  hexutil.Uint64   `json:"block"`  // Block number corresponding to this trace
-	Hash   common.Hash      `json:"hash"`   // Block hash corresponding to this trace
-	Traces []*txTraceResult `json:"traces"` // Trace results produced by the task
+	Block    hexutil.Uint64      `json:"block"`              // Block number corresponding to this trace
+	Hash     common.Hash         `json:"hash"`               // Block hash corresponding to this trace
+	Traces   []*txTraceResult    `json:"traces"`             // Trace results produced by the task
+	Progress *chainTraceProgress `json:"progress,omitempty"` // Progress of the chain tracing
+	Error    string              `json:"error,omitempty"`    // Error aborting the chain tracing at this block
+}
+
+// chainTraceProgress reports the progress of chain tracing along with every
+// block result delivered.
+type chainTraceProgress struct {
+	Regenerated hexutil.Uint64 `json:"regenerated"` // Highest block whose state was checkpointed
+	Traced      hexutil.Uint64 `json:"traced"`      // Number of blocks traced so far
+	Remaining   hexutil.Uint64 `json:"remaining"`   // Number of blocks left to trace
+	Elapsed     hexutil.Uint64 `json:"elapsed"`     // Seconds elapsed since tracing started
+	Estimated   hexutil.Uint64 `json:"estimated"`   // Estimated seconds until tracing finishes
+}
+
+// newChainTraceProgress creates a progress report, estimating the remaining
+// time based on the average tracing speed so far.
+func newChainTraceProgress(regenerated, traced, remaining uint64, elapsed time.Duration) *chainTraceProgress {
+	progress := &chainTraceProgress{
+		Regenerated: hexutil.Uint64(regenerated),
+		Traced:      hexutil.Uint64(traced),
+		Remaining:   hexutil.Uint64(remaining),
+		Elapsed:     hexutil.Uint64(elapsed / time.Second),
+	}
+	if traced > 0 {
+		progress.Estimated = hexutil.Uint64(time.Duration(float64(elapsed)*float64(remaining)/float64(traced)) / time.Second)
+	}
+	return progress
 }
 
 // txTraceTask represents a single transaction trace task when an entire block
@@ -210,206 +299,401 @@ type txTraceTask struct {
 
 // TraceChain returns the structured logs created during the execution of EVM
 // between two blocks (excluding start) and returns them as a JSON object.
-func (api *API) TraceChain(ctx context.Context, start, end rpc.BlockNumber, config *TraceConfig) (*rpc.Subscription, error) { // Fetch the block interval that we want to trace
-	from, err := api.blockByNumber(ctx, start)
+//
+// The results are streamed as subscription notifications, one per block, in
+// ascending block order. Blocks without transactions are skipped, apart from
+// the end block, which is always delivered to signal completion. The block
+// number of each result doubles as a cursor: if the stream is interrupted, it
+// can be resumed by starting a new trace from the last received block. Should
+// tracing fail, the last result carries the error instead of the traces.
+func (api *API) TraceChain(ctx context.Context, start, end rpc.BlockNumber, config *TraceChainConfig) (*rpc.Subscription, error) { // Fetch the block interval that we want to trace
+	from, to, err := api.chainRange(ctx, start, end)
 	if err != nil {
 		return nil, err
 	}
+	// Tracing a chain is a **long** operation, only do with subscriptions
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
+	}
+	sub := notifier.CreateSubscription()
+
+	resCh := api.traceChain(from, to, config, notifier.Closed())
+	go func() {
+		for result := range resCh {
+			notifier.Notify(sub.ID, result)
+		}
+	}()
+	return sub, nil
+}
+
+// chainRange retrieves the boundary blocks of a chain segment to trace.
+func (api *API) chainRange(ctx context.Context, start, end rpc.BlockNumber) (*types.Block, *types.Block, error) {
+	from, err := api.blockByNumber(ctx, start)
+	if err != nil {
+		return nil, nil, err
+	}
 	to, err := api.blockByNumber(ctx, end)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if from.Number().Cmp(to.Number()) >= 0 {
-		return nil, fmt.Errorf("end block (#%d) needs to come after start block (#%d)", end, start)
+		return nil, nil, fmt.Errorf("end block (#%d) needs to come after start block (#%d)", end, start)
 	}
-	return api.traceChain(ctx, from, to, config)
+	return from, to, nil
 }
 
 // traceChain configures a new tracer according to the provided configuration, and
-// executes all the transactions contained within. The return value will be one item
-// per transaction, dependent on the requested tracer.
-func (api *API) traceChain(ctx context.Context, start, end *types.Block, config *TraceConfig) (*rpc.Subscription, error) {
-	// Tracing a chain is a **long** operation, only do with subscriptions
-	notifier, supported := rpc.NotifierFromContext(ctx)
-	if !supported {
-		return &rpc.Subscription{}, rpc.ErrNotificationsUnsupported
-	}
-	sub := notifier.CreateSubscription()
-
+// executes all the transactions contained within. The tracing chain range includes
+// the end block but excludes the start one. The return value will be one item per
+// transaction, dependent on the requested tracer.
+//
+// The results are delivered in block order over the returned channel, which is
+// closed when tracing finishes or is aborted via the closed channel. Tracing is
+// flow controlled: at most a configured number of blocks may be in flight (fed
+// to the tracers, but not yet consumed from the result channel), so a slow
+// consumer throttles tracing instead of accumulating results in memory.
+//
+// The state of the range is regenerated once sequentially, checkpointing it at
+// fixed intervals in the temporary trie database. The sub-ranges between the
+// checkpoints are then re-executed and traced concurrently. The first sub-range
+// would be re-executed alongside its regeneration, so its blocks are traced off
+// the regenerated states instead, one by one.
+//
+// Should tracing fail, the error is delivered to the consumer as the result of
+// the first block not traced, ending the stream.
+func (api *API) traceChain(start, end *types.Block, config *TraceChainConfig, closed <-chan interface{}) chan *blockTraceResult {
 	// Prepare all the states for tracing. Note this procedure can take very
 	// long time. Timeout mechanism is necessary.
-	reexec := defaultTraceReexec
-	if config != nil && config.Reexec != nil {
-		reexec = *config.Reexec
+	var (
+		reexec   = defaultTraceReexec
+		inflight = defaultTraceChainInflight
+		interval = defaultTraceChainCheckpoint
+		txconfig *TraceConfig
+	)
+	if config != nil {
+		if config.Reexec != nil {
+			reexec = *config.Reexec
+		}
+		if config.InflightBlocks != nil && *config.InflightBlocks > 0 {
+			inflight = *config.InflightBlocks
+		}
+		if config.CheckpointInterval != nil && *config.CheckpointInterval > 0 {
+			interval = *config.CheckpointInterval
+		}
+		txconfig = &config.TraceConfig
+	}
+	blocks := end.NumberU64() - start.NumberU64()
+	first := interval // Blocks of the first segment, each traced on its own
+	if first > blocks {
+		first = blocks
 	}
-	blocks := int(end.NumberU64() - start.NumberU64())
 	threads := runtime.NumCPU()
-	if threads > blocks {
-		threads = blocks
+	if segments := first + (blocks-first+interval-1)/interval; uint64(threads) > segments {
+		threads = int(segments)
 	}
 	var (
 		pend     = new(sync.WaitGroup)
-		tasks    = make(chan *blockTraceTask, threads)
-		results  = make(chan *blockTraceTask, threads)
+		segments = make(chan *chainSegment, threads)
+		results  = make(chan *blockTraceResult, threads)
+		resCh    = make(chan *blockTraceResult)
 		localctx = context.Background()
-	)
-	for th := 0; th < threads; th++ {
-		pend.Add(1)
-		go func() {
-			defer pend.Done()
 
-			// Fetch and execute the next block trace tasks
-			for task := range tasks {
-				signer := types.MakeSigner(api.backend.ChainConfig(), task.block.Number())
-				blockCtx := core.NewEVMBlockContext(task.block.Header(), api.chainContext(localctx), nil)
-				// Trace all the transactions contained within
-				for i, tx := range task.block.Transactions() {
-					msg, _ := tx.AsMessage(signer, task.block.BaseFee())
-					txctx := &Context{
-						BlockHash: task.block.Hash(),
-						TxIndex:   i,
-						TxHash:    tx.Hash(),
-					}
-					res, err := api.traceTx(localctx, msg, txctx, blockCtx, task.statedb, config)
-					if err != nil {
-						task.results[i] = &txTraceResult{Error: err.Error()}
-						log.Warn("Tracing failed", "hash", tx.Hash(), "block", task.block.NumberU64(), "err", err)
-						break
-					}
-					// Only delete empty objects if EIP158/161 (a.k.a Spurious Dragon) is in effect
-					task.statedb.Finalise(api.backend.ChainConfig().IsEIP158(task.block.Number()))
-					task.results[i] = &txTraceResult{Result: res}
-				}
-				// Stream the result back to the user or abort on teardown
-				select {
-				case results <- task:
-				case <-notifier.Closed():
-					return
-				}
-			}
-		}()
-	}
-	// Start a goroutine to feed all the blocks into the tracers
-	var (
-		begin     = time.Now()
-		derefTodo []common.Hash // list of hashes to dereference from the db
-		derefsMu  sync.Mutex    // mutex for the derefs
-	)
+		begin       = time.Now()
+		regenerated = start.NumberU64() // Last block whose state was regenerated (atomic)
 
+		lock      sync.Mutex
+		delivered = start.NumberU64()   // Last block delivered to the consumer
+		advanced  = make(chan struct{}) // Closed and replaced whenever a block is delivered
+		failed    error                 // First error encountered during tracing
+
+		quit     = make(chan struct{}) // Closed to tear down all goroutines
+		quitOnce sync.Once
+	)
+	// abort tears down tracing, recording the error that caused it, if any
+	abort := func(err error) {
+		quitOnce.Do(func() {
+			lock.Lock()
+			failed = err
+			lock.Unlock()
+			close(quit)
+		})
+	}
 	go func() {
-		var (
-			logged  time.Time
-			number  uint64
-			traced  uint64
-			failed  error
-			parent  common.Hash
-			statedb *state.StateDB
-		)
-		// Ensure everything is properly cleaned up on any exit path
-		defer func() {
-			close(tasks)
-			pend.Wait()
+		select {
+		case <-closed:
+			abort(nil)
+		case <-quit:
+		}
+	}()
+	// admit blocks until the given block is allowed in flight
+	admit := func(number uint64) bool {
+		for {
+			lock.Lock()
+			allowed, wait := number <= delivered+inflight, advanced
+			lock.Unlock()
 
-			switch {
-			case failed != nil:
-				log.Warn("Chain tracing failed", "start", start.NumberU64(), "end", end.NumberU64(), "transactions", traced, "elapsed", time.Since(begin), "err", failed)
-			case number < end.NumberU64():
-				log.Warn("Chain tracing aborted", "start", start.NumberU64(), "end", end.NumberU64(), "abort", number, "transactions", traced, "elapsed", time.Since(begin))
-			default:
-				log.Info("Chain tracing finished", "start", start.NumberU64(), "end", end.NumberU64(), "transactions", traced, "elapsed", time.Since(begin))
+			if allowed {
+				return true
 			}
-			close(results)
-		}()
-		// Feed all the blocks both into the tracer, as well as fast process concurrently
-		for number = start.NumberU64(); number < end.NumberU64(); number++ {
-			// Stop tracing if interruption was requested
 			select {
-			case <-notifier.Closed():
-				return
-			default:
-			}
-			// clean out any derefs
-			derefsMu.Lock()
-			for _, h := range derefTodo {
-				statedb.Database().TrieDB().Dereference(h)
+			case <-wait:
+			case <-quit:
+				return false
 			}
-			derefTodo = derefTodo[:0]
-			derefsMu.Unlock()
+		}
+	}
+	// Start a goroutine to regenerate the state of the range, checkpointing it
+	// at the start of every segment for the tracers to pick up
+	go func() {
+		defer close(segments)
 
-			// Print progress logs if long enough time elapsed
-			if time.Since(logged) > 8*time.Second {
-				logged = time.Now()
-				log.Info("Tracing chain segment", "start", start.NumberU64(), "end", end.NumberU64(), "current", number, "transactions", traced, "elapsed", time.Since(begin))
-			}
-			// Retrieve the parent state to trace on top
+		statedb, err := api.backend.StateAtBlock(localctx, start, reexec, nil, false)
+		if err != nil {
+			abort(err)
+			return
+		}
+		for number := start.NumberU64(); number < end.NumberU64(); {
 			block, err := api.blockByNumber(localctx, rpc.BlockNumber(number))
 			if err != nil {
-				failed = err
-				break
+				abort(err)
+				return
 			}
-			// Prepare the statedb for tracing. Don't use the live database for
-			// tracing to avoid persisting state junks into the database.
-			statedb, err = api.backend.StateAtBlock(localctx, block, reexec, statedb, false)
-			if err != nil {
-				failed = err
-				break
+			last := number + interval
+			if number-start.NumberU64() < first {
+				last = number + 1
 			}
+			if last > end.NumberU64() {
+				last = end.NumberU64()
+			}
+			// Hand the checkpoint over to the tracers, holding an extra trie
+			// reference for them, since the regeneration moves on
 			if statedb.Database().TrieDB() != nil {
-				// Hold the reference for tracer, will be released at the final stage
 				statedb.Database().TrieDB().Reference(block.Root(), common.Hash{})
-
-				// Release the parent state because it's already held by the tracer
-				if parent != (common.Hash{}) {
-					statedb.Database().TrieDB().Dereference(parent)
-				}
-			}
-			parent = block.Root()
-
-			next, err := api.blockByNumber(localctx, rpc.BlockNumber(number+1))
-			if err != nil {
-				failed = err
-				break
 			}
-			// Send the block over to the concurrent tracers (if not in the fast-forward phase)
-			txs := next.Transactions()
 			select {
-			case tasks <- &blockTraceTask{statedb: statedb.Copy(), block: next, rootref: block.Root(), results: make([]*txTraceResult, len(txs))}:
-			case <-notifier.Closed():
+			case segments <- &chainSegment{statedb: statedb.Copy(), block: block, last: last}:
+			case <-quit:
+				api.release(statedb, block.Root())
+				api.release(statedb, block.Root())
 				return
 			}
-			traced += uint64(len(txs))
+			if last == end.NumberU64() {
+				api.release(statedb, block.Root())
+				break
+			}
+			// Regenerate the state up to the next checkpoint, releasing the
+			// intermediate ones as soon as they are superseded
+			for ; number < last; number++ {
+				next, err := api.blockByNumber(localctx, rpc.BlockNumber(number+1))
+				if err != nil {
+					abort(err)
+					return
+				}
+				if statedb, err = api.backend.StateAtBlock(localctx, next, reexec, statedb, false); err != nil {
+					abort(err)
+					return
+				}
+				api.release(statedb, block.Root())
+				block = next
+
+				atomic.StoreUint64(&regenerated, number+1)
+
+				select {
+				case <-quit:
+					api.release(statedb, block.Root())
+					return
+				default:
+				}
+			}
 		}
 	}()
 
-	// Keep reading the trace results and stream the to the user
+	// Start the tracers, each re-executing and tracing a segment at a time
+	for th := 0; th < threads; th++ {
+		pend.Add(1)
+		go func() {
+			defer pend.Done()
+
+			for segment := range segments {
+				if err := api.traceSegment(localctx, segment, reexec, txconfig, admit, results, quit); err != nil {
+					abort(err)
+				}
+			}
+		}()
+	}
+	go func() {
+		pend.Wait()
+		close(results)
+	}()
+
+	// Keep reading the trace results and stream them to result channel.
 	go func() {
+		defer close(resCh)
+
 		var (
-			done = make(map[uint64]*blockTraceResult)
-			next = start.NumberU64() + 1
+			logged time.Time
+			done   = make(map[uint64]*blockTraceResult)
+			next   = start.NumberU64() + 1
 		)
+		defer func() {
+			// Drain any results still in flight, so the tracers can terminate
+			for range results {
+			}
+			lock.Lock()
+			err := failed
+			lock.Unlock()
+
+			// Tear down the interruption watcher if tracing completed
+			abort(nil)
+
+			// Report the failure to the consumer, otherwise it can't tell the
+			// stream apart from a completed one
+			if err != nil {
+				traced := next - start.NumberU64() - 1
+				result := &blockTraceResult{
+					Block:    hexutil.Uint64(next),
+					Progress: newChainTraceProgress(atomic.LoadUint64(&regenerated), traced, blocks-traced, time.Since(begin)),
+					Error:    err.Error(),
+				}
+				if header, _ := api.backend.HeaderByNumber(localctx, rpc.BlockNumber(next)); header != nil {
+					result.Hash = header.Hash()
+				}
+				select {
+				case resCh <- result:
+				case <-closed:
+				}
+			}
+			switch {
+			case err != nil:
+				log.Warn("Chain tracing failed", "start", start.NumberU64(), "end", end.NumberU64(), "traced", next-start.NumberU64()-1, "elapsed", time.Since(begin), "err", err)
+			case next <= end.NumberU64():
+				log.Warn("Chain tracing aborted", "start", start.NumberU64(), "end", end.NumberU64(), "abort", next, "elapsed", time.Since(begin))
+			default:
+				log.Info("Chain tracing finished", "start", start.NumberU64(), "end", end.NumberU64(), "elapsed", time.Since(begin))
+			}
+		}()
 		for res := range results {
 			// Queue up next received result
-			result := &blockTraceResult{
-				Block:  hexutil.Uint64(res.block.NumberU64()),
-				Hash:   res.block.Hash(),
-				Traces: res.results,
-			}
-			// Schedule any parent tries held in memory by this task for dereferencing
-			done[uint64(result.Block)] = result
-			derefsMu.Lock()
-			derefTodo = append(derefTodo, res.rootref)
-			derefsMu.Unlock()
+			done[uint64(res.Block)] = res
+
 			// Stream completed traces to the user, aborting on the first error
 			for result, ok := done[next]; ok; result, ok = done[next] {
+				traced := next - start.NumberU64()
+				result.Progress = newChainTraceProgress(atomic.LoadUint64(&regenerated), traced, blocks-traced, time.Since(begin))
+
 				if len(result.Traces) > 0 || next == end.NumberU64() {
-					notifier.Notify(sub.ID, result)
+					// Bail out before delivering if the consumer is already gone,
+					// a ready send might otherwise win the select below
+					select {
+					case <-closed:
+						abort(nil)
+						return
+					case <-quit:
+						return
+					default:
+					}
+					select {
+					case resCh <- result:
+					case <-closed:
+						abort(nil)
+						return
+					case <-quit:
+						return
+					}
 				}
 				delete(done, next)
+
+				// Allow another block in flight now that this one is delivered
+				lock.Lock()
+				delivered = next
+				close(advanced)
+				advanced = make(chan struct{})
+				lock.Unlock()
+
 				next++
 			}
+			// Print progress logs if long enough time elapsed
+			if time.Since(logged) > 8*time.Second {
+				logged = time.Now()
+				log.Info("Tracing chain segment", "start", start.NumberU64(), "end", end.NumberU64(), "current", next-1, "regenerated", atomic.LoadUint64(&regenerated), "elapsed", time.Since(begin))
+			}
 		}
 	}()
-	return sub, nil
+	return resCh
+}
+
+// traceSegment re-executes a segment of the chain from its checkpoint, tracing
+// the transactions of every block and sending the results to the collector.
+// Each block waits to be admitted before being traced, to keep the number of
+// blocks in flight bounded.
+func (api *API) traceSegment(ctx context.Context, segment *chainSegment, reexec uint64, config *TraceConfig, admit func(uint64) bool, results chan<- *blockTraceResult, quit <-chan struct{}) error {
+	var (
+		statedb = segment.statedb
+		parent  = segment.block
+	)
+	// Release the state of the last processed block when done
+	defer func() { api.release(statedb, parent.Root()) }()
+
+	for number := parent.NumberU64() + 1; number <= segment.last; number++ {
+		if !admit(number) {
+			return nil
+		}
+		block, err := api.blockByNumber(ctx, rpc.BlockNumber(number))
+		if err != nil {
+			return err
+		}
+		// Trace all the transactions contained within
+		var (
+			signer   = types.MakeSigner(api.backend.ChainConfig(), block.Number())
+			blockCtx = core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
+			txs      = block.Transactions()
+			traces   = make([]*txTraceResult, len(txs))
+			tracedb  = statedb.Copy()
+		)
+		for i, tx := range txs {
+			msg, _ := tx.AsMessage(signer, block.BaseFee())
+			txctx := &Context{
+				BlockHash: block.Hash(),
+				TxIndex:   i,
+				TxHash:    tx.Hash(),
+			}
+			res, err := api.traceTx(ctx, msg, txctx, blockCtx, tracedb, config)
+			if err != nil {
+				traces[i] = &txTraceResult{Error: err.Error()}
+				log.Warn("Tracing failed", "hash", tx.Hash(), "block", block.NumberU64(), "err", err)
+				break
+			}
+			// Only delete empty objects if EIP158/161 (a.k.a Spurious Dragon) is in effect
+			tracedb.Finalise(api.backend.ChainConfig().IsEIP158(block.Number()))
+			traces[i] = &txTraceResult{Result: res}
+		}
+		// Stream the result back to the collector or abort on teardown
+		select {
+		case results <- &blockTraceResult{Block: hexutil.Uint64(number), Hash: block.Hash(), Traces: traces}:
+		case <-quit:
+			return nil
+		}
+		// Move the state forward, unless the segment is done
+		if number == segment.last {
+			break
+		}
+		next, err := api.backend.StateAtBlock(ctx, block, reexec, statedb, false)
+		if err != nil {
+			return err
+		}
+		api.release(statedb, parent.Root())
+		statedb, parent = next, block
+	}
+	return nil
+}
+
+// release drops the trie reference held for a state regenerated during chain
+// tracing. It's a noop for states read directly from the database.
+func (api *API) release(statedb *state.StateDB, root common.Hash) {
+	if statedb.Database().TrieDB() != nil {
+		statedb.Database().TrieDB().Dereference(root)
+	}
 }
 
 // TraceBlockByNumber returns the structured logs created during the execution of
@@ -694,6 +978,7 @@ func (api *API) standardTraceBlockToFile(ctx context.Context, block *types.Block
 			vmConf    vm.Config
 			dump      *os.File
 			writer    *bufio.Writer
+			logger    *vm.JSONLogger
 			err       error
 		)
 		// If the transaction needs tracing, swap out the configs
@@ -711,16 +996,28 @@ func (api *API) standardTraceBlockToFile(ctx context.Context, block *types.Block
 
 			// Swap out the noop logger to the standard tracer
 			writer = bufio.NewWriter(dump)
+			logger = vm.NewJSONLogger(&logConfig, writer)
 			vmConf = vm.Config{
 				Debug:                   true,
-				Tracer:                  vm.NewJSONLogger(&logConfig, writer),
+				Tracer:                  logger,
 				EnablePreimageRecording: true,
 			}
 		}
 		// Execute the transaction and flush any traces to disk
 		vmenv := vm.NewEVM(vmctx, txContext, statedb, chainConfig, vmConf)
 		statedb.Prepare(tx.Hash(), i)
-		_, err = core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+		result, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(msg.Gas()))
+		if err == nil {
+			// Finalize the state so any modifications are written to the trie
+			// Only delete empty objects if EIP158/161 (a.k.a Spurious Dragon) is in effect
+			deleteEmptyObjects := vmenv.ChainConfig().IsEIP158(block.Number())
+			if logger != nil {
+				// calling IntermediateRoot will internally call Finalize on the state
+				logger.WriteSummary(statedb.IntermediateRoot(deleteEmptyObjects), !result.Failed(), "")
+			} else {
+				statedb.Finalise(deleteEmptyObjects)
+			}
+		}
 		if writer != nil {
 			writer.Flush()
 		}
@@ -731,9 +1028,6 @@ func (api *API) standardTraceBlockToFile(ctx context.Context, block *types.Block
 		if err != nil {
 			return dumps, err
 		}
-		// Finalize the state so any modifications are written to the trie
-		// Only delete empty objects if EIP158/161 (a.k.a Spurious Dragon) is in effect
-		statedb.Finalise(vmenv.ChainConfig().IsEIP158(block.Number()))
 
 		// If we've traced the transaction we were looking for, abort
 		if tx.Hash() == txHash {
@@ -791,21 +1085,79 @@ func (api *API) TraceTransaction(ctx context.Context, hash common.Hash, config *
 // You can provide -2 as a block number to trace on top of the pending block.
 func (api *API) TraceCall(ctx context.Context, args ethapi.TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, config *TraceCallConfig) (interface{}, error) {
 	// Try to retrieve the specified block
-	var (
-		err   error
-		block *types.Block
-	)
-	if hash, ok := blockNrOrHash.Hash(); ok {
-		block, err = api.blockByHash(ctx, hash)
-	} else if number, ok := blockNrOrHash.Number(); ok {
-		block, err = api.blockByNumber(ctx, number)
-	} else {
-		return nil, errors.New("invalid arguments; neither block nor hash specified")
+	block, err := api.blockByNumberOrHash(ctx, blockNrOrHash)
+	if err != nil {
+		return nil, err
+	}
+	statedb, err := api.callState(ctx, block, config)
+	if err != nil {
+		return nil, err
 	}
+	vmctx := core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
+	if config != nil {
+		config.BlockOverrides.Apply(&vmctx)
+	}
+	// Execute the trace
+	msg, err := args.ToMessage(api.backend.RPCGasCap(), vmctx.BaseFee)
+	if err != nil {
+		return nil, err
+	}
+	return api.traceTx(ctx, msg, new(Context), vmctx, statedb, config.traceConfig())
+}
+
+// TraceCallMany lets you trace a sequence of eth_calls, grouped into bundles, on
+// top of the provided block. The calls are executed in order and each one sees
+// the state changes of the preceding ones. The block context of every bundle can
+// be customized separately, on top of the overrides given in the config. It
+// returns one trace result for each call, grouped the same way as the bundles.
+func (api *API) TraceCallMany(ctx context.Context, bundles []*Bundle, blockNrOrHash rpc.BlockNumberOrHash, config *TraceCallConfig) ([][]interface{}, error) {
+	if len(bundles) == 0 {
+		return nil, errors.New("empty bundle list")
+	}
+	block, err := api.blockByNumberOrHash(ctx, blockNrOrHash)
 	if err != nil {
 		return nil, err
 	}
-	// try to recompute the state
+	statedb, err := api.callState(ctx, block, config)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		traceConfig = config.traceConfig()
+		results     = make([][]interface{}, len(bundles))
+	)
+	for i, bundle := range bundles {
+		if bundle == nil {
+			return nil, fmt.Errorf("bundle %d is empty", i)
+		}
+		vmctx := core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
+		if config != nil {
+			config.BlockOverrides.Apply(&vmctx)
+		}
+		bundle.BlockOverrides.Apply(&vmctx)
+
+		results[i] = make([]interface{}, len(bundle.Transactions))
+		for j, args := range bundle.Transactions {
+			msg, err := args.ToMessage(api.backend.RPCGasCap(), vmctx.BaseFee)
+			if err != nil {
+				return nil, fmt.Errorf("bundle %d, call %d: %w", i, j, err)
+			}
+			res, err := api.traceTx(ctx, msg, new(Context), vmctx, statedb, traceConfig)
+			if err != nil {
+				return nil, fmt.Errorf("bundle %d, call %d: %w", i, j, err)
+			}
+			results[i][j] = res
+
+			// Finalize the state so the next call sees the changes
+			statedb.Finalise(api.backend.ChainConfig().IsEIP158(vmctx.BlockNumber))
+		}
+	}
+	return results, nil
+}
+
+// callState regenerates the state of the given block to run calls on top of,
+// applying any state overrides requested in the config.
+func (api *API) callState(ctx context.Context, block *types.Block, config *TraceCallConfig) (*state.StateDB, error) {
 	reexec := defaultTraceReexec
 	if config != nil && config.Reexec != nil {
 		reexec = *config.Reexec
@@ -820,23 +1172,7 @@ func (api *API) TraceCall(ctx context.Context, args ethapi.TransactionArgs, bloc
 			return nil, err
 		}
 	}
-	// Execute the trace
-	msg, err := args.ToMessage(api.backend.RPCGasCap(), block.BaseFee())
-	if err != nil {
-		return nil, err
-	}
-	vmctx := core.NewEVMBlockContext(block.Header(), api.chainContext(ctx), nil)
-
-	var traceConfig *TraceConfig
-	if config != nil {
-		traceConfig = &TraceConfig{
-			LogConfig: config.LogConfig,
-			Tracer:    config.Tracer,
-			Timeout:   config.Timeout,
-			Reexec:    config.Reexec,
-		}
-	}
-	return api.traceTx(ctx, msg, new(Context), vmctx, statedb, traceConfig)
+	return statedb, nil
 }
 
 // traceTx configures a new tracer according to the provided configuration, and
@@ -858,16 +1194,19 @@ func (api *API) traceTx(ctx context.Context, message core.Message, txctx *Contex
 				return nil, err
 			}
 		}
-		// Constuct the JavaScript tracer to execute with
-		if tracer, err = New(*config.Tracer, txctx); err != nil {
+		// Constuct the native or JavaScript tracer to execute with
+		t, err := New(*config.Tracer, txctx, config.TracerConfig)
+		if err != nil {
 			return nil, err
 		}
+		tracer = t
+
 		// Handle timeouts and RPC cancellations
 		deadlineCtx, cancel := context.WithTimeout(ctx, timeout)
 		go func() {
 			<-deadlineCtx.Done()
 			if deadlineCtx.Err() == context.DeadlineExceeded {
-				tracer.(*Tracer).Stop(errors.New("execution timeout"))
+				t.Stop(errors.New("execution timeout"))
 			}
 		}()
 		defer cancel()
@@ -904,7 +1243,7 @@ func (api *API) traceTx(ctx context.Context, message core.Message, txctx *Contex
 			StructLogs:  ethapi.FormatLogs(tracer.StructLogs()),
 		}, nil
 
-	case *Tracer:
+	case Tracer:
 		return tracer.GetResult()
 
 	default:
@@ -17,6 +17,7 @@
 package tracers
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/ecdsa"
@@ -24,8 +25,12 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -41,8 +46,10 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/internal/ethapi"
+	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 var (
@@ -416,6 +423,36 @@ func TestOverriddenTraceCall(t *testing.T) {
 				Value:   (*hexutil.Big)(big.NewInt(0)),
 			},
 		},
+		// Successful call with block overriding, returning the block number
+		{
+			blockNumber: rpc.PendingBlockNumber,
+			call: ethapi.TransactionArgs{
+				From: &randomAccounts[0].addr,
+				To:   &randomAccounts[2].addr,
+			},
+			config: &TraceCallConfig{
+				Tracer: &tracer,
+				StateOverrides: &ethapi.StateOverride{
+					randomAccounts[2].addr: ethapi.OverrideAccount{
+						Code: newRPCBytes(common.Hex2Bytes("4360005260206000f3")), // NUMBER PUSH1 0 MSTORE PUSH1 32 PUSH1 0 RETURN
+					},
+				},
+				BlockOverrides: &ethapi.BlockOverrides{
+					Number: (*hexutil.Big)(big.NewInt(1337)),
+				},
+			},
+			expectErr: nil,
+			expect: &callTrace{
+				Type:    "CALL",
+				From:    randomAccounts[0].addr,
+				To:      randomAccounts[2].addr,
+				Input:   hexutil.Bytes{},
+				Output:  hexutil.Bytes(common.BigToHash(big.NewInt(1337)).Bytes()),
+				Gas:     newRPCUint64(24979000),
+				GasUsed: newRPCUint64(17),
+				Value:   (*hexutil.Big)(big.NewInt(0)),
+			},
+		},
 	}
 	for i, testspec := range testSuite {
 		result, err := api.TraceCall(context.Background(), testspec.call, rpc.BlockNumberOrHash{BlockNumber: &testspec.blockNumber}, testspec.config)
@@ -447,6 +484,102 @@ func TestOverriddenTraceCall(t *testing.T) {
 	}
 }
 
+func TestTraceCallMany(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(3)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[2].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 10
+	signer := types.HomesteadSigner{}
+	api := NewAPI(newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	}))
+	var (
+		randomAccounts = newAccounts(3)
+		tracer         = "callTracer"
+		counter        = randomAccounts[2].addr
+		number         = common.HexToAddress("0x1337")
+	)
+	config := &TraceCallConfig{
+		Tracer: &tracer,
+		StateOverrides: &ethapi.StateOverride{
+			randomAccounts[0].addr: ethapi.OverrideAccount{Balance: newRPCBalance(big.NewInt(params.Ether))},
+			// Increments the value of slot 0 and returns it
+			counter: ethapi.OverrideAccount{Code: newRPCBytes(common.Hex2Bytes("6000546001018060005560005260206000f3"))},
+			// Returns the block number
+			number: ethapi.OverrideAccount{Code: newRPCBytes(common.Hex2Bytes("4360005260206000f3"))},
+		},
+		BlockOverrides: &ethapi.BlockOverrides{
+			Number: (*hexutil.Big)(big.NewInt(100)),
+		},
+	}
+	bundles := []*Bundle{
+		{
+			Transactions: []ethapi.TransactionArgs{
+				// Fund an empty account, so it can send funds in the next bundle
+				{From: &randomAccounts[0].addr, To: &randomAccounts[1].addr, Value: (*hexutil.Big)(big.NewInt(1000))},
+				{From: &randomAccounts[0].addr, To: &counter},
+				{From: &randomAccounts[0].addr, To: &number},
+			},
+		},
+		{
+			Transactions: []ethapi.TransactionArgs{
+				{From: &randomAccounts[1].addr, To: &accounts[0].addr, Value: (*hexutil.Big)(big.NewInt(1000))},
+				{From: &randomAccounts[0].addr, To: &counter},
+				{From: &randomAccounts[0].addr, To: &counter},
+				{From: &randomAccounts[0].addr, To: &number},
+			},
+			BlockOverrides: &ethapi.BlockOverrides{
+				Number: (*hexutil.Big)(big.NewInt(200)),
+			},
+		},
+	}
+	want := [][]hexutil.Bytes{
+		{nil, common.BigToHash(big.NewInt(1)).Bytes(), common.BigToHash(big.NewInt(100)).Bytes()},
+		{nil, common.BigToHash(big.NewInt(2)).Bytes(), common.BigToHash(big.NewInt(3)).Bytes(), common.BigToHash(big.NewInt(200)).Bytes()},
+	}
+	results, err := api.TraceCallMany(context.Background(), bundles, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), config)
+	if err != nil {
+		t.Fatalf("failed to trace call bundles: %v", err)
+	}
+	if len(results) != len(want) {
+		t.Fatalf("bundle count mismatch: have %d, want %d", len(results), len(want))
+	}
+	for i := range want {
+		if len(results[i]) != len(want[i]) {
+			t.Fatalf("bundle %d: call count mismatch: have %d, want %d", i, len(results[i]), len(want[i]))
+		}
+		for j, output := range want[i] {
+			ret := new(callTrace)
+			if err := json.Unmarshal(results[i][j].(json.RawMessage), ret); err != nil {
+				t.Fatalf("bundle %d, call %d: failed to unmarshal trace result: %v", i, j, err)
+			}
+			if ret.Error != "" {
+				t.Errorf("bundle %d, call %d: unexpected failure: %v", i, j, ret.Error)
+			}
+			if !bytes.Equal(ret.Output, output) {
+				t.Errorf("bundle %d, call %d: output mismatch: have %x, want %x", i, j, []byte(ret.Output), []byte(output))
+			}
+		}
+	}
+	// Without the state of the first bundle, the transfer in the second one fails
+	if _, err := api.TraceCallMany(context.Background(), bundles[1:], rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), config); !errors.Is(err, core.ErrInsufficientFunds) {
+		t.Errorf("error mismatch: have %v, want %v", err, core.ErrInsufficientFunds)
+	}
+	if _, err := api.TraceCallMany(context.Background(), nil, rpc.BlockNumberOrHashWithNumber(rpc.LatestBlockNumber), config); err == nil {
+		t.Errorf("expected error for empty bundle list")
+	}
+}
+
 func TestTraceTransaction(t *testing.T) {
 	t.Parallel()
 
@@ -480,6 +613,49 @@ func TestTraceTransaction(t *testing.T) {
 	}
 }
 
+func TestTracerConfig(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	target := common.Hash{}
+	signer := types.HomesteadSigner{}
+	api := NewAPI(newTestBackend(t, 1, genesis, func(i int, b *core.BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+		target = tx.Hash()
+	}))
+	tracer := "{cfg: null, setup: function(cfg) { if (cfg.fail) throw new Error('invalid config'); this.cfg = cfg; }, step: function() {}, fault: function() {}, result: function() { return this.cfg.echo; }}"
+
+	// Tracing with a valid config should hand it to the tracer
+	result, err := api.TraceTransaction(context.Background(), target, &TraceConfig{
+		Tracer:       &tracer,
+		TracerConfig: json.RawMessage(`{"echo": "hello"}`),
+	})
+	if err != nil {
+		t.Fatalf("Failed to trace transaction: %v", err)
+	}
+	if have := string(result.(json.RawMessage)); have != `"hello"` {
+		t.Errorf("Tracer config mismatch: have %s, want %s", have, `"hello"`)
+	}
+	// Tracing with an invalid config should return the validation error
+	_, err = api.TraceCall(context.Background(), ethapi.TransactionArgs{
+		From:  &accounts[0].addr,
+		To:    &accounts[1].addr,
+		Value: (*hexutil.Big)(big.NewInt(1000)),
+	}, rpc.BlockNumberOrHash{BlockNumber: new(rpc.BlockNumber)}, &TraceCallConfig{
+		Tracer:       &tracer,
+		TracerConfig: json.RawMessage(`{"fail": true}`),
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid config") {
+		t.Errorf("Expected tracer config validation error, got %v", err)
+	}
+}
+
 func TestTraceBlock(t *testing.T) {
 	t.Parallel()
 
@@ -591,6 +767,423 @@ func TestTraceBlock(t *testing.T) {
 	}
 }
 
+func TestTraceChain(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(3)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[2].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 12
+	signer := types.HomesteadSigner{}
+	nonce := uint64(0)
+	backend := newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Leave every third block empty
+		if i%3 == 0 {
+			return
+		}
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(nonce, accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+		nonce++
+	})
+	api := NewAPI(backend)
+
+	var testSuite = []struct {
+		start, end uint64
+		inflight   uint64
+		expect     []uint64
+	}{
+		{start: 0, end: 12, inflight: 0, expect: []uint64{2, 3, 5, 6, 8, 9, 11, 12}},
+		{start: 0, end: 12, inflight: 1, expect: []uint64{2, 3, 5, 6, 8, 9, 11, 12}},
+		{start: 5, end: 10, inflight: 2, expect: []uint64{6, 8, 9, 10}}, // end block always delivered
+		{start: 9, end: 10, inflight: 4, expect: []uint64{10}},
+	}
+	for i, tc := range testSuite {
+		from, _ := backend.BlockByNumber(context.Background(), rpc.BlockNumber(tc.start))
+		to, _ := backend.BlockByNumber(context.Background(), rpc.BlockNumber(tc.end))
+
+		inflight := tc.inflight
+		config := &TraceChainConfig{InflightBlocks: &inflight}
+
+		var have []uint64
+		for result := range api.traceChain(from, to, config, make(chan interface{})) {
+			have = append(have, uint64(result.Block))
+			if want := uint64(result.Block)%3 != 1; want != (len(result.Traces) > 0) {
+				t.Errorf("test %d, block %d: trace count mismatch: have %d", i, result.Block, len(result.Traces))
+			}
+			for j, trace := range result.Traces {
+				if trace.Error != "" {
+					t.Errorf("test %d, block %d, tx %d: tracing failed: %v", i, result.Block, j, trace.Error)
+				}
+			}
+		}
+		if !reflect.DeepEqual(have, tc.expect) {
+			t.Errorf("test %d: delivered blocks mismatch: have %v, want %v", i, have, tc.expect)
+		}
+	}
+	// Abort tracing midway and ensure the stream terminates. The results of the
+	// first run double as a cursor to resume tracing from.
+	var (
+		from, _  = backend.BlockByNumber(context.Background(), 0)
+		to, _    = backend.BlockByNumber(context.Background(), rpc.BlockNumber(genBlocks))
+		inflight = uint64(1)
+		closed   = make(chan interface{})
+		cursor   uint64
+	)
+	resCh := api.traceChain(from, to, &TraceChainConfig{InflightBlocks: &inflight}, closed)
+	for result := range resCh {
+		cursor = uint64(result.Block)
+		close(closed)
+		break
+	}
+	select {
+	case _, ok := <-resCh:
+		if ok {
+			// A single result might have been in flight already, the stream
+			// must terminate right after though.
+			if _, ok := <-resCh; ok {
+				t.Fatalf("stream not terminated after abort")
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stream not terminated after abort")
+	}
+	from, _ = backend.BlockByNumber(context.Background(), rpc.BlockNumber(cursor))
+	var have []uint64
+	for result := range api.traceChain(from, to, nil, make(chan interface{})) {
+		have = append(have, uint64(result.Block))
+	}
+	if want := []uint64{3, 5, 6, 8, 9, 11, 12}; !reflect.DeepEqual(have, want) {
+		t.Errorf("resumed blocks mismatch: have %v, want %v", have, want)
+	}
+}
+
+// regenBackend is a test backend regenerating the requested states on top of the
+// given base ones in a temporary trie database, the same way a pruned node does.
+type regenBackend struct {
+	*testBackend
+	database    state.Database // Temporary database holding the regenerated states
+	regenerated uint64         // Number of blocks regenerated (atomic)
+}
+
+func (b *regenBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool) (*state.StateDB, error) {
+	if base == nil {
+		b.database = state.NewDatabaseWithConfig(b.chaindb, &trie.Config{Cache: 16})
+		return state.New(block.Root(), b.database, nil)
+	}
+	if _, _, _, err := b.chain.Processor().Process(block, base, vm.Config{}); err != nil {
+		return nil, err
+	}
+	root, err := base.Commit(b.chainConfig.IsEIP158(block.Number()))
+	if err != nil {
+		return nil, err
+	}
+	if root != block.Root() {
+		return nil, fmt.Errorf("block %d: root mismatch: have %x, want %x", block.NumberU64(), root, block.Root())
+	}
+	statedb, err := state.New(root, base.Database(), nil)
+	if err != nil {
+		return nil, err
+	}
+	base.Database().TrieDB().Reference(root, common.Hash{})
+	atomic.AddUint64(&b.regenerated, 1)
+	return statedb, nil
+}
+
+func TestTraceChainCheckpoints(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(3)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[2].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 20
+	signer := types.HomesteadSigner{}
+	backend := newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	})
+	var (
+		from, _ = backend.BlockByNumber(context.Background(), 2)
+		to, _   = backend.BlockByNumber(context.Background(), rpc.BlockNumber(genBlocks))
+		blocks  = uint64(genBlocks - 2)
+	)
+	// Trace the range on an archive node as reference
+	var want []*blockTraceResult
+	for result := range NewAPI(backend).traceChain(from, to, nil, make(chan interface{})) {
+		want = append(want, result)
+	}
+	for _, interval := range []uint64{1, 3, 7, 100} {
+		var (
+			regen    = &regenBackend{testBackend: backend}
+			inflight = uint64(4)
+			config   = &TraceChainConfig{InflightBlocks: &inflight, CheckpointInterval: &interval}
+			have     []*blockTraceResult
+		)
+		for result := range NewAPI(regen).traceChain(from, to, config, make(chan interface{})) {
+			have = append(have, result)
+		}
+		if len(have) != len(want) {
+			t.Fatalf("interval %d: result count mismatch: have %d, want %d", interval, len(have), len(want))
+		}
+		for i := range have {
+			if have[i].Hash != want[i].Hash || !reflect.DeepEqual(have[i].Traces, want[i].Traces) {
+				t.Errorf("interval %d, block %d: trace mismatch", interval, have[i].Block)
+			}
+			if progress := have[i].Progress; uint64(progress.Traced) != uint64(have[i].Block)-2 || uint64(progress.Traced+progress.Remaining) != blocks {
+				t.Errorf("interval %d, block %d: progress mismatch: %+v", interval, have[i].Block, progress)
+			}
+		}
+		// Checkpointing regenerates all but the last segment, the first one block
+		// by block for tracing, the others are regenerated again by the tracers
+		first := interval
+		if first > blocks {
+			first = blocks
+		}
+		segments := (blocks - first + interval - 1) / interval
+		executed := first - 1
+		if segments > 0 {
+			executed = segments*interval + (blocks - first - segments)
+		}
+		if regenerated := atomic.LoadUint64(&regen.regenerated); regenerated != executed {
+			t.Errorf("interval %d: regenerated blocks mismatch: have %d, want %d", interval, regenerated, executed)
+		}
+		// All the checkpoints and intermediate states should have been released
+		if size, _ := regen.database.TrieDB().Size(); size != 0 {
+			t.Errorf("interval %d: trie nodes leaked: %v", interval, size)
+		}
+	}
+}
+
+// failingBackend is a regenBackend failing to regenerate the state of a block.
+type failingBackend struct {
+	*regenBackend
+	fail uint64 // Number of the block whose state can't be regenerated
+}
+
+func (b *failingBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool) (*state.StateDB, error) {
+	if block.NumberU64() == b.fail {
+		return nil, errStateNotFound
+	}
+	return b.regenBackend.StateAtBlock(ctx, block, reexec, base, checkLive)
+}
+
+func TestTraceChainFailure(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 12
+	signer := types.HomesteadSigner{}
+	backend := newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	})
+	from, _ := backend.BlockByNumber(context.Background(), 0)
+	to, _ := backend.BlockByNumber(context.Background(), rpc.BlockNumber(genBlocks))
+
+	// Fail both in the first segment, traced off the checkpointing, and in a
+	// later one, re-executed by the tracers
+	for _, fail := range []uint64{2, 8} {
+		var (
+			failing  = &failingBackend{regenBackend: &regenBackend{testBackend: backend}, fail: fail}
+			interval = uint64(4)
+			config   = &TraceChainConfig{CheckpointInterval: &interval}
+			results  []*blockTraceResult
+		)
+		for result := range NewAPI(failing).traceChain(from, to, config, make(chan interface{})) {
+			results = append(results, result)
+		}
+		if len(results) == 0 {
+			t.Fatalf("fail %d: no results delivered", fail)
+		}
+		last := results[len(results)-1]
+		if last.Error == "" {
+			t.Fatalf("fail %d: failure not delivered", fail)
+		}
+		// The state of the failing block is needed to trace the next one
+		if uint64(last.Block) > fail+1 {
+			t.Errorf("fail %d: failure delivered at block %d", fail, last.Block)
+		}
+		if header, _ := backend.HeaderByNumber(context.Background(), rpc.BlockNumber(last.Block)); last.Hash != header.Hash() {
+			t.Errorf("fail %d: failed block hash mismatch: have %x, want %x", fail, last.Hash, header.Hash())
+		}
+		for i, result := range results[:len(results)-1] {
+			if result.Error != "" {
+				t.Errorf("fail %d, block %d: unexpected failure: %v", fail, result.Block, result.Error)
+			}
+			if uint64(result.Block) != uint64(i)+1 {
+				t.Errorf("fail %d: result %d block mismatch: have %d, want %d", fail, i, result.Block, i+1)
+			}
+		}
+		if uint64(last.Block) != uint64(len(results)) {
+			t.Errorf("fail %d: failed block mismatch: have %d, want %d", fail, last.Block, len(results))
+		}
+	}
+}
+
+func TestTraceChainStream(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 5
+	signer := types.HomesteadSigner{}
+	srv := httptest.NewServer(NewChainStreamHandler(newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	})))
+	defer srv.Close()
+
+	// Invalid requests should be rejected before streaming starts
+	for _, body := range []string{`{"start": "0x2", "end": "0x1"}`, `{"start": `} {
+		res, err := http.Post(srv.URL, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("request %s: status mismatch: have %d, want %d", body, res.StatusCode, http.StatusBadRequest)
+		}
+	}
+	// Stream a chain segment and check each line is a standalone result
+	res, err := http.Post(srv.URL, "application/json", strings.NewReader(`{"start": "0x1", "end": "latest", "config": {"tracer": "{data: [], fault: function(log) {}, step: function(log) {}, result: function() { return 1 }}", "inflightBlocks": 1}}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	if ct := res.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("content type mismatch: have %q", ct)
+	}
+	var (
+		scanner = bufio.NewScanner(res.Body)
+		next    = uint64(2)
+	)
+	for scanner.Scan() {
+		var result struct {
+			Block  hexutil.Uint64    `json:"block"`
+			Traces []json.RawMessage `json:"traces"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("invalid stream line %q: %v", scanner.Text(), err)
+		}
+		if uint64(result.Block) != next {
+			t.Fatalf("block mismatch: have %d, want %d", result.Block, next)
+		}
+		if len(result.Traces) != 1 || !strings.Contains(string(result.Traces[0]), `"result":1`) {
+			t.Errorf("block %d: unexpected traces: %s", result.Block, result.Traces)
+		}
+		next++
+	}
+	if next != uint64(genBlocks)+1 {
+		t.Errorf("stream ended early at block %d", next-1)
+	}
+}
+
+// slowBackend is a test backend taking its time to retrieve blocks.
+type slowBackend struct {
+	*testBackend
+	delay time.Duration
+}
+
+func (b *slowBackend) BlockByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Block, error) {
+	time.Sleep(b.delay)
+	return b.testBackend.BlockByNumber(ctx, number)
+}
+
+func TestTraceChainStreamWriteTimeout(t *testing.T) {
+	t.Parallel()
+
+	// Initialize test accounts
+	accounts := newAccounts(2)
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		accounts[0].addr: {Balance: big.NewInt(params.Ether)},
+		accounts[1].addr: {Balance: big.NewInt(params.Ether)},
+	}}
+	genBlocks := 10
+	signer := types.HomesteadSigner{}
+	backend := newTestBackend(t, genBlocks, genesis, func(i int, b *core.BlockGen) {
+		// Transfer from account[0] to account[1]
+		//    value: 1000 wei
+		//    fee:   0 wei
+		tx, _ := types.SignTx(types.NewTransaction(uint64(i), accounts[1].addr, big.NewInt(1000), params.TxGas, b.BaseFee(), nil), signer, accounts[0].key)
+		b.AddTx(tx)
+	})
+	// Stream through a node whose write timeout is way shorter than the time
+	// needed to trace the entire range, using the same handler stack as the
+	// node's own HTTP handlers.
+	timeouts := rpc.DefaultHTTPTimeouts
+	timeouts.WriteTimeout = time.Second
+
+	stack, err := node.New(&node.Config{HTTPHost: "127.0.0.1", HTTPTimeouts: timeouts})
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	defer stack.Close()
+
+	handler := NewChainStreamHandler(&slowBackend{testBackend: backend, delay: 200 * time.Millisecond})
+	stack.RegisterHandler("Chain trace stream", "/debug/traceChain", node.NewHTTPHandlerStack(handler, nil, nil))
+	if err := stack.Start(); err != nil {
+		t.Fatalf("failed to start node: %v", err)
+	}
+	start := time.Now()
+	res, err := http.Post(stack.HTTPEndpoint()+"/debug/traceChain", "application/json", strings.NewReader(`{"start": "0x0", "end": "latest", "config": {"inflightBlocks": 1}}`))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	var (
+		scanner = bufio.NewScanner(res.Body)
+		next    = uint64(1)
+	)
+	for scanner.Scan() {
+		var result struct {
+			Block hexutil.Uint64 `json:"block"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			t.Fatalf("invalid stream line %q: %v", scanner.Text(), err)
+		}
+		if uint64(result.Block) != next {
+			t.Fatalf("block mismatch: have %d, want %d", result.Block, next)
+		}
+		next++
+	}
+	if elapsed := time.Since(start); elapsed < timeouts.WriteTimeout {
+		t.Fatalf("stream finished within the write timeout: %v", elapsed)
+	}
+	if next != uint64(genBlocks)+1 {
+		t.Errorf("stream cut at block %d, error: %v", next-1, scanner.Err())
+	}
+}
+
 type Account struct {
 	key  *ecdsa.PrivateKey
 	addr common.Address
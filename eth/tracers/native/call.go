@@ -0,0 +1,274 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package native is a collection of tracers written in Go, which are much faster
+// than their JavaScript counterparts while producing identical results.
+//
+// The tracers register themselves with the tracers package on import, so any
+// program wishing to make them available needs to import this package, e.g.
+//
+//	import _ "github.com/ethereum/go-ethereum/eth/tracers/native"
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.RegisterNativeTracer("callTracerNative", newCallTracer)
+}
+
+// callFrame is a single call frame of the call tracer. The field order matches
+// the one produced by the JavaScript call tracer.
+type callFrame struct {
+	Type    string      `json:"type"`
+	From    string      `json:"from"`
+	To      string      `json:"to,omitempty"`
+	Value   string      `json:"value,omitempty"`
+	Gas     string      `json:"gas"`
+	GasUsed string      `json:"gasUsed"`
+	Input   string      `json:"input"`
+	Output  string      `json:"output,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Logs    []callLog   `json:"logs,omitempty"`
+	Calls   []callFrame `json:"calls,omitempty"`
+}
+
+// callLog is an event log emitted within a call frame.
+type callLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+	// Position of the log relative to the subcalls within the same frame
+	Position hexutil.Uint `json:"position"`
+}
+
+// callTracerConfig are the configuration options of the call tracer.
+type callTracerConfig struct {
+	OnlyTopCall bool `json:"onlyTopCall"` // If true, call tracer won't collect any subcalls
+	WithLog     bool `json:"withLog"`     // If true, call tracer will collect event logs
+}
+
+// callTracer is the native Go port of call_tracer.js, reporting the tree of
+// internal calls made during the execution of a transaction.
+type callTracer struct {
+	env       *vm.EVM
+	callstack []callFrame
+	config    callTracerConfig
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+}
+
+// newCallTracer returns a native go tracer which tracks
+// call frames of a tx, and implements vm.Tracer.
+func newCallTracer(cfg json.RawMessage) (tracers.Tracer, error) {
+	var config callTracerConfig
+	if len(cfg) > 0 {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, fmt.Errorf("invalid call tracer config: %v", err)
+		}
+	}
+	// First callframe contains tx context info
+	// and is populated on start and end.
+	return &callTracer{callstack: make([]callFrame, 1), config: config}, nil
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *callTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.callstack[0] = callFrame{
+		Type:  "CALL",
+		From:  addrToHex(from),
+		To:    addrToHex(to),
+		Input: bytesToHex(input),
+		Gas:   uintToHex(gas),
+		Value: bigToHex(value),
+	}
+	if create {
+		t.callstack[0].Type = "CREATE"
+	}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *callTracer) CaptureEnd(output []byte, gasUsed uint64, _ time.Duration, err error) {
+	t.callstack[0].GasUsed = uintToHex(gasUsed)
+	if err != nil {
+		t.callstack[0].Error = err.Error()
+		if err == vm.ErrExecutionReverted && len(output) > 0 {
+			t.callstack[0].Output = bytesToHex(output)
+		}
+	} else {
+		t.callstack[0].Output = bytesToHex(output)
+	}
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *callTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// Only logging opcodes are of interest, if they were requested at all
+	if !t.config.WithLog || op < vm.LOG0 || op > vm.LOG4 {
+		return
+	}
+	// Skip failed instructions, neither the stack nor the memory was validated
+	if err != nil {
+		return
+	}
+	// Skip if tracing was interrupted or the frame isn't being tracked
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		env.Cancel()
+		return
+	}
+	if t.config.OnlyTopCall && depth > 1 {
+		return
+	}
+	var (
+		stack  = scope.Stack.Data()
+		offset = stack[len(stack)-1]
+		size   = stack[len(stack)-2]
+		topics = make([]common.Hash, int(op-vm.LOG0))
+	)
+	for i := range topics {
+		topics[i] = common.Hash(stack[len(stack)-3-i].Bytes32())
+	}
+	frame := &t.callstack[len(t.callstack)-1]
+	frame.Logs = append(frame.Logs, callLog{
+		Address:  scope.Contract.Address(),
+		Topics:   topics,
+		Data:     scope.Memory.GetCopy(int64(offset.Uint64()), int64(size.Uint64())),
+		Position: hexutil.Uint(len(frame.Calls)),
+	})
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault.
+func (t *callTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *callTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	if t.config.OnlyTopCall {
+		return
+	}
+	// Skip if tracing was interrupted
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.env.Cancel()
+		return
+	}
+	call := callFrame{
+		Type:  typ.String(),
+		From:  addrToHex(from),
+		To:    addrToHex(to),
+		Input: bytesToHex(input),
+		Gas:   uintToHex(gas),
+		Value: bigToHex(value),
+	}
+	t.callstack = append(t.callstack, call)
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *callTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if t.config.OnlyTopCall {
+		return
+	}
+	size := len(t.callstack)
+	if size <= 1 {
+		return
+	}
+	// Pop the call frame off the stack
+	call := t.callstack[size-1]
+	t.callstack = t.callstack[:size-1]
+	size -= 1
+
+	call.GasUsed = uintToHex(gasUsed)
+	if err == nil {
+		call.Output = bytesToHex(output)
+	} else {
+		call.Error = err.Error()
+		if call.Type == "CREATE" || call.Type == "CREATE2" {
+			call.To = ""
+		}
+	}
+	t.callstack[size-1].Calls = append(t.callstack[size-1].Calls, call)
+}
+
+// GetResult returns the json-encoded nested list of call traces, and any
+// error arising from the encoding or forceful termination (via `Stop`).
+func (t *callTracer) GetResult() (json.RawMessage, error) {
+	if len(t.callstack) != 1 {
+		return nil, errors.New("incorrect number of top-level calls")
+	}
+	if t.config.WithLog {
+		clearFailedLogs(&t.callstack[0], false)
+	}
+	res, err := json.Marshal(t.callstack[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(res), t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *callTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// clearFailedLogs drops the logs of all the frames which failed or had one of
+// their ancestors fail, since their effects were reverted.
+func clearFailedLogs(frame *callFrame, parentFailed bool) {
+	failed := frame.Error != "" || parentFailed
+	if failed {
+		frame.Logs = nil
+	}
+	for i := range frame.Calls {
+		clearFailedLogs(&frame.Calls[i], failed)
+	}
+}
+
+// addrToHex formats an address the same way the toHex JavaScript helper does.
+func addrToHex(a common.Address) string {
+	return strings.ToLower(a.Hex())
+}
+
+// bytesToHex formats a byte slice the same way the toHex JavaScript helper does.
+func bytesToHex(s []byte) string {
+	return hexutil.Encode(s)
+}
+
+// bigToHex formats a big integer as a 0x prefixed hex quantity, or returns the
+// empty string if the number is missing altogether.
+func bigToHex(n *big.Int) string {
+	if n == nil {
+		return ""
+	}
+	return hexutil.EncodeBig(n)
+}
+
+// uintToHex formats an integer as a 0x prefixed hex quantity.
+func uintToHex(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
@@ -0,0 +1,351 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func init() {
+	tracers.RegisterNativeTracer("gasProfilerNative", newGasProfiler)
+}
+
+// Leaf names of the gas surcharges, reported below the instruction paying them.
+const (
+	memoryExpansionLeaf = "memory_expansion"
+	coldAccessLeaf      = "cold_access"
+	codeDepositLeaf     = "code_deposit"
+)
+
+// gasOp is an instruction whose gas usage is only known once the next one in
+// the same frame starts, or the frame exits.
+type gasOp struct {
+	op       vm.OpCode
+	gas      uint64 // Gas available before the instruction
+	memory   uint64 // Gas paid for memory expansion
+	children uint64 // Gas used by the call frames entered by the instruction
+	failed   bool   // Whether the instruction failed, consuming all gas
+
+	copySize   uint64 // Number of bytes copied by EXTCODECOPY
+	value      bool   // Whether the call transfers value
+	newAccount bool   // Whether the call transfers value to an empty account
+}
+
+// gasFrame is a call frame being profiled.
+type gasFrame struct {
+	path    string // Collapsed stack of the frame, rooted at the transaction
+	gas     uint64 // Gas available to the frame
+	create  bool   // Whether the frame runs init code
+	memSize uint64 // Memory size after the last instruction
+	pending *gasOp // Last instruction executed in the frame
+}
+
+// gasProfiler attributes the gas used by a transaction to the call frames, the
+// contracts and the instructions spending it, along with the surcharges paid for
+// memory expansion and cold state accesses. The profile is returned in the
+// collapsed stack format, one line per stack with the gas spent in it, which is
+// accepted as is by flame graph tools.
+//
+// Example:
+//
+//	> debug.traceTransaction( "0xb9ea...", {tracer: "gasProfilerNative"})
+//	"CALL:0x7a25...;CALL:0x6b17...;SLOAD 100\nCALL:0x7a25...;CALL:0x6b17...;SLOAD;cold_access 2000\n..."
+type gasProfiler struct {
+	env       *vm.EVM
+	berlin    bool
+	frames    []*gasFrame // Frames being executed, nil for pseudo-frames of SELFDESTRUCT
+	samples   map[string]uint64
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+}
+
+// newGasProfiler returns a native go tracer which profiles the gas usage of a
+// transaction, and implements vm.Tracer.
+func newGasProfiler(cfg json.RawMessage) (tracers.Tracer, error) {
+	if !tracers.IsEmptyConfig(cfg) {
+		return nil, tracers.ErrConfigUnsupported
+	}
+	return &gasProfiler{samples: make(map[string]uint64)}, nil
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *gasProfiler) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.berlin = env.ChainConfig().IsBerlin(env.Context.BlockNumber)
+
+	typ := vm.CALL
+	if create {
+		typ = vm.CREATE
+	}
+	t.frames = []*gasFrame{{path: frameLabel(typ, to), gas: gas, create: create}}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *gasProfiler) CaptureEnd(output []byte, gasUsed uint64, _ time.Duration, err error) {
+	if len(t.frames) > 0 {
+		t.exit(t.frames[0], output, gasUsed, err)
+	}
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *gasProfiler) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// Skip if tracing was interrupted
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.env.Cancel()
+		return
+	}
+	if depth > len(t.frames) || t.frames[depth-1] == nil {
+		return
+	}
+	frame := t.frames[depth-1]
+
+	// The previous instruction completed, attribute the gas it used
+	if frame.pending != nil {
+		t.settle(frame, gas)
+	}
+	pending := &gasOp{op: op, gas: gas, failed: err != nil}
+	if err == nil {
+		// Memory is already expanded for the instruction, account for the growth
+		size := uint64(scope.Memory.Len())
+		if size > frame.memSize {
+			pending.memory = memoryGas(size) - memoryGas(frame.memSize)
+			frame.memSize = size
+		}
+		stack := scope.Stack
+		switch op {
+		case vm.EXTCODECOPY:
+			pending.copySize = stack.Back(3).Uint64()
+		case vm.CALL, vm.CALLCODE:
+			pending.value = stack.Back(2).Sign() != 0
+			if op == vm.CALL && pending.value {
+				pending.newAccount = env.StateDB.Empty(common.Address(stack.Back(1).Bytes20()))
+			}
+		}
+	}
+	frame.pending = pending
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault.
+func (t *gasProfiler) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+	// Reverts return the remaining gas, only failures consume all of it
+	if err == vm.ErrExecutionReverted || depth > len(t.frames) || t.frames[depth-1] == nil {
+		return
+	}
+	if pending := t.frames[depth-1].pending; pending != nil {
+		pending.failed = true
+	}
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *gasProfiler) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	// Self destructs are reported as pseudo-calls, they don't run any code
+	if typ == vm.SELFDESTRUCT {
+		t.frames = append(t.frames, nil)
+		return
+	}
+	var path string
+	if parent := t.frames[len(t.frames)-1]; parent != nil {
+		path = parent.path + ";"
+	}
+	t.frames = append(t.frames, &gasFrame{
+		path:   path + frameLabel(typ, to),
+		gas:    gas,
+		create: typ == vm.CREATE || typ == vm.CREATE2,
+	})
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *gasProfiler) CaptureExit(output []byte, gasUsed uint64, err error) {
+	size := len(t.frames)
+	if size <= 1 {
+		return
+	}
+	frame := t.frames[size-1]
+	t.frames = t.frames[:size-1]
+	if frame == nil {
+		return
+	}
+	t.exit(frame, output, gasUsed, err)
+
+	// Charge the gas of the frame to the instruction that entered it
+	if parent := t.frames[size-2]; parent != nil && parent.pending != nil {
+		parent.pending.children += gasUsed
+	}
+}
+
+// GetResult returns the json-encoded gas profile in the collapsed stack format,
+// and any error arising from the encoding or forceful termination (via `Stop`).
+func (t *gasProfiler) GetResult() (json.RawMessage, error) {
+	if t.env == nil {
+		return nil, errors.New("no transaction traced")
+	}
+	stacks := make([]string, 0, len(t.samples))
+	for stack, gas := range t.samples {
+		stacks = append(stacks, fmt.Sprintf("%s %d", stack, gas))
+	}
+	sort.Strings(stacks)
+
+	res, err := json.Marshal(strings.Join(stacks, "\n"))
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(res), t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *gasProfiler) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// exit attributes the gas used by a frame which isn't accounted for by any of
+// its instructions yet: the last instruction, the code deposit of contract
+// creations, and the execution of precompiles.
+func (t *gasProfiler) exit(frame *gasFrame, output []byte, gasUsed uint64, err error) {
+	var deposit uint64
+	if frame.create && err == nil {
+		deposit = uint64(len(output)) * params.CreateDataGas
+		t.sample(frame.path+";"+codeDepositLeaf, deposit)
+	}
+	left := frame.gas - gasUsed
+	if frame.pending != nil {
+		t.settle(frame, left+deposit)
+		return
+	}
+	// Frames without any instructions are calls into precompiles or accounts
+	// without code, charge them as a whole
+	if gasUsed > deposit {
+		t.sample(frame.path, gasUsed-deposit)
+	}
+}
+
+// settle attributes the gas used by the pending instruction of a frame, given
+// the gas available to the frame after it.
+func (t *gasProfiler) settle(frame *gasFrame, gas uint64) {
+	pending := frame.pending
+	frame.pending = nil
+
+	var used uint64
+	if pending.gas > gas+pending.children {
+		used = pending.gas - gas - pending.children
+	}
+	path := frame.path + ";" + pending.op.String()
+	if pending.failed {
+		t.sample(path, used)
+		return
+	}
+	memory := pending.memory
+	if memory > used {
+		memory = used
+	}
+	cold := t.coldSurcharge(pending, used-memory)
+
+	t.sample(path, used-memory-cold)
+	t.sample(path+";"+memoryExpansionLeaf, memory)
+	t.sample(path+";"+coldAccessLeaf, cold)
+}
+
+// coldSurcharge returns the surcharge paid by an instruction for accessing a
+// cold account or storage slot, as introduced by EIP-2929. As the access list
+// is already updated by the time the instruction is reported, the surcharge is
+// derived from the gas used apart from memory expansion.
+func (t *gasProfiler) coldSurcharge(op *gasOp, used uint64) uint64 {
+	if !t.berlin {
+		return 0
+	}
+	const (
+		warm        = params.WarmStorageReadCostEIP2929
+		coldAccount = params.ColdAccountAccessCostEIP2929 - params.WarmStorageReadCostEIP2929
+		coldSlot    = params.ColdSloadCostEIP2929
+	)
+	switch op.op {
+	case vm.SLOAD:
+		if used == params.ColdSloadCostEIP2929 {
+			return coldSlot - warm
+		}
+	case vm.SSTORE:
+		switch used {
+		case warm + coldSlot, params.SstoreResetGasEIP2200, params.SstoreSetGasEIP2200 + coldSlot:
+			return coldSlot
+		}
+	case vm.BALANCE, vm.EXTCODESIZE, vm.EXTCODEHASH:
+		if used == params.ColdAccountAccessCostEIP2929 {
+			return coldAccount
+		}
+	case vm.EXTCODECOPY:
+		copyGas := ((op.copySize + 31) / 32) * params.CopyGas
+		if used == warm+copyGas+coldAccount {
+			return coldAccount
+		}
+	case vm.SELFDESTRUCT:
+		switch used {
+		case params.SelfdestructGasEIP150 + params.ColdAccountAccessCostEIP2929,
+			params.SelfdestructGasEIP150 + params.CreateBySelfdestructGas + params.ColdAccountAccessCostEIP2929:
+			return params.ColdAccountAccessCostEIP2929
+		}
+	case vm.CALL, vm.CALLCODE, vm.DELEGATECALL, vm.STATICCALL:
+		// The callee gets a stipend for free when value is transferred, some of
+		// which might be returned to the caller
+		expect := warm + coldAccount
+		if op.value {
+			expect += params.CallValueTransferGas
+			if op.newAccount {
+				expect += params.CallNewAccountGas
+			}
+			if used+params.CallStipend == expect {
+				return coldAccount
+			}
+			return 0
+		}
+		if used == expect {
+			return coldAccount
+		}
+	}
+	return 0
+}
+
+// sample adds the gas spent in the given stack to the profile.
+func (t *gasProfiler) sample(stack string, gas uint64) {
+	if gas > 0 {
+		t.samples[stack] += gas
+	}
+}
+
+// frameLabel returns the name of a call frame in the collapsed stacks, made up
+// of the type of the call and the contract whose code is run.
+func frameLabel(typ vm.OpCode, addr common.Address) string {
+	return typ.String() + ":" + strings.ToLower(addr.Hex())
+}
+
+// memoryGas returns the gas cost of a memory of the given size in bytes.
+func memoryGas(size uint64) uint64 {
+	words := (size + 31) / 32
+	return words*params.MemoryGas + words*words/params.QuadCoeffDiv
+}
@@ -0,0 +1,317 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.RegisterNativeTracer("prestateTracerNative", newPrestateTracer)
+}
+
+// prestate is the genesis-style allocation of all the accounts touched by a
+// transaction, keyed by address.
+type prestate = map[common.Address]*account
+
+// account is the state of a single account prior to the execution of the
+// transaction.
+type account struct {
+	Balance string                      `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    string                      `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+}
+
+// accountDiff contains the fields of an account which were modified by the
+// transaction, reporting their values after its execution.
+type accountDiff struct {
+	Balance string                      `json:"balance,omitempty"`
+	Nonce   uint64                      `json:"nonce,omitempty"`
+	Code    string                      `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// stateDiff is the result of the prestate tracer in diff mode.
+type stateDiff struct {
+	Pre  prestate                        `json:"pre"`
+	Post map[common.Address]*accountDiff `json:"post"`
+}
+
+// prestateTracerConfig are the configuration options of the prestate tracer.
+type prestateTracerConfig struct {
+	DiffMode bool `json:"diffMode"` // If true, this tracer will return state modifications
+}
+
+// prestateTracer is the native Go port of prestate_tracer.js, which outputs
+// sufficient information to create a local execution of the transaction from
+// a custom assembled genesis block.
+//
+// In diff mode the tracer instead reports both the state prior to and after
+// the execution of the transaction, restricted to the accounts and fields it
+// modified. Accounts created by the transaction are only present in the post
+// state, whereas self-destructed (or otherwise deleted) accounts are only
+// present in the pre state.
+type prestateTracer struct {
+	env       *vm.EVM
+	prestate  prestate
+	create    bool
+	to        common.Address
+	gasLimit  uint64
+	config    prestateTracerConfig
+	exists    map[common.Address]bool // Whether an account existed prior to the transaction
+	interrupt uint32                  // Atomic flag to signal execution interruption
+	reason    error                   // Textual reason for the interruption
+}
+
+// newPrestateTracer returns a native go tracer which collects the pre-state of
+// all accounts and storage slots accessed by a transaction.
+func newPrestateTracer(cfg json.RawMessage) (tracers.Tracer, error) {
+	var config prestateTracerConfig
+	if len(cfg) > 0 {
+		if err := json.Unmarshal(cfg, &config); err != nil {
+			return nil, fmt.Errorf("invalid prestate tracer config: %v", err)
+		}
+	}
+	return &prestateTracer{
+		prestate: make(prestate),
+		config:   config,
+		exists:   make(map[common.Address]bool),
+	}, nil
+}
+
+// CaptureTxStart is invoked with the gas limit of the transaction before it is
+// executed, to restore the sender balance from the gas it purchased.
+func (t *prestateTracer) CaptureTxStart(gasLimit uint64) {
+	t.gasLimit = gasLimit
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *prestateTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.create = create
+	t.to = to
+
+	t.lookupAccount(from)
+	t.lookupAccount(to)
+	if t.config.DiffMode {
+		// The miner is credited with the fees after the execution finishes
+		t.lookupAccount(env.Context.Coinbase)
+	}
+	if create {
+		// The contract account was already created, but didn't exist before
+		t.exists[to] = false
+	}
+
+	// The recipient balance already includes the transferred value, deduct it
+	toBal := new(big.Int).Sub(t.env.StateDB.GetBalance(to), value)
+	t.prestate[to].Balance = bigToHex(toBal)
+
+	// The sender balance was already reduced by all the gas purchased by the
+	// transaction and, unless sending to itself, by the value. Add them back.
+	// If the message isn't executed as a transaction, approximate the purchased
+	// gas from the intrinsic gas plus the gas available for execution.
+	gasLimit := t.gasLimit
+	if gasLimit == 0 {
+		isHomestead := env.ChainConfig().IsHomestead(env.Context.BlockNumber)
+		isIstanbul := env.ChainConfig().IsIstanbul(env.Context.BlockNumber)
+		intrinsicGas, err := core.IntrinsicGas(input, nil, create, isHomestead, isIstanbul)
+		if err != nil {
+			return
+		}
+		gasLimit = intrinsicGas + gas
+	}
+	consumed := new(big.Int).Mul(env.TxContext.GasPrice, new(big.Int).SetUint64(gasLimit))
+
+	fromBal := new(big.Int).Add(t.env.StateDB.GetBalance(from), consumed)
+	if from != to {
+		fromBal.Add(fromBal, value)
+	}
+	t.prestate[from].Balance = bigToHex(fromBal)
+	t.prestate[from].Nonce--
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *prestateTracer) CaptureEnd(output []byte, gasUsed uint64, _ time.Duration, err error) {
+	if t.create && !t.config.DiffMode {
+		// We can blindly delete the contract prestate, as any existing state would
+		// have caused the transaction to be rejected as invalid in the first place.
+		delete(t.prestate, t.to)
+	}
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *prestateTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// Skip if tracing was interrupted
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		env.Cancel()
+		return
+	}
+	// Skip failed instructions, neither the stack nor the memory was validated
+	if err != nil {
+		return
+	}
+	stack := scope.Stack.Data()
+	switch {
+	case len(stack) >= 1 && (op == vm.SLOAD || op == vm.SSTORE):
+		slot := common.Hash(stack[len(stack)-1].Bytes32())
+		t.lookupStorage(scope.Contract.Address(), slot)
+
+	case len(stack) >= 1 && (op == vm.EXTCODECOPY || op == vm.EXTCODEHASH || op == vm.EXTCODESIZE || op == vm.BALANCE || op == vm.SELFDESTRUCT):
+		addr := common.Address(stack[len(stack)-1].Bytes20())
+		t.lookupAccount(addr)
+
+	case len(stack) >= 2 && (op == vm.DELEGATECALL || op == vm.CALL || op == vm.STATICCALL || op == vm.CALLCODE):
+		addr := common.Address(stack[len(stack)-2].Bytes20())
+		t.lookupAccount(addr)
+
+	case op == vm.CREATE:
+		addr := scope.Contract.Address()
+		nonce := t.env.StateDB.GetNonce(addr)
+		t.lookupAccount(crypto.CreateAddress(addr, nonce))
+
+	case len(stack) >= 4 && op == vm.CREATE2:
+		offset, size := stack[len(stack)-2], stack[len(stack)-3]
+		init := scope.Memory.GetCopy(int64(offset.Uint64()), int64(size.Uint64()))
+		salt := stack[len(stack)-4]
+		t.lookupAccount(crypto.CreateAddress2(scope.Contract.Address(), salt.Bytes32(), crypto.Keccak256(init)))
+	}
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault.
+func (t *prestateTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *prestateTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *prestateTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+}
+
+// GetResult returns the json-encoded prestate of the touched accounts, and
+// any error arising from the encoding or forceful termination (via `Stop`).
+//
+// In diff mode the post state is read from the state database, so the result
+// must be retrieved right after the transaction has been applied.
+func (t *prestateTracer) GetResult() (json.RawMessage, error) {
+	var (
+		res []byte
+		err error
+	)
+	if t.config.DiffMode {
+		res, err = json.Marshal(t.diff())
+	} else {
+		res, err = json.Marshal(t.prestate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(res), t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *prestateTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// diff assembles the pre and post states of all the accounts modified by the
+// transaction, dropping the untouched accounts and fields.
+func (t *prestateTracer) diff() *stateDiff {
+	diff := &stateDiff{
+		Pre:  make(prestate),
+		Post: make(map[common.Address]*accountDiff),
+	}
+	for addr, pre := range t.prestate {
+		// Accounts deleted by the transaction are only reported in the pre state
+		if t.env.StateDB.HasSuicided(addr) || !t.env.StateDB.Exist(addr) {
+			if t.exists[addr] {
+				diff.Pre[addr] = pre
+			}
+			continue
+		}
+		var (
+			post     = &accountDiff{Storage: make(map[common.Hash]common.Hash)}
+			modified bool
+		)
+		if balance := bigToHex(t.env.StateDB.GetBalance(addr)); balance != pre.Balance {
+			post.Balance, modified = balance, true
+		}
+		if nonce := t.env.StateDB.GetNonce(addr); nonce != pre.Nonce {
+			post.Nonce, modified = nonce, true
+		}
+		if code := bytesToHex(t.env.StateDB.GetCode(addr)); code != pre.Code {
+			post.Code, modified = code, true
+		}
+		storage := make(map[common.Hash]common.Hash)
+		for key, val := range pre.Storage {
+			if cur := t.env.StateDB.GetState(addr, key); cur != val {
+				storage[key], post.Storage[key], modified = val, cur, true
+			}
+		}
+		if !modified {
+			continue
+		}
+		diff.Post[addr] = post
+		if t.exists[addr] {
+			diff.Pre[addr] = &account{
+				Balance: pre.Balance,
+				Nonce:   pre.Nonce,
+				Code:    pre.Code,
+				Storage: storage,
+			}
+		}
+	}
+	return diff
+}
+
+// lookupAccount fetches details of an account and adds it to the prestate
+// if it doesn't exist there yet.
+func (t *prestateTracer) lookupAccount(addr common.Address) {
+	if _, ok := t.prestate[addr]; ok {
+		return
+	}
+	t.exists[addr] = t.env.StateDB.Exist(addr)
+	t.prestate[addr] = &account{
+		Balance: bigToHex(t.env.StateDB.GetBalance(addr)),
+		Nonce:   t.env.StateDB.GetNonce(addr),
+		Code:    bytesToHex(t.env.StateDB.GetCode(addr)),
+		Storage: make(map[common.Hash]common.Hash),
+	}
+}
+
+// lookupStorage fetches the requested storage slot and adds it to the prestate
+// of the given account. It assumes the account itself is already present.
+func (t *prestateTracer) lookupStorage(addr common.Address, key common.Hash) {
+	if _, ok := t.prestate[addr].Storage[key]; ok {
+		return
+	}
+	t.prestate[addr].Storage[key] = t.env.StateDB.GetState(addr, key)
+}
@@ -0,0 +1,701 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/core/vm/runtime"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/tests"
+)
+
+// callTrace is the result of a callTracer run.
+type callTrace struct {
+	Type    string          `json:"type"`
+	From    common.Address  `json:"from"`
+	To      common.Address  `json:"to"`
+	Input   hexutil.Bytes   `json:"input"`
+	Output  hexutil.Bytes   `json:"output"`
+	Gas     *hexutil.Uint64 `json:"gas,omitempty"`
+	GasUsed *hexutil.Uint64 `json:"gasUsed,omitempty"`
+	Value   *hexutil.Big    `json:"value,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Calls   []callTrace     `json:"calls,omitempty"`
+}
+
+type callContext struct {
+	Number     math.HexOrDecimal64   `json:"number"`
+	Difficulty *math.HexOrDecimal256 `json:"difficulty"`
+	Time       math.HexOrDecimal64   `json:"timestamp"`
+	GasLimit   math.HexOrDecimal64   `json:"gasLimit"`
+	Miner      common.Address        `json:"miner"`
+}
+
+// callTracerTest defines a single test to check the call tracer against.
+type callTracerTest struct {
+	Genesis *core.Genesis   `json:"genesis"`
+	Context *callContext    `json:"context"`
+	Input   string          `json:"input"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// loadTests reads all the call tracer test cases from the shared testdata
+// folder of the tracers package.
+func loadTests(t *testing.T) map[string]*callTracerTest {
+	dir := filepath.Join("..", "testdata", "call_tracer")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to retrieve tracer test suite: %v", err)
+	}
+	tests := make(map[string]*callTracerTest)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		blob, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatalf("failed to read testcase: %v", err)
+		}
+		test := new(callTracerTest)
+		if err := json.Unmarshal(blob, test); err != nil {
+			t.Fatalf("failed to parse testcase: %v", err)
+		}
+		tests[strings.TrimSuffix(file.Name(), ".json")] = test
+	}
+	return tests
+}
+
+// runTest executes the transaction of a test case on top of its prestate with
+// the requested tracer and returns the produced trace along with the post state.
+func runTest(t *testing.T, test *callTracerTest, name string, cfg json.RawMessage) (json.RawMessage, *state.StateDB) {
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(common.FromHex(test.Input), tx); err != nil {
+		t.Fatalf("failed to parse testcase input: %v", err)
+	}
+	signer := types.MakeSigner(test.Genesis.Config, new(big.Int).SetUint64(uint64(test.Context.Number)))
+	origin, _ := signer.Sender(tx)
+	txContext := vm.TxContext{
+		Origin:   origin,
+		GasPrice: tx.GasPrice(),
+	}
+	context := vm.BlockContext{
+		CanTransfer: core.CanTransfer,
+		Transfer:    core.Transfer,
+		Coinbase:    test.Context.Miner,
+		BlockNumber: new(big.Int).SetUint64(uint64(test.Context.Number)),
+		Time:        new(big.Int).SetUint64(uint64(test.Context.Time)),
+		Difficulty:  (*big.Int)(test.Context.Difficulty),
+		GasLimit:    uint64(test.Context.GasLimit),
+	}
+	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
+
+	tracer, err := tracers.New(name, new(tracers.Context), cfg)
+	if err != nil {
+		t.Fatalf("failed to create tracer %s: %v", name, err)
+	}
+	evm := vm.NewEVM(context, txContext, statedb, test.Genesis.Config, vm.Config{Debug: true, Tracer: tracer})
+
+	msg, err := tx.AsMessage(signer, nil)
+	if err != nil {
+		t.Fatalf("failed to prepare transaction for tracing: %v", err)
+	}
+	st := core.NewStateTransition(evm, msg, new(core.GasPool).AddGas(tx.Gas()))
+	if _, err = st.TransitionDb(); err != nil {
+		t.Fatalf("failed to execute transaction: %v", err)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	statedb.Finalise(true)
+	return res, statedb
+}
+
+// callTraceEqual is similar to reflect.DeepEqual, but does a 'bounce' via json
+// prior to comparison to normalize empty and missing fields.
+func callTraceEqual(x, y *callTrace) bool {
+	xTrace := new(callTrace)
+	yTrace := new(callTrace)
+	if xj, err := json.Marshal(x); err == nil {
+		json.Unmarshal(xj, xTrace)
+	} else {
+		return false
+	}
+	if yj, err := json.Marshal(y); err == nil {
+		json.Unmarshal(yj, yTrace)
+	} else {
+		return false
+	}
+	return reflect.DeepEqual(xTrace, yTrace)
+}
+
+// jsonEqual reports whether two JSON blobs encode the same value, disregarding
+// field ordering and formatting.
+func jsonEqual(x, y json.RawMessage) bool {
+	var xv, yv interface{}
+	if err := json.Unmarshal(x, &xv); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(y, &yv); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(xv, yv)
+}
+
+// Tests that the native call tracer produces the expected results of the call
+// tracer test suite.
+func TestCallTracer(t *testing.T) {
+	for name, test := range loadTests(t) {
+		have, want := new(callTrace), new(callTrace)
+		res, _ := runTest(t, test, "callTracerNative", nil)
+		if err := json.Unmarshal(res, have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		if err := json.Unmarshal(test.Result, want); err != nil {
+			t.Fatalf("%s: failed to unmarshal expected result: %v", name, err)
+		}
+		if !callTraceEqual(have, want) {
+			t.Errorf("%s: trace mismatch:\nhave %+v\nwant %+v", name, have, want)
+		}
+	}
+}
+
+// Tests that the native call tracer can be configured to only report the top
+// level call, and that invalid configurations are rejected.
+func TestCallTracerConfig(t *testing.T) {
+	for name, test := range loadTests(t) {
+		res, _ := runTest(t, test, "callTracerNative", json.RawMessage(`{"onlyTopCall": true}`))
+
+		have, want := new(callTrace), new(callTrace)
+		if err := json.Unmarshal(res, have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		if err := json.Unmarshal(test.Result, want); err != nil {
+			t.Fatalf("%s: failed to unmarshal expected result: %v", name, err)
+		}
+		want.Calls = nil
+		if !callTraceEqual(have, want) {
+			t.Errorf("%s: trace mismatch:\nhave %+v\nwant %+v", name, have, want)
+		}
+	}
+	if _, err := tracers.New("callTracerNative", new(tracers.Context), json.RawMessage(`{"onlyTopCall": 1}`)); err == nil {
+		t.Error("expected error for invalid call tracer config")
+	}
+}
+
+// Tests that the native tracers without options reject any non-empty config.
+func TestTracerConfigUnsupported(t *testing.T) {
+	for _, name := range []string{"4byteTracerNative", "gasProfilerNative", "vmTracerNative"} {
+		for _, cfg := range []string{"", "null", "{}"} {
+			if _, err := tracers.New(name, new(tracers.Context), json.RawMessage(cfg)); err != nil {
+				t.Errorf("%s: empty config %q rejected: %v", name, cfg, err)
+			}
+		}
+		for _, cfg := range []string{`{"onlyTopCall": true}`, `[]`, `1`} {
+			if _, err := tracers.New(name, new(tracers.Context), json.RawMessage(cfg)); !errors.Is(err, tracers.ErrConfigUnsupported) {
+				t.Errorf("%s: config %q: have error %v, want %v", name, cfg, err, tracers.ErrConfigUnsupported)
+			}
+		}
+	}
+}
+
+// Tests that the native call tracer attaches the emitted logs to their frames
+// in the same order and with the same contents the state database collected.
+func TestCallTracerWithLog(t *testing.T) {
+	var total int
+	for name, test := range loadTests(t) {
+		res, statedb := runTest(t, test, "callTracerNative", json.RawMessage(`{"withLog": true}`))
+
+		have := new(logFrame)
+		if err := json.Unmarshal(res, have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		var (
+			logs = have.flatten(nil)
+			want = statedb.Logs()
+		)
+		if len(logs) != len(want) {
+			t.Fatalf("%s: log count mismatch: have %d, want %d", name, len(logs), len(want))
+		}
+		for i, log := range logs {
+			if log.Address != want[i].Address || !reflect.DeepEqual(log.Topics, want[i].Topics) || !bytes.Equal(log.Data, want[i].Data) {
+				t.Errorf("%s: log %d mismatch: have %+v, want %+v", name, i, log, want[i])
+			}
+		}
+		total += len(logs)
+	}
+	if total == 0 {
+		t.Fatalf("no logs emitted by the test suite")
+	}
+}
+
+// Tests that the native call tracer drops the logs of reverted frames.
+func TestCallTracerWithLogRevert(t *testing.T) {
+	var (
+		a = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+		b = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	// Contract b emits a log and reverts, contract a calls b and emits a log
+	statedb.SetCode(b, []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG0),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.REVERT),
+	})
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH20),
+	}
+	code = append(code, b.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP))
+	code = append(code, byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1), byte(vm.STOP))
+	statedb.SetCode(a, code)
+
+	tracer, err := tracers.New("callTracerNative", new(tracers.Context), json.RawMessage(`{"withLog": true}`))
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	_, _, err = runtime.Call(a, nil, &runtime.Config{
+		State:     statedb,
+		EVMConfig: vm.Config{Debug: true, Tracer: tracer},
+	})
+	if err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	have := new(logFrame)
+	if err := json.Unmarshal(res, have); err != nil {
+		t.Fatalf("failed to unmarshal trace result: %v", err)
+	}
+	if len(have.Logs) != 1 || have.Logs[0].Address != a || have.Logs[0].Position != 1 || len(have.Logs[0].Topics) != 1 {
+		t.Errorf("top level logs mismatch: %s", res)
+	}
+	if len(have.Calls) != 1 || have.Calls[0].Error == "" || len(have.Calls[0].Logs) != 0 {
+		t.Errorf("reverted call logs not dropped: %s", res)
+	}
+}
+
+// Tests that the native call tracer doesn't choke on logging opcodes that fail
+// before their operands were validated.
+func TestCallTracerWithLogFailure(t *testing.T) {
+	tests := map[string][]byte{
+		// LOG1 with only two stack items
+		"stack underflow": {byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.LOG1)},
+		// LOG0 with a memory expansion beyond the available gas
+		"out of gas": {
+			byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.MSTORE),
+			byte(vm.PUSH3), 0xff, 0xff, 0xff, byte(vm.PUSH1), 0, byte(vm.LOG0),
+		},
+	}
+	for name, code := range tests {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(common.Address{0xaa}, code)
+
+		tracer, err := tracers.New("callTracerNative", new(tracers.Context), json.RawMessage(`{"withLog": true}`))
+		if err != nil {
+			t.Fatalf("%s: failed to create tracer: %v", name, err)
+		}
+		_, _, err = runtime.Call(common.Address{0xaa}, nil, &runtime.Config{
+			State:     statedb,
+			GasLimit:  100000,
+			EVMConfig: vm.Config{Debug: true, Tracer: tracer},
+		})
+		if err == nil {
+			t.Fatalf("%s: call succeeded", name)
+		}
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("%s: failed to retrieve trace result: %v", name, err)
+		}
+		have := new(logFrame)
+		if err := json.Unmarshal(res, have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		if have.Error == "" || len(have.Logs) != 0 {
+			t.Errorf("%s: failed log reported: %s", name, res)
+		}
+	}
+}
+
+// Tests that the gas profiler attributes the gas used to the right frames and
+// instructions, splitting out memory expansion and cold access surcharges.
+func TestGasProfiler(t *testing.T) {
+	var (
+		a = common.HexToAddress("0x00000000000000000000000000000000000000aa")
+		b = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	// Contract b loads a cold slot, contract a loads a slot twice, expands its
+	// memory and calls b
+	statedb.SetCode(b, []byte{byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.STOP)})
+	code := []byte{
+		byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP),
+		byte(vm.PUSH1), 0, byte(vm.SLOAD), byte(vm.POP),
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0x40, byte(vm.MSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0,
+		byte(vm.PUSH20),
+	}
+	code = append(code, b.Bytes()...)
+	code = append(code, byte(vm.GAS), byte(vm.CALL), byte(vm.POP), byte(vm.STOP))
+	statedb.SetCode(a, code)
+
+	tracer, err := tracers.New("gasProfilerNative", new(tracers.Context), nil)
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	gasLimit := uint64(1000000)
+	_, left, err := runtime.Call(a, nil, &runtime.Config{
+		State:     statedb,
+		GasLimit:  gasLimit,
+		EVMConfig: vm.Config{Debug: true, Tracer: tracer},
+	})
+	if err != nil {
+		t.Fatalf("failed to execute call: %v", err)
+	}
+	res, err := tracer.GetResult()
+	if err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+	var profile string
+	if err := json.Unmarshal(res, &profile); err != nil {
+		t.Fatalf("failed to unmarshal trace result: %v", err)
+	}
+	want := strings.Join([]string{
+		"CALL:0x00000000000000000000000000000000000000aa;CALL 100",
+		"CALL:0x00000000000000000000000000000000000000aa;CALL:0x00000000000000000000000000000000000000bb;PUSH1 3",
+		"CALL:0x00000000000000000000000000000000000000aa;CALL:0x00000000000000000000000000000000000000bb;SLOAD 100",
+		"CALL:0x00000000000000000000000000000000000000aa;CALL:0x00000000000000000000000000000000000000bb;SLOAD;cold_access 2000",
+		"CALL:0x00000000000000000000000000000000000000aa;CALL;cold_access 2500",
+		"CALL:0x00000000000000000000000000000000000000aa;GAS 2",
+		"CALL:0x00000000000000000000000000000000000000aa;MSTORE 3",
+		"CALL:0x00000000000000000000000000000000000000aa;MSTORE;memory_expansion 9",
+		"CALL:0x00000000000000000000000000000000000000aa;POP 6",
+		"CALL:0x00000000000000000000000000000000000000aa;PUSH1 27",
+		"CALL:0x00000000000000000000000000000000000000aa;PUSH20 3",
+		"CALL:0x00000000000000000000000000000000000000aa;SLOAD 200",
+		"CALL:0x00000000000000000000000000000000000000aa;SLOAD;cold_access 2000",
+	}, "\n")
+	if profile != want {
+		t.Errorf("profile mismatch:\nhave:\n%s\nwant:\n%s", profile, want)
+	}
+	// The profile must account for all the gas used
+	var total uint64
+	for _, line := range strings.Split(profile, "\n") {
+		gas, err := strconv.ParseUint(line[strings.LastIndex(line, " ")+1:], 10, 64)
+		if err != nil {
+			t.Fatalf("invalid profile line %q: %v", line, err)
+		}
+		total += gas
+	}
+	if used := gasLimit - left; total != used {
+		t.Errorf("profiled gas mismatch: have %d, want %d", total, used)
+	}
+}
+
+// Tests that the gas profiles of the call tracer test suite account for all the
+// gas used by the transactions, as reported by the call tracer.
+func TestGasProfilerTotals(t *testing.T) {
+	for file, test := range loadTests(t) {
+		res, _ := runTest(t, test, "gasProfilerNative", nil)
+		var profile string
+		if err := json.Unmarshal(res, &profile); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", file, err)
+		}
+		var total uint64
+		for _, line := range strings.Split(profile, "\n") {
+			if line == "" {
+				continue
+			}
+			gas, err := strconv.ParseUint(line[strings.LastIndex(line, " ")+1:], 10, 64)
+			if err != nil {
+				t.Fatalf("%s: invalid profile line %q: %v", file, line, err)
+			}
+			total += gas
+		}
+		res, _ = runTest(t, test, "callTracerNative", nil)
+		call := new(callTrace)
+		if err := json.Unmarshal(res, call); err != nil {
+			t.Fatalf("%s: failed to unmarshal call trace: %v", file, err)
+		}
+		if total != uint64(*call.GasUsed) {
+			t.Errorf("%s: profiled gas mismatch: have %d, want %d", file, total, uint64(*call.GasUsed))
+		}
+	}
+}
+
+// logFrame is the subset of a call frame needed to verify the collected logs.
+type logFrame struct {
+	Error string `json:"error"`
+	Logs  []struct {
+		Address  common.Address `json:"address"`
+		Topics   []common.Hash  `json:"topics"`
+		Data     hexutil.Bytes  `json:"data"`
+		Position hexutil.Uint   `json:"position"`
+	} `json:"logs"`
+	Calls []*logFrame `json:"calls"`
+}
+
+// flatten collects the logs of the frame and all its subcalls in the order
+// they were emitted.
+func (f *logFrame) flatten(logs []*types.Log) []*types.Log {
+	var next int
+	for i, call := range f.Calls {
+		for ; next < len(f.Logs) && int(f.Logs[next].Position) <= i; next++ {
+			logs = append(logs, &types.Log{Address: f.Logs[next].Address, Topics: f.Logs[next].Topics, Data: f.Logs[next].Data})
+		}
+		logs = call.flatten(logs)
+	}
+	for ; next < len(f.Logs); next++ {
+		logs = append(logs, &types.Log{Address: f.Logs[next].Address, Topics: f.Logs[next].Topics, Data: f.Logs[next].Data})
+	}
+	return logs
+}
+
+// Tests that the native prestate tracer reproduces the genesis allocation the
+// test cases were assembled from.
+func TestPrestateTracer(t *testing.T) {
+	for name, test := range loadTests(t) {
+		var have map[common.Address]*prestateAccount
+
+		res, _ := runTest(t, test, "prestateTracerNative", nil)
+		if err := json.Unmarshal(res, &have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		for addr, acc := range have {
+			checkPrestate(t, name, addr, acc, test.Genesis.Alloc[addr])
+		}
+	}
+}
+
+// Tests that the diff mode of the native prestate tracer reports the state of
+// the modified accounts both before and after the transaction.
+func TestPrestateTracerDiffMode(t *testing.T) {
+	for name, test := range loadTests(t) {
+		var have struct {
+			Pre  map[common.Address]*prestateAccount `json:"pre"`
+			Post map[common.Address]*prestateAccount `json:"post"`
+		}
+		res, statedb := runTest(t, test, "prestateTracerNative", json.RawMessage(`{"diffMode": true}`))
+		if err := json.Unmarshal(res, &have); err != nil {
+			t.Fatalf("%s: failed to unmarshal trace result: %v", name, err)
+		}
+		if len(have.Post) == 0 {
+			t.Errorf("%s: no modified accounts reported", name)
+		}
+		// Every account in the pre state must have existed with the reported values
+		for addr, acc := range have.Pre {
+			alloc, ok := test.Genesis.Alloc[addr]
+			if !ok {
+				t.Errorf("%s: %x reported in pre state, but didn't exist", name, addr)
+			}
+			checkPrestate(t, name, addr, acc, alloc)
+
+			if _, ok := have.Post[addr]; !ok && statedb.Exist(addr) {
+				t.Errorf("%s: %x only reported in pre state, but wasn't deleted", name, addr)
+			}
+		}
+		// Every field in the post state must match the state after the transaction
+		for addr, acc := range have.Post {
+			if !statedb.Exist(addr) {
+				t.Errorf("%s: %x reported in post state, but was deleted", name, addr)
+			}
+			if _, ok := have.Pre[addr]; !ok {
+				// The test generator may have injected empty accounts for contracts yet to be created
+				if alloc, ok := test.Genesis.Alloc[addr]; ok && (alloc.Nonce != 0 || len(alloc.Code) != 0 || (alloc.Balance != nil && alloc.Balance.Sign() != 0)) {
+					t.Errorf("%s: %x only reported in post state, but already existed", name, addr)
+				}
+			}
+			if acc.Balance != nil && acc.Balance.ToInt().Cmp(statedb.GetBalance(addr)) != 0 {
+				t.Errorf("%s: %x post balance mismatch: have %v, want %v", name, addr, acc.Balance.ToInt(), statedb.GetBalance(addr))
+			}
+			if acc.Nonce != 0 && acc.Nonce != statedb.GetNonce(addr) {
+				t.Errorf("%s: %x post nonce mismatch: have %d, want %d", name, addr, acc.Nonce, statedb.GetNonce(addr))
+			}
+			if acc.Code != nil && !bytes.Equal(acc.Code, statedb.GetCode(addr)) {
+				t.Errorf("%s: %x post code mismatch: have %x, want %x", name, addr, acc.Code, statedb.GetCode(addr))
+			}
+			for key, val := range acc.Storage {
+				if want := statedb.GetState(addr, key); val != want {
+					t.Errorf("%s: %x post slot %x mismatch: have %x, want %x", name, addr, key, val, want)
+				}
+			}
+		}
+	}
+}
+
+// Tests that the native prestate tracer restores the sender balance from the
+// full gas purchase, including the access list, and handles self transfers.
+func TestPrestateTracerSenderBalance(t *testing.T) {
+	var (
+		key, _  = crypto.GenerateKey()
+		from    = crypto.PubkeyToAddress(key.PublicKey)
+		config  = params.AllEthashProtocolChanges
+		balance = big.NewInt(params.Ether)
+		signer  = types.LatestSigner(config)
+	)
+	for _, to := range []common.Address{{0xaa}, from} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetBalance(from, balance)
+
+		tx := types.MustSignNewTx(key, signer, &types.DynamicFeeTx{
+			ChainID:   config.ChainID,
+			Gas:       100000,
+			GasFeeCap: big.NewInt(params.GWei),
+			GasTipCap: big.NewInt(params.GWei),
+			To:        &to,
+			Value:     big.NewInt(1000),
+			AccessList: types.AccessList{{
+				Address:     common.Address{0xbb},
+				StorageKeys: []common.Hash{{0x01}, {0x02}},
+			}},
+		})
+		msg, err := tx.AsMessage(signer, nil)
+		if err != nil {
+			t.Fatalf("failed to prepare transaction: %v", err)
+		}
+		tracer, err := tracers.New("prestateTracerNative", new(tracers.Context), nil)
+		if err != nil {
+			t.Fatalf("failed to create tracer: %v", err)
+		}
+		context := vm.BlockContext{
+			CanTransfer: core.CanTransfer,
+			Transfer:    core.Transfer,
+			BlockNumber: big.NewInt(1),
+			Time:        big.NewInt(1),
+			Difficulty:  big.NewInt(1),
+			GasLimit:    tx.Gas(),
+			BaseFee:     new(big.Int),
+		}
+		evm := vm.NewEVM(context, core.NewEVMTxContext(msg), statedb, config, vm.Config{Debug: true, Tracer: tracer})
+		if _, err := core.ApplyMessage(evm, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+			t.Fatalf("failed to execute transaction: %v", err)
+		}
+		res, err := tracer.GetResult()
+		if err != nil {
+			t.Fatalf("failed to retrieve trace result: %v", err)
+		}
+		var have map[common.Address]*prestateAccount
+		if err := json.Unmarshal(res, &have); err != nil {
+			t.Fatalf("failed to unmarshal trace result: %v", err)
+		}
+		if have[from].Balance.ToInt().Cmp(balance) != 0 || have[from].Nonce != 0 {
+			t.Errorf("sender prestate mismatch (to %x): have %v/%d, want %v/0", to, have[from].Balance, have[from].Nonce, balance)
+		}
+		if to != from && have[to].Balance.ToInt().Sign() != 0 {
+			t.Errorf("recipient prestate mismatch: have %v, want 0", have[to].Balance)
+		}
+	}
+}
+
+// Tests that the native prestate tracer doesn't choke on a CREATE2 running out
+// of gas before its memory was expanded.
+func TestPrestateTracerCreate2Failure(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(common.Address{0xaa}, []byte{
+		byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.MSTORE),
+		byte(vm.PUSH1), 0, byte(vm.PUSH3), 0xff, 0xff, 0xff, byte(vm.PUSH1), 0, byte(vm.PUSH1), 0, byte(vm.CREATE2),
+	})
+	tracer, err := tracers.New("prestateTracerNative", new(tracers.Context), nil)
+	if err != nil {
+		t.Fatalf("failed to create tracer: %v", err)
+	}
+	_, _, err = runtime.Call(common.Address{0xaa}, nil, &runtime.Config{
+		State:     statedb,
+		GasLimit:  100000,
+		EVMConfig: vm.Config{Debug: true, Tracer: tracer},
+	})
+	if err == nil {
+		t.Fatalf("call succeeded")
+	}
+	if _, err := tracer.GetResult(); err != nil {
+		t.Fatalf("failed to retrieve trace result: %v", err)
+	}
+}
+
+// prestateAccount is a single account as reported by the prestate tracer.
+type prestateAccount struct {
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    hexutil.Bytes               `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+}
+
+// checkPrestate verifies that an account reported by the prestate tracer matches
+// the genesis allocation the test case was assembled from.
+func checkPrestate(t *testing.T, name string, addr common.Address, have *prestateAccount, want core.GenesisAccount) {
+	t.Helper()
+
+	if want.Balance == nil {
+		want.Balance = new(big.Int)
+	}
+	if have.Balance.ToInt().Cmp(want.Balance) != 0 {
+		t.Errorf("%s: %x balance mismatch: have %v, want %v", name, addr, have.Balance.ToInt(), want.Balance)
+	}
+	if have.Nonce != want.Nonce {
+		t.Errorf("%s: %x nonce mismatch: have %d, want %d", name, addr, have.Nonce, want.Nonce)
+	}
+	if !bytes.Equal(have.Code, want.Code) {
+		t.Errorf("%s: %x code mismatch: have %x, want %x", name, addr, have.Code, want.Code)
+	}
+	for key, val := range have.Storage {
+		if val != want.Storage[key] {
+			t.Errorf("%s: %x slot %x mismatch: have %x, want %x", name, addr, key, val, want.Storage[key])
+		}
+	}
+}
+
+// Tests that the native tracers produce the exact same output as their JavaScript
+// counterparts. The prestate tracer is deliberately left out as the JavaScript
+// version only approximates the sender's balance from the post-state.
+func TestJavaScriptEquivalence(t *testing.T) {
+	tracers := map[string]string{
+		"callTracerNative":  "callTracer",
+		"4byteTracerNative": "4byteTracer",
+	}
+	for name, test := range loadTests(t) {
+		for native, js := range tracers {
+			have, _ := runTest(t, test, native, nil)
+			want, _ := runTest(t, test, js, nil)
+			if !jsonEqual(have, want) {
+				t.Errorf("%s: %s mismatch:\nhave %s\nwant %s", name, native, have, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package native
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+)
+
+func init() {
+	tracers.RegisterNativeTracer("vmTracerNative", newVMTracer)
+}
+
+// vmTrace is the instruction level trace of a single call frame, in the format
+// of the OpenEthereum (parity) vmTrace.
+type vmTrace struct {
+	Code hexutil.Bytes `json:"code"`
+	Ops  []*vmOp       `json:"ops"`
+}
+
+// vmOp is a single executed instruction within a vmTrace.
+type vmOp struct {
+	Cost uint64      `json:"cost"`
+	Ex   *vmExecuted `json:"ex"`
+	Pc   uint64      `json:"pc"`
+	Sub  *vmTrace    `json:"sub"`
+}
+
+// vmExecuted contains the effects of executing an instruction. It is missing if
+// the instruction failed.
+type vmExecuted struct {
+	Mem   *vmMem   `json:"mem"`
+	Push  []string `json:"push"`
+	Store *vmStore `json:"store"`
+	Used  uint64   `json:"used"`
+}
+
+// vmMem is a memory region written by an instruction.
+type vmMem struct {
+	Data hexutil.Bytes `json:"data"`
+	Off  uint64        `json:"off"`
+}
+
+// vmStore is a storage slot written by an instruction.
+type vmStore struct {
+	Key string `json:"key"`
+	Val string `json:"val"`
+}
+
+// vmFrame tracks the trace of a call frame being executed, along with the last
+// instruction, whose effects are only known once the next one starts.
+type vmFrame struct {
+	trace *vmTrace
+
+	pending *vmOp     // Last instruction executed in the frame
+	op      vm.OpCode // Opcode of the pending instruction
+	gas     uint64    // Gas available before the pending instruction
+	memOff  uint64    // Start of the memory region written by the pending instruction
+	memSize uint64    // Size of the memory region written by the pending instruction
+	store   *vmStore  // Storage slot written by the pending instruction
+}
+
+// vmTracer reports the instructions executed during a transaction along with
+// their effects on the stack, memory and storage, in the same format as the
+// OpenEthereum (parity) vmTrace.
+type vmTracer struct {
+	env       *vm.EVM
+	frames    []*vmFrame // Frames being executed, nil for pseudo-frames of SELFDESTRUCT
+	root      *vmTrace
+	interrupt uint32 // Atomic flag to signal execution interruption
+	reason    error  // Textual reason for the interruption
+}
+
+// newVMTracer returns a native go tracer which reports the executed instructions
+// of a transaction in the OpenEthereum vmTrace format.
+func newVMTracer(cfg json.RawMessage) (tracers.Tracer, error) {
+	if !tracers.IsEmptyConfig(cfg) {
+		return nil, tracers.ErrConfigUnsupported
+	}
+	return &vmTracer{}, nil
+}
+
+// CaptureStart implements the Tracer interface to initialize the tracing operation.
+func (t *vmTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	t.env = env
+	t.root = t.newTrace(to, create, input)
+	t.frames = []*vmFrame{{trace: t.root}}
+}
+
+// CaptureEnd is called after the call finishes to finalize the tracing.
+func (t *vmTracer) CaptureEnd(output []byte, gasUsed uint64, _ time.Duration, err error) {
+	if len(t.frames) > 0 {
+		t.frames[0].finish(err)
+	}
+}
+
+// CaptureState implements the Tracer interface to trace a single step of VM execution.
+func (t *vmTracer) CaptureState(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	// Skip if tracing was interrupted
+	if atomic.LoadUint32(&t.interrupt) > 0 {
+		t.env.Cancel()
+		return
+	}
+	if depth > len(t.frames) || t.frames[depth-1] == nil {
+		return
+	}
+	frame := t.frames[depth-1]
+
+	// The previous instruction completed, gather its effects
+	frame.collect(gas, scope)
+
+	// Instructions failing before execution are not reported
+	if err != nil {
+		return
+	}
+	frame.pending = &vmOp{Cost: cost, Pc: pc}
+	frame.op, frame.gas = op, gas
+	frame.memOff, frame.memSize, frame.store = 0, 0, nil
+	frame.trace.Ops = append(frame.trace.Ops, frame.pending)
+
+	stack := scope.Stack
+	switch op {
+	case vm.MSTORE:
+		frame.memOff, frame.memSize = stack.Back(0).Uint64(), 32
+	case vm.MSTORE8:
+		frame.memOff, frame.memSize = stack.Back(0).Uint64(), 1
+	case vm.CALLDATACOPY, vm.CODECOPY, vm.RETURNDATACOPY:
+		frame.memOff, frame.memSize = stack.Back(0).Uint64(), stack.Back(2).Uint64()
+	case vm.EXTCODECOPY:
+		frame.memOff, frame.memSize = stack.Back(1).Uint64(), stack.Back(3).Uint64()
+	case vm.CALL, vm.CALLCODE:
+		frame.memOff, frame.memSize = stack.Back(5).Uint64(), stack.Back(6).Uint64()
+	case vm.DELEGATECALL, vm.STATICCALL:
+		frame.memOff, frame.memSize = stack.Back(4).Uint64(), stack.Back(5).Uint64()
+	case vm.SSTORE:
+		frame.store = &vmStore{Key: stack.Back(0).Hex(), Val: stack.Back(1).Hex()}
+	}
+}
+
+// CaptureFault implements the Tracer interface to trace an execution fault.
+func (t *vmTracer) CaptureFault(env *vm.EVM, pc uint64, op vm.OpCode, gas, cost uint64, _ *vm.ScopeContext, depth int, err error) {
+}
+
+// CaptureEnter is called when EVM enters a new scope (via call, create or selfdestruct).
+func (t *vmTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	// Self destructs are reported as pseudo-calls, they don't run any code
+	if typ == vm.SELFDESTRUCT {
+		t.frames = append(t.frames, nil)
+		return
+	}
+	trace := t.newTrace(to, typ == vm.CREATE || typ == vm.CREATE2, input)
+	if parent := t.frames[len(t.frames)-1]; parent != nil && parent.pending != nil {
+		parent.pending.Sub = trace
+	}
+	t.frames = append(t.frames, &vmFrame{trace: trace})
+}
+
+// CaptureExit is called when EVM exits a scope, even if the scope didn't
+// execute any code.
+func (t *vmTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	size := len(t.frames)
+	if size <= 1 {
+		return
+	}
+	frame := t.frames[size-1]
+	t.frames = t.frames[:size-1]
+	if frame != nil {
+		frame.finish(err)
+	}
+}
+
+// GetResult returns the json-encoded vmTrace of the transaction, and any error
+// arising from the encoding or forceful termination (via `Stop`).
+func (t *vmTracer) GetResult() (json.RawMessage, error) {
+	if t.root == nil {
+		return nil, errors.New("no transaction traced")
+	}
+	res, err := json.Marshal(t.root)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(res), t.reason
+}
+
+// Stop terminates execution of the tracer at the first opportune moment.
+func (t *vmTracer) Stop(err error) {
+	t.reason = err
+	atomic.StoreUint32(&t.interrupt, 1)
+}
+
+// newTrace creates the trace of a new call frame, running either the init code
+// of a contract creation or the code deployed at the destination of a call.
+func (t *vmTracer) newTrace(to common.Address, create bool, input []byte) *vmTrace {
+	if create {
+		return &vmTrace{Code: common.CopyBytes(input), Ops: []*vmOp{}}
+	}
+	return &vmTrace{Code: common.CopyBytes(t.env.StateDB.GetCode(to)), Ops: []*vmOp{}}
+}
+
+// collect fills in the effects of the pending instruction once it executed,
+// based on the gas, stack and memory of the frame afterwards.
+func (f *vmFrame) collect(gas uint64, scope *vm.ScopeContext) {
+	if f.pending == nil {
+		return
+	}
+	ex := &vmExecuted{Push: []string{}, Store: f.store, Used: gas}
+
+	data := scope.Stack.Data()
+	if n := pushCount(f.op); n > 0 && n <= len(data) {
+		for _, item := range data[len(data)-n:] {
+			ex.Push = append(ex.Push, item.Hex())
+		}
+	}
+	if f.memSize > 0 {
+		ex.Mem = &vmMem{
+			Data: scope.Memory.GetCopy(int64(f.memOff), int64(f.memSize)),
+			Off:  f.memOff,
+		}
+	}
+	f.pending.Ex, f.pending = ex, nil
+}
+
+// finish fills in the effects of the last instruction of a frame, which are
+// only known to be its gas usage. Failed instructions are left without effects.
+func (f *vmFrame) finish(err error) {
+	if f.pending == nil {
+		return
+	}
+	if err == nil || err == vm.ErrExecutionReverted {
+		used := uint64(0)
+		if f.gas > f.pending.Cost {
+			used = f.gas - f.pending.Cost
+		}
+		f.pending.Ex = &vmExecuted{Push: []string{}, Store: f.store, Used: used}
+	}
+	f.pending = nil
+}
+
+// pushCount returns the number of stack items reported as pushed by an opcode.
+// Similarly to OpenEthereum, duplications and swaps report all stack items they
+// touched.
+func pushCount(op vm.OpCode) int {
+	switch {
+	case op >= vm.PUSH1 && op <= vm.PUSH32:
+		return 1
+	case op >= vm.DUP1 && op <= vm.DUP16:
+		return int(op-vm.DUP1) + 2
+	case op >= vm.SWAP1 && op <= vm.SWAP16:
+		return int(op-vm.SWAP1) + 2
+	case op >= vm.LOG0 && op <= vm.LOG4:
+		return 0
+	}
+	switch op {
+	case vm.STOP, vm.POP, vm.MSTORE, vm.MSTORE8, vm.SSTORE, vm.JUMP, vm.JUMPI, vm.JUMPDEST,
+		vm.CALLDATACOPY, vm.CODECOPY, vm.EXTCODECOPY, vm.RETURNDATACOPY,
+		vm.RETURN, vm.REVERT, vm.SELFDESTRUCT:
+		return 0
+	}
+	return 1
+}
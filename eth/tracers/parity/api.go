@@ -0,0 +1,413 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package parity implements the trace RPC namespace of OpenEthereum (parity),
+// reporting flat call traces, state diffs and VM traces. It is built on top of
+// the debug tracing API, sharing its historical state regeneration.
+package parity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/rpc"
+
+	// Force-load the native tracers the trace namespace is built on
+	_ "github.com/ethereum/go-ethereum/eth/tracers/native"
+)
+
+const (
+	// callTracer is the tracer producing the call trees to flatten.
+	callTracer = "callTracerNative"
+
+	// prestateTracer is the tracer producing the state diffs.
+	prestateTracer = "prestateTracerNative"
+
+	// vmTracer is the tracer producing the VM traces.
+	vmTracer = "vmTracerNative"
+)
+
+// The trace types which can be requested when replaying transactions.
+const (
+	traceTypeTrace     = "trace"
+	traceTypeStateDiff = "stateDiff"
+	traceTypeVMTrace   = "vmTrace"
+)
+
+// TraceResults is the result of replaying a transaction, containing the trace
+// types requested.
+type TraceResults struct {
+	Output          hexutil.Bytes   `json:"output"`
+	StateDiff       StateDiff       `json:"stateDiff"`
+	Trace           []*Trace        `json:"trace"`
+	VMTrace         json.RawMessage `json:"vmTrace"`
+	TransactionHash *common.Hash    `json:"transactionHash,omitempty"`
+}
+
+// FilterArgs are the criteria of trace_filter. Missing block numbers default to
+// the latest block, missing address lists match any address.
+type FilterArgs struct {
+	FromBlock   *rpc.BlockNumber `json:"fromBlock"`
+	ToBlock     *rpc.BlockNumber `json:"toBlock"`
+	FromAddress []common.Address `json:"fromAddress"`
+	ToAddress   []common.Address `json:"toAddress"`
+	After       *hexutil.Uint64  `json:"after"`
+	Count       *hexutil.Uint64  `json:"count"`
+}
+
+// API is the collection of tracing APIs exposed over the trace namespace. Note
+// block reward traces are not reported.
+type API struct {
+	backend tracers.Backend
+	tracer  *tracers.API
+}
+
+// NewAPI creates a new API definition for the trace namespace.
+func NewAPI(backend tracers.Backend) *API {
+	return &API{backend: backend, tracer: tracers.NewAPI(backend)}
+}
+
+// APIs return the collection of RPC services the trace package offers.
+func APIs(backend tracers.Backend) []rpc.API {
+	// Append all the local APIs and return
+	return []rpc.API{
+		{
+			Namespace: "trace",
+			Version:   "1.0",
+			Service:   NewAPI(backend),
+			Public:    false,
+		},
+	}
+}
+
+// Block returns the flat call traces of all the transactions within a block.
+func (api *API) Block(ctx context.Context, number rpc.BlockNumber) ([]*Trace, error) {
+	block, err := api.blockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	return api.traceBlock(ctx, block)
+}
+
+// Transaction returns the flat call traces of a transaction.
+func (api *API) Transaction(ctx context.Context, hash common.Hash) ([]*Trace, error) {
+	res, err := api.tracer.TraceTransaction(ctx, hash, traceConfig(callTracer, nil))
+	if err != nil {
+		return nil, err
+	}
+	_, blockHash, blockNumber, index, err := api.backend.GetTransaction(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := api.backend.BlockByHash(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block %#x not found", blockHash)
+	}
+	traces, err := api.flatten(block, res.(json.RawMessage))
+	if err != nil {
+		return nil, err
+	}
+	for _, trace := range traces {
+		trace.BlockHash, trace.BlockNumber = &blockHash, &blockNumber
+		trace.TransactionHash, trace.TransactionPosition = &hash, &index
+	}
+	return traces, nil
+}
+
+// Filter returns the flat call traces within a block range matching the given
+// sender and recipient addresses.
+func (api *API) Filter(ctx context.Context, args FilterArgs) ([]*Trace, error) {
+	from, to := rpc.LatestBlockNumber, rpc.LatestBlockNumber
+	if args.FromBlock != nil {
+		from = *args.FromBlock
+	}
+	if args.ToBlock != nil {
+		to = *args.ToBlock
+	}
+	start, err := api.blockByNumber(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	end, err := api.blockByNumber(ctx, to)
+	if err != nil {
+		return nil, err
+	}
+	if start.NumberU64() > end.NumberU64() {
+		return nil, fmt.Errorf("end block (#%d) needs to come after start block (#%d)", end.NumberU64(), start.NumberU64())
+	}
+	var (
+		skip    uint64
+		results = []*Trace{}
+	)
+	if args.After != nil {
+		skip = uint64(*args.After)
+	}
+	for number := start.NumberU64(); number <= end.NumberU64(); number++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// The genesis block can't be traced, skip it along with empty blocks
+		if number == 0 {
+			continue
+		}
+		block, err := api.blockByNumber(ctx, rpc.BlockNumber(number))
+		if err != nil {
+			return nil, err
+		}
+		if len(block.Transactions()) == 0 {
+			continue
+		}
+		traces, err := api.traceBlock(ctx, block)
+		if err != nil {
+			return nil, err
+		}
+		for _, trace := range traces {
+			if !trace.matches(args.FromAddress, args.ToAddress) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			results = append(results, trace)
+			if args.Count != nil && uint64(len(results)) >= uint64(*args.Count) {
+				return results, nil
+			}
+		}
+	}
+	return results, nil
+}
+
+// ReplayBlockTransactions replays all the transactions within a block, returning
+// the requested trace types for each of them.
+func (api *API) ReplayBlockTransactions(ctx context.Context, number rpc.BlockNumber, traceTypes []string) ([]*TraceResults, error) {
+	block, err := api.blockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := parseTraceTypes(traceTypes)
+	if err != nil {
+		return nil, err
+	}
+	// Every trace type requires a separate run of the block
+	calls, err := api.tracer.TraceBlockByHash(ctx, block.Hash(), traceConfig(callTracer, nil))
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*TraceResults, len(calls))
+	for i, call := range calls {
+		if call.Error != "" {
+			return nil, errors.New(call.Error)
+		}
+		hash := block.Transactions()[i].Hash()
+		if results[i], err = api.newTraceResults(block, call.Result.(json.RawMessage), requested); err != nil {
+			return nil, err
+		}
+		results[i].TransactionHash = &hash
+	}
+	if requested[traceTypeStateDiff] {
+		diffs, err := api.tracer.TraceBlockByHash(ctx, block.Hash(), traceConfig(prestateTracer, json.RawMessage(`{"diffMode": true}`)))
+		if err != nil {
+			return nil, err
+		}
+		for i, diff := range diffs {
+			if diff.Error != "" {
+				return nil, errors.New(diff.Error)
+			}
+			if results[i].StateDiff, err = parseStateDiff(diff.Result.(json.RawMessage)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if requested[traceTypeVMTrace] {
+		vmtraces, err := api.tracer.TraceBlockByHash(ctx, block.Hash(), traceConfig(vmTracer, nil))
+		if err != nil {
+			return nil, err
+		}
+		for i, vmtrace := range vmtraces {
+			if vmtrace.Error != "" {
+				return nil, errors.New(vmtrace.Error)
+			}
+			results[i].VMTrace = vmtrace.Result.(json.RawMessage)
+		}
+	}
+	return results, nil
+}
+
+// ReplayTransaction replays a transaction, returning the requested trace types.
+func (api *API) ReplayTransaction(ctx context.Context, hash common.Hash, traceTypes []string) (*TraceResults, error) {
+	requested, err := parseTraceTypes(traceTypes)
+	if err != nil {
+		return nil, err
+	}
+	call, err := api.tracer.TraceTransaction(ctx, hash, traceConfig(callTracer, nil))
+	if err != nil {
+		return nil, err
+	}
+	_, blockHash, _, _, err := api.backend.GetTransaction(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	block, err := api.backend.BlockByHash(ctx, blockHash)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block %#x not found", blockHash)
+	}
+	results, err := api.newTraceResults(block, call.(json.RawMessage), requested)
+	if err != nil {
+		return nil, err
+	}
+	if requested[traceTypeStateDiff] {
+		diff, err := api.tracer.TraceTransaction(ctx, hash, traceConfig(prestateTracer, json.RawMessage(`{"diffMode": true}`)))
+		if err != nil {
+			return nil, err
+		}
+		if results.StateDiff, err = parseStateDiff(diff.(json.RawMessage)); err != nil {
+			return nil, err
+		}
+	}
+	if requested[traceTypeVMTrace] {
+		vmtrace, err := api.tracer.TraceTransaction(ctx, hash, traceConfig(vmTracer, nil))
+		if err != nil {
+			return nil, err
+		}
+		results.VMTrace = vmtrace.(json.RawMessage)
+	}
+	return results, nil
+}
+
+// blockByNumber is the wrapper of the chain access function offered by the backend.
+// It will return an error if the block is not found.
+func (api *API) blockByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Block, error) {
+	block, err := api.backend.BlockByNumber(ctx, number)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, fmt.Errorf("block #%d not found", number)
+	}
+	return block, nil
+}
+
+// traceBlock returns the flat call traces of all the transactions within a
+// block, annotated with their positions in the chain.
+func (api *API) traceBlock(ctx context.Context, block *types.Block) ([]*Trace, error) {
+	results, err := api.tracer.TraceBlockByHash(ctx, block.Hash(), traceConfig(callTracer, nil))
+	if err != nil {
+		return nil, err
+	}
+	var (
+		hash   = block.Hash()
+		number = block.NumberU64()
+		traces = []*Trace{}
+	)
+	for i, res := range results {
+		if res.Error != "" {
+			return nil, errors.New(res.Error)
+		}
+		txtraces, err := api.flatten(block, res.Result.(json.RawMessage))
+		if err != nil {
+			return nil, err
+		}
+		var (
+			txhash = block.Transactions()[i].Hash()
+			index  = uint64(i)
+		)
+		for _, trace := range txtraces {
+			trace.BlockHash, trace.BlockNumber = &hash, &number
+			trace.TransactionHash, trace.TransactionPosition = &txhash, &index
+		}
+		traces = append(traces, txtraces...)
+	}
+	return traces, nil
+}
+
+// flatten converts the result of the call tracer for a transaction within the
+// given block into flat call traces.
+func (api *API) flatten(block *types.Block, result json.RawMessage) ([]*Trace, error) {
+	var frame callFrame
+	if err := json.Unmarshal(result, &frame); err != nil {
+		return nil, err
+	}
+	precompiles := make(map[common.Address]bool)
+	for _, addr := range vm.ActivePrecompiles(api.backend.ChainConfig().Rules(block.Number())) {
+		precompiles[addr] = true
+	}
+	return flatten(&frame, []int{}, precompiles, nil), nil
+}
+
+// newTraceResults creates the replay results of a transaction from its call
+// tracer result, filling in the call traces if requested.
+func (api *API) newTraceResults(block *types.Block, result json.RawMessage, requested map[string]bool) (*TraceResults, error) {
+	traces, err := api.flatten(block, result)
+	if err != nil {
+		return nil, err
+	}
+	res := &TraceResults{Output: hexutil.Bytes{}}
+	if output := traces[0].Result; output != nil {
+		switch output := output.(type) {
+		case *CallResult:
+			res.Output = output.Output
+		case *CreateResult:
+			res.Output = output.Code
+		}
+	}
+	if requested[traceTypeTrace] {
+		res.Trace = traces
+	}
+	return res, nil
+}
+
+// traceConfig creates the configuration to run one of the native tracers.
+func traceConfig(tracer string, config json.RawMessage) *tracers.TraceConfig {
+	return &tracers.TraceConfig{Tracer: &tracer, TracerConfig: config}
+}
+
+// parseTraceTypes validates the trace types requested for replaying.
+func parseTraceTypes(traceTypes []string) (map[string]bool, error) {
+	requested := make(map[string]bool)
+	for _, typ := range traceTypes {
+		switch typ {
+		case traceTypeTrace, traceTypeStateDiff, traceTypeVMTrace:
+			requested[typ] = true
+		default:
+			return nil, fmt.Errorf("invalid trace type: %q", typ)
+		}
+	}
+	return requested, nil
+}
+
+// parseStateDiff converts the result of the prestate tracer in diff mode into a
+// state diff.
+func parseStateDiff(result json.RawMessage) (StateDiff, error) {
+	var diff prestateDiff
+	if err := json.Unmarshal(result, &diff); err != nil {
+		return nil, err
+	}
+	return newStateDiff(&diff), nil
+}
@@ -0,0 +1,443 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package parity
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	errStateNotFound       = errors.New("state not found")
+	errTransactionNotFound = errors.New("transaction not found")
+)
+
+type testBackend struct {
+	chainConfig *params.ChainConfig
+	engine      consensus.Engine
+	chaindb     ethdb.Database
+	chain       *core.BlockChain
+}
+
+func newTestBackend(t *testing.T, n int, gspec *core.Genesis, generator func(i int, b *core.BlockGen)) *testBackend {
+	backend := &testBackend{
+		chainConfig: params.TestChainConfig,
+		engine:      ethash.NewFaker(),
+		chaindb:     rawdb.NewMemoryDatabase(),
+	}
+	// Generate blocks for testing
+	gspec.Config = backend.chainConfig
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		genesis = gspec.MustCommit(gendb)
+	)
+	blocks, _ := core.GenerateChain(backend.chainConfig, genesis, backend.engine, gendb, n, generator)
+
+	// Import the canonical chain
+	gspec.MustCommit(backend.chaindb)
+	cacheConfig := &core.CacheConfig{
+		TrieCleanLimit:    256,
+		TrieDirtyLimit:    256,
+		TrieTimeLimit:     5 * time.Minute,
+		SnapshotLimit:     0,
+		TrieDirtyDisabled: true, // Archive mode
+	}
+	chain, err := core.NewBlockChain(backend.chaindb, cacheConfig, backend.chainConfig, backend.engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	backend.chain = chain
+	return backend
+}
+
+func (b *testBackend) HeaderByHash(ctx context.Context, hash common.Hash) (*types.Header, error) {
+	return b.chain.GetHeaderByHash(hash), nil
+}
+
+func (b *testBackend) HeaderByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Header, error) {
+	if number == rpc.PendingBlockNumber || number == rpc.LatestBlockNumber {
+		return b.chain.CurrentHeader(), nil
+	}
+	return b.chain.GetHeaderByNumber(uint64(number)), nil
+}
+
+func (b *testBackend) BlockByHash(ctx context.Context, hash common.Hash) (*types.Block, error) {
+	return b.chain.GetBlockByHash(hash), nil
+}
+
+func (b *testBackend) BlockByNumber(ctx context.Context, number rpc.BlockNumber) (*types.Block, error) {
+	if number == rpc.PendingBlockNumber || number == rpc.LatestBlockNumber {
+		return b.chain.CurrentBlock(), nil
+	}
+	return b.chain.GetBlockByNumber(uint64(number)), nil
+}
+
+func (b *testBackend) GetTransaction(ctx context.Context, txHash common.Hash) (*types.Transaction, common.Hash, uint64, uint64, error) {
+	tx, hash, blockNumber, index := rawdb.ReadTransaction(b.chaindb, txHash)
+	if tx == nil {
+		return nil, common.Hash{}, 0, 0, errTransactionNotFound
+	}
+	return tx, hash, blockNumber, index, nil
+}
+
+func (b *testBackend) RPCGasCap() uint64 {
+	return 25000000
+}
+
+func (b *testBackend) ChainConfig() *params.ChainConfig {
+	return b.chainConfig
+}
+
+func (b *testBackend) Engine() consensus.Engine {
+	return b.engine
+}
+
+func (b *testBackend) ChainDb() ethdb.Database {
+	return b.chaindb
+}
+
+func (b *testBackend) StateAtBlock(ctx context.Context, block *types.Block, reexec uint64, base *state.StateDB, checkLive bool) (*state.StateDB, error) {
+	statedb, err := b.chain.StateAt(block.Root())
+	if err != nil {
+		return nil, errStateNotFound
+	}
+	return statedb, nil
+}
+
+func (b *testBackend) StateAtTransaction(ctx context.Context, block *types.Block, txIndex int, reexec uint64) (core.Message, vm.BlockContext, *state.StateDB, error) {
+	parent := b.chain.GetBlock(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return nil, vm.BlockContext{}, nil, errors.New("block not found")
+	}
+	statedb, err := b.chain.StateAt(parent.Root())
+	if err != nil {
+		return nil, vm.BlockContext{}, nil, errStateNotFound
+	}
+	// Recompute transactions up to the target index.
+	signer := types.MakeSigner(b.chainConfig, block.Number())
+	for idx, tx := range block.Transactions() {
+		msg, _ := tx.AsMessage(signer, block.BaseFee())
+		txContext := core.NewEVMTxContext(msg)
+		context := core.NewEVMBlockContext(block.Header(), b.chain, nil)
+		if idx == txIndex {
+			return msg, context, statedb, nil
+		}
+		vmenv := vm.NewEVM(context, txContext, statedb, b.chainConfig, vm.Config{})
+		if _, err := core.ApplyMessage(vmenv, msg, new(core.GasPool).AddGas(tx.Gas())); err != nil {
+			return nil, vm.BlockContext{}, nil, fmt.Errorf("transaction %#x failed: %v", tx.Hash(), err)
+		}
+		statedb.Finalise(vmenv.ChainConfig().IsEIP158(block.Number()))
+	}
+	return nil, vm.BlockContext{}, nil, fmt.Errorf("transaction index %d out of range for block %#x", txIndex, block.Hash())
+}
+
+var (
+	// caller is a contract which stores 1 into slot 0, then calls into the
+	// destructor and the identity precompile.
+	caller = common.HexToAddress("0x00000000000000000000000000000000000000cc")
+
+	// destructor is a contract which self destructs, sending its funds to the
+	// beneficiary.
+	destructor = common.HexToAddress("0x00000000000000000000000000000000000000dd")
+
+	// beneficiary is a non-existent account receiving the funds of destructor.
+	beneficiary = common.HexToAddress("0x00000000000000000000000000000000000000bb")
+)
+
+// newTestChain creates a chain of three blocks: the first one calls into the
+// caller contract, the second one deploys a contract and the third one makes a
+// plain transfer.
+func newTestChain(t *testing.T) (*API, common.Address, []common.Hash) {
+	key, _ := crypto.GenerateKey()
+	sender := crypto.PubkeyToAddress(key.PublicKey)
+
+	var callerCode []byte
+	callerCode = append(callerCode, 0x60, 0x01, 0x60, 0x00, 0x55)                   // SSTORE(0, 1)
+	callerCode = append(callerCode, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00) // CALL(GAS, destructor, 0, 0, 0, 0, 0)
+	callerCode = append(callerCode, 0x60, 0x00, 0x73)
+	callerCode = append(callerCode, destructor.Bytes()...)
+	callerCode = append(callerCode, 0x5a, 0xf1, 0x50)
+	callerCode = append(callerCode, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00, 0x60, 0x00) // CALL(GAS, 0x04, 0, 0, 0, 0, 0)
+	callerCode = append(callerCode, 0x60, 0x00, 0x60, 0x04, 0x5a, 0xf1, 0x50)
+	callerCode = append(callerCode, 0x00) // STOP
+
+	destructorCode := append([]byte{0x73}, beneficiary.Bytes()...)
+	destructorCode = append(destructorCode, 0xff) // SELFDESTRUCT(beneficiary)
+
+	genesis := &core.Genesis{Alloc: core.GenesisAlloc{
+		sender:     {Balance: big.NewInt(params.Ether)},
+		caller:     {Code: callerCode, Balance: new(big.Int)},
+		destructor: {Code: destructorCode, Balance: big.NewInt(1)},
+	}}
+	var (
+		signer = types.HomesteadSigner{}
+		hashes []common.Hash
+	)
+	backend := newTestBackend(t, 3, genesis, func(i int, b *core.BlockGen) {
+		var tx *types.Transaction
+		switch i {
+		case 0:
+			tx = types.NewTransaction(uint64(i), caller, new(big.Int), 100000, b.BaseFee(), nil)
+		case 1:
+			tx = types.NewContractCreation(uint64(i), new(big.Int), 100000, b.BaseFee(), []byte{0x00})
+		case 2:
+			tx = types.NewTransaction(uint64(i), beneficiary, big.NewInt(1000), params.TxGas, b.BaseFee(), nil)
+		}
+		tx, _ = types.SignTx(tx, signer, key)
+		b.AddTx(tx)
+		hashes = append(hashes, tx.Hash())
+	})
+	return NewAPI(backend), sender, hashes
+}
+
+func TestTraceBlock(t *testing.T) {
+	t.Parallel()
+
+	api, sender, hashes := newTestChain(t)
+	traces, err := api.Block(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("failed to trace block: %v", err)
+	}
+	// The call into the precompile should be omitted
+	if len(traces) != 3 {
+		t.Fatalf("trace count mismatch: have %d, want 3", len(traces))
+	}
+	var (
+		types     = []string{"call", "call", "suicide"}
+		addresses = [][]int{{}, {0}, {0, 0}}
+		subtraces = []int{1, 1, 0}
+	)
+	for i, trace := range traces {
+		if trace.Type != types[i] {
+			t.Errorf("trace %d: type mismatch: have %s, want %s", i, trace.Type, types[i])
+		}
+		if !reflect.DeepEqual(trace.TraceAddress, addresses[i]) {
+			t.Errorf("trace %d: trace address mismatch: have %v, want %v", i, trace.TraceAddress, addresses[i])
+		}
+		if trace.Subtraces != subtraces[i] {
+			t.Errorf("trace %d: subtraces mismatch: have %d, want %d", i, trace.Subtraces, subtraces[i])
+		}
+		if *trace.BlockNumber != 1 || *trace.TransactionHash != hashes[0] || *trace.TransactionPosition != 0 {
+			t.Errorf("trace %d: position mismatch: block %d, tx %x, index %d", i, *trace.BlockNumber, *trace.TransactionHash, *trace.TransactionPosition)
+		}
+	}
+	if action := traces[0].Action.(*CallAction); action.From != sender || action.To != caller || action.CallType != "call" {
+		t.Errorf("top call action mismatch: %+v", action)
+	}
+	if action := traces[2].Action.(*SuicideAction); action.Address != destructor || action.RefundAddress != beneficiary || action.Balance.ToInt().Uint64() != 1 {
+		t.Errorf("suicide action mismatch: %+v", action)
+	}
+	if traces[2].Result != nil {
+		t.Errorf("suicide result mismatch: have %v, want nil", traces[2].Result)
+	}
+	// Contract creations should report the deployed contract
+	traces, err = api.Transaction(context.Background(), hashes[1])
+	if err != nil {
+		t.Fatalf("failed to trace transaction: %v", err)
+	}
+	if len(traces) != 1 || traces[0].Type != "create" {
+		t.Fatalf("creation trace mismatch: %+v", traces)
+	}
+	if result := traces[0].Result.(*CreateResult); result.Address != crypto.CreateAddress(sender, 1) {
+		t.Errorf("created address mismatch: have %x, want %x", result.Address, crypto.CreateAddress(sender, 1))
+	}
+	if *traces[0].BlockNumber != 2 || *traces[0].TransactionHash != hashes[1] {
+		t.Errorf("creation position mismatch: block %d, tx %x", *traces[0].BlockNumber, *traces[0].TransactionHash)
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	t.Parallel()
+
+	api, sender, hashes := newTestChain(t)
+
+	block := func(n int64) *rpc.BlockNumber {
+		number := rpc.BlockNumber(n)
+		return &number
+	}
+	count := func(n uint64) *hexutil.Uint64 {
+		return (*hexutil.Uint64)(&n)
+	}
+	var testSuite = []struct {
+		args   FilterArgs
+		expect []common.Hash // Transaction of each matching trace
+	}{
+		// All traces of the chain
+		{
+			args:   FilterArgs{FromBlock: block(0)},
+			expect: []common.Hash{hashes[0], hashes[0], hashes[0], hashes[1], hashes[2]},
+		},
+		// Traces of a block range
+		{
+			args:   FilterArgs{FromBlock: block(2), ToBlock: block(3)},
+			expect: []common.Hash{hashes[1], hashes[2]},
+		},
+		// Traces sent by an address
+		{
+			args:   FilterArgs{FromBlock: block(1), FromAddress: []common.Address{sender}},
+			expect: []common.Hash{hashes[0], hashes[1], hashes[2]},
+		},
+		// Traces sent to an address
+		{
+			args:   FilterArgs{FromBlock: block(1), ToAddress: []common.Address{beneficiary}},
+			expect: []common.Hash{hashes[0], hashes[2]},
+		},
+		// Traces sent between two addresses
+		{
+			args:   FilterArgs{FromBlock: block(1), FromAddress: []common.Address{caller}, ToAddress: []common.Address{destructor}},
+			expect: []common.Hash{hashes[0]},
+		},
+		// Paginated traces
+		{
+			args:   FilterArgs{FromBlock: block(1), After: count(2), Count: count(2)},
+			expect: []common.Hash{hashes[0], hashes[1]},
+		},
+	}
+	for i, tc := range testSuite {
+		traces, err := api.Filter(context.Background(), tc.args)
+		if err != nil {
+			t.Errorf("test %d: failed to filter traces: %v", i, err)
+			continue
+		}
+		have := []common.Hash{}
+		for _, trace := range traces {
+			have = append(have, *trace.TransactionHash)
+		}
+		if !reflect.DeepEqual(have, tc.expect) {
+			t.Errorf("test %d: traces mismatch: have %x, want %x", i, have, tc.expect)
+		}
+	}
+	if _, err := api.Filter(context.Background(), FilterArgs{FromBlock: block(3), ToBlock: block(2)}); err == nil {
+		t.Errorf("expected error for inverted block range")
+	}
+}
+
+func TestReplayBlockTransactions(t *testing.T) {
+	t.Parallel()
+
+	api, _, hashes := newTestChain(t)
+
+	if _, err := api.ReplayBlockTransactions(context.Background(), 1, []string{"trace", "bogus"}); err == nil {
+		t.Fatalf("expected error for invalid trace type")
+	}
+	results, err := api.ReplayBlockTransactions(context.Background(), 1, []string{"trace", "stateDiff", "vmTrace"})
+	if err != nil {
+		t.Fatalf("failed to replay block: %v", err)
+	}
+	if len(results) != 1 || *results[0].TransactionHash != hashes[0] {
+		t.Fatalf("result mismatch: %+v", results)
+	}
+	if len(results[0].Trace) != 3 {
+		t.Errorf("trace count mismatch: have %d, want 3", len(results[0].Trace))
+	}
+	// Check the state diff in its encoded form
+	blob, err := json.Marshal(results[0].StateDiff)
+	if err != nil {
+		t.Fatalf("failed to encode state diff: %v", err)
+	}
+	var diff map[common.Address]map[string]interface{}
+	if err := json.Unmarshal(blob, &diff); err != nil {
+		t.Fatalf("failed to decode state diff: %v", err)
+	}
+	slot := diff[caller]["storage"].(map[string]interface{})[common.Hash{}.Hex()]
+	if want := map[string]interface{}{"*": map[string]interface{}{"from": common.Hash{}.Hex(), "to": common.BigToHash(common.Big1).Hex()}}; !reflect.DeepEqual(slot, want) {
+		t.Errorf("caller storage diff mismatch: have %v, want %v", slot, want)
+	}
+	if balance := diff[caller]["balance"]; balance != "=" {
+		t.Errorf("caller balance diff mismatch: have %v, want =", balance)
+	}
+	if balance, want := diff[destructor]["balance"], map[string]interface{}{"-": "0x1"}; !reflect.DeepEqual(balance, want) {
+		t.Errorf("destructor balance diff mismatch: have %v, want %v", balance, want)
+	}
+	if balance, want := diff[beneficiary]["balance"], map[string]interface{}{"+": "0x1"}; !reflect.DeepEqual(balance, want) {
+		t.Errorf("beneficiary balance diff mismatch: have %v, want %v", balance, want)
+	}
+	// Check the VM trace of the storage write and the subcall
+	var vmtrace struct {
+		Code hexutil.Bytes `json:"code"`
+		Ops  []struct {
+			Cost uint64 `json:"cost"`
+			Ex   *struct {
+				Push  []string               `json:"push"`
+				Store map[string]string      `json:"store"`
+				Mem   map[string]interface{} `json:"mem"`
+			} `json:"ex"`
+			Pc  uint64 `json:"pc"`
+			Sub *struct {
+				Code hexutil.Bytes     `json:"code"`
+				Ops  []json.RawMessage `json:"ops"`
+			} `json:"sub"`
+		} `json:"ops"`
+	}
+	if err := json.Unmarshal(results[0].VMTrace, &vmtrace); err != nil {
+		t.Fatalf("failed to decode vm trace: %v", err)
+	}
+	if len(vmtrace.Ops) < 5 || len(vmtrace.Code) == 0 {
+		t.Fatalf("vm trace too short: %d ops", len(vmtrace.Ops))
+	}
+	if push := vmtrace.Ops[0].Ex.Push; !reflect.DeepEqual(push, []string{"0x1"}) {
+		t.Errorf("push mismatch: have %v, want [0x1]", push)
+	}
+	if store := vmtrace.Ops[2].Ex.Store; store["key"] != "0x0" || store["val"] != "0x1" {
+		t.Errorf("store mismatch: have %v", store)
+	}
+	// Both the destructor and the (codeless) precompile calls open sub traces
+	type subtrace struct{ code, ops int }
+	subs := make(map[uint64]subtrace)
+	for _, op := range vmtrace.Ops {
+		if op.Sub != nil {
+			subs[op.Pc] = subtrace{len(op.Sub.Code), len(op.Sub.Ops)}
+		}
+	}
+	if want := map[uint64]subtrace{37: {22, 2}, 52: {0, 0}}; !reflect.DeepEqual(subs, want) {
+		t.Errorf("sub traces mismatch: have %v, want %v", subs, want)
+	}
+	// Replaying a single transaction should yield the same results
+	result, err := api.ReplayTransaction(context.Background(), hashes[0], []string{"stateDiff"})
+	if err != nil {
+		t.Fatalf("failed to replay transaction: %v", err)
+	}
+	if result.Trace != nil || result.VMTrace != nil {
+		t.Errorf("unrequested trace types returned")
+	}
+	if !reflect.DeepEqual(result.StateDiff, results[0].StateDiff) {
+		t.Errorf("state diff mismatch between block and transaction replay")
+	}
+}
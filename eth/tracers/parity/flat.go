@@ -0,0 +1,234 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package parity
+
+import (
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// Trace is a single call frame of a transaction, flattened into a list in the
+// OpenEthereum (parity) format. The position of the frame within the call tree
+// is given by its trace address.
+type Trace struct {
+	Action              interface{}  `json:"action"`
+	BlockHash           *common.Hash `json:"blockHash,omitempty"`
+	BlockNumber         *uint64      `json:"blockNumber,omitempty"`
+	Error               string       `json:"error,omitempty"`
+	Result              interface{}  `json:"result"`
+	Subtraces           int          `json:"subtraces"`
+	TraceAddress        []int        `json:"traceAddress"`
+	TransactionHash     *common.Hash `json:"transactionHash,omitempty"`
+	TransactionPosition *uint64      `json:"transactionPosition,omitempty"`
+	Type                string       `json:"type"`
+}
+
+// CallAction is the action of a message call frame.
+type CallAction struct {
+	CallType string         `json:"callType"`
+	From     common.Address `json:"from"`
+	Gas      hexutil.Uint64 `json:"gas"`
+	Input    hexutil.Bytes  `json:"input"`
+	To       common.Address `json:"to"`
+	Value    *hexutil.Big   `json:"value"`
+}
+
+// CallResult is the outcome of a successful message call frame.
+type CallResult struct {
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Output  hexutil.Bytes  `json:"output"`
+}
+
+// CreateAction is the action of a contract creation frame.
+type CreateAction struct {
+	From  common.Address `json:"from"`
+	Gas   hexutil.Uint64 `json:"gas"`
+	Init  hexutil.Bytes  `json:"init"`
+	Value *hexutil.Big   `json:"value"`
+}
+
+// CreateResult is the outcome of a successful contract creation frame.
+type CreateResult struct {
+	Address common.Address `json:"address"`
+	Code    hexutil.Bytes  `json:"code"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+}
+
+// SuicideAction is the action of a self destruct, which has no result.
+type SuicideAction struct {
+	Address       common.Address `json:"address"`
+	Balance       *hexutil.Big   `json:"balance"`
+	RefundAddress common.Address `json:"refundAddress"`
+}
+
+// callFrame is the result format of the native call tracer, used as the source
+// of the flat traces.
+type callFrame struct {
+	Type    string         `json:"type"`
+	From    common.Address `json:"from"`
+	To      common.Address `json:"to"`
+	Value   *hexutil.Big   `json:"value"`
+	Gas     hexutil.Uint64 `json:"gas"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Input   hexutil.Bytes  `json:"input"`
+	Output  hexutil.Bytes  `json:"output"`
+	Error   string         `json:"error"`
+	Calls   []*callFrame   `json:"calls"`
+}
+
+// parityErrors maps the execution errors of go-ethereum to their equivalents
+// reported by OpenEthereum.
+var parityErrors = map[string]string{
+	vm.ErrCodeStoreOutOfGas.Error():     "Out of gas",
+	vm.ErrOutOfGas.Error():              "Out of gas",
+	vm.ErrGasUintOverflow.Error():       "Out of gas",
+	vm.ErrMaxCodeSizeExceeded.Error():   "Out of gas",
+	vm.ErrInvalidJump.Error():           "Bad jump destination",
+	vm.ErrExecutionReverted.Error():     "Reverted",
+	vm.ErrReturnDataOutOfBounds.Error(): "Out of bounds",
+	vm.ErrWriteProtection.Error():       "Mutable call in static context",
+	vm.ErrDepth.Error():                 "Out of stack",
+	vm.ErrInsufficientBalance.Error():   "Insufficient balance",
+	"precompiled failed":                "Built-in failed",
+	"invalid input length":              "Built-in failed",
+}
+
+// parityError converts an execution error to the format of OpenEthereum, falling
+// back to the original message if no equivalent is known.
+func parityError(err string) string {
+	if perr, ok := parityErrors[err]; ok {
+		return perr
+	}
+	switch {
+	case strings.HasPrefix(err, "invalid opcode"):
+		return "Bad instruction"
+	case strings.HasPrefix(err, "stack underflow"):
+		return "Stack underflow"
+	case strings.HasPrefix(err, "stack limit reached"):
+		return "Out of stack"
+	}
+	return err
+}
+
+// flatten converts a call frame and all its descendants into a list of flat
+// traces, appending them to the given list in depth-first order. Calls into
+// precompiled contracts are omitted, same as OpenEthereum does.
+func flatten(frame *callFrame, address []int, precompiles map[common.Address]bool, traces []*Trace) []*Trace {
+	trace := &Trace{TraceAddress: address}
+	switch frame.Type {
+	case "CREATE", "CREATE2":
+		trace.Type = "create"
+		trace.Action = &CreateAction{
+			From:  frame.From,
+			Gas:   frame.Gas,
+			Init:  frame.Input,
+			Value: bigOrZero(frame.Value),
+		}
+		trace.Result = &CreateResult{
+			Address: frame.To,
+			Code:    frame.Output,
+			GasUsed: frame.GasUsed,
+		}
+	case "SELFDESTRUCT":
+		trace.Type = "suicide"
+		trace.Action = &SuicideAction{
+			Address:       frame.From,
+			Balance:       bigOrZero(frame.Value),
+			RefundAddress: frame.To,
+		}
+	default:
+		trace.Type = "call"
+		trace.Action = &CallAction{
+			CallType: strings.ToLower(frame.Type),
+			From:     frame.From,
+			Gas:      frame.Gas,
+			Input:    frame.Input,
+			To:       frame.To,
+			Value:    bigOrZero(frame.Value),
+		}
+		trace.Result = &CallResult{
+			GasUsed: frame.GasUsed,
+			Output:  frame.Output,
+		}
+	}
+	if frame.Error != "" {
+		trace.Error = parityError(frame.Error)
+		trace.Result = nil
+	}
+	var calls []*callFrame
+	for _, call := range frame.Calls {
+		if call.Type != "CREATE" && call.Type != "CREATE2" && call.Type != "SELFDESTRUCT" && precompiles[call.To] {
+			continue
+		}
+		calls = append(calls, call)
+	}
+	trace.Subtraces = len(calls)
+	traces = append(traces, trace)
+
+	for i, call := range calls {
+		child := make([]int, len(address)+1)
+		copy(child, address)
+		child[len(address)] = i
+
+		traces = flatten(call, child, precompiles, traces)
+	}
+	return traces
+}
+
+// bigOrZero returns the given number, or zero if it's missing.
+func bigOrZero(n *hexutil.Big) *hexutil.Big {
+	if n == nil {
+		return (*hexutil.Big)(new(big.Int))
+	}
+	return n
+}
+
+// matches checks whether a trace is sent from and/or to any of the given
+// addresses. An empty address list matches any trace.
+func (t *Trace) matches(from, to []common.Address) bool {
+	var sender, recipient common.Address
+	switch action := t.Action.(type) {
+	case *CallAction:
+		sender, recipient = action.From, action.To
+	case *CreateAction:
+		sender = action.From
+		if result, ok := t.Result.(*CreateResult); ok {
+			recipient = result.Address
+		}
+	case *SuicideAction:
+		sender, recipient = action.Address, action.RefundAddress
+	}
+	return contains(from, sender) && contains(to, recipient)
+}
+
+// contains checks whether an address is within the given list, treating an
+// empty list as a wildcard.
+func contains(addresses []common.Address, address common.Address) bool {
+	if len(addresses) == 0 {
+		return true
+	}
+	for _, addr := range addresses {
+		if addr == address {
+			return true
+		}
+	}
+	return false
+}
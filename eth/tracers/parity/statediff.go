@@ -0,0 +1,142 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package parity
+
+import (
+	"encoding/json"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Diff is the change of a single value of the state. Depending on which sides
+// are present, it is either born, died, changed, or unchanged.
+type Diff struct {
+	From interface{} // Value before the transaction, nil if born
+	To   interface{} // Value after the transaction, nil if died
+}
+
+// MarshalJSON implements json.Marshaler, encoding the diff in the format of
+// OpenEthereum: "=" if unchanged, {"+": to} if born, {"-": from} if died, and
+// {"*": {"from": from, "to": to}} if changed.
+func (d *Diff) MarshalJSON() ([]byte, error) {
+	switch {
+	case d.From == nil && d.To == nil:
+		return []byte(`"="`), nil
+	case d.From == nil:
+		return json.Marshal(map[string]interface{}{"+": d.To})
+	case d.To == nil:
+		return json.Marshal(map[string]interface{}{"-": d.From})
+	default:
+		return json.Marshal(map[string]interface{}{"*": map[string]interface{}{"from": d.From, "to": d.To}})
+	}
+}
+
+// AccountDiff is the change of an account caused by a transaction.
+type AccountDiff struct {
+	Balance *Diff                 `json:"balance"`
+	Code    *Diff                 `json:"code"`
+	Nonce   *Diff                 `json:"nonce"`
+	Storage map[common.Hash]*Diff `json:"storage"`
+}
+
+// StateDiff is the change of all accounts touched by a transaction.
+type StateDiff map[common.Address]*AccountDiff
+
+// prestateAccount is an account in the result of the native prestate tracer. In
+// the post state of the diff mode, unchanged fields are missing.
+type prestateAccount struct {
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    *hexutil.Bytes              `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+}
+
+// prestateDiff is the result of the native prestate tracer in diff mode.
+type prestateDiff struct {
+	Pre  map[common.Address]*prestateAccount `json:"pre"`
+	Post map[common.Address]*prestateAccount `json:"post"`
+}
+
+// newStateDiff converts the result of the prestate tracer in diff mode into the
+// state diff format of OpenEthereum. Accounts only present in the post state
+// were created, and ones only in the pre state were deleted.
+func newStateDiff(diff *prestateDiff) StateDiff {
+	res := make(StateDiff)
+	for addr, post := range diff.Post {
+		pre, ok := diff.Pre[addr]
+		account := &AccountDiff{
+			Balance: new(Diff),
+			Code:    new(Diff),
+			Nonce:   new(Diff),
+			Storage: make(map[common.Hash]*Diff),
+		}
+		if !ok {
+			// The account was born, report all its fields
+			account.Balance.To = bigOrZero(post.Balance)
+			account.Nonce.To = hexutil.Uint64(post.Nonce)
+			account.Code.To = bytesOrEmpty(post.Code)
+			for key, val := range post.Storage {
+				if val != (common.Hash{}) {
+					account.Storage[key] = &Diff{To: val}
+				}
+			}
+			res[addr] = account
+			continue
+		}
+		if post.Balance != nil {
+			account.Balance.From, account.Balance.To = bigOrZero(pre.Balance), post.Balance
+		}
+		if post.Nonce != 0 && post.Nonce != pre.Nonce {
+			account.Nonce.From, account.Nonce.To = hexutil.Uint64(pre.Nonce), hexutil.Uint64(post.Nonce)
+		}
+		if post.Code != nil {
+			account.Code.From, account.Code.To = bytesOrEmpty(pre.Code), *post.Code
+		}
+		for key, val := range post.Storage {
+			account.Storage[key] = &Diff{From: pre.Storage[key], To: val}
+		}
+		res[addr] = account
+	}
+	for addr, pre := range diff.Pre {
+		if _, ok := diff.Post[addr]; ok {
+			continue
+		}
+		// The account died, report all its previous fields
+		account := &AccountDiff{
+			Balance: &Diff{From: bigOrZero(pre.Balance)},
+			Code:    &Diff{From: bytesOrEmpty(pre.Code)},
+			Nonce:   &Diff{From: hexutil.Uint64(pre.Nonce)},
+			Storage: make(map[common.Hash]*Diff),
+		}
+		for key, val := range pre.Storage {
+			if val != (common.Hash{}) {
+				account.Storage[key] = &Diff{From: val}
+			}
+		}
+		res[addr] = account
+	}
+	return res
+}
+
+// bytesOrEmpty returns the given byte slice, or an empty one if it's missing.
+func bytesOrEmpty(b *hexutil.Bytes) hexutil.Bytes {
+	if b == nil {
+		return hexutil.Bytes{}
+	}
+	return *b
+}
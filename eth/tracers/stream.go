@@ -0,0 +1,121 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// maxStreamRequestSize is the maximum size of a chain trace stream request.
+const maxStreamRequestSize = 1024 * 1024
+
+// ChainStreamRequest is the request body accepted by the chain trace streaming
+// HTTP handler. The fields mirror the parameters of debug_traceChain.
+type ChainStreamRequest struct {
+	Start  rpc.BlockNumber   `json:"start"`
+	End    rpc.BlockNumber   `json:"end"`
+	Config *TraceChainConfig `json:"config"`
+}
+
+// chainStreamHandler is an HTTP handler streaming chain traces.
+type chainStreamHandler struct {
+	api *API
+}
+
+// NewChainStreamHandler creates an HTTP handler that traces a chain segment, the
+// same way debug_traceChain does, and streams the results as newline delimited
+// JSON: one block result object per line, flushed as soon as it is available.
+//
+// Tracing is paced by the client, a slow reader throttles the tracer instead of
+// making the node buffer results. The server's write timeout is applied to each
+// result separately instead of the entire stream, so long ranges can be traced
+// in one go. Should the connection drop, the stream can be resumed by issuing a
+// new request starting at the block number of the last received result.
+func NewChainStreamHandler(backend Backend) http.Handler {
+	return &chainStreamHandler{api: NewAPI(backend)}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *chainStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var req ChainStreamRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxStreamRequestSize)).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	from, to, err := h.api.chainRange(r.Context(), req.Start, req.End)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Abort tracing as soon as the client goes away. The request context is
+	// also cancelled when this method returns, so the goroutine can't leak.
+	closed := make(chan interface{})
+	go func() {
+		<-r.Context().Done()
+		close(closed)
+	}()
+	// The write deadline set by the server covers the entire response, which
+	// would cut long streams short. Push it forward before every result if the
+	// writer allows it.
+	var timeout time.Duration
+	if srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server); ok {
+		timeout = srv.WriteTimeout
+	}
+	extendDeadline := func() {
+		d, ok := w.(interface{ SetWriteDeadline(time.Time) error })
+		if !ok {
+			return
+		}
+		var deadline time.Time
+		if timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+		if err := d.SetWriteDeadline(deadline); err != nil {
+			log.Debug("Failed to extend chain trace stream deadline", "err", err)
+		}
+	}
+	extendDeadline()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for result := range h.api.traceChain(from, to, req.Config, closed) {
+		extendDeadline()
+		if err := enc.Encode(result); err != nil {
+			log.Debug("Chain trace stream failed", "block", uint64(result.Block), "err", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
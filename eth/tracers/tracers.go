@@ -14,19 +14,70 @@
 // You should have received a copy of the GNU Lesser General Public License
 // along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
 
-// Package tracers is a collection of JavaScript transaction tracers.
+// Package tracers is a collection of JavaScript and native Go transaction tracers.
 package tracers
 
 import (
+	"encoding/json"
+	"errors"
 	"strings"
 	"unicode"
 
+	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/eth/tracers/internal/tracers"
 )
 
+// Tracer interface extends vm.Tracer and additionally allows collecting the
+// tracing result and aborting a running trace.
+type Tracer interface {
+	vm.Tracer
+
+	// GetResult returns the JSON encoded result of the trace, or any error
+	// which occurred during the tracing.
+	GetResult() (json.RawMessage, error)
+
+	// Stop terminates execution of the tracer at the first opportune moment.
+	Stop(err error)
+}
+
+// ErrConfigUnsupported is returned if a tracer specific configuration is given
+// to a tracer which doesn't take any.
+var ErrConfigUnsupported = errors.New("tracer does not take a config")
+
 // all contains all the built in JavaScript tracers by name.
 var all = make(map[string]string)
 
+// native contains the constructors of all the registered native Go tracers.
+var native = make(map[string]func(cfg json.RawMessage) (Tracer, error))
+
+// RegisterNativeTracer makes a native Go tracer available under the given name,
+// shadowing any JavaScript tracer with the same name. It is meant to be invoked
+// from the init function of the package implementing the tracer, and it panics
+// if a native tracer with the same name is already registered.
+//
+// The constructor receives the opaque, tracer specific configuration supplied
+// by the user (nil if none) and should reject it if it's invalid.
+func RegisterNativeTracer(name string, ctor func(cfg json.RawMessage) (Tracer, error)) {
+	if _, ok := native[name]; ok {
+		panic("tracers: duplicate native tracer " + name)
+	}
+	native[name] = ctor
+}
+
+// IsEmptyConfig reports whether a tracer specific configuration is missing, null
+// or an empty object. Tracers without any options should reject anything else
+// with ErrConfigUnsupported, so misspelled options don't go unnoticed.
+func IsEmptyConfig(cfg json.RawMessage) bool {
+	if len(cfg) == 0 {
+		return true
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(cfg, &fields); err != nil {
+		return false
+	}
+	return len(fields) == 0
+}
+
 // camel converts a snake cased input string into a camel cased output.
 func camel(str string) string {
 	pieces := strings.Split(str, "_")
@@ -44,6 +95,20 @@ func init() {
 	}
 }
 
+// New instantiates a new tracer instance. If code is the name of a registered
+// native tracer, that one is constructed. Otherwise code is either the name of
+// a built in JavaScript tracer or a Javascript snippet, which must evaluate to
+// an expression returning an object with 'step', 'fault' and 'result' functions.
+//
+// The opaque tracer specific configuration is handed to native tracers upon
+// construction and to the 'setup' function of JavaScript tracers.
+func New(code string, ctx *Context, cfg json.RawMessage) (Tracer, error) {
+	if ctor, ok := native[code]; ok {
+		return ctor(cfg)
+	}
+	return newJsTracer(code, ctx, cfg)
+}
+
 // tracer retrieves a specific JavaScript tracer by name.
 func tracer(name string) (string, bool) {
 	if tracer, ok := all[name]; ok {
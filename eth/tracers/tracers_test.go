@@ -173,7 +173,7 @@ func TestPrestateTracerCreate2(t *testing.T) {
 	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), alloc, false)
 
 	// Create the tracer, the EVM environment and run it
-	tracer, err := New("prestateTracer", new(Context))
+	tracer, err := New("prestateTracer", new(Context), nil)
 	if err != nil {
 		t.Fatalf("failed to create call tracer: %v", err)
 	}
@@ -252,7 +252,7 @@ func testCallTracer(tracer string, dirPath string, t *testing.T) {
 			_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
 
 			// Create the tracer, the EVM environment and run it
-			tracer, err := New(tracer, new(Context))
+			tracer, err := New(tracer, new(Context), nil)
 			if err != nil {
 				t.Fatalf("failed to create call tracer: %v", err)
 			}
@@ -439,7 +439,7 @@ func benchTracer(tracerName string, test *callTracerTest, b *testing.B) {
 	_, statedb := tests.MakePreState(rawdb.NewMemoryDatabase(), test.Genesis.Alloc, false)
 
 	// Create the tracer, the EVM environment and run it
-	tracer, err := New(tracerName, new(Context))
+	tracer, err := New(tracerName, new(Context), nil)
 	if err != nil {
 		b.Fatalf("failed to create call tracer: %v", err)
 	}
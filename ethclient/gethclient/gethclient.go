@@ -118,6 +118,87 @@ func (ec *Client) GetProof(ctx context.Context, account common.Address, keys []s
 	return &result, err
 }
 
+// ProofRequest specifies an account and the storage slots of it to be proven
+// in a batch proof.
+type ProofRequest struct {
+	Address     common.Address `json:"address"`
+	StorageKeys []string       `json:"storageKeys"`
+}
+
+// MultiProofResult is the result of a GetMultiProof operation.
+type MultiProofResult struct {
+	StateRoot common.Hash
+	Nodes     [][]byte
+	Accounts  []MultiProofAccount
+}
+
+// MultiProofAccount is a proven account in a batch proof.
+type MultiProofAccount struct {
+	Address     common.Address
+	Balance     *big.Int
+	CodeHash    common.Hash
+	Nonce       uint64
+	StorageHash common.Hash
+	Storage     []MultiProofValue
+}
+
+// MultiProofValue is a proven storage slot in a batch proof.
+type MultiProofValue struct {
+	Key   string
+	Value *big.Int
+}
+
+// GetMultiProof returns the values of the specified accounts and storage slots together
+// with a single set of trie nodes proving all of them against the state root.
+// The block number can be nil, in which case the value is taken from the latest known block.
+func (ec *Client) GetMultiProof(ctx context.Context, requests []ProofRequest, blockNumber *big.Int) (*MultiProofResult, error) {
+	type valueResult struct {
+		Key   string       `json:"key"`
+		Value *hexutil.Big `json:"value"`
+	}
+	type accountResult struct {
+		Address     common.Address `json:"address"`
+		Balance     *hexutil.Big   `json:"balance"`
+		CodeHash    common.Hash    `json:"codeHash"`
+		Nonce       hexutil.Uint64 `json:"nonce"`
+		StorageHash common.Hash    `json:"storageHash"`
+		Storage     []valueResult  `json:"storage"`
+	}
+	type multiProofResult struct {
+		StateRoot common.Hash     `json:"stateRoot"`
+		Nodes     []hexutil.Bytes `json:"nodes"`
+		Accounts  []accountResult `json:"accounts"`
+	}
+	var res multiProofResult
+	if err := ec.c.CallContext(ctx, &res, "eth_getMultiProof", requests, toBlockNumArg(blockNumber)); err != nil {
+		return nil, err
+	}
+	// Turn hexutils back to normal datatypes
+	result := &MultiProofResult{
+		StateRoot: res.StateRoot,
+		Nodes:     make([][]byte, 0, len(res.Nodes)),
+		Accounts:  make([]MultiProofAccount, 0, len(res.Accounts)),
+	}
+	for _, node := range res.Nodes {
+		result.Nodes = append(result.Nodes, node)
+	}
+	for _, acc := range res.Accounts {
+		storage := make([]MultiProofValue, 0, len(acc.Storage))
+		for _, st := range acc.Storage {
+			storage = append(storage, MultiProofValue{Key: st.Key, Value: st.Value.ToInt()})
+		}
+		result.Accounts = append(result.Accounts, MultiProofAccount{
+			Address:     acc.Address,
+			Balance:     acc.Balance.ToInt(),
+			CodeHash:    acc.CodeHash,
+			Nonce:       uint64(acc.Nonce),
+			StorageHash: acc.StorageHash,
+			Storage:     storage,
+		})
+	}
+	return result, nil
+}
+
 // OverrideAccount specifies the state of an account to be overridden.
 type OverrideAccount struct {
 	Nonce     uint64                      `json:"nonce"`
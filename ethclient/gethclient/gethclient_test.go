@@ -32,9 +32,12 @@ import (
 	"github.com/ethereum/go-ethereum/eth"
 	"github.com/ethereum/go-ethereum/eth/ethconfig"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/node"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 var (
@@ -108,6 +111,9 @@ func TestGethClient(t *testing.T) {
 		{
 			"TestGetProof",
 			func(t *testing.T) { testGetProof(t, client) },
+		}, {
+			"TestGetMultiProof",
+			func(t *testing.T) { testGetMultiProof(t, client) },
 		}, {
 			"TestGCStats",
 			func(t *testing.T) { testGCStats(t, client) },
@@ -210,6 +216,61 @@ func testGetProof(t *testing.T, client *rpc.Client) {
 	}
 }
 
+func testGetMultiProof(t *testing.T, client *rpc.Client) {
+	ec := New(client)
+	ethcl := ethclient.NewClient(client)
+	missing := common.HexToAddress("0xdeadbeef")
+	requests := []ProofRequest{
+		{Address: testAddr, StorageKeys: []string{"0x00"}},
+		{Address: missing, StorageKeys: []string{"0x01"}},
+	}
+	result, err := ec.GetMultiProof(context.Background(), requests, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := ethcl.HeaderByNumber(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.StateRoot != head.Root {
+		t.Fatalf("unexpected state root, want: %x got: %x", head.Root, result.StateRoot)
+	}
+	if len(result.Accounts) != len(requests) {
+		t.Fatalf("unexpected number of accounts, want: %d got: %d", len(requests), len(result.Accounts))
+	}
+	// Every node must be included only once and prove both accounts
+	proofs := memorydb.New()
+	for _, node := range result.Nodes {
+		hash := crypto.Keccak256(node)
+		if ok, _ := proofs.Has(hash); ok {
+			t.Fatalf("duplicate proof node %x", hash)
+		}
+		proofs.Put(hash, node)
+	}
+	for i, req := range requests {
+		blob, err := trie.VerifyProof(result.StateRoot, crypto.Keccak256(req.Address.Bytes()), proofs)
+		if err != nil {
+			t.Fatalf("account %d: invalid proof: %v", i, err)
+		}
+		if req.Address == missing {
+			if blob != nil {
+				t.Fatalf("account %d: unexpected proof of existence", i)
+			}
+			continue
+		}
+		var acc types.StateAccount
+		if err := rlp.DecodeBytes(blob, &acc); err != nil {
+			t.Fatalf("account %d: invalid account: %v", i, err)
+		}
+		if acc.Balance.Cmp(result.Accounts[i].Balance) != 0 {
+			t.Fatalf("account %d: invalid balance, want: %v got: %v", i, acc.Balance, result.Accounts[i].Balance)
+		}
+		if acc.Root != result.Accounts[i].StorageHash {
+			t.Fatalf("account %d: invalid storage hash, want: %x got: %x", i, acc.Root, result.Accounts[i].StorageHash)
+		}
+	}
+}
+
 func testGCStats(t *testing.T, client *rpc.Client) {
 	ec := New(client)
 	_, err := ec.GCStats(context.Background())
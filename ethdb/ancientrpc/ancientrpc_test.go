@@ -0,0 +1,120 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ancientrpc
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Tests that the items of an ancient store are served over RPC, and that the
+// remote store rejects modifications.
+func TestRemoteAncients(t *testing.T) {
+	freezer, err := rawdb.NewChainFreezer(t.TempDir(), "", false)
+	if err != nil {
+		t.Fatalf("failed to open freezer: %v", err)
+	}
+	defer freezer.Close()
+
+	kinds := []string{"headers", "hashes", "bodies", "receipts", "diffs"}
+	_, err = freezer.ModifyAncients(func(op ethdb.AncientWriteOp) error {
+		for i := uint64(0); i < 10; i++ {
+			for _, kind := range kinds {
+				if err := op.AppendRaw(kind, i, []byte(fmt.Sprintf("%s-%d", kind, i))); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to write ancients: %v", err)
+	}
+	server, err := NewServer(freezer)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	defer server.Stop()
+
+	remote := New(rpc.DialInProc(server))
+	defer remote.Close()
+
+	if n, err := remote.Ancients(); err != nil || n != 10 {
+		t.Fatalf("ancients mismatch: have %d, %v, want 10", n, err)
+	}
+	for i := uint64(0); i < 10; i++ {
+		blob, err := remote.Ancient("bodies", i)
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve: %v", i, err)
+		}
+		if want := []byte(fmt.Sprintf("bodies-%d", i)); !bytes.Equal(blob, want) {
+			t.Fatalf("item %d: blob mismatch: have %q, want %q", i, blob, want)
+		}
+	}
+	if has, err := remote.HasAncient("bodies", 9); err != nil || !has {
+		t.Fatalf("existing item missing: %v", err)
+	}
+	if has, err := remote.HasAncient("bodies", 10); err != nil || has {
+		t.Fatalf("missing item reported: %v", err)
+	}
+	if _, err := remote.Ancient("bodies", 10); err == nil {
+		t.Fatalf("retrieved missing item")
+	}
+	items, err := remote.ReadAncients("hashes", 2, 5, 0)
+	if err != nil {
+		t.Fatalf("failed to read items: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("item count mismatch: have %d, want 1", len(items))
+	}
+	if items, err = remote.ReadAncients("hashes", 2, 5, 1024); err != nil || len(items) != 5 {
+		t.Fatalf("item count mismatch: have %d, want 5: %v", len(items), err)
+	}
+	for i, item := range items {
+		if want := []byte(fmt.Sprintf("hashes-%d", i+2)); !bytes.Equal(item, want) {
+			t.Fatalf("item %d: blob mismatch: have %q, want %q", i+2, item, want)
+		}
+	}
+	// Remove a few items from the tail and ensure it's reflected remotely
+	if err := freezer.TruncateAncientTail("receipts", 4); err != nil {
+		t.Fatalf("failed to truncate tail: %v", err)
+	}
+	if tail, err := remote.AncientTail("receipts"); err != nil || tail != 4 {
+		t.Fatalf("tail mismatch: have %d, %v, want 4", tail, err)
+	}
+	if size, err := remote.AncientSize("receipts"); err != nil || size == 0 {
+		t.Fatalf("size unavailable: %v", err)
+	}
+	// Modifications are rejected without reaching the store
+	if !remote.AncientReadOnly() {
+		t.Fatalf("remote store writable")
+	}
+	if _, err := remote.ModifyAncients(func(ethdb.AncientWriteOp) error { return nil }); err == nil {
+		t.Fatalf("remote store modified")
+	}
+	if err := remote.TruncateAncients(5); err == nil {
+		t.Fatalf("remote store truncated")
+	}
+	if n, _ := freezer.Ancients(); n != 10 {
+		t.Fatalf("store modified: have %d items, want 10", n)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package ancientrpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// requestTimeout is the maximum time to wait for a response of the remote store.
+const requestTimeout = 30 * time.Second
+
+// errReadOnly is returned for any modification of the remote ancient store.
+var errReadOnly = errors.New("remote ancient store is read only")
+
+// Client is an ancient store served by a remote process over RPC. The store is
+// read-only, modifications are left to the process serving it.
+type Client struct {
+	client *rpc.Client
+}
+
+// IsRemote reports whether the ancient store location is the URL of a remote
+// store instead of a directory.
+func IsRemote(location string) bool {
+	for _, scheme := range []string{"http://", "https://", "ws://", "wss://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial connects to the ancient store served at the given URL.
+func Dial(url string) (*Client, error) {
+	client, err := rpc.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return New(client), nil
+}
+
+// New creates an ancient store accessed through the given RPC client.
+func New(client *rpc.Client) *Client {
+	return &Client{client: client}
+}
+
+// call invokes the given method of the remote store.
+func (c *Client) call(result interface{}, method string, args ...interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	return c.client.CallContext(ctx, result, Namespace+"_"+method, args...)
+}
+
+// HasAncient returns an indicator whether the specified data exists in the
+// remote store.
+func (c *Client) HasAncient(kind string, number uint64) (bool, error) {
+	var has bool
+	if err := c.call(&has, "hasAncient", kind, hexutil.Uint64(number)); err != nil {
+		return false, err
+	}
+	return has, nil
+}
+
+// Ancient retrieves an ancient binary blob from the remote store.
+func (c *Client) Ancient(kind string, number uint64) ([]byte, error) {
+	var blob hexutil.Bytes
+	if err := c.call(&blob, "ancient", kind, hexutil.Uint64(number)); err != nil {
+		return nil, err
+	}
+	return blob, nil
+}
+
+// ReadAncients retrieves multiple items in sequence from the remote store.
+func (c *Client) ReadAncients(kind string, start, count, maxBytes uint64) ([][]byte, error) {
+	var blobs []hexutil.Bytes
+	if err := c.call(&blobs, "readAncients", kind, hexutil.Uint64(start), hexutil.Uint64(count), hexutil.Uint64(maxBytes)); err != nil {
+		return nil, err
+	}
+	items := make([][]byte, len(blobs))
+	for i, blob := range blobs {
+		items[i] = blob
+	}
+	return items, nil
+}
+
+// Ancients returns the ancient item numbers in the remote store.
+func (c *Client) Ancients() (uint64, error) {
+	var n hexutil.Uint64
+	if err := c.call(&n, "ancients"); err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// AncientSize returns the ancient size of the specified category.
+func (c *Client) AncientSize(kind string) (uint64, error) {
+	var size hexutil.Uint64
+	if err := c.call(&size, "ancientSize", kind); err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
+
+// AncientTail returns the number of the first accessible item of the specified
+// category.
+func (c *Client) AncientTail(kind string) (uint64, error) {
+	var tail hexutil.Uint64
+	if err := c.call(&tail, "ancientTail", kind); err != nil {
+		return 0, err
+	}
+	return uint64(tail), nil
+}
+
+// AncientReadOnly returns true, the remote store can't be modified.
+func (c *Client) AncientReadOnly() bool {
+	return true
+}
+
+// ModifyAncients returns an error as the remote store is read only.
+func (c *Client) ModifyAncients(func(ethdb.AncientWriteOp) error) (int64, error) {
+	return 0, errReadOnly
+}
+
+// TruncateAncients returns an error as the remote store is read only.
+func (c *Client) TruncateAncients(n uint64) error {
+	return errReadOnly
+}
+
+// TruncateAncientTail returns an error as the remote store is read only.
+func (c *Client) TruncateAncientTail(kind string, n uint64) error {
+	return errReadOnly
+}
+
+// Sync returns an error as the remote store is read only.
+func (c *Client) Sync() error {
+	return errReadOnly
+}
+
+// Close closes the connection to the remote store.
+func (c *Client) Close() error {
+	c.client.Close()
+	return nil
+}
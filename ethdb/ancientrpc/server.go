@@ -0,0 +1,89 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package ancientrpc implements serving an ancient store over RPC, and a read-only
+// client to attach such a remote store to a database.
+package ancientrpc
+
+import (
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Namespace is the RPC namespace the ancient store is served under.
+const Namespace = "ancient"
+
+// api exposes the read methods of an ancient store.
+type api struct {
+	store ethdb.AncientReader
+}
+
+// HasAncient returns an indicator whether the specified data exists in the
+// ancient store.
+func (api *api) HasAncient(kind string, number hexutil.Uint64) (bool, error) {
+	return api.store.HasAncient(kind, uint64(number))
+}
+
+// Ancient retrieves an ancient binary blob from the append-only immutable files.
+func (api *api) Ancient(kind string, number hexutil.Uint64) (hexutil.Bytes, error) {
+	return api.store.Ancient(kind, uint64(number))
+}
+
+// ReadAncients retrieves multiple items in sequence, starting from the index
+// 'start'. It returns at most 'count' items, and at least one item even if it
+// exceeds maxBytes.
+func (api *api) ReadAncients(kind string, start, count, maxBytes hexutil.Uint64) ([]hexutil.Bytes, error) {
+	items, err := api.store.ReadAncients(kind, uint64(start), uint64(count), uint64(maxBytes))
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]hexutil.Bytes, len(items))
+	for i, item := range items {
+		blobs[i] = item
+	}
+	return blobs, nil
+}
+
+// Ancients returns the ancient item numbers in the ancient store.
+func (api *api) Ancients() (hexutil.Uint64, error) {
+	n, err := api.store.Ancients()
+	return hexutil.Uint64(n), err
+}
+
+// AncientSize returns the ancient size of the specified category.
+func (api *api) AncientSize(kind string) (hexutil.Uint64, error) {
+	size, err := api.store.AncientSize(kind)
+	return hexutil.Uint64(size), err
+}
+
+// AncientTail returns the number of the first accessible item of the specified
+// category.
+func (api *api) AncientTail(kind string) (hexutil.Uint64, error) {
+	tail, err := api.store.AncientTail(kind)
+	return hexutil.Uint64(tail), err
+}
+
+// NewServer creates an RPC server serving the read methods of the given ancient
+// store. Modifications are not exposed, the store stays owned by the process
+// serving it.
+func NewServer(store ethdb.AncientReader) (*rpc.Server, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName(Namespace, &api{store: store}); err != nil {
+		return nil, err
+	}
+	return server, nil
+}
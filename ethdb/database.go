@@ -88,10 +88,18 @@ type AncientReader interface {
 
 	// AncientSize returns the ancient size of the specified category.
 	AncientSize(kind string) (uint64, error)
+
+	// AncientTail returns the number of the first accessible item of the
+	// specified category, the items below it were pruned from the store.
+	AncientTail(kind string) (uint64, error)
 }
 
 // AncientWriter contains the methods required to write to immutable ancient data.
 type AncientWriter interface {
+	// AncientReadOnly returns whether the ancient store rejects modifications,
+	// e.g. because it is shared with a different process appending to it.
+	AncientReadOnly() bool
+
 	// ModifyAncients runs a write operation on the ancient store.
 	// If the function returns an error, any changes to the underlying store are reverted.
 	// The integer return value is the total size of the written data.
@@ -100,6 +108,10 @@ type AncientWriter interface {
 	// TruncateAncients discards all but the first n ancient data from the ancient store.
 	TruncateAncients(n uint64) error
 
+	// TruncateAncientTail discards the first n ancient data of the specified
+	// category from the ancient store, the remaining items keep their numbers.
+	TruncateAncientTail(kind string, n uint64) error
+
 	// Sync flushes all in-memory ancient store data to disk.
 	Sync() error
 }
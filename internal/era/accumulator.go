@@ -0,0 +1,99 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ComputeAccumulator calculates the accumulator root of an epoch, the SSZ hash
+// tree root of the list of header records, each consisting of a block hash and
+// the total difficulty of the chain up to the block:
+//
+//	header-record := { block-hash: Bytes32, total-difficulty: Uint256 }
+//	accumulator   := hash_tree_root(List[header-record, MaxEra1Size])
+func ComputeAccumulator(hashes []common.Hash, tds []*big.Int) (common.Hash, error) {
+	if len(hashes) != len(tds) {
+		return common.Hash{}, fmt.Errorf("hash and total difficulty count mismatch: %d != %d", len(hashes), len(tds))
+	}
+	if len(hashes) > MaxEra1Size {
+		return common.Hash{}, fmt.Errorf("too many records: have %d, max %d", len(hashes), MaxEra1Size)
+	}
+	// Hash the records into the leaves of the tree, padded with zero leaves to
+	// the maximum list size
+	layer := make([][32]byte, len(hashes))
+	for i, hash := range hashes {
+		td, err := encodeTD(tds[i])
+		if err != nil {
+			return common.Hash{}, err
+		}
+		layer[i] = sha256.Sum256(append(hash.Bytes(), td...))
+	}
+	var zero [32]byte
+	for size := MaxEra1Size; size > 1; size /= 2 {
+		next := make([][32]byte, (len(layer)+1)/2)
+		for i := range next {
+			right := zero
+			if 2*i+1 < len(layer) {
+				right = layer[2*i+1]
+			}
+			next[i] = sha256.Sum256(append(layer[2*i][:], right[:]...))
+		}
+		if len(layer) == 0 {
+			next = nil
+		}
+		layer, zero = next, sha256.Sum256(append(zero[:], zero[:]...))
+	}
+	root := zero
+	if len(layer) > 0 {
+		root = layer[0]
+	}
+	// Mix in the length of the list
+	var length [32]byte
+	binary.LittleEndian.PutUint64(length[:], uint64(len(hashes)))
+	return sha256.Sum256(append(root[:], length[:]...)), nil
+}
+
+// encodeTD encodes a total difficulty as a 32 byte little endian integer.
+func encodeTD(td *big.Int) ([]byte, error) {
+	if td.Sign() < 0 || td.BitLen() > 256 {
+		return nil, fmt.Errorf("invalid total difficulty %v", td)
+	}
+	blob := make([]byte, 32)
+	td.FillBytes(blob)
+	for i, j := 0, len(blob)-1; i < j; i, j = i+1, j-1 {
+		blob[i], blob[j] = blob[j], blob[i]
+	}
+	return blob, nil
+}
+
+// decodeTD decodes a 32 byte little endian total difficulty.
+func decodeTD(blob []byte) (*big.Int, error) {
+	if len(blob) != 32 {
+		return nil, fmt.Errorf("invalid total difficulty length %d", len(blob))
+	}
+	be := make([]byte, 32)
+	for i := range blob {
+		be[31-i] = blob[i]
+	}
+	return new(big.Int).SetBytes(be), nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package e2store implements the e2store container format, a simple sequence of
+// type-length-value entries.
+//
+// Every entry starts with an 8 byte header, holding the 2 byte type, the 4 byte
+// length of the value and 2 reserved bytes which must be zero, all in little
+// endian byte order, followed by the value itself:
+//
+//	entry := type | length | reserved | value
+package e2store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// headerSize is the size of the header preceding each entry value.
+const headerSize = 8
+
+var errReserved = errors.New("reserved header bytes not zero")
+
+// Entry is a single type-length-value record of an e2store file.
+type Entry struct {
+	Type  uint16
+	Value []byte
+}
+
+// Writer appends entries to an e2store stream.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter creates a writer appending entries to the given stream.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write appends an entry of the given type and value, returning the number of
+// bytes written.
+func (w *Writer) Write(typ uint16, value []byte) (int, error) {
+	if uint64(len(value)) > uint64(^uint32(0)) {
+		return 0, fmt.Errorf("entry value too large: %d bytes", len(value))
+	}
+	var header [headerSize]byte
+	binary.LittleEndian.PutUint16(header[0:], typ)
+	binary.LittleEndian.PutUint32(header[2:], uint32(len(value)))
+
+	n, err := w.w.Write(header[:])
+	if err != nil {
+		return n, err
+	}
+	m, err := w.w.Write(value)
+	return n + m, err
+}
+
+// Reader reads entries from an e2store file at arbitrary offsets.
+type Reader struct {
+	r io.ReaderAt
+}
+
+// NewReader creates a reader retrieving entries from the given file.
+func NewReader(r io.ReaderAt) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadAt reads the entry starting at the given offset, returning it along with
+// its total length including the header. It returns io.EOF if there is no entry
+// at the offset.
+func (r *Reader) ReadAt(off int64) (*Entry, int64, error) {
+	typ, length, err := r.ReadMetadataAt(off)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry := &Entry{Type: typ, Value: make([]byte, length)}
+	if _, err := r.r.ReadAt(entry.Value, off+headerSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	return entry, headerSize + int64(length), nil
+}
+
+// ReadMetadataAt reads the header of the entry starting at the given offset,
+// returning the type and value length of the entry. It returns io.EOF if there
+// is no entry at the offset.
+func (r *Reader) ReadMetadataAt(off int64) (uint16, uint32, error) {
+	var header [headerSize]byte
+	if n, err := r.r.ReadAt(header[:], off); err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, err
+	}
+	if header[6] != 0 || header[7] != 0 {
+		return 0, 0, errReserved
+	}
+	return binary.LittleEndian.Uint16(header[0:]), binary.LittleEndian.Uint32(header[2:]), nil
+}
+
+// Find returns the first entry of the given type, searching from the start of
+// the file. It returns io.EOF if there is no such entry.
+func (r *Reader) Find(typ uint16) (*Entry, error) {
+	var off int64
+	for {
+		t, length, err := r.ReadMetadataAt(off)
+		if err != nil {
+			return nil, err
+		}
+		if t == typ {
+			entry, _, err := r.ReadAt(off)
+			return entry, err
+		}
+		off += headerSize + int64(length)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package e2store
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+// Tests that entries are encoded as expected and read back at their offsets.
+func TestEncodeDecode(t *testing.T) {
+	var (
+		buf     = new(bytes.Buffer)
+		w       = NewWriter(buf)
+		entries = []Entry{
+			{Type: 0x3265, Value: []byte{}},
+			{Type: 0x03, Value: []byte("header")},
+			{Type: 0xffff, Value: bytes.Repeat([]byte{0xaa}, 300)},
+		}
+	)
+	for _, entry := range entries {
+		if _, err := w.Write(entry.Type, entry.Value); err != nil {
+			t.Fatalf("failed to write entry: %v", err)
+		}
+	}
+	if have, want := hex.EncodeToString(buf.Bytes()[:22]), "65320000000000000300060000000000686561646572"; have != want {
+		t.Fatalf("encoding mismatch: have %s, want %s", have, want)
+	}
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+
+	var off int64
+	for i, want := range entries {
+		entry, n, err := r.ReadAt(off)
+		if err != nil {
+			t.Fatalf("entry %d: failed to read: %v", i, err)
+		}
+		if entry.Type != want.Type || !bytes.Equal(entry.Value, want.Value) {
+			t.Fatalf("entry %d: mismatch: have %x/%x, want %x/%x", i, entry.Type, entry.Value, want.Type, want.Value)
+		}
+		off += n
+	}
+	if _, _, err := r.ReadAt(off); err != io.EOF {
+		t.Fatalf("read past the last entry: %v", err)
+	}
+	if entry, err := r.Find(0xffff); err != nil || len(entry.Value) != 300 {
+		t.Fatalf("failed to find entry: %v", err)
+	}
+	if _, err := r.Find(0x1234); err != io.EOF {
+		t.Fatalf("found missing entry: %v", err)
+	}
+	// Truncated entries and non-zero reserved bytes must be rejected
+	if _, _, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-1])).ReadAt(off - 308); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated entry read: %v", err)
+	}
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[7] = 1
+	if _, _, err := NewReader(bytes.NewReader(corrupt)).ReadAt(0); err != errReserved {
+		t.Fatalf("entry with reserved bytes read: %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package era implements era1 archives, e2store files holding the blocks, the
+// receipts and the total difficulties of a single epoch of the chain, together
+// with an accumulator root over the epoch and an index for random access:
+//
+//	era1        := Version | block-tuple* | Accumulator | BlockIndex
+//	block-tuple := CompressedHeader | CompressedBody | CompressedReceipts | TotalDifficulty
+//	BlockIndex  := starting-number | offset* | count
+//
+// Headers, bodies and receipts are snappy compressed RLP in their consensus
+// encoding, the total difficulty is a 32 byte little endian integer. The index
+// holds the offset of each block tuple relative to the start of the index entry,
+// all its fields being 8 byte little endian integers.
+package era
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/internal/era/e2store"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/golang/snappy"
+)
+
+// Entry types of era1 archives.
+const (
+	TypeVersion            uint16 = 0x3265
+	TypeCompressedHeader   uint16 = 0x03
+	TypeCompressedBody     uint16 = 0x04
+	TypeCompressedReceipts uint16 = 0x05
+	TypeTotalDifficulty    uint16 = 0x06
+	TypeAccumulator        uint16 = 0x07
+	TypeBlockIndex         uint16 = 0x3266
+)
+
+// MaxEra1Size is the number of blocks in an epoch, the maximum number of blocks
+// in an archive.
+const MaxEra1Size = 8192
+
+var (
+	errBuilderFull     = errors.New("archive full")
+	errBuilderEmpty    = errors.New("archive empty")
+	errBuilderFinished = errors.New("archive finalized")
+)
+
+// Filename returns the name of the archive of the given epoch, tagged with the
+// network name and the first bytes of the accumulator root.
+func Filename(network string, epoch int, root common.Hash) string {
+	return fmt.Sprintf("%s-%05d-%s.era1", network, epoch, root.Hex()[2:10])
+}
+
+// ReadDir returns the archives of the given network in the directory, ordered
+// by epoch. The epochs must be contiguous.
+func ReadDir(dir, network string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if filepath.Ext(name) != ".era1" || !strings.HasPrefix(name, network+"-") {
+			continue
+		}
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	var prev int
+	for i, name := range files {
+		var epoch int
+		if _, err := fmt.Sscanf(strings.TrimPrefix(name, network+"-"), "%05d-", &epoch); err != nil {
+			return nil, fmt.Errorf("malformed archive name %s: %v", name, err)
+		}
+		if i > 0 && epoch != prev+1 {
+			return nil, fmt.Errorf("archive of epoch %d missing", prev+1)
+		}
+		prev = epoch
+	}
+	return files, nil
+}
+
+// Builder writes the blocks of an epoch into an archive. The blocks must be
+// added in order, and the archive finalized once all of them were added.
+type Builder struct {
+	w        *e2store.Writer
+	start    *uint64
+	offsets  []int64
+	hashes   []common.Hash
+	tds      []*big.Int
+	written  int64
+	finished bool
+}
+
+// NewBuilder creates a builder writing an archive into the given stream.
+func NewBuilder(w io.Writer) *Builder {
+	return &Builder{w: e2store.NewWriter(w)}
+}
+
+// Add appends a block, its receipts and the total difficulty of the chain up
+// to it to the archive.
+func (b *Builder) Add(block *types.Block, receipts types.Receipts, td *big.Int) error {
+	header, err := rlp.EncodeToBytes(block.Header())
+	if err != nil {
+		return err
+	}
+	body, err := rlp.EncodeToBytes(block.Body())
+	if err != nil {
+		return err
+	}
+	encReceipts, err := rlp.EncodeToBytes(receipts)
+	if err != nil {
+		return err
+	}
+	return b.AddRLP(header, body, encReceipts, block.NumberU64(), block.Hash(), td)
+}
+
+// AddRLP appends the already encoded header, body and receipts of a block to the
+// archive, along with the total difficulty of the chain up to it.
+func (b *Builder) AddRLP(header, body, receipts []byte, number uint64, hash common.Hash, td *big.Int) error {
+	switch {
+	case b.finished:
+		return errBuilderFinished
+	case len(b.offsets) >= MaxEra1Size:
+		return errBuilderFull
+	case b.start != nil && number != *b.start+uint64(len(b.offsets)):
+		return fmt.Errorf("non contiguous block #%d, expected #%d", number, *b.start+uint64(len(b.offsets)))
+	}
+	encTD, err := encodeTD(td)
+	if err != nil {
+		return err
+	}
+	if b.start == nil {
+		if err := b.write(TypeVersion, nil); err != nil {
+			return err
+		}
+		b.start = &number
+	}
+	b.offsets = append(b.offsets, b.written)
+	b.hashes = append(b.hashes, hash)
+	b.tds = append(b.tds, new(big.Int).Set(td))
+
+	for _, entry := range []struct {
+		typ   uint16
+		value []byte
+	}{
+		{TypeCompressedHeader, snappy.Encode(nil, header)},
+		{TypeCompressedBody, snappy.Encode(nil, body)},
+		{TypeCompressedReceipts, snappy.Encode(nil, receipts)},
+		{TypeTotalDifficulty, encTD},
+	} {
+		if err := b.write(entry.typ, entry.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finalize writes the accumulator and the block index, completing the archive.
+// It returns the accumulator root.
+func (b *Builder) Finalize() (common.Hash, error) {
+	if b.finished {
+		return common.Hash{}, errBuilderFinished
+	}
+	if b.start == nil {
+		return common.Hash{}, errBuilderEmpty
+	}
+	root, err := ComputeAccumulator(b.hashes, b.tds)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := b.write(TypeAccumulator, root.Bytes()); err != nil {
+		return common.Hash{}, err
+	}
+	// Write the index, with offsets relative to the start of its entry
+	index := make([]byte, 8+8*len(b.offsets)+8)
+	binary.LittleEndian.PutUint64(index, *b.start)
+	for i, offset := range b.offsets {
+		binary.LittleEndian.PutUint64(index[8+8*i:], uint64(offset-b.written))
+	}
+	binary.LittleEndian.PutUint64(index[8+8*len(b.offsets):], uint64(len(b.offsets)))
+	if err := b.write(TypeBlockIndex, index); err != nil {
+		return common.Hash{}, err
+	}
+	b.finished = true
+	return root, nil
+}
+
+// write appends a single entry to the archive.
+func (b *Builder) write(typ uint16, value []byte) error {
+	n, err := b.w.Write(typ, value)
+	b.written += int64(n)
+	return err
+}
+
+// ReadAtSeekCloser is the file access needed to read an archive.
+type ReadAtSeekCloser interface {
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+}
+
+// Era is an archive opened for reading.
+type Era struct {
+	f     ReadAtSeekCloser
+	s     *e2store.Reader
+	start uint64 // Number of the first block
+	count uint64 // Number of blocks
+	index int64  // Offset of the block index entry
+}
+
+// Open opens the archive at the given path.
+func Open(path string) (*Era, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	e, err := From(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return e, nil
+}
+
+// From reads the archive from the given file, taking ownership of it.
+func From(f ReadAtSeekCloser) (*Era, error) {
+	length, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	e := &Era{f: f, s: e2store.NewReader(f)}
+
+	// Locate the block index from the block count stored at the very end
+	if length < 8 {
+		return nil, errors.New("archive too short")
+	}
+	var buf [8]byte
+	if _, err := f.ReadAt(buf[:], length-8); err != nil {
+		return nil, err
+	}
+	e.count = binary.LittleEndian.Uint64(buf[:])
+	if e.count == 0 || e.count > MaxEra1Size {
+		return nil, fmt.Errorf("invalid block count %d", e.count)
+	}
+	e.index = length - 8 - int64(8+8*e.count+8)
+	if e.index < 0 {
+		return nil, errors.New("archive too short for block index")
+	}
+	typ, size, err := e.s.ReadMetadataAt(e.index)
+	if err != nil {
+		return nil, err
+	}
+	if typ != TypeBlockIndex || int64(size) != int64(8+8*e.count+8) {
+		return nil, errors.New("block index not found")
+	}
+	if _, err := f.ReadAt(buf[:], e.index+8); err != nil {
+		return nil, err
+	}
+	e.start = binary.LittleEndian.Uint64(buf[:])
+	return e, nil
+}
+
+// Close closes the archive file.
+func (e *Era) Close() error {
+	return e.f.Close()
+}
+
+// Start returns the number of the first block in the archive.
+func (e *Era) Start() uint64 {
+	return e.start
+}
+
+// Count returns the number of blocks in the archive.
+func (e *Era) Count() uint64 {
+	return e.count
+}
+
+// Accumulator returns the accumulator root stored in the archive.
+func (e *Era) Accumulator() (common.Hash, error) {
+	entry, _, err := e.s.ReadAt(e.index - 8 - common.HashLength)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if entry.Type != TypeAccumulator || len(entry.Value) != common.HashLength {
+		return common.Hash{}, errors.New("accumulator not found")
+	}
+	return common.BytesToHash(entry.Value), nil
+}
+
+// tupleOffset returns the offset of the block tuple of the given block.
+func (e *Era) tupleOffset(number uint64) (int64, error) {
+	if number < e.start || number >= e.start+e.count {
+		return 0, fmt.Errorf("block #%d out of range [%d, %d)", number, e.start, e.start+e.count)
+	}
+	var buf [8]byte
+	if _, err := e.f.ReadAt(buf[:], e.index+8+8+8*int64(number-e.start)); err != nil {
+		return 0, err
+	}
+	offset := e.index + int64(binary.LittleEndian.Uint64(buf[:]))
+	if offset < 0 || offset >= e.index {
+		return 0, fmt.Errorf("invalid offset of block #%d", number)
+	}
+	return offset, nil
+}
+
+// readTuple reads the entries of the block tuple of the given block, returning
+// the decompressed header, body and receipts, and the total difficulty.
+func (e *Era) readTuple(number uint64) ([][]byte, *big.Int, error) {
+	offset, err := e.tupleOffset(number)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		kinds = []uint16{TypeCompressedHeader, TypeCompressedBody, TypeCompressedReceipts, TypeTotalDifficulty}
+		blobs = make([][]byte, 0, 3)
+	)
+	for _, typ := range kinds {
+		entry, n, err := e.s.ReadAt(offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if entry.Type != typ {
+			return nil, nil, fmt.Errorf("block #%d: unexpected entry type %#x, want %#x", number, entry.Type, typ)
+		}
+		offset += n
+
+		if typ == TypeTotalDifficulty {
+			td, err := decodeTD(entry.Value)
+			if err != nil {
+				return nil, nil, fmt.Errorf("block #%d: %v", number, err)
+			}
+			return blobs, td, nil
+		}
+		blob, err := snappy.Decode(nil, entry.Value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("block #%d: %v", number, err)
+		}
+		blobs = append(blobs, blob)
+	}
+	panic("unreachable")
+}
+
+// GetRawByNumber returns the RLP encoded header, body and receipts of the given
+// block, along with the total difficulty of the chain up to it.
+func (e *Era) GetRawByNumber(number uint64) (header, body, receipts []byte, td *big.Int, err error) {
+	blobs, td, err := e.readTuple(number)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	return blobs[0], blobs[1], blobs[2], td, nil
+}
+
+// GetByNumber returns the given block, its receipts and the total difficulty of
+// the chain up to it.
+func (e *Era) GetByNumber(number uint64) (*types.Block, types.Receipts, *big.Int, error) {
+	header, body, encReceipts, td, err := e.GetRawByNumber(number)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var h types.Header
+	if err := rlp.DecodeBytes(header, &h); err != nil {
+		return nil, nil, nil, fmt.Errorf("block #%d: invalid header: %v", number, err)
+	}
+	var b types.Body
+	if err := rlp.DecodeBytes(body, &b); err != nil {
+		return nil, nil, nil, fmt.Errorf("block #%d: invalid body: %v", number, err)
+	}
+	var receipts types.Receipts
+	if err := rlp.DecodeBytes(encReceipts, &receipts); err != nil {
+		return nil, nil, nil, fmt.Errorf("block #%d: invalid receipts: %v", number, err)
+	}
+	return types.NewBlockWithHeader(&h).WithBody(b.Transactions, b.Uncles), receipts, td, nil
+}
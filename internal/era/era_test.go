@@ -0,0 +1,161 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package era
+
+import (
+	"bytes"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// makeBlocks creates a linked chain of blocks starting at the given number, each
+// with a few transactions and receipts.
+func makeBlocks(start uint64, n int) ([]*types.Block, []types.Receipts, []*big.Int) {
+	var (
+		blocks   []*types.Block
+		receipts []types.Receipts
+		tds      []*big.Int
+		parent   common.Hash
+		td       = big.NewInt(1000)
+	)
+	for i := 0; i < n; i++ {
+		var (
+			txs  types.Transactions
+			recs types.Receipts
+		)
+		for j := 0; j < i%4; j++ {
+			txs = append(txs, types.NewTransaction(uint64(j), common.Address{byte(i)}, big.NewInt(int64(j)), 21000, big.NewInt(1), nil))
+			recs = append(recs, &types.Receipt{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: uint64(21000 * (j + 1)), Logs: []*types.Log{}})
+		}
+		header := &types.Header{
+			ParentHash: parent,
+			Number:     new(big.Int).SetUint64(start + uint64(i)),
+			Difficulty: big.NewInt(int64(i + 1)),
+			GasLimit:   8_000_000,
+		}
+		block := types.NewBlock(header, txs, nil, recs, trie.NewStackTrie(nil))
+		td = new(big.Int).Add(td, header.Difficulty)
+
+		blocks, receipts, tds = append(blocks, block), append(receipts, recs), append(tds, td)
+		parent = block.Hash()
+	}
+	return blocks, receipts, tds
+}
+
+// Tests that the blocks written into an archive can be read back at random, and
+// that the accumulator root is stored.
+func TestEra1Builder(t *testing.T) {
+	var (
+		path                  = filepath.Join(t.TempDir(), "test.era1")
+		blocks, receipts, tds = makeBlocks(100, 128)
+	)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	builder := NewBuilder(f)
+	for i, block := range blocks {
+		if err := builder.Add(block, receipts[i], tds[i]); err != nil {
+			t.Fatalf("failed to add block %d: %v", i, err)
+		}
+	}
+	if err := builder.Add(blocks[0], receipts[0], tds[0]); err == nil {
+		t.Fatalf("non contiguous block added")
+	}
+	root, err := builder.Finalize()
+	if err != nil {
+		t.Fatalf("failed to finalize archive: %v", err)
+	}
+	f.Close()
+
+	e, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open archive: %v", err)
+	}
+	defer e.Close()
+
+	if e.Start() != 100 || e.Count() != 128 {
+		t.Fatalf("range mismatch: have [%d, +%d), want [100, +128)", e.Start(), e.Count())
+	}
+	if have, err := e.Accumulator(); err != nil || have != root {
+		t.Fatalf("accumulator mismatch: have %x, want %x: %v", have, root, err)
+	}
+	hashes := make([]common.Hash, len(blocks))
+	for i, block := range blocks {
+		hashes[i] = block.Hash()
+	}
+	if want, _ := ComputeAccumulator(hashes, tds); want != root {
+		t.Fatalf("accumulator mismatch: have %x, want %x", root, want)
+	}
+	for _, i := range []int{127, 0, 64, 3, 99} {
+		block, recs, td, err := e.GetByNumber(100 + uint64(i))
+		if err != nil {
+			t.Fatalf("block %d: failed to read: %v", i, err)
+		}
+		if block.Hash() != blocks[i].Hash() {
+			t.Fatalf("block %d: hash mismatch: have %x, want %x", i, block.Hash(), blocks[i].Hash())
+		}
+		if hash := types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)); hash != block.TxHash() {
+			t.Fatalf("block %d: transactions mismatch", i)
+		}
+		have, _ := rlp.EncodeToBytes(recs)
+		want, _ := rlp.EncodeToBytes(receipts[i])
+		if !bytes.Equal(have, want) {
+			t.Fatalf("block %d: receipts mismatch", i)
+		}
+		if td.Cmp(tds[i]) != 0 {
+			t.Fatalf("block %d: total difficulty mismatch: have %v, want %v", i, td, tds[i])
+		}
+	}
+	if _, _, _, err := e.GetByNumber(99); err == nil {
+		t.Fatalf("block before the archive retrieved")
+	}
+	if _, _, _, err := e.GetByNumber(228); err == nil {
+		t.Fatalf("block after the archive retrieved")
+	}
+}
+
+// Tests that the accumulator commits to both the block hashes and the total
+// difficulties, as well as the number of records.
+func TestComputeAccumulator(t *testing.T) {
+	blocks, _, tds := makeBlocks(0, 10)
+	hashes := make([]common.Hash, len(blocks))
+	for i, block := range blocks {
+		hashes[i] = block.Hash()
+	}
+	root, err := ComputeAccumulator(hashes, tds)
+	if err != nil {
+		t.Fatalf("failed to compute accumulator: %v", err)
+	}
+	if shorter, _ := ComputeAccumulator(hashes[:9], tds[:9]); shorter == root {
+		t.Fatalf("accumulator ignores records")
+	}
+	tds[5] = new(big.Int).Add(tds[5], common.Big1)
+	if modified, _ := ComputeAccumulator(hashes, tds); modified == root {
+		t.Fatalf("accumulator ignores total difficulties")
+	}
+	if _, err := ComputeAccumulator(make([]common.Hash, MaxEra1Size+1), make([]*big.Int, MaxEra1Size+1)); err == nil {
+		t.Fatalf("oversized accumulator computed")
+	}
+}
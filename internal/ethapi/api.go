@@ -651,7 +651,7 @@ type StorageResult struct {
 
 // GetProof returns the Merkle-proof for a given account and optionally some storage keys.
 func (s *PublicBlockChainAPI) GetProof(ctx context.Context, address common.Address, storageKeys []string, blockNrOrHash rpc.BlockNumberOrHash) (*AccountResult, error) {
-	state, _, err := s.b.StateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	state, _, err := s.b.ProofStateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
 	if state == nil || err != nil {
 		return nil, err
 	}
@@ -669,14 +669,14 @@ func (s *PublicBlockChainAPI) GetProof(ctx context.Context, address common.Addre
 		codeHash = crypto.Keccak256Hash(nil)
 	}
 
-	// create the proof for the storageKeys
+	// create the proof for the storageKeys, all proven on the same storage trie
 	for i, key := range storageKeys {
 		if storageTrie != nil {
-			proof, storageError := state.GetStorageProof(address, common.HexToHash(key))
-			if storageError != nil {
-				return nil, storageError
+			var proof proofList
+			if err := storageTrie.Prove(crypto.Keccak256(common.HexToHash(key).Bytes()), 0, &proof); err != nil {
+				return nil, err
 			}
-			storageProof[i] = StorageResult{key, (*hexutil.Big)(state.GetState(address, common.HexToHash(key)).Big()), toHexSlice(proof)}
+			storageProof[i] = StorageResult{key, (*hexutil.Big)(state.GetState(address, common.HexToHash(key)).Big()), proof}
 		} else {
 			storageProof[i] = StorageResult{key, &hexutil.Big{}, []string{}}
 		}
@@ -699,6 +699,127 @@ func (s *PublicBlockChainAPI) GetProof(ctx context.Context, address common.Addre
 	}, state.Error()
 }
 
+// ProofRequest specifies an account and the storage slots of it to be proven
+// in a batch proof.
+type ProofRequest struct {
+	Address     common.Address `json:"address"`
+	StorageKeys []string       `json:"storageKeys"`
+}
+
+// MultiProofResult is the result of a batch proof. The trie nodes proving all
+// the requested accounts and storage slots are returned in a single set, the
+// nodes shared by multiple paths are only included once.
+type MultiProofResult struct {
+	StateRoot common.Hash         `json:"stateRoot"`
+	Nodes     []hexutil.Bytes     `json:"nodes"`
+	Accounts  []MultiProofAccount `json:"accounts"`
+}
+
+// MultiProofAccount is a proven account in a batch proof.
+type MultiProofAccount struct {
+	Address     common.Address    `json:"address"`
+	Balance     *hexutil.Big      `json:"balance"`
+	CodeHash    common.Hash       `json:"codeHash"`
+	Nonce       hexutil.Uint64    `json:"nonce"`
+	StorageHash common.Hash       `json:"storageHash"`
+	Storage     []MultiProofValue `json:"storage"`
+}
+
+// MultiProofValue is a proven storage slot in a batch proof.
+type MultiProofValue struct {
+	Key   string       `json:"key"`
+	Value *hexutil.Big `json:"value"`
+}
+
+// GetMultiProof returns the Merkle-proof for a batch of accounts and storage
+// keys, sharing the trie nodes common to multiple paths.
+func (s *PublicBlockChainAPI) GetMultiProof(ctx context.Context, requests []ProofRequest, blockNrOrHash rpc.BlockNumberOrHash) (*MultiProofResult, error) {
+	state, header, err := s.b.ProofStateAndHeaderByNumberOrHash(ctx, blockNrOrHash)
+	if state == nil || err != nil {
+		return nil, err
+	}
+	var (
+		nodes    = newProofSet()
+		accounts = make([]MultiProofAccount, len(requests))
+	)
+	for i, req := range requests {
+		proof, err := state.GetProof(req.Address)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range proof {
+			nodes.Put(crypto.Keccak256(node), node)
+		}
+		account := MultiProofAccount{
+			Address:     req.Address,
+			Balance:     (*hexutil.Big)(state.GetBalance(req.Address)),
+			CodeHash:    state.GetCodeHash(req.Address),
+			Nonce:       hexutil.Uint64(state.GetNonce(req.Address)),
+			StorageHash: types.EmptyRootHash,
+			Storage:     make([]MultiProofValue, len(req.StorageKeys)),
+		}
+		storageTrie := state.StorageTrie(req.Address)
+		if storageTrie != nil {
+			account.StorageHash = storageTrie.Hash()
+		} else {
+			account.CodeHash = crypto.Keccak256Hash(nil)
+		}
+		for j, key := range req.StorageKeys {
+			slot := common.HexToHash(key)
+			if storageTrie == nil {
+				account.Storage[j] = MultiProofValue{key, &hexutil.Big{}}
+				continue
+			}
+			if err := storageTrie.Prove(crypto.Keccak256(slot.Bytes()), 0, nodes); err != nil {
+				return nil, err
+			}
+			account.Storage[j] = MultiProofValue{key, (*hexutil.Big)(state.GetState(req.Address, slot).Big())}
+		}
+		accounts[i] = account
+	}
+	return &MultiProofResult{
+		StateRoot: header.Root,
+		Nodes:     nodes.list,
+		Accounts:  accounts,
+	}, state.Error()
+}
+
+// proofList is a proof writer collecting the nodes of a single proof path.
+type proofList []string
+
+func (n *proofList) Put(key []byte, value []byte) error {
+	*n = append(*n, hexutil.Encode(value))
+	return nil
+}
+
+func (n *proofList) Delete(key []byte) error {
+	panic("not supported")
+}
+
+// proofSet is a proof writer collecting the nodes of multiple proof paths,
+// keeping each node only once.
+type proofSet struct {
+	seen map[string]struct{}
+	list []hexutil.Bytes
+}
+
+func newProofSet() *proofSet {
+	return &proofSet{seen: make(map[string]struct{})}
+}
+
+func (n *proofSet) Put(key []byte, value []byte) error {
+	if _, ok := n.seen[string(key)]; ok {
+		return nil
+	}
+	n.seen[string(key)] = struct{}{}
+	n.list = append(n.list, common.CopyBytes(value))
+	return nil
+}
+
+func (n *proofSet) Delete(key []byte) error {
+	panic("not supported")
+}
+
 // GetHeaderByNumber returns the requested canonical block header.
 // * When blockNr is -1 the chain head is returned.
 // * When blockNr is -2 the pending chain head is returned.
@@ -880,6 +1001,41 @@ func (diff *StateOverride) Apply(state *state.StateDB) error {
 	return nil
 }
 
+// BlockOverrides is a set of header fields to override.
+type BlockOverrides struct {
+	Number     *hexutil.Big
+	Difficulty *hexutil.Big
+	Time       *hexutil.Big
+	GasLimit   *hexutil.Uint64
+	Coinbase   *common.Address
+	BaseFee    *hexutil.Big
+}
+
+// Apply overrides the given header fields into the given block context.
+func (diff *BlockOverrides) Apply(blockCtx *vm.BlockContext) {
+	if diff == nil {
+		return
+	}
+	if diff.Number != nil {
+		blockCtx.BlockNumber = diff.Number.ToInt()
+	}
+	if diff.Difficulty != nil {
+		blockCtx.Difficulty = diff.Difficulty.ToInt()
+	}
+	if diff.Time != nil {
+		blockCtx.Time = diff.Time.ToInt()
+	}
+	if diff.GasLimit != nil {
+		blockCtx.GasLimit = uint64(*diff.GasLimit)
+	}
+	if diff.Coinbase != nil {
+		blockCtx.Coinbase = *diff.Coinbase
+	}
+	if diff.BaseFee != nil {
+		blockCtx.BaseFee = diff.BaseFee.ToInt()
+	}
+}
+
 func DoCall(ctx context.Context, b Backend, args TransactionArgs, blockNrOrHash rpc.BlockNumberOrHash, overrides *StateOverride, timeout time.Duration, globalGasCap uint64) (*core.ExecutionResult, error) {
 	defer func(start time.Time) { log.Debug("Executing EVM call finished", "runtime", time.Since(start)) }(time.Now())
 
@@ -1596,6 +1752,10 @@ func (s *PublicTransactionPoolAPI) GetRawTransactionByHash(ctx context.Context,
 func (s *PublicTransactionPoolAPI) GetTransactionReceipt(ctx context.Context, hash common.Hash) (map[string]interface{}, error) {
 	tx, blockHash, blockNumber, index, err := s.b.GetTransaction(ctx, hash)
 	if err != nil {
+		// Report pruned history, but treat lookup failures as unknown transactions
+		if errors.Is(err, core.ErrHistoryPruned) {
+			return nil, err
+		}
 		return nil, nil
 	}
 	receipts, err := s.b.GetReceipts(ctx, blockHash)
@@ -190,6 +190,16 @@ type Config struct {
 
 	// AllowUnprotectedTxs allows non EIP-155 protected transactions to be send over RPC.
 	AllowUnprotectedTxs bool `toml:",omitempty"`
+
+	// DBEngine is the key-value store implementation backing the databases,
+	// either "leveldb" or "pebble". If empty, the engine of an existing database
+	// is used, falling back to leveldb for new ones.
+	DBEngine string `toml:",omitempty"`
+
+	// AncientsReadOnly opens the ancient chain segments read-only, so they can be
+	// shared with the single node appending to them. Remote ancient stores are
+	// always read-only.
+	AncientsReadOnly bool `toml:",omitempty"`
 }
 
 // IPCEndpoint resolves an IPC endpoint based on a configured value, taking into
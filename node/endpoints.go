@@ -40,6 +40,7 @@ func StartHTTPEndpoint(endpoint string, timeouts rpc.HTTPTimeouts, handler http.
 	// Bundle and start the HTTP server
 	httpSrv := &http.Server{
 		Handler:      handler,
+		ConnContext:  connContext,
 		ReadTimeout:  timeouts.ReadTimeout,
 		WriteTimeout: timeouts.WriteTimeout,
 		IdleTimeout:  timeouts.IdleTimeout,
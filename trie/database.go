@@ -21,7 +21,6 @@ import (
 	"fmt"
 	"io"
 	"reflect"
-	"runtime"
 	"sync"
 	"time"
 
@@ -68,6 +67,7 @@ var (
 // servers even while the trie is executing expensive garbage collection.
 type Database struct {
 	diskdb ethdb.KeyValueStore // Persistent storage for matured trie nodes
+	scheme string              // Storage scheme of the persistent trie nodes
 
 	cleans  *fastcache.Cache            // GC friendly memory cache of clean node RLPs
 	dirties map[common.Hash]*cachedNode // Data and references relationships of dirty trie nodes
@@ -88,7 +88,20 @@ type Database struct {
 	childrenSize  common.StorageSize // Storage size of the external children tracking
 	preimagesSize common.StorageSize // Storage size of the preimages cache
 
-	lock sync.RWMutex
+	layers     map[common.Hash]*diffLayer // In-memory diff layers on top of the disk state (path scheme)
+	head       common.Hash                // State root of the most recently added diff layer
+	diskRoot   common.Hash                // State root of the persisted state (path scheme)
+	diskID     uint64                     // State id of the persisted state (path scheme)
+	history    uint64                     // Number of reverse diffs to retain (path scheme)
+	layersSize common.StorageSize         // Storage size of all the diff layers
+
+	cleansRoot  common.Hash // State root the loaded clean cache journal was taken at
+	cleansSets  uint64      // Number of clean cache insertions when the journal was last saved
+	cleansSaved bool        // Whether the clean cache journal was saved already
+	cleansLock  sync.Mutex  // Lock serializing the clean cache journal saves
+
+	lock      sync.RWMutex
+	flushLock sync.Mutex // Lock held while persisting nodes, allows external deleters to exclude flushes
 }
 
 // rawNode is a simple binary blob used to differentiate between collapsed trie
@@ -274,9 +287,11 @@ func expandNode(hash hashNode, n node) node {
 
 // Config defines all necessary options for database.
 type Config struct {
-	Cache     int    // Memory allowance (MB) to use for caching trie nodes in memory
-	Journal   string // Journal of clean cache to survive node restarts
-	Preimages bool   // Flag whether the preimage of trie key is recorded
+	Cache        int    // Memory allowance (MB) to use for caching trie nodes in memory
+	Journal      string // Journal of clean cache to survive node restarts
+	Preimages    bool   // Flag whether the preimage of trie key is recorded
+	Scheme       string // Storage scheme of the trie nodes, empty to use the persisted one
+	StateHistory uint64 // Number of recent reverse diffs to retain in path scheme, zero for the default
 }
 
 // NewDatabase creates a new trie database to store ephemeral trie content before
@@ -290,17 +305,21 @@ func NewDatabase(diskdb ethdb.KeyValueStore) *Database {
 // before its written out to disk or garbage collected. It also acts as a read cache
 // for nodes loaded from disk.
 func NewDatabaseWithConfig(diskdb ethdb.KeyValueStore, config *Config) *Database {
-	var cleans *fastcache.Cache
+	var (
+		cleans     *fastcache.Cache
+		cleansRoot common.Hash
+	)
 	if config != nil && config.Cache > 0 {
 		if config.Journal == "" {
 			cleans = fastcache.New(config.Cache * 1024 * 1024)
 		} else {
-			cleans = fastcache.LoadFromFileOrNew(config.Journal, config.Cache*1024*1024)
+			cleans, cleansRoot = loadCleanCache(config.Journal, config.Cache*1024*1024)
 		}
 	}
 	db := &Database{
-		diskdb: diskdb,
-		cleans: cleans,
+		diskdb:     diskdb,
+		cleans:     cleans,
+		cleansRoot: cleansRoot,
 		dirties: map[common.Hash]*cachedNode{{}: {
 			children: make(map[common.Hash]uint16),
 		}},
@@ -308,6 +327,18 @@ func NewDatabaseWithConfig(diskdb ethdb.KeyValueStore, config *Config) *Database
 	if config == nil || config.Preimages { // TODO(karalabe): Flip to default off in the future
 		db.preimages = make(map[common.Hash][]byte)
 	}
+	if config != nil && config.Scheme != "" {
+		db.scheme = config.Scheme
+	} else {
+		db.scheme = rawdb.ReadStateScheme(diskdb)
+	}
+	if db.scheme == rawdb.PathScheme {
+		db.history = defaultStateHistory
+		if config != nil && config.StateHistory != 0 {
+			db.history = config.StateHistory
+		}
+		db.loadDiskState()
+	}
 	return db
 }
 
@@ -316,6 +347,12 @@ func (db *Database) DiskDB() ethdb.KeyValueStore {
 	return db.diskdb
 }
 
+// Scheme returns the storage scheme of the trie nodes, either rawdb.HashScheme
+// or rawdb.PathScheme.
+func (db *Database) Scheme() string {
+	return db.scheme
+}
+
 // insert inserts a collapsed trie node into the memory database.
 // The blob size must be specified to allow proper size tracking.
 // All nodes inserted by this function will be reference tracked
@@ -368,8 +405,9 @@ func (db *Database) insertPreimage(hash common.Hash, preimage []byte) {
 }
 
 // node retrieves a cached trie node from memory, or returns nil if none can be
-// found in the memory cache.
-func (db *Database) node(hash common.Hash) node {
+// found in the memory cache. The nodes loaded from disk are only inserted into
+// the clean cache if requested.
+func (db *Database) node(hash common.Hash, cache bool) node {
 	// Retrieve the node from the clean cache if available
 	if db.cleans != nil {
 		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
@@ -395,7 +433,7 @@ func (db *Database) node(hash common.Hash) node {
 	if err != nil || enc == nil {
 		return nil
 	}
-	if db.cleans != nil {
+	if db.cleans != nil && cache {
 		db.cleans.Set(hash[:], enc)
 		memcacheCleanMissMeter.Mark(1)
 		memcacheCleanWriteMeter.Mark(int64(len(enc)))
@@ -482,6 +520,10 @@ func (db *Database) Nodes() []common.Hash {
 // and external node(e.g. storage trie root), all internal trie nodes
 // are referenced together by database itself.
 func (db *Database) Reference(child common.Hash, parent common.Hash) {
+	// Nodes are tracked by state in path scheme, references are meaningless
+	if db.scheme == rawdb.PathScheme {
+		return
+	}
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -516,6 +558,9 @@ func (db *Database) Dereference(root common.Hash) {
 		log.Error("Attempted to dereference the trie cache meta root")
 		return
 	}
+	if db.scheme == rawdb.PathScheme {
+		return
+	}
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
@@ -590,6 +635,12 @@ func (db *Database) dereference(child common.Hash, parent common.Hash) {
 // Note, this method is a non-synchronized mutator. It is unsafe to call this
 // concurrently with other mutators.
 func (db *Database) Cap(limit common.StorageSize) error {
+	if db.scheme == rawdb.PathScheme {
+		return db.capLayers(limit)
+	}
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
 	// Create a database batch to flush persistent data out. It is important that
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
@@ -693,6 +744,12 @@ func (db *Database) Cap(limit common.StorageSize) error {
 // Note, this method is a non-synchronized mutator. It is unsafe to call this
 // concurrently with other mutators.
 func (db *Database) Commit(node common.Hash, report bool, callback func(common.Hash)) error {
+	if db.scheme == rawdb.PathScheme {
+		return db.commitLayers(node, report)
+	}
+	db.flushLock.Lock()
+	defer db.flushLock.Unlock()
+
 	// Create a database batch to flush persistent data out. It is important that
 	// outside code doesn't see an inconsistent state (referenced data removed from
 	// memory cache during commit but not yet in persistent storage). This is ensured
@@ -834,6 +891,46 @@ func (c *cleaner) Delete(key []byte) error {
 	panic("not implemented")
 }
 
+// LockFlush blocks Cap and Commit from persisting any trie nodes until UnlockFlush
+// is called. It allows deleting stale nodes from disk without racing a flush that
+// writes the very same nodes back as part of a live state.
+func (db *Database) LockFlush() {
+	db.flushLock.Lock()
+}
+
+// UnlockFlush releases the lock acquired by LockFlush.
+func (db *Database) UnlockFlush() {
+	db.flushLock.Unlock()
+}
+
+// DeleteNodes removes the given hash-keyed trie nodes from the persistent store
+// and evicts them from the clean cache so they cannot be resolved any more. The
+// caller is expected to hold the flush lock.
+func (db *Database) DeleteNodes(hashes []common.Hash) error {
+	if db.scheme == rawdb.PathScheme {
+		return errHashSchemeOnly
+	}
+	batch := db.diskdb.NewBatch()
+	for _, hash := range hashes {
+		rawdb.DeleteTrieNode(batch, hash)
+		if batch.ValueSize() >= ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	if db.cleans != nil {
+		for _, hash := range hashes {
+			db.cleans.Del(hash[:])
+		}
+	}
+	return nil
+}
+
 // Size returns the current storage size of the memory cache in front of the
 // persistent database layer.
 func (db *Database) Size() (common.StorageSize, common.StorageSize) {
@@ -845,45 +942,5 @@ func (db *Database) Size() (common.StorageSize, common.StorageSize) {
 	// counted.
 	var metadataSize = common.StorageSize((len(db.dirties) - 1) * cachedNodeSize)
 	var metarootRefs = common.StorageSize(len(db.dirties[common.Hash{}].children) * (common.HashLength + 2))
-	return db.dirtiesSize + db.childrenSize + metadataSize - metarootRefs, db.preimagesSize
-}
-
-// saveCache saves clean state cache to given directory path
-// using specified CPU cores.
-func (db *Database) saveCache(dir string, threads int) error {
-	if db.cleans == nil {
-		return nil
-	}
-	log.Info("Writing clean trie cache to disk", "path", dir, "threads", threads)
-
-	start := time.Now()
-	err := db.cleans.SaveToFileConcurrent(dir, threads)
-	if err != nil {
-		log.Error("Failed to persist clean trie cache", "error", err)
-		return err
-	}
-	log.Info("Persisted the clean trie cache", "path", dir, "elapsed", common.PrettyDuration(time.Since(start)))
-	return nil
-}
-
-// SaveCache atomically saves fast cache data to the given dir using all
-// available CPU cores.
-func (db *Database) SaveCache(dir string) error {
-	return db.saveCache(dir, runtime.GOMAXPROCS(0))
-}
-
-// SaveCachePeriodically atomically saves fast cache data to the given dir with
-// the specified interval. All dump operation will only use a single CPU core.
-func (db *Database) SaveCachePeriodically(dir string, interval time.Duration, stopCh <-chan struct{}) {
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			db.saveCache(dir, 1)
-		case <-stopCh:
-			return
-		}
-	}
+	return db.dirtiesSize + db.childrenSize + metadataSize - metarootRefs + db.layersSize, db.preimagesSize
 }
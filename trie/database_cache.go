@@ -0,0 +1,320 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// cacheMarkerName is the file written last into a clean cache journal, which
+	// marks it as complete.
+	cacheMarkerName = "journal.rlp"
+
+	// cacheValidationNodes is the maximum number of cached nodes verified when
+	// validating a loaded clean cache against a state root.
+	cacheValidationNodes = 4096
+)
+
+// cacheMarker records the state a clean cache journal was taken at, along with
+// the checksums of the files making it up.
+type cacheMarker struct {
+	Root  common.Hash
+	Files []cacheFile
+}
+
+// cacheFile is the checksum of a single file of a clean cache journal.
+type cacheFile struct {
+	Name string
+	Hash common.Hash
+}
+
+// hashCacheFile calculates the checksum of a journal file and flushes it to disk.
+func hashCacheFile(path string) (common.Hash, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	defer f.Close()
+
+	hasher := crypto.NewKeccakState()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return common.Hash{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return common.Hash{}, err
+	}
+	var hash common.Hash
+	hasher.Read(hash[:])
+	return hash, nil
+}
+
+// syncDir flushes the entries of a directory to disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// readCacheMarker reads the marker of a clean cache journal and verifies that
+// the journal is complete and not corrupted.
+func readCacheMarker(dir string) (*cacheMarker, error) {
+	blob, err := os.ReadFile(filepath.Join(dir, cacheMarkerName))
+	if err != nil {
+		return nil, err
+	}
+	marker := new(cacheMarker)
+	if err := rlp.DecodeBytes(blob, marker); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != len(marker.Files)+1 {
+		return nil, fmt.Errorf("file count mismatch: have %d, want %d", len(entries)-1, len(marker.Files))
+	}
+	for _, file := range marker.Files {
+		hash, err := hashCacheFile(filepath.Join(dir, file.Name))
+		if err != nil {
+			return nil, err
+		}
+		if hash != file.Hash {
+			return nil, fmt.Errorf("file %s checksum mismatch: have %x, want %x", file.Name, hash, file.Hash)
+		}
+	}
+	return marker, nil
+}
+
+// loadCleanCache loads the clean cache from the journal in the given directory,
+// returning the state root the journal was taken at. If the journal is missing
+// or corrupted, an empty cache is created.
+//
+// A journal interrupted while replacing the previous one is still complete in
+// the temporary directory, so that is tried as a fallback.
+func loadCleanCache(dir string, size int) (*fastcache.Cache, common.Hash) {
+	for _, path := range []string{dir, dir + ".tmp"} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		marker, err := readCacheMarker(path)
+		if err != nil {
+			log.Warn("Discarding invalid clean trie cache journal", "path", path, "err", err)
+			continue
+		}
+		// A journal of a different size can't be loaded, it is replaced by an
+		// empty cache and rewritten on the next save
+		cache := fastcache.LoadFromFileOrNew(path, size)
+
+		var stats fastcache.Stats
+		cache.UpdateStats(&stats)
+		if stats.EntriesCount == 0 {
+			log.Info("Discarding empty or resized clean trie cache journal", "path", path)
+			return cache, common.Hash{}
+		}
+		log.Info("Loaded clean trie cache journal", "path", path, "root", marker.Root, "entries", stats.EntriesCount)
+		return cache, marker.Root
+	}
+	return fastcache.New(size), common.Hash{}
+}
+
+// saveCache saves the clean cache into the given directory, recording the
+// given state root, using the specified number of CPU cores.
+//
+// The journal is written into a temporary directory first, flushed to disk
+// and marked as complete, and only then moved into place, so a crash at any
+// point leaves either the previous or the new journal behind.
+func (db *Database) saveCache(dir string, root common.Hash, threads int) error {
+	if db.cleans == nil {
+		return nil
+	}
+	db.cleansLock.Lock()
+	defer db.cleansLock.Unlock()
+
+	log.Info("Writing clean trie cache to disk", "path", dir, "threads", threads)
+
+	var (
+		start = time.Now()
+		stats fastcache.Stats
+		tmp   = dir + ".tmp"
+	)
+	db.cleans.UpdateStats(&stats)
+	err := func() error {
+		if err := os.RemoveAll(tmp); err != nil {
+			return err
+		}
+		if err := db.cleans.SaveToFileConcurrent(tmp, threads); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(tmp)
+		if err != nil {
+			return err
+		}
+		marker := &cacheMarker{Root: root}
+		for _, entry := range entries {
+			hash, err := hashCacheFile(filepath.Join(tmp, entry.Name()))
+			if err != nil {
+				return err
+			}
+			marker.Files = append(marker.Files, cacheFile{Name: entry.Name(), Hash: hash})
+		}
+		blob, err := rlp.EncodeToBytes(marker)
+		if err != nil {
+			return err
+		}
+		f, err := os.Create(filepath.Join(tmp, cacheMarkerName))
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(blob); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := syncDir(tmp); err != nil {
+			return err
+		}
+		// The new journal is complete, replace the old one with it
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dir); err != nil {
+			return err
+		}
+		return syncDir(filepath.Dir(dir))
+	}()
+	if err != nil {
+		log.Error("Failed to persist clean trie cache", "error", err)
+		return err
+	}
+	db.cleansSets, db.cleansSaved = stats.SetCalls, true
+	log.Info("Persisted the clean trie cache", "path", dir, "root", root, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// SaveCache atomically saves fast cache data to the given dir using all
+// available CPU cores, recording the given state root as the one the cache
+// was taken at.
+func (db *Database) SaveCache(dir string, root common.Hash) error {
+	return db.saveCache(dir, root, runtime.GOMAXPROCS(0))
+}
+
+// SaveCachePeriodically atomically saves fast cache data to the given dir with
+// the specified interval, recording the state root returned by the callback at
+// the time of the save. All dump operation will only use a single CPU core and
+// are skipped if the cache did not change since the last one.
+func (db *Database) SaveCachePeriodically(dir string, interval time.Duration, root func() common.Hash, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if db.cleans == nil {
+				continue
+			}
+			var stats fastcache.Stats
+			db.cleans.UpdateStats(&stats)
+
+			db.cleansLock.Lock()
+			unchanged := db.cleansSaved && stats.SetCalls == db.cleansSets
+			db.cleansLock.Unlock()
+
+			if unchanged {
+				log.Debug("Skipping clean trie cache journal, no changes")
+				continue
+			}
+			db.saveCache(dir, root(), 1)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// ValidateCache checks the clean cache loaded from the journal against the
+// given state root, typically the one of the chain head. The cached nodes
+// reachable from the root and from the state the journal was taken at are
+// verified against their hashes, the whole cache is dropped on any mismatch.
+func (db *Database) ValidateCache(root common.Hash) error {
+	if db.cleans == nil || db.cleansRoot == (common.Hash{}) {
+		return nil
+	}
+	if root != db.cleansRoot {
+		log.Info("Clean trie cache journal taken at different state", "head", root, "journal", db.cleansRoot)
+	}
+	var (
+		queue   = []common.Hash{root, db.cleansRoot}
+		checked = make(map[common.Hash]struct{})
+		err     error
+	)
+	for len(queue) > 0 && len(checked) < cacheValidationNodes {
+		hash := queue[0]
+		queue = queue[1:]
+
+		if _, ok := checked[hash]; ok {
+			continue
+		}
+		checked[hash] = struct{}{}
+
+		// Nodes missing from the cache are loaded from disk when needed, only
+		// the cached ones are verified and traversed
+		enc := db.cleans.Get(nil, hash[:])
+		if enc == nil {
+			continue
+		}
+		if have := crypto.Keccak256Hash(enc); have != hash {
+			err = fmt.Errorf("node %x hash mismatch: have %x", hash, have)
+			break
+		}
+		n, derr := decodeNode(hash[:], enc)
+		if derr != nil {
+			err = fmt.Errorf("node %x undecodable: %v", hash, derr)
+			break
+		}
+		forGatherChildren(simplifyNode(n), func(child common.Hash) {
+			queue = append(queue, child)
+		})
+	}
+	db.cleansRoot = common.Hash{}
+	if err != nil {
+		log.Warn("Dropping inconsistent clean trie cache", "err", err)
+		db.cleans.Reset()
+		return err
+	}
+	log.Debug("Validated clean trie cache", "root", root, "nodes", len(checked))
+	return nil
+}
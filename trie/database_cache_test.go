@@ -0,0 +1,195 @@
+// Copyright 2022 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// newCacheTestTrie creates and flushes a trie with a few hundred entries,
+// returning its root and the hashes of its nodes.
+func newCacheTestTrie(t *testing.T) (ethdb.KeyValueStore, common.Hash, []common.Hash) {
+	diskdb := memorydb.New()
+	tr, _ := New(common.Hash{}, NewDatabase(diskdb))
+	for i := 0; i < 500; i++ {
+		tr.Update(crypto.Keccak256([]byte(fmt.Sprintf("key-%d", i))), []byte(fmt.Sprintf("value-%d", i)))
+	}
+	root, _, err := tr.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit trie: %v", err)
+	}
+	if err := tr.db.Commit(root, false, nil); err != nil {
+		t.Fatalf("failed to flush trie: %v", err)
+	}
+	var nodes []common.Hash
+	it := diskdb.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) == common.HashLength {
+			nodes = append(nodes, common.BytesToHash(it.Key()))
+		}
+	}
+	it.Release()
+	return diskdb, root, nodes
+}
+
+// warmCache loads all the nodes of the trie through the database.
+func warmCache(t *testing.T, db *Database, root common.Hash, cold bool) {
+	tr, err := New(root, db)
+	if err != nil {
+		t.Fatalf("failed to open trie: %v", err)
+	}
+	if cold {
+		tr.SetCold()
+	}
+	it := tr.NodeIterator(nil)
+	for it.Next(true) {
+	}
+	if it.Error() != nil {
+		t.Fatalf("failed to iterate trie: %v", it.Error())
+	}
+}
+
+// Tests that the clean cache survives a restart through its journal, including
+// one interrupted while replacing the previous journal.
+func TestCleanCacheJournal(t *testing.T) {
+	diskdb, root, nodes := newCacheTestTrie(t)
+	dir := filepath.Join(t.TempDir(), "triecache")
+
+	db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16})
+	warmCache(t, db, root, false)
+	if err := db.SaveCache(dir, root); err != nil {
+		t.Fatalf("failed to save cache: %v", err)
+	}
+	check := func() {
+		db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16, Journal: dir})
+		if db.cleansRoot != root {
+			t.Fatalf("journal root mismatch: have %x, want %x", db.cleansRoot, root)
+		}
+		for _, hash := range nodes {
+			if !db.cleans.Has(hash[:]) {
+				t.Fatalf("node %x missing from the loaded cache", hash)
+			}
+		}
+		if err := db.ValidateCache(root); err != nil {
+			t.Fatalf("failed to validate cache: %v", err)
+		}
+	}
+	check()
+
+	// Simulate a crash after the new journal was completed, but before it was
+	// moved in place of the old one
+	if err := os.Rename(dir, dir+".tmp"); err != nil {
+		t.Fatalf("failed to move journal: %v", err)
+	}
+	check()
+}
+
+// Tests that corrupted and incomplete journals are discarded.
+func TestCleanCacheJournalCorruption(t *testing.T) {
+	diskdb, root, _ := newCacheTestTrie(t)
+	dir := filepath.Join(t.TempDir(), "triecache")
+
+	db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16})
+	warmCache(t, db, root, false)
+	if err := db.SaveCache(dir, root); err != nil {
+		t.Fatalf("failed to save cache: %v", err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "data.*.bin"))
+	if len(files) == 0 {
+		t.Fatalf("no cache data files")
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("failed to read cache data: %v", err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatalf("failed to write cache data: %v", err)
+	}
+	if db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16, Journal: dir}); db.cleansRoot != (common.Hash{}) || db.cleans.Has(root[:]) {
+		t.Fatalf("corrupted journal loaded")
+	}
+	// Journals without the completion marker are discarded too
+	if err := db.SaveCache(dir, root); err != nil {
+		t.Fatalf("failed to save cache: %v", err)
+	}
+	if err := os.Remove(filepath.Join(dir, cacheMarkerName)); err != nil {
+		t.Fatalf("failed to remove marker: %v", err)
+	}
+	if db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16, Journal: dir}); db.cleansRoot != (common.Hash{}) || db.cleans.Has(root[:]) {
+		t.Fatalf("incomplete journal loaded")
+	}
+}
+
+// Tests that a loaded cache holding invalid nodes of the head state is dropped.
+func TestCleanCacheValidation(t *testing.T) {
+	diskdb, root, nodes := newCacheTestTrie(t)
+	dir := filepath.Join(t.TempDir(), "triecache")
+
+	db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16})
+	warmCache(t, db, root, false)
+
+	// Overwrite a node deeper in the trie
+	var victim common.Hash
+	for _, hash := range nodes {
+		if hash != root {
+			victim = hash
+			break
+		}
+	}
+	db.cleans.Set(victim[:], []byte{0xc0})
+	if err := db.SaveCache(dir, root); err != nil {
+		t.Fatalf("failed to save cache: %v", err)
+	}
+	db = NewDatabaseWithConfig(diskdb, &Config{Cache: 16, Journal: dir})
+	if err := db.ValidateCache(root); err == nil {
+		t.Fatalf("inconsistent cache validated")
+	}
+	if db.cleans.Has(root[:]) {
+		t.Fatalf("inconsistent cache retained")
+	}
+}
+
+// Tests that cold tries don't insert the nodes they load into the clean cache.
+func TestColdTrie(t *testing.T) {
+	diskdb, root, nodes := newCacheTestTrie(t)
+
+	db := NewDatabaseWithConfig(diskdb, &Config{Cache: 16})
+	warmCache(t, db, root, true)
+
+	var stats fastcache.Stats
+	db.cleans.UpdateStats(&stats)
+	if stats.EntriesCount > 1 { // The root is resolved before the trie is made cold
+		t.Fatalf("cold trie warmed the cache: %d entries", stats.EntriesCount)
+	}
+	warmCache(t, db, root, false)
+
+	stats.Reset()
+	db.cleans.UpdateStats(&stats)
+	if stats.EntriesCount != uint64(len(nodes)) {
+		t.Fatalf("cache entry mismatch: have %d, want %d", stats.EntriesCount, len(nodes))
+	}
+}
@@ -0,0 +1,809 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// maxDiffLayers is the maximum number of diff layers kept in memory on top
+	// of the persisted state in path scheme. Beyond it, the bottom-most layers
+	// are flushed into disk.
+	maxDiffLayers = 128
+
+	// defaultStateHistory is the default number of reverse diffs retained in
+	// path scheme, allowing the persisted state to be reverted that many times.
+	defaultStateHistory = 90000
+)
+
+var (
+	// errPathSchemeOnly is returned if a path scheme specific operation is
+	// requested on a hash scheme database.
+	errPathSchemeOnly = errors.New("operation is only supported in path scheme")
+
+	// errHashSchemeOnly is returned if a hash scheme specific operation is
+	// requested on a path scheme database.
+	errHashSchemeOnly = errors.New("operation is only supported in hash scheme")
+
+	// errStateUnavailable is returned if the requested state is neither the
+	// persisted one, nor tracked by any diff layer.
+	errStateUnavailable = errors.New("state not available")
+
+	// errStateUnrecoverable is returned if the persisted state can't be reverted
+	// to the requested one, because it's unknown or the reverse diffs needed
+	// are already pruned.
+	errStateUnrecoverable = errors.New("state is unrecoverable")
+)
+
+// pathNode is a trie node tracked by a diff layer in path scheme. Nodes deleted
+// by the state transition are tracked with an empty hash and blob.
+type pathNode struct {
+	hash common.Hash // Hash of the node, used to verify lookups
+	blob []byte      // RLP encoded node blob, nil if the node was deleted
+}
+
+// diffLayer is a set of trie nodes modified by a state transition, keyed by the
+// owner of the trie (zero for the account trie) and the path of the node. The
+// layers form a tree on top of the persisted state, each of them referencing
+// its parent by state root.
+type diffLayer struct {
+	root   common.Hash                          // State root of the layer
+	parent common.Hash                          // State root of the parent layer (or the persisted state)
+	id     uint64                               // State id, incremented by one for every transition
+	nodes  map[common.Hash]map[string]*pathNode // Trie nodes keyed by owner and path
+	size   common.StorageSize                   // Storage size of the tracked nodes
+}
+
+// node retrieves the trie node of the given trie at the given path, if it's
+// tracked by the layer.
+func (dl *diffLayer) node(owner common.Hash, path []byte) *pathNode {
+	subset, ok := dl.nodes[owner]
+	if !ok {
+		return nil
+	}
+	return subset[string(path)]
+}
+
+// reverseDiff is the set of trie nodes overwritten when persisting a state
+// transition, allowing the persisted state to be reverted to its parent.
+type reverseDiff struct {
+	Parent common.Hash       // State root before the transition
+	Root   common.Hash       // State root after the transition
+	Nodes  []reverseDiffNode // Trie nodes overwritten by the transition
+}
+
+// reverseDiffNode is the previous value of a trie node in a reverse diff.
+type reverseDiffNode struct {
+	Owner common.Hash // Owner of the trie, zero for the account trie
+	Path  []byte      // Path of the node in the trie
+	Prev  []byte      // Previous node blob, empty if the node didn't exist
+}
+
+// loadDiskState retrieves the root and id of the persisted state.
+func (db *Database) loadDiskState() {
+	db.layers = make(map[common.Hash]*diffLayer)
+	db.head = common.Hash{}
+	db.diskRoot = emptyRoot
+	if blob := rawdb.ReadAccountTrieNode(db.diskdb, nil); len(blob) > 0 {
+		db.diskRoot = crypto.Keccak256Hash(blob)
+	}
+	db.diskID = rawdb.ReadPersistentStateID(db.diskdb)
+	db.layersSize = 0
+}
+
+// resolve retrieves the trie node with the given hash, located at the given
+// path of the trie owned by owner in the given state. The state, owner and path
+// are only used as lookup keys in path scheme. The nodes loaded from disk are
+// only inserted into the clean cache if requested.
+func (db *Database) resolve(state common.Hash, owner common.Hash, path []byte, hash common.Hash, cache bool) node {
+	if db.scheme != rawdb.PathScheme {
+		return db.node(hash, cache)
+	}
+	if blob := db.pathNode(state, owner, path, hash, cache); blob != nil {
+		return mustDecodeNode(hash[:], blob)
+	}
+	return nil
+}
+
+// nodeBlob retrieves the encoded trie node with the given hash, located at the
+// given path of the trie owned by owner in the given state.
+func (db *Database) nodeBlob(state common.Hash, owner common.Hash, path []byte, hash common.Hash) ([]byte, error) {
+	if db.scheme != rawdb.PathScheme {
+		return db.Node(hash)
+	}
+	if blob := db.pathNode(state, owner, path, hash, true); blob != nil {
+		return blob, nil
+	}
+	return nil, errors.New("not found")
+}
+
+// pathNode retrieves the encoded trie node in path scheme. Since the nodes
+// at a given path are overwritten by newer states, all the lookups are verified
+// against the expected hash. The nodes loaded from disk are only inserted into
+// the clean cache if requested.
+func (db *Database) pathNode(state common.Hash, owner common.Hash, path []byte, hash common.Hash, cache bool) []byte {
+	// Retrieve the node from the clean cache if available
+	if db.cleans != nil {
+		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
+			memcacheCleanHitMeter.Mark(1)
+			memcacheCleanReadMeter.Mark(int64(len(enc)))
+			return enc
+		}
+	}
+	// Retrieve the node from the dirty cache or the diff layers if available
+	db.lock.RLock()
+	if dirty := db.dirties[hash]; dirty != nil {
+		db.lock.RUnlock()
+
+		memcacheDirtyHitMeter.Mark(1)
+		memcacheDirtyReadMeter.Mark(int64(dirty.size))
+		return dirty.rlp()
+	}
+	blob, disk := db.layerNode(state, owner, path, hash)
+	db.lock.RUnlock()
+
+	if blob != nil {
+		memcacheDirtyHitMeter.Mark(1)
+		memcacheDirtyReadMeter.Mark(int64(len(blob)))
+		return blob
+	}
+	memcacheDirtyMissMeter.Mark(1)
+
+	// Content unavailable in memory, attempt to retrieve from disk
+	if disk {
+		if enc := db.readDiskNode(owner, path); len(enc) > 0 && crypto.Keccak256Hash(enc) == hash {
+			if db.cleans != nil && cache {
+				db.cleans.Set(hash[:], enc)
+				memcacheCleanMissMeter.Mark(1)
+				memcacheCleanWriteMeter.Mark(int64(len(enc)))
+			}
+			return enc
+		}
+	}
+	// The node doesn't belong to the requested state, which happens if the trie
+	// was committed since it was opened. Search all the layers as a last resort.
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.scanLayers(owner, path, hash)
+}
+
+// layerNode retrieves the trie node of the given state from the diff layers,
+// walking them from the state down to the persisted one. The first layer which
+// tracks the path holds the node of the state. If none does, the node of the
+// state is the persisted one, which is reported by the second return value.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) layerNode(state common.Hash, owner common.Hash, path []byte, hash common.Hash) ([]byte, bool) {
+	if state == db.diskRoot {
+		return nil, true
+	}
+	layer := db.layers[state]
+	if layer == nil {
+		// The state is unknown, search all the layers before going to disk
+		if blob := db.scanLayers(owner, path, hash); blob != nil {
+			return blob, false
+		}
+		return nil, true
+	}
+	for ; layer != nil; layer = db.layers[layer.parent] {
+		if n := layer.node(owner, path); n != nil {
+			if n.hash == hash {
+				return n.blob, false
+			}
+			return nil, false
+		}
+	}
+	return nil, true
+}
+
+// scanLayers searches all the diff layers for the trie node with the given hash
+// at the given path, regardless of the state they belong to.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) scanLayers(owner common.Hash, path []byte, hash common.Hash) []byte {
+	for _, layer := range db.layers {
+		if n := layer.node(owner, path); n != nil && n.hash == hash {
+			return n.blob
+		}
+	}
+	return nil
+}
+
+// parentNode retrieves the trie node of the given state while a new diff layer
+// is being assembled on top of it, bypassing the dirty cache.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) parentNode(state common.Hash, owner common.Hash, path []byte, hash common.Hash) []byte {
+	if db.cleans != nil {
+		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
+			return enc
+		}
+	}
+	blob, disk := db.layerNode(state, owner, path, hash)
+	if blob != nil {
+		return blob
+	}
+	if disk {
+		if enc := db.readDiskNode(owner, path); len(enc) > 0 && crypto.Keccak256Hash(enc) == hash {
+			return enc
+		}
+	}
+	return db.scanLayers(owner, path, hash)
+}
+
+// readDiskNode retrieves the persisted trie node at the given path.
+func (db *Database) readDiskNode(owner common.Hash, path []byte) []byte {
+	if owner == (common.Hash{}) {
+		return rawdb.ReadAccountTrieNode(db.diskdb, path)
+	}
+	return rawdb.ReadStorageTrieNode(db.diskdb, owner, path)
+}
+
+// writeDiskNode stores the trie node at the given path, deleting it if the
+// blob is empty.
+func writeDiskNode(batch ethdb.KeyValueWriter, owner common.Hash, path []byte, blob []byte) {
+	switch {
+	case owner == (common.Hash{}) && len(blob) == 0:
+		rawdb.DeleteAccountTrieNode(batch, path)
+	case owner == (common.Hash{}):
+		rawdb.WriteAccountTrieNode(batch, path, blob)
+	case len(blob) == 0:
+		rawdb.DeleteStorageTrieNode(batch, owner, path)
+	default:
+		rawdb.WriteStorageTrieNode(batch, owner, path, blob)
+	}
+}
+
+// Update adds a new diff layer on top of the state with the given parent root,
+// containing all the dirty trie nodes reachable from root, storage tries
+// included, along with the deletion of all the nodes of the parent state which
+// are not part of the new one anymore. It's only supported in path scheme.
+//
+// All the dirty nodes are consumed, unreachable ones are discarded. If the
+// number of layers on top of the persisted state exceeds the limit, the
+// bottom-most ones are flushed into disk.
+func (db *Database) Update(root common.Hash, parent common.Hash) error {
+	if db.scheme != rawdb.PathScheme {
+		return errPathSchemeOnly
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	c := newNodeCollector(db)
+	c.collect(common.Hash{}, nil, root)
+	db.resetDirties()
+
+	// Nothing to do if the transition didn't change the state, or the state
+	// is already known
+	if root == parent || root == db.diskRoot || db.layers[root] != nil {
+		return nil
+	}
+	var id uint64
+	switch {
+	case parent == db.diskRoot:
+		id = db.diskID + 1
+	case db.layers[parent] != nil:
+		id = db.layers[parent].id + 1
+	default:
+		return fmt.Errorf("%w: parent %x", errStateUnavailable, parent)
+	}
+	if err := c.collectDeletions(parent, common.Hash{}, nil, parent); err != nil {
+		return err
+	}
+	db.layers[root] = &diffLayer{root: root, parent: parent, id: id, nodes: c.nodes, size: c.size}
+	db.layersSize += c.size
+	db.head = root
+
+	if id-db.diskID > maxDiffLayers {
+		return db.flatten(root, maxDiffLayers)
+	}
+	return nil
+}
+
+// resetDirties drops all the dirty trie nodes, which are tracked by the diff
+// layers instead in path scheme.
+func (db *Database) resetDirties() {
+	db.dirties = map[common.Hash]*cachedNode{{}: {
+		children: make(map[common.Hash]uint16),
+	}}
+	db.oldest, db.newest = common.Hash{}, common.Hash{}
+	db.dirtiesSize, db.childrenSize = 0, 0
+}
+
+// nodeCollector assembles the node set of a new diff layer: the dirty trie
+// nodes of the new state, along with deletion markers (nodes without a blob)
+// for the nodes of the parent state which are gone.
+type nodeCollector struct {
+	db    *Database
+	nodes map[common.Hash]map[string]*pathNode   // Trie nodes keyed by owner and path
+	clean map[common.Hash]map[string]common.Hash // Unmodified nodes referenced by the dirty ones
+	roots map[common.Hash]common.Hash            // Storage roots of the modified accounts
+	size  common.StorageSize                     // Storage size of the collected nodes
+}
+
+// newNodeCollector creates a collector for the dirty nodes of the database.
+func newNodeCollector(db *Database) *nodeCollector {
+	return &nodeCollector{
+		db:    db,
+		nodes: make(map[common.Hash]map[string]*pathNode),
+		clean: make(map[common.Hash]map[string]common.Hash),
+		roots: make(map[common.Hash]common.Hash),
+	}
+}
+
+// add inserts a trie node into the node set.
+func (c *nodeCollector) add(owner common.Hash, path []byte, n *pathNode) {
+	subset := c.nodes[owner]
+	if subset == nil {
+		subset = make(map[string]*pathNode)
+		c.nodes[owner] = subset
+	}
+	subset[string(path)] = n
+	c.size += common.StorageSize(common.HashLength + len(path) + len(n.blob))
+}
+
+// collect gathers the dirty trie node with the given hash located at the given
+// path, along with all its dirty descendants into the node set. Storage tries
+// are followed from the account leaves.
+func (c *nodeCollector) collect(owner common.Hash, path []byte, hash common.Hash) {
+	entry, ok := c.db.dirties[hash]
+	if !ok {
+		// Unchanged node, tracked by a lower layer or persisted
+		subset := c.clean[owner]
+		if subset == nil {
+			subset = make(map[string]common.Hash)
+			c.clean[owner] = subset
+		}
+		subset[string(path)] = hash
+		return
+	}
+	blob := entry.rlp()
+	c.add(owner, path, &pathNode{hash: hash, blob: blob})
+
+	n := entry.node
+	if raw, ok := n.(rawNode); ok {
+		n = mustDecodeNode(hash[:], raw)
+	}
+	c.collectChildren(owner, path, n)
+}
+
+// collectChildren gathers the dirty descendants of the given (collapsed or
+// expanded) trie node located at the given path.
+func (c *nodeCollector) collectChildren(owner common.Hash, path []byte, n node) {
+	switch n := n.(type) {
+	case *rawShortNode:
+		c.collectShort(owner, path, compactToHex(n.Key), n.Val)
+	case *shortNode:
+		c.collectShort(owner, path, n.Key, n.Val)
+	case rawFullNode:
+		for i := 0; i < 16; i++ {
+			if n[i] != nil {
+				c.collectChildren(owner, appendPath(path, byte(i)), n[i])
+			}
+		}
+	case *fullNode:
+		for i := 0; i < 16; i++ {
+			if n.Children[i] != nil {
+				c.collectChildren(owner, appendPath(path, byte(i)), n.Children[i])
+			}
+		}
+	case hashNode:
+		c.collect(owner, path, common.BytesToHash(n))
+	}
+}
+
+// collectShort gathers the dirty descendants of a short node located at the
+// given path, following the storage trie if it's an account leaf.
+func (c *nodeCollector) collectShort(owner common.Hash, path []byte, key []byte, val node) {
+	if !hasTerm(key) {
+		c.collectChildren(owner, appendPath(path, key...), val)
+		return
+	}
+	account, root, ok := storageRoot(owner, appendPath(path, key[:len(key)-1]...), val)
+	if !ok {
+		return
+	}
+	c.roots[account] = root
+	if root != emptyRoot {
+		c.collect(account, nil, root)
+	}
+}
+
+// collectDeletions adds a deletion marker for the trie node of the parent state
+// with the given hash located at the given path, unless the new state has a
+// node at the same path. The descendants are checked recursively, until the
+// node is found to be retained by the new state as is.
+func (c *nodeCollector) collectDeletions(state common.Hash, owner common.Hash, path []byte, hash common.Hash) error {
+	if hash == emptyRoot || hash == (common.Hash{}) {
+		return nil
+	}
+	retained, ok := c.clean[owner][string(path)]
+	if ok && retained == hash {
+		return nil
+	}
+	if _, dirty := c.nodes[owner][string(path)]; !dirty && !ok {
+		c.add(owner, path, new(pathNode))
+	}
+	blob := c.db.parentNode(state, owner, path, hash)
+	if blob == nil {
+		return &MissingNodeError{NodeHash: hash, Path: path}
+	}
+	return c.collectDeletedChildren(state, owner, path, mustDecodeNode(hash[:], blob))
+}
+
+// collectDeletedChildren checks the descendants of the given trie node of the
+// parent state located at the given path for deletion, following the storage
+// tries of the accounts whose storage changed.
+func (c *nodeCollector) collectDeletedChildren(state common.Hash, owner common.Hash, path []byte, n node) error {
+	switch n := n.(type) {
+	case *shortNode:
+		if !hasTerm(n.Key) {
+			return c.collectDeletedChildren(state, owner, appendPath(path, n.Key...), n.Val)
+		}
+		account, root, ok := storageRoot(owner, appendPath(path, n.Key[:len(n.Key)-1]...), n.Val)
+		if !ok {
+			return nil
+		}
+		// Accounts not modified by the new state are either retained as part
+		// of an unmodified node, or deleted along with their storage
+		next, ok := c.roots[account]
+		if !ok {
+			next = emptyRoot
+		}
+		if next == root {
+			return nil
+		}
+		return c.collectDeletions(state, account, nil, root)
+
+	case *fullNode:
+		for i := 0; i < 16; i++ {
+			if n.Children[i] != nil {
+				if err := c.collectDeletedChildren(state, owner, appendPath(path, byte(i)), n.Children[i]); err != nil {
+					return err
+				}
+			}
+		}
+	case hashNode:
+		return c.collectDeletions(state, owner, path, common.BytesToHash(n))
+	}
+	return nil
+}
+
+// storageRoot decodes the storage root of the account leaf with the given value
+// located at the given full path, returning false if it's not an account leaf.
+func storageRoot(owner common.Hash, path []byte, val node) (common.Hash, common.Hash, bool) {
+	value, ok := val.(valueNode)
+	if !ok || owner != (common.Hash{}) || len(path) != 2*common.HashLength {
+		return common.Hash{}, common.Hash{}, false
+	}
+	var account struct {
+		Nonce    uint64
+		Balance  *big.Int
+		Root     common.Hash
+		CodeHash []byte
+	}
+	if err := rlp.DecodeBytes(value, &account); err != nil {
+		return common.Hash{}, common.Hash{}, false
+	}
+	return common.BytesToHash(hexToKeybytes(path)), account.Root, true
+}
+
+// appendPath returns a new path with the given nibbles appended, leaving the
+// original one untouched.
+func appendPath(path []byte, nibbles ...byte) []byte {
+	res := make([]byte, 0, len(path)+len(nibbles))
+	return append(append(res, path...), nibbles...)
+}
+
+// flatten persists the ancestors of the given layer bottom up, until at most
+// keep layers are left on top of the persisted state. Layers not descending
+// from the new persisted state are discarded.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) flatten(root common.Hash, keep int) error {
+	var chain []*diffLayer
+	for hash := root; hash != db.diskRoot; {
+		layer := db.layers[hash]
+		if layer == nil {
+			return fmt.Errorf("%w: %x", errStateUnavailable, hash)
+		}
+		chain = append(chain, layer)
+		hash = layer.parent
+	}
+	if len(chain) <= keep {
+		return nil
+	}
+	for i := len(chain) - 1; i >= keep; i-- {
+		if err := db.persist(chain[i]); err != nil {
+			return err
+		}
+	}
+	db.discardStale()
+	return nil
+}
+
+// persist writes the nodes of the given layer, which must be on top of the
+// persisted state, into disk along with the reverse diff of the transition.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) persist(layer *diffLayer) error {
+	var (
+		start = time.Now()
+		id    = db.diskID + 1
+		batch = db.diskdb.NewBatch()
+		diff  = reverseDiff{Parent: db.diskRoot, Root: layer.root}
+	)
+	owners := make([]common.Hash, 0, len(layer.nodes))
+	for owner := range layer.nodes {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(i, j int) bool { return bytes.Compare(owners[i][:], owners[j][:]) < 0 })
+
+	for _, owner := range owners {
+		subset := layer.nodes[owner]
+		paths := make([]string, 0, len(subset))
+		for path := range subset {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			diff.Nodes = append(diff.Nodes, reverseDiffNode{
+				Owner: owner,
+				Path:  []byte(path),
+				Prev:  db.readDiskNode(owner, []byte(path)),
+			})
+			writeDiskNode(batch, owner, []byte(path), subset[path].blob)
+		}
+	}
+	enc, err := rlp.EncodeToBytes(&diff)
+	if err != nil {
+		return err
+	}
+	rawdb.WriteReverseDiff(batch, id, enc)
+	rawdb.WriteReverseDiffLookup(batch, layer.root, id)
+	rawdb.WritePersistentStateID(batch, id)
+
+	// Drop the oldest reverse diff beyond the retention limit
+	if id > db.history {
+		db.pruneReverseDiff(batch, id-db.history)
+	}
+	if err := batch.Write(); err != nil {
+		log.Error("Failed to write trie layer to disk", "err", err)
+		return err
+	}
+	db.diskRoot, db.diskID = layer.root, id
+	db.layersSize -= layer.size
+	delete(db.layers, layer.root)
+	if db.head == layer.root {
+		db.head = common.Hash{}
+	}
+	memcacheFlushTimeTimer.Update(time.Since(start))
+	memcacheFlushSizeMeter.Mark(int64(layer.size))
+	memcacheFlushNodesMeter.Mark(int64(len(diff.Nodes)))
+
+	log.Debug("Persisted trie layer", "id", id, "root", layer.root, "nodes", len(diff.Nodes), "size", layer.size, "time", time.Since(start))
+	return nil
+}
+
+// pruneReverseDiff deletes the reverse diff with the given id, along with its
+// state root lookup if it's not overwritten by a newer state.
+func (db *Database) pruneReverseDiff(batch ethdb.KeyValueWriter, id uint64) {
+	blob := rawdb.ReadReverseDiff(db.diskdb, id)
+	if len(blob) == 0 {
+		return
+	}
+	var diff reverseDiff
+	if err := rlp.DecodeBytes(blob, &diff); err == nil {
+		if lookup := rawdb.ReadReverseDiffLookup(db.diskdb, diff.Root); lookup != nil && *lookup == id {
+			rawdb.DeleteReverseDiffLookup(batch, diff.Root)
+		}
+	}
+	rawdb.DeleteReverseDiff(batch, id)
+}
+
+// discardStale drops all the diff layers which are not descendants of the
+// persisted state anymore.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) discardStale() {
+	for {
+		var dropped bool
+		for root, layer := range db.layers {
+			if layer.parent != db.diskRoot && db.layers[layer.parent] == nil {
+				db.layersSize -= layer.size
+				delete(db.layers, root)
+				if db.head == root {
+					db.head = common.Hash{}
+				}
+				dropped = true
+			}
+		}
+		if !dropped {
+			return
+		}
+	}
+}
+
+// capLayers flushes the bottom-most diff layers below the most recently added
+// one until the total memory usage goes below the given threshold.
+func (db *Database) capLayers(limit common.StorageSize) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.preimagesSize > 4*1024*1024 {
+		if err := db.flushPreimages(); err != nil {
+			return err
+		}
+	}
+	if db.layersSize <= limit || db.head == (common.Hash{}) {
+		return nil
+	}
+	var chain []*diffLayer
+	for hash := db.head; hash != db.diskRoot; {
+		layer := db.layers[hash]
+		if layer == nil {
+			return fmt.Errorf("%w: %x", errStateUnavailable, hash)
+		}
+		chain = append(chain, layer)
+		hash = layer.parent
+	}
+	for i := len(chain) - 1; i >= 0 && db.layersSize > limit; i-- {
+		if err := db.persist(chain[i]); err != nil {
+			return err
+		}
+	}
+	db.discardStale()
+	return nil
+}
+
+// commitLayers persists the state with the given root, along with all the diff
+// layers below it. Dirty nodes not yet added as a diff layer are assumed to be
+// on top of the persisted state.
+func (db *Database) commitLayers(root common.Hash, report bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	start, layers := time.Now(), len(db.layers)
+	if _, ok := db.dirties[root]; ok && db.layers[root] == nil && root != db.diskRoot {
+		c := newNodeCollector(db)
+		c.collect(common.Hash{}, nil, root)
+		db.resetDirties()
+
+		if err := c.collectDeletions(db.diskRoot, common.Hash{}, nil, db.diskRoot); err != nil {
+			return err
+		}
+		db.layers[root] = &diffLayer{root: root, parent: db.diskRoot, id: db.diskID + 1, nodes: c.nodes, size: c.size}
+		db.layersSize += c.size
+		layers++
+	}
+	if err := db.flushPreimages(); err != nil {
+		return err
+	}
+	if root == db.diskRoot {
+		return nil
+	}
+	if err := db.flatten(root, 0); err != nil {
+		return err
+	}
+	logger := log.Info
+	if !report {
+		logger = log.Debug
+	}
+	logger("Persisted trie from memory database", "root", root, "id", db.diskID, "layers", layers-len(db.layers), "time", time.Since(start),
+		"livelayers", len(db.layers), "livesize", db.layersSize)
+	return nil
+}
+
+// flushPreimages writes all the accumulated preimages into disk.
+//
+// Note, this method assumes that the database's lock is held!
+func (db *Database) flushPreimages() error {
+	if db.preimages == nil || len(db.preimages) == 0 {
+		return nil
+	}
+	batch := db.diskdb.NewBatch()
+	rawdb.WritePreimages(batch, db.preimages)
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	db.preimages, db.preimagesSize = make(map[common.Hash][]byte), 0
+	return nil
+}
+
+// Recoverable reports whether the persisted state can be reverted to the one
+// with the given root using the retained reverse diffs. It's always false in
+// hash scheme.
+func (db *Database) Recoverable(root common.Hash) bool {
+	if db.scheme != rawdb.PathScheme {
+		return false
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.recoverable(root)
+}
+
+// recoverable is the private locked version of Recoverable.
+func (db *Database) recoverable(root common.Hash) bool {
+	id := rawdb.ReadReverseDiffLookup(db.diskdb, root)
+	if id == nil || *id >= db.diskID {
+		return false
+	}
+	// Reverse diffs are pruned from the tail, check the oldest one needed
+	return len(rawdb.ReadReverseDiff(db.diskdb, *id+1)) != 0
+}
+
+// Recover reverts the persisted state to the one with the given root by applying
+// the retained reverse diffs. All the diff layers are discarded, since they are
+// built on top of the reverted state. It's only supported in path scheme.
+func (db *Database) Recover(root common.Hash) error {
+	if db.scheme != rawdb.PathScheme {
+		return errPathSchemeOnly
+	}
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if root == db.diskRoot {
+		return nil
+	}
+	if !db.recoverable(root) {
+		return fmt.Errorf("%w: %x", errStateUnrecoverable, root)
+	}
+	db.layers, db.layersSize, db.head = make(map[common.Hash]*diffLayer), 0, common.Hash{}
+	db.resetDirties()
+
+	start, target := time.Now(), *rawdb.ReadReverseDiffLookup(db.diskdb, root)
+	for db.diskID > target {
+		var diff reverseDiff
+		if err := rlp.DecodeBytes(rawdb.ReadReverseDiff(db.diskdb, db.diskID), &diff); err != nil {
+			return fmt.Errorf("invalid reverse diff %d: %v", db.diskID, err)
+		}
+		if diff.Root != db.diskRoot {
+			return fmt.Errorf("reverse diff %d mismatch: have %x, want %x", db.diskID, diff.Root, db.diskRoot)
+		}
+		batch := db.diskdb.NewBatch()
+		for _, n := range diff.Nodes {
+			writeDiskNode(batch, n.Owner, n.Path, n.Prev)
+		}
+		rawdb.DeleteReverseDiff(batch, db.diskID)
+		if lookup := rawdb.ReadReverseDiffLookup(db.diskdb, diff.Root); lookup != nil && *lookup == db.diskID {
+			rawdb.DeleteReverseDiffLookup(batch, diff.Root)
+		}
+		rawdb.WritePersistentStateID(batch, db.diskID-1)
+		if err := batch.Write(); err != nil {
+			return err
+		}
+		db.diskRoot, db.diskID = diff.Parent, db.diskID-1
+	}
+	log.Info("Reverted persisted state", "root", root, "id", db.diskID, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// pathTestState returns the expected content of the test trie after applying
+// the first n+1 transitions: transition i sets one of 20 keys to a new value.
+func pathTestState(n int) map[string]string {
+	state := make(map[string]string)
+	for i := 0; i <= n; i++ {
+		state[fmt.Sprintf("key-%02d", i%20)] = fmt.Sprintf("value-%d", i)
+	}
+	return state
+}
+
+// checkPathTestState verifies that the state with the given root is available
+// in the database and matches the expected content.
+func checkPathTestState(db *Database, root common.Hash, state map[string]string) error {
+	tr, err := New(root, db)
+	if err != nil {
+		return err
+	}
+	for key, want := range state {
+		have, err := tr.TryGet([]byte(key))
+		if err != nil {
+			return err
+		}
+		if string(have) != want {
+			return fmt.Errorf("value mismatch for %s: have %s, want %s", key, have, want)
+		}
+	}
+	return nil
+}
+
+// Tests that the path scheme keeps a bounded number of diff layers on top of a
+// single persisted state, overwriting the stale nodes in place, and that the
+// persisted state can be reverted with the reverse diffs.
+func TestPathSchemeLayers(t *testing.T) {
+	diskdb := memorydb.New()
+	rawdb.WriteStateScheme(diskdb, rawdb.PathScheme)
+
+	db := NewDatabase(diskdb)
+	if db.Scheme() != rawdb.PathScheme {
+		t.Fatalf("scheme mismatch: have %s, want %s", db.Scheme(), rawdb.PathScheme)
+	}
+	var (
+		roots  []common.Hash
+		parent = emptyRoot
+		tr, _  = New(common.Hash{}, db)
+		total  = maxDiffLayers + 10
+	)
+	for i := 0; i < total; i++ {
+		tr.Update([]byte(fmt.Sprintf("key-%02d", i%20)), []byte(fmt.Sprintf("value-%d", i)))
+		root, _, err := tr.Commit(nil)
+		if err != nil {
+			t.Fatalf("transition %d: failed to commit trie: %v", i, err)
+		}
+		if err := db.Update(root, parent); err != nil {
+			t.Fatalf("transition %d: failed to update database: %v", i, err)
+		}
+		roots, parent = append(roots, root), root
+		if tr, err = New(root, db); err != nil {
+			t.Fatalf("transition %d: failed to reopen trie: %v", i, err)
+		}
+	}
+	if len(db.layers) != maxDiffLayers {
+		t.Fatalf("diff layer count mismatch: have %d, want %d", len(db.layers), maxDiffLayers)
+	}
+	if want := uint64(total - maxDiffLayers); db.diskID != want {
+		t.Fatalf("persisted state id mismatch: have %d, want %d", db.diskID, want)
+	}
+	// The states tracked in memory and the persisted one are available, the
+	// older ones are overwritten
+	for i := total - maxDiffLayers - 1; i < total; i++ {
+		if err := checkPathTestState(db, roots[i], pathTestState(i)); err != nil {
+			t.Fatalf("state %d unavailable: %v", i, err)
+		}
+	}
+	if err := checkPathTestState(db, roots[0], pathTestState(0)); err == nil {
+		t.Fatalf("stale state available")
+	}
+	// Nodes must be keyed by path, not by hash
+	it := diskdb.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) == common.HashLength {
+			t.Fatalf("hash keyed node found: %x", it.Key())
+		}
+	}
+	it.Release()
+
+	// Persist everything and check that the state survives a restart
+	if err := db.Commit(roots[total-1], false, nil); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	db = NewDatabase(diskdb)
+	if db.diskRoot != roots[total-1] || db.diskID != uint64(total) {
+		t.Fatalf("persisted state mismatch: have %x/%d, want %x/%d", db.diskRoot, db.diskID, roots[total-1], total)
+	}
+	if err := checkPathTestState(db, roots[total-1], pathTestState(total-1)); err != nil {
+		t.Fatalf("persisted state unavailable: %v", err)
+	}
+	// Revert the persisted state with the reverse diffs
+	if !db.Recoverable(roots[5]) {
+		t.Fatalf("state not recoverable")
+	}
+	if err := db.Recover(roots[5]); err != nil {
+		t.Fatalf("failed to recover state: %v", err)
+	}
+	if err := checkPathTestState(db, roots[5], pathTestState(5)); err != nil {
+		t.Fatalf("recovered state unavailable: %v", err)
+	}
+	if err := checkPathTestState(db, roots[total-1], pathTestState(total-1)); err == nil {
+		t.Fatalf("reverted state available")
+	}
+	if err := db.Recover(roots[total-1]); !errors.Is(err, errStateUnrecoverable) {
+		t.Fatalf("reverted state recovery error mismatch: have %v, want %v", err, errStateUnrecoverable)
+	}
+}
+
+// Tests that forks not descending from the persisted state are discarded, and
+// that the reverse diffs beyond the retention limit are pruned.
+func TestPathSchemeForks(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabaseWithConfig(diskdb, &Config{Scheme: rawdb.PathScheme, StateHistory: 4})
+
+	commit := func(parent common.Hash, key, value string) common.Hash {
+		tr, err := New(parent, db)
+		if err != nil {
+			t.Fatalf("failed to open trie %x: %v", parent, err)
+		}
+		tr.Update([]byte(key), []byte(value))
+		root, _, err := tr.Commit(nil)
+		if err != nil {
+			t.Fatalf("failed to commit trie: %v", err)
+		}
+		if err := db.Update(root, parent); err != nil {
+			t.Fatalf("failed to update database: %v", err)
+		}
+		return root
+	}
+	var (
+		base  = commit(emptyRoot, "base", "0")
+		left  = commit(base, "fork", "left")
+		right = commit(base, "fork", "right")
+		head  = left
+	)
+	for i := 0; i < 10; i++ {
+		head = commit(head, "head", fmt.Sprint(i))
+	}
+	if err := db.Commit(head, false, nil); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if len(db.layers) != 0 {
+		t.Fatalf("diff layers left: %d", len(db.layers))
+	}
+	if _, err := New(right, db); err == nil {
+		t.Fatalf("discarded fork available")
+	}
+	if db.Recoverable(left) {
+		t.Fatalf("pruned state recoverable")
+	}
+	if blob := rawdb.ReadReverseDiff(diskdb, db.diskID-4); len(blob) != 0 {
+		t.Fatalf("reverse diff beyond retention limit not pruned")
+	}
+	if blob := rawdb.ReadReverseDiff(diskdb, db.diskID-3); len(blob) == 0 {
+		t.Fatalf("reverse diff within retention limit pruned")
+	}
+	tr, _ := New(head, db)
+	tr.Update([]byte("head"), []byte("x"))
+	root, _, _ := tr.Commit(nil)
+	if err := db.Update(root, common.HexToHash("0xdeadbeef")); !errors.Is(err, errStateUnavailable) {
+		t.Fatalf("unknown parent error mismatch: have %v, want %v", err, errStateUnavailable)
+	}
+}
+
+// Tests that the nodes removed by a state transition, including the storage
+// trie of a deleted account, are deleted from disk when the diff layer gets
+// persisted, and that they are restored when reverting the transition.
+func TestPathSchemeDeletions(t *testing.T) {
+	diskdb := memorydb.New()
+	db := NewDatabaseWithConfig(diskdb, &Config{Scheme: rawdb.PathScheme})
+
+	// Create a state with a bunch of accounts, one of them with storage
+	var (
+		owner    = common.HexToHash("0x1000000000000000000000000000000000000000000000000000000000000001")
+		codeHash = common.HexToHash("0xc5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470")
+	)
+	storage, _ := NewWithOwner(emptyRoot, owner, common.Hash{}, db)
+	for i := 0; i < 10; i++ {
+		storage.Update(common.BigToHash(big.NewInt(int64(i))).Bytes(), []byte{byte(i + 1)})
+	}
+	storageRoot, _, err := storage.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit storage trie: %v", err)
+	}
+	account := func(nonce uint64, root common.Hash) []byte {
+		blob, _ := rlp.EncodeToBytes([]interface{}{nonce, new(big.Int), root, codeHash.Bytes()})
+		return blob
+	}
+	accounts, _ := New(common.Hash{}, db)
+	accounts.Update(owner.Bytes(), account(0, storageRoot))
+	for i := 0; i < 10; i++ {
+		accounts.Update(common.BigToHash(big.NewInt(int64(i+1))).Bytes(), account(uint64(i), emptyRoot))
+	}
+	base, _, err := accounts.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	if err := db.Update(base, emptyRoot); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	if err := db.Commit(base, false, nil); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	// Delete the account with the storage along with most of the others, which
+	// collapses the account trie
+	accounts, _ = New(base, db)
+	if err := accounts.TryDelete(owner.Bytes()); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		if err := accounts.TryDelete(common.BigToHash(big.NewInt(int64(i + 1))).Bytes()); err != nil {
+			t.Fatalf("failed to delete account %d: %v", i+1, err)
+		}
+	}
+	root, _, err := accounts.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit account trie: %v", err)
+	}
+	if err := db.Update(root, base); err != nil {
+		t.Fatalf("failed to update database: %v", err)
+	}
+	// Both states are available while the transition is in memory
+	if tr, err := NewWithOwner(base, owner, storageRoot, db); err != nil {
+		t.Fatalf("storage of parent state unavailable: %v", err)
+	} else if val, err := tr.TryGet(common.BigToHash(big.NewInt(0)).Bytes()); err != nil || !bytes.Equal(val, []byte{1}) {
+		t.Fatalf("storage slot of parent state mismatch: have %x, %v", val, err)
+	}
+	if err := db.Commit(root, false, nil); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	// Only the nodes of the new state may be left on disk
+	countNodes := func() (int, int) {
+		var accountNodes, storageNodes int
+		it := diskdb.NewIterator(nil, nil)
+		defer it.Release()
+		for it.Next() {
+			switch {
+			case rawdb.IsAccountTrieNode(it.Key()):
+				accountNodes++
+			case rawdb.IsStorageTrieNode(it.Key()):
+				storageNodes++
+			}
+		}
+		return accountNodes, storageNodes
+	}
+	var want int
+	for it := accounts.NodeIterator(nil); it.Next(true); {
+		if it.Hash() != (common.Hash{}) {
+			want++
+		}
+	}
+	if accountNodes, storageNodes := countNodes(); accountNodes != want || storageNodes != 0 {
+		t.Fatalf("persisted node count mismatch: have %d/%d, want %d/0", accountNodes, storageNodes, want)
+	}
+	// Reverting the transition restores the deleted nodes
+	if err := db.Recover(base); err != nil {
+		t.Fatalf("failed to recover state: %v", err)
+	}
+	if _, storageNodes := countNodes(); storageNodes == 0 {
+		t.Fatalf("storage trie nodes not restored")
+	}
+	tr, err := NewWithOwner(base, owner, storageRoot, db)
+	if err != nil {
+		t.Fatalf("recovered storage trie unavailable: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if val, err := tr.TryGet(common.BigToHash(big.NewInt(int64(i))).Bytes()); err != nil || !bytes.Equal(val, []byte{byte(i + 1)}) {
+			t.Fatalf("recovered storage slot %d mismatch: have %x, %v", i, val, err)
+		}
+	}
+}
@@ -513,6 +513,8 @@ func TestNodeIteratorLargeTrie(t *testing.T) {
 	// Create some arbitrary test trie to iterate
 	db, trie, logDb := makeLargeTestTrie()
 	db.Cap(0) // flush everything
+	logDb.getCount = 0
+
 	// Do a seek operation
 	trie.NodeIterator(common.FromHex("0x77667766776677766778855885885885"))
 	// master: 24 get operations
@@ -54,10 +54,18 @@ type SecureTrie struct {
 // A new cache generation is created by each call to Commit.
 // cachelimit sets the number of past cache generations to keep.
 func NewSecure(root common.Hash, db *Database) (*SecureTrie, error) {
+	return NewSecureWithOwner(root, common.Hash{}, root, db)
+}
+
+// NewSecureWithOwner creates a secure trie with an existing root node, owned by
+// the given account and belonging to the given state. Storage tries must be
+// opened with the hash of the account as the owner, so their nodes can be
+// located in path scheme.
+func NewSecureWithOwner(state common.Hash, owner common.Hash, root common.Hash, db *Database) (*SecureTrie, error) {
 	if db == nil {
 		panic("trie.NewSecure called without a database")
 	}
-	trie, err := New(root, db)
+	trie, err := NewWithOwner(state, owner, root, db)
 	if err != nil {
 		return nil, err
 	}
@@ -183,9 +191,16 @@ func (t *SecureTrie) Hash() common.Hash {
 	return t.trie.Hash()
 }
 
+// Witness returns the encoded form of all the nodes resolved from the database
+// since the trie was opened.
+func (t *SecureTrie) Witness() map[string]struct{} {
+	return t.trie.Witness()
+}
+
 // Copy returns a copy of SecureTrie.
 func (t *SecureTrie) Copy() *SecureTrie {
 	cpy := *t
+	cpy.trie = *t.trie.Copy()
 	return &cpy
 }
 
@@ -60,12 +60,20 @@ type LeafCallback func(paths [][]byte, hexpath []byte, leaf []byte, parent commo
 //
 // Trie is not safe for concurrent use.
 type Trie struct {
-	db   *Database
-	root node
+	db    *Database
+	root  node
+	owner common.Hash // Owner of the trie, the account hash for storage tries
+	state common.Hash // State root the trie belongs to, zero if unknown
 	// Keep track of the number leafs which have been inserted since the last
 	// hashing operation. This number will not directly map to the number of
 	// actually unhashed nodes
 	unhashed int
+
+	// Hashes of all the nodes resolved from the database, keyed by their paths.
+	// These are the nodes needed to replay the trie accesses without a database.
+	accessed map[string]common.Hash
+
+	cold bool // Whether the nodes loaded from disk are kept out of the clean cache
 }
 
 // newFlag returns the cache flag value for a newly created node.
@@ -80,11 +88,23 @@ func (t *Trie) newFlag() nodeFlag {
 // New will panic if db is nil and returns a MissingNodeError if root does
 // not exist in the database. Accessing the trie loads nodes from db on demand.
 func New(root common.Hash, db *Database) (*Trie, error) {
+	return NewWithOwner(root, common.Hash{}, root, db)
+}
+
+// NewWithOwner creates a trie with an existing root node from db, owned by the
+// given account and belonging to the given state. The owner is the hash of the
+// account for storage tries, and zero for the account trie and any other
+// standalone trie. Both are needed to look up the nodes if the database uses
+// the path scheme, though the state root may be zero if it's unknown at the
+// expense of slower lookups.
+func NewWithOwner(state common.Hash, owner common.Hash, root common.Hash, db *Database) (*Trie, error) {
 	if db == nil {
 		panic("trie.New called without a database")
 	}
 	trie := &Trie{
-		db: db,
+		db:    db,
+		owner: owner,
+		state: state,
 	}
 	if root != (common.Hash{}) && root != emptyRoot {
 		rootnode, err := trie.resolveHash(root[:], nil)
@@ -194,7 +214,7 @@ func (t *Trie) tryGetNode(origNode node, path []byte, pos int) (item []byte, new
 		if hash == nil {
 			return nil, origNode, 0, errors.New("non-consensus node")
 		}
-		blob, err := t.db.Node(common.BytesToHash(hash))
+		blob, err := t.db.nodeBlob(t.state, t.owner, path[:pos], common.BytesToHash(hash))
 		return blob, origNode, 1, err
 	}
 	// Path still needs to be traversed, descend into children
@@ -451,7 +471,7 @@ func (t *Trie) delete(n node, prefix, key []byte) (bool, node, error) {
 				// shortNode{..., shortNode{...}}.  Since the entry
 				// might not be loaded yet, resolve it just for this
 				// check.
-				cnode, err := t.resolve(n.Children[pos], prefix)
+				cnode, err := t.resolve(n.Children[pos], append(prefix, byte(pos)))
 				if err != nil {
 					return false, nil, err
 				}
@@ -508,7 +528,11 @@ func (t *Trie) resolve(n node, prefix []byte) (node, error) {
 
 func (t *Trie) resolveHash(n hashNode, prefix []byte) (node, error) {
 	hash := common.BytesToHash(n)
-	if node := t.db.node(hash); node != nil {
+	if node := t.db.resolve(t.state, t.owner, prefix, hash, !t.cold); node != nil {
+		if t.accessed == nil {
+			t.accessed = make(map[string]common.Hash)
+		}
+		t.accessed[string(prefix)] = hash
 		return node, nil
 	}
 	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
@@ -566,6 +590,11 @@ func (t *Trie) Commit(onleaf LeafCallback) (common.Hash, int, error) {
 		return common.Hash{}, 0, err
 	}
 	t.root = newRoot
+
+	// The account trie (or a standalone one) becomes its own state
+	if t.owner == (common.Hash{}) {
+		t.state = rootHash
+	}
 	return rootHash, committed, nil
 }
 
@@ -582,8 +611,47 @@ func (t *Trie) hashRoot() (node, node, error) {
 	return hashed, cached, nil
 }
 
+// Witness returns the encoded form of all the nodes resolved from the database
+// since the trie was opened. Together with the accessed keys, they are enough to
+// replay all the reads and writes done on the trie, including the deletions
+// collapsing branches into their remaining siblings.
+func (t *Trie) Witness() map[string]struct{} {
+	witness := make(map[string]struct{}, len(t.accessed))
+	for path, hash := range t.accessed {
+		blob, err := t.db.nodeBlob(t.state, t.owner, []byte(path), hash)
+		if err != nil {
+			log.Error("Accessed trie node is missing", "owner", t.owner, "path", []byte(path), "hash", hash, "err", err)
+			continue
+		}
+		witness[string(blob)] = struct{}{}
+	}
+	return witness
+}
+
+// Copy returns a copy of the trie, sharing the immutable nodes but not the
+// record of the accessed ones.
+func (t *Trie) Copy() *Trie {
+	cpy := *t
+	if t.accessed != nil {
+		cpy.accessed = make(map[string]common.Hash, len(t.accessed))
+		for path, hash := range t.accessed {
+			cpy.accessed[path] = hash
+		}
+	}
+	return &cpy
+}
+
+// SetCold configures the trie to not insert the nodes it loads from disk into
+// the clean cache of the database. Nodes already cached are still served from
+// it. It's meant for sweeping through the state without evicting the nodes of
+// the live tries from the cache.
+func (t *Trie) SetCold() {
+	t.cold = true
+}
+
 // Reset drops the referenced root node and cleans all internal state.
 func (t *Trie) Reset() {
 	t.root = nil
 	t.unhashed = 0
+	t.accessed = nil
 }
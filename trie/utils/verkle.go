@@ -0,0 +1,171 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Package utils implements the mapping of the account and storage data into the
+// key space of a verkle tree.
+package utils
+
+import (
+	"github.com/gballet/go-verkle"
+	"github.com/holiman/uint256"
+)
+
+const (
+	VersionLeafKey    = 0 // Sub index of the account version
+	BalanceLeafKey    = 1 // Sub index of the account balance
+	NonceLeafKey      = 2 // Sub index of the account nonce
+	CodeKeccakLeafKey = 3 // Sub index of the hash of the account code
+	CodeSizeLeafKey   = 4 // Sub index of the size of the account code
+)
+
+const (
+	push1  = 0x60 // Opcode of PUSH1
+	push32 = 0x7f // Opcode of PUSH32
+)
+
+var (
+	zero                = uint256.NewInt(0)
+	HeaderStorageOffset = uint256.NewInt(64)  // Position of the first storage slot kept next to the account header
+	CodeOffset          = uint256.NewInt(128) // Position of the first code chunk
+	MainStorageOffset   = new(uint256.Int).Lsh(uint256.NewInt(256), 31*8)
+	VerkleNodeWidth     = uint256.NewInt(256)
+	codeStorageDelta    = new(uint256.Int).Sub(CodeOffset, HeaderStorageOffset)
+)
+
+// GetTreeKey computes the key of a leaf in the verkle tree, as the pedersen hash
+// of the address and the tree index, with the last byte replaced by the sub index
+// within the group of 256 leaves sharing the same stem.
+func GetTreeKey(address []byte, treeIndex *uint256.Int, subIndex byte) []byte {
+	var (
+		poly [256]verkle.Fr
+		addr [32]byte
+	)
+	copy(addr[32-len(address):], address)
+
+	// The input is interpreted as 16 byte little endian integers, prefixed by the
+	// marker of a 64 byte long input.
+	verkle.FromLEBytes(&poly[0], []byte{2, 64})
+	verkle.FromLEBytes(&poly[1], addr[:16])
+	verkle.FromLEBytes(&poly[2], addr[16:])
+
+	index := treeIndex.Bytes32()
+	for i := 0; i < len(index)/2; i++ {
+		index[i], index[len(index)-1-i] = index[len(index)-1-i], index[i]
+	}
+	verkle.FromLEBytes(&poly[3], index[:16])
+	verkle.FromLEBytes(&poly[4], index[16:])
+	for i := 5; i < len(poly); i++ {
+		verkle.CopyFr(&poly[i], &verkle.FrZero)
+	}
+	cfg, _ := verkle.GetConfig()
+	key := cfg.CommitToPoly(poly[:], 0).Bytes()
+	key[31] = subIndex
+	return key[:]
+}
+
+// GetTreeKeyAccountLeaf computes the key of one of the account header leaves.
+func GetTreeKeyAccountLeaf(address []byte, leaf byte) []byte {
+	return GetTreeKey(address, zero, leaf)
+}
+
+// GetTreeKeyVersion computes the key of the account version.
+func GetTreeKeyVersion(address []byte) []byte {
+	return GetTreeKey(address, zero, VersionLeafKey)
+}
+
+// GetTreeKeyBalance computes the key of the account balance.
+func GetTreeKeyBalance(address []byte) []byte {
+	return GetTreeKey(address, zero, BalanceLeafKey)
+}
+
+// GetTreeKeyNonce computes the key of the account nonce.
+func GetTreeKeyNonce(address []byte) []byte {
+	return GetTreeKey(address, zero, NonceLeafKey)
+}
+
+// GetTreeKeyCodeKeccak computes the key of the hash of the account code.
+func GetTreeKeyCodeKeccak(address []byte) []byte {
+	return GetTreeKey(address, zero, CodeKeccakLeafKey)
+}
+
+// GetTreeKeyCodeSize computes the key of the size of the account code.
+func GetTreeKeyCodeSize(address []byte) []byte {
+	return GetTreeKey(address, zero, CodeSizeLeafKey)
+}
+
+// GetTreeKeyCodeChunk computes the key of the code chunk with the given number.
+func GetTreeKeyCodeChunk(address []byte, chunk *uint256.Int) []byte {
+	pos := new(uint256.Int).Add(CodeOffset, chunk)
+	return getTreeKeyAt(address, pos)
+}
+
+// GetTreeKeyStorageSlot computes the key of the given storage slot. The first
+// few slots are kept next to the account header, the rest is spread over the
+// main storage space.
+func GetTreeKeyStorageSlot(address []byte, slot *uint256.Int) []byte {
+	pos := new(uint256.Int)
+	if slot.Cmp(codeStorageDelta) < 0 {
+		pos.Add(HeaderStorageOffset, slot)
+	} else {
+		pos.Add(MainStorageOffset, slot)
+	}
+	return getTreeKeyAt(address, pos)
+}
+
+// getTreeKeyAt computes the key of the leaf at the given absolute position in
+// the address' key space.
+func getTreeKeyAt(address []byte, pos *uint256.Int) []byte {
+	var (
+		treeIndex = new(uint256.Int).Div(pos, VerkleNodeWidth)
+		subIndex  = new(uint256.Int).Mod(pos, VerkleNodeWidth)
+	)
+	return GetTreeKey(address, treeIndex, byte(subIndex.Uint64()))
+}
+
+// ChunkifyCode splits the code into 31 byte chunks, each of them prefixed by the
+// number of its leading bytes that are the immediate data of a PUSH instruction
+// started in a previous chunk. The returned slice is the concatenation of the
+// resulting 32 byte leaves.
+func ChunkifyCode(code []byte) []byte {
+	var (
+		chunks  = (len(code) + 30) / 31
+		output  = make([]byte, chunks*32)
+		pushEnd = 0 // Offset of the first byte after the immediate data of the last PUSH
+	)
+	for i := 0; i < chunks; i++ {
+		start, end := i*31, (i+1)*31
+		if end > len(code) {
+			end = len(code)
+		}
+		leading := pushEnd - start
+		if leading < 0 {
+			leading = 0
+		}
+		if leading > 31 {
+			leading = 31
+		}
+		output[i*32] = byte(leading)
+		copy(output[i*32+1:], code[start:end])
+
+		for pc := start + leading; pc < end; pc++ {
+			if op := code[pc]; op >= push1 && op <= push32 {
+				pc += int(op - push1 + 1)
+				pushEnd = pc + 1
+			}
+		}
+	}
+	return output
+}
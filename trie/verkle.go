@@ -0,0 +1,416 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie/utils"
+	"github.com/gballet/go-verkle"
+)
+
+// verkleInternalNode is the type marker of serialized internal verkle nodes.
+const verkleInternalNode = 1
+
+var (
+	// errInvalidVerkleProof is returned if a verkle proof doesn't match the root
+	// commitment and the proven values.
+	errInvalidVerkleProof = errors.New("invalid verkle proof")
+
+	// errVerkleValueTooLong is returned when inserting a value not fitting into
+	// a single verkle leaf.
+	errVerkleValueTooLong = errors.New("value longer than 32 bytes")
+)
+
+// VerkleTrie is a verkle tree implementing the same interface as the Merkle
+// Patricia tries used by the state. Opposed to those, there are no separate
+// storage tries: accounts are keyed by their addresses and are spread over the
+// header leaves of their stem, while everything else, storage slots and code
+// chunks included, is keyed by the tree keys derived with the trie/utils package.
+//
+// The nodes are persisted keyed by their commitments, bypassing the in-memory
+// node cache of the trie database.
+type VerkleTrie struct {
+	root    verkle.VerkleNode
+	db      *Database
+	witness map[string]struct{} // Encoded nodes resolved from the database
+}
+
+// NewVerkleTrie opens the verkle tree with the given root commitment, or creates
+// an empty one if the root is empty.
+func NewVerkleTrie(root common.Hash, db *Database) (*VerkleTrie, error) {
+	t := &VerkleTrie{db: db, witness: make(map[string]struct{})}
+	if root == (common.Hash{}) {
+		t.root = verkle.New()
+		return t, nil
+	}
+	blob, err := db.diskdb.Get(root[:])
+	if err != nil || len(blob) == 0 {
+		return nil, &MissingNodeError{NodeHash: root}
+	}
+	t.witness[string(blob)] = struct{}{}
+	if t.root, err = parseVerkleNode(blob, 0, root[:]); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseVerkleNode decodes a persisted verkle node. Opposed to verkle.ParseNode,
+// internal nodes are decoded into regular nodes with hashed children instead of
+// stateless ones, which don't support deletions and can't be recommitted.
+func parseVerkleNode(blob []byte, depth byte, commitment []byte) (verkle.VerkleNode, error) {
+	if len(blob) > 33 && blob[0] == verkleInternalNode {
+		return verkle.CreateInternalNode(blob[1:33], blob[33:], depth, commitment)
+	}
+	return verkle.ParseNode(blob, depth, commitment)
+}
+
+// resolve retrieves a persisted node by its commitment.
+func (t *VerkleTrie) resolve(commitment []byte) ([]byte, error) {
+	blob, err := t.db.diskdb.Get(commitment)
+	if err == nil && len(blob) > 0 {
+		t.witness[string(blob)] = struct{}{}
+	}
+	return blob, err
+}
+
+// resolvePath loads all the persisted nodes along the path of the given key,
+// so that the tree operations never have to resolve nodes on their own.
+func (t *VerkleTrie) resolvePath(key []byte) error {
+	n, ok := t.root.(*verkle.InternalNode)
+	for depth := 0; ok && depth < len(key); {
+		children := n.Children()
+		switch child := children[key[depth]].(type) {
+		case *verkle.HashedNode:
+			commitment := child.Commitment().Bytes()
+			blob, err := t.resolve(commitment[:])
+			if err != nil || len(blob) == 0 {
+				return &MissingNodeError{NodeHash: commitment, Path: common.CopyBytes(key[:depth+1])}
+			}
+			node, err := parseVerkleNode(blob, byte(depth+1), commitment[:])
+			if err != nil {
+				return err
+			}
+			children[key[depth]] = node
+		case *verkle.InternalNode:
+			n, depth = child, depth+1
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// GetKey returns the key itself, as keys are not hashed before insertion.
+func (t *VerkleTrie) GetKey(key []byte) []byte {
+	return key
+}
+
+// TryGet returns the value stored at the given key. If the key is an address,
+// the account is assembled from its header leaves and returned RLP encoded.
+//
+// Deleted leaves are zeroed out rather than removed from the tree, so a leaf
+// containing only zeroes is reported as missing.
+func (t *VerkleTrie) TryGet(key []byte) ([]byte, error) {
+	if len(key) != common.AddressLength {
+		return t.get(key)
+	}
+	var (
+		stem   = utils.GetTreeKeyVersion(key)
+		leaves = make([][]byte, utils.CodeSizeLeafKey+1)
+	)
+	for i := range leaves {
+		stem[31] = byte(i)
+		leaf, err := t.get(stem)
+		if err != nil {
+			return nil, err
+		}
+		leaves[i] = leaf
+	}
+	// Every existing account has a code hash, even if the code is empty
+	if leaves[utils.CodeKeccakLeafKey] == nil {
+		return nil, nil
+	}
+	acc := &types.StateAccount{
+		Nonce:    binary.LittleEndian.Uint64(leftPad32(leaves[utils.NonceLeafKey])),
+		Balance:  new(big.Int).SetBytes(reverse(leftPad32(leaves[utils.BalanceLeafKey]))),
+		Root:     emptyRoot,
+		CodeHash: leaves[utils.CodeKeccakLeafKey],
+	}
+	return rlp.EncodeToBytes(acc)
+}
+
+// get retrieves a single leaf, resolving the nodes on its path if needed.
+func (t *VerkleTrie) get(key []byte) ([]byte, error) {
+	if err := t.resolvePath(key); err != nil {
+		return nil, err
+	}
+	value, err := t.root.Get(key, t.resolve)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	for _, b := range value {
+		if b != 0 {
+			return value, nil
+		}
+	}
+	return nil, nil
+}
+
+// TryUpdateAccount writes the header leaves of the account with the given
+// address. The storage root of the account is meaningless in a verkle tree
+// and it's ignored.
+func (t *VerkleTrie) TryUpdateAccount(key []byte, acc *types.StateAccount) error {
+	var (
+		stem    = utils.GetTreeKeyVersion(key)
+		version [32]byte
+		balance [32]byte
+		nonce   [32]byte
+	)
+	if b := acc.Balance.Bytes(); len(b) > 0 {
+		copy(balance[:], reverse(b))
+	}
+	binary.LittleEndian.PutUint64(nonce[:], acc.Nonce)
+
+	leaves := map[byte][]byte{
+		utils.VersionLeafKey:    version[:],
+		utils.BalanceLeafKey:    balance[:],
+		utils.NonceLeafKey:      nonce[:],
+		utils.CodeKeccakLeafKey: acc.CodeHash,
+	}
+	for leaf, value := range leaves {
+		key := common.CopyBytes(stem)
+		key[31] = leaf
+		if err := t.insert(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TryUpdate associates the key with the value. Values are stored in 32 byte
+// leaves, shorter ones are padded with zeroes on the right, matching the little
+// endian encoding of the numbers stored in the tree.
+func (t *VerkleTrie) TryUpdate(key, value []byte) error {
+	if len(value) == 0 {
+		return t.TryDelete(key)
+	}
+	if len(value) > 32 {
+		return errVerkleValueTooLong
+	}
+	leaf := make([]byte, 32)
+	copy(leaf, value)
+	return t.insert(key, leaf)
+}
+
+// insert stores a single leaf, resolving the nodes on its path if needed.
+func (t *VerkleTrie) insert(key, value []byte) error {
+	if err := t.resolvePath(key); err != nil {
+		return err
+	}
+	return t.root.Insert(key, value, t.resolve)
+}
+
+// TryDelete removes the value stored at the given key. If the key is an address,
+// all the header leaves of the account are removed.
+func (t *VerkleTrie) TryDelete(key []byte) error {
+	if len(key) != common.AddressLength {
+		return t.delete(key)
+	}
+	stem := utils.GetTreeKeyVersion(key)
+	for i := 0; i <= utils.CodeSizeLeafKey; i++ {
+		key := common.CopyBytes(stem)
+		key[31] = byte(i)
+		if err := t.delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete zeroes out a single leaf, if it exists.
+func (t *VerkleTrie) delete(key []byte) error {
+	value, err := t.get(key)
+	if err != nil || value == nil {
+		return err
+	}
+	return t.root.Delete(key, t.resolve)
+}
+
+// Witness returns the encoded form of all the nodes resolved from the database
+// since the tree was opened.
+func (t *VerkleTrie) Witness() map[string]struct{} {
+	witness := make(map[string]struct{}, len(t.witness))
+	for blob := range t.witness {
+		witness[blob] = struct{}{}
+	}
+	return witness
+}
+
+// Hash returns the root commitment of the tree.
+func (t *VerkleTrie) Hash() common.Hash {
+	return common.Hash(t.root.Commit().Bytes())
+}
+
+// Commit computes the commitments of the tree and writes all the loaded nodes
+// to disk. The leaf callback is never invoked, there are no storage tries to
+// be referenced.
+func (t *VerkleTrie) Commit(onleaf LeafCallback) (common.Hash, int, error) {
+	root := t.Hash()
+
+	batch := t.db.diskdb.NewBatch()
+	nodes, err := t.flush(t.root, batch)
+	if err != nil {
+		return common.Hash{}, 0, err
+	}
+	if err := batch.Write(); err != nil {
+		return common.Hash{}, 0, err
+	}
+	return root, nodes, nil
+}
+
+// flush writes the given node and all its loaded descendants into the batch,
+// returning the number of nodes written.
+func (t *VerkleTrie) flush(n verkle.VerkleNode, batch ethdb.Batch) (int, error) {
+	var children []verkle.VerkleNode
+	switch n := n.(type) {
+	case *verkle.InternalNode:
+		children = n.Children()
+	case *verkle.LeafNode:
+	default:
+		return 0, nil // Empty or already persisted
+	}
+	var nodes int
+	for _, child := range children {
+		count, err := t.flush(child, batch)
+		if err != nil {
+			return 0, err
+		}
+		nodes += count
+	}
+	blob, err := n.Serialize()
+	if err != nil {
+		return 0, err
+	}
+	commitment := n.Commitment().Bytes()
+	if err := batch.Put(commitment[:], blob); err != nil {
+		return 0, err
+	}
+	if batch.ValueSize() >= ethdb.IdealBatchSize {
+		if err := batch.Write(); err != nil {
+			return 0, err
+		}
+		batch.Reset()
+	}
+	return nodes + 1, nil
+}
+
+// NodeIterator returns an iterator over the nodes and the leaves of the tree,
+// starting at the given key.
+func (t *VerkleTrie) NodeIterator(start []byte) NodeIterator {
+	return newVerkleNodeIterator(t, start)
+}
+
+// Prove writes the serialized verkle proof of the given key into the proof
+// database, keyed by the key itself. The proof of a verkle tree is a single
+// multiproof rather than a list of nodes, so fromLevel is ignored.
+func (t *VerkleTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error {
+	proof, _, err := t.ProveKeys([][]byte{key})
+	if err != nil {
+		return err
+	}
+	return proofDb.Put(key, proof)
+}
+
+// ProveKeys creates a serialized multiproof of the given keys, returning it with
+// the proven key-value pairs.
+func (t *VerkleTrie) ProveKeys(keys [][]byte) ([]byte, []verkle.KeyValuePair, error) {
+	// Resolve all the nodes along the proven paths, the proof can't be built
+	// with any of them missing
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if err := t.resolvePath(key); err != nil {
+			return nil, nil, err
+		}
+		value, err := t.root.Get(key, t.resolve)
+		if err != nil {
+			return nil, nil, err
+		}
+		values[string(key)] = value
+	}
+	proof, _, _, _, err := verkle.MakeVerkleMultiProof(t.root, keys, values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return verkle.SerializeProof(proof)
+}
+
+// VerifyVerkleProof checks that the serialized multiproof proves the given
+// key-value pairs against the root commitment. Absent keys have nil values.
+func VerifyVerkleProof(root common.Hash, proof []byte, keyvals []verkle.KeyValuePair) error {
+	deserialized, err := verkle.DeserializeProof(proof, keyvals)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidVerkleProof, err)
+	}
+	var commitment verkle.Point
+	if err := commitment.SetBytes(root[:]); err != nil {
+		return fmt.Errorf("%w: %v", errInvalidVerkleProof, err)
+	}
+	tree, err := verkle.TreeFromProof(deserialized, &commitment)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidVerkleProof, err)
+	}
+	keys := make([][]byte, len(keyvals))
+	for i, kv := range keyvals {
+		keys[i] = kv.Key
+	}
+	elements, _, _ := verkle.GetCommitmentsForMultiproof(tree, keys)
+
+	cfg, err := verkle.GetConfig()
+	if err != nil {
+		return err
+	}
+	if !verkle.VerifyVerkleProof(deserialized, elements.Cis, elements.Zis, elements.Yis, cfg) {
+		return errInvalidVerkleProof
+	}
+	return nil
+}
+
+// leftPad32 returns the given 32 byte leaf, or an all zero one if it's missing.
+func leftPad32(leaf []byte) []byte {
+	if len(leaf) == 0 {
+		return make([]byte, 32)
+	}
+	return leaf
+}
+
+// reverse returns a copy of the given slice with the byte order reversed,
+// converting between little and big endian encodings.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,217 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/gballet/go-verkle"
+)
+
+// verkleIteratorState represents the iteration state at one particular node of
+// the verkle tree.
+type verkleIteratorState struct {
+	node  verkle.VerkleNode // Tree node being iterated, nil if positioned at a value
+	hash  common.Hash       // Commitment of the node, empty for values
+	path  []byte            // Child indices leading to the node, or the key of the value
+	value []byte            // Value of the leaf, if positioned at one
+	index int               // Child to be processed next
+}
+
+// verkleNodeIterator is a pre-order iterator over the nodes and the values of a
+// verkle tree. Paths are the sequences of child indices leading to the nodes,
+// whereas the paths of the values are their full keys.
+type verkleNodeIterator struct {
+	trie    *VerkleTrie
+	start   []byte
+	stack   []*verkleIteratorState
+	started bool
+	err     error
+
+	resolver ethdb.KeyValueStore // Optional intermediate resolver above the disk layer
+}
+
+func newVerkleNodeIterator(trie *VerkleTrie, start []byte) NodeIterator {
+	return &verkleNodeIterator{trie: trie, start: start}
+}
+
+// Next moves the iterator to the next node or value. If the parameter is false,
+// the children of the current node are skipped.
+func (it *verkleNodeIterator) Next(descend bool) bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.started = true
+		if _, ok := it.trie.root.(verkle.Empty); ok {
+			it.err = errIteratorEnd
+			return false
+		}
+		commitment := it.trie.root.Commit().Bytes()
+		it.stack = append(it.stack, &verkleIteratorState{node: it.trie.root, hash: commitment})
+		return true
+	}
+	if !descend && len(it.stack) > 0 {
+		it.stack[len(it.stack)-1].index = verkle.NodeWidth
+	}
+	for len(it.stack) > 0 {
+		state := it.stack[len(it.stack)-1]
+		child, err := it.nextChild(state)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if child != nil {
+			it.stack = append(it.stack, child)
+			return true
+		}
+		it.stack = it.stack[:len(it.stack)-1]
+	}
+	it.err = errIteratorEnd
+	return false
+}
+
+// nextChild returns the next child of the given node not preceding the start
+// key, or nil if all the children have been iterated.
+func (it *verkleNodeIterator) nextChild(state *verkleIteratorState) (*verkleIteratorState, error) {
+	switch n := state.node.(type) {
+	case *verkle.InternalNode:
+		children := n.Children()
+		for ; state.index < verkle.NodeWidth; state.index++ {
+			child := children[state.index]
+			if _, ok := child.(verkle.Empty); ok {
+				continue
+			}
+			path := append(common.CopyBytes(state.path), byte(state.index))
+			if it.precedes(path) {
+				continue
+			}
+			state.index++
+
+			if hashed, ok := child.(*verkle.HashedNode); ok {
+				var err error
+				if child, err = it.resolve(hashed.Commitment().Bytes(), path); err != nil {
+					return nil, err
+				}
+			}
+			return &verkleIteratorState{node: child, hash: child.Commitment().Bytes(), path: path}, nil
+		}
+	case *verkle.LeafNode:
+		for ; state.index < verkle.NodeWidth; state.index++ {
+			value := n.Value(state.index)
+			if value == nil {
+				continue
+			}
+			key := n.Key(state.index)
+			if bytes.Compare(key, it.start) < 0 {
+				continue
+			}
+			state.index++
+			return &verkleIteratorState{path: key, value: value}, nil
+		}
+	}
+	return nil, nil
+}
+
+// precedes reports whether the subtree at the given path contains only keys
+// preceding the start key.
+func (it *verkleNodeIterator) precedes(path []byte) bool {
+	if len(it.start) < len(path) {
+		return bytes.Compare(path[:len(it.start)], it.start) < 0
+	}
+	return bytes.Compare(path, it.start[:len(path)]) < 0
+}
+
+// resolve loads the node with the given commitment, without attaching it to
+// the tree being iterated.
+func (it *verkleNodeIterator) resolve(commitment [32]byte, path []byte) (verkle.VerkleNode, error) {
+	if it.resolver != nil {
+		if blob, err := it.resolver.Get(commitment[:]); err == nil && len(blob) > 0 {
+			return parseVerkleNode(blob, byte(len(path)), commitment[:])
+		}
+	}
+	blob, err := it.trie.resolve(commitment[:])
+	if err != nil || len(blob) == 0 {
+		return nil, &MissingNodeError{NodeHash: commitment, Path: path}
+	}
+	return parseVerkleNode(blob, byte(len(path)), commitment[:])
+}
+
+func (it *verkleNodeIterator) Error() error {
+	if it.err == errIteratorEnd {
+		return nil
+	}
+	return it.err
+}
+
+func (it *verkleNodeIterator) Hash() common.Hash {
+	if len(it.stack) == 0 {
+		return common.Hash{}
+	}
+	return it.stack[len(it.stack)-1].hash
+}
+
+func (it *verkleNodeIterator) Parent() common.Hash {
+	if len(it.stack) < 2 {
+		return common.Hash{}
+	}
+	return it.stack[len(it.stack)-2].hash
+}
+
+func (it *verkleNodeIterator) Path() []byte {
+	if len(it.stack) == 0 {
+		return nil
+	}
+	return it.stack[len(it.stack)-1].path
+}
+
+func (it *verkleNodeIterator) Leaf() bool {
+	return len(it.stack) > 0 && it.stack[len(it.stack)-1].node == nil
+}
+
+func (it *verkleNodeIterator) LeafKey() []byte {
+	if !it.Leaf() {
+		panic("not at leaf")
+	}
+	return it.stack[len(it.stack)-1].path
+}
+
+func (it *verkleNodeIterator) LeafBlob() []byte {
+	if !it.Leaf() {
+		panic("not at leaf")
+	}
+	return it.stack[len(it.stack)-1].value
+}
+
+// LeafProof returns the serialized verkle proof of the current value as the
+// only element of the list.
+func (it *verkleNodeIterator) LeafProof() [][]byte {
+	if !it.Leaf() {
+		panic("not at leaf")
+	}
+	proof, _, err := it.trie.ProveKeys([][]byte{it.LeafKey()})
+	if err != nil {
+		panic(err)
+	}
+	return [][]byte{proof}
+}
+
+func (it *verkleNodeIterator) AddResolver(resolver ethdb.KeyValueStore) {
+	it.resolver = resolver
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie/utils"
+	"github.com/gballet/go-verkle"
+	"github.com/holiman/uint256"
+)
+
+// makeVerkleKeys generates some keys sharing stems as well as some sharing only
+// short prefixes, to exercise both leaf updates and node splits.
+func makeVerkleKeys(n int) [][]byte {
+	keys := make([][]byte, 0, n)
+	for i := 0; len(keys) < n; i++ {
+		key := crypto.Keccak256(big.NewInt(int64(i)).Bytes())
+		keys = append(keys, key)
+		if len(keys) < n {
+			sibling := common.CopyBytes(key)
+			sibling[31]++
+			keys = append(keys, sibling)
+		}
+	}
+	return keys
+}
+
+// Tests that a verkle tree built across several commits and reopens ends up
+// with the same root as one built entirely in memory.
+func TestVerkleTrieReopen(t *testing.T) {
+	var (
+		keys     = makeVerkleKeys(200)
+		memtree  = verkle.New()
+		triedb   = NewDatabase(memorydb.New())
+		root     common.Hash
+		inserted int
+	)
+	for _, key := range keys {
+		if err := memtree.Insert(key, key, nil); err != nil {
+			t.Fatalf("failed to insert into memory tree: %v", err)
+		}
+	}
+	for inserted < len(keys) {
+		tr, err := NewVerkleTrie(root, triedb)
+		if err != nil {
+			t.Fatalf("failed to open tree %x: %v", root, err)
+		}
+		for _, key := range keys[inserted : inserted+50] {
+			if err := tr.TryUpdate(key, key); err != nil {
+				t.Fatalf("failed to insert key %x: %v", key, err)
+			}
+		}
+		inserted += 50
+
+		if root, _, err = tr.Commit(nil); err != nil {
+			t.Fatalf("failed to commit tree: %v", err)
+		}
+	}
+	if want := common.Hash(memtree.Commit().Bytes()); root != want {
+		t.Fatalf("root mismatch: have %x, want %x", root, want)
+	}
+	tr, err := NewVerkleTrie(root, triedb)
+	if err != nil {
+		t.Fatalf("failed to open tree %x: %v", root, err)
+	}
+	for _, key := range keys {
+		value, err := tr.TryGet(key)
+		if err != nil {
+			t.Fatalf("failed to retrieve key %x: %v", key, err)
+		}
+		if !bytes.Equal(value, key) {
+			t.Fatalf("value mismatch for key %x: have %x, want %x", key, value, key)
+		}
+	}
+	// Iterate over the persisted tree and ensure all the values are found
+	it, values := tr.NodeIterator(nil), 0
+	for it.Next(true) {
+		if it.Leaf() {
+			if !bytes.Equal(it.LeafKey(), it.LeafBlob()) {
+				t.Fatalf("value mismatch for key %x: have %x", it.LeafKey(), it.LeafBlob())
+			}
+			values++
+		}
+	}
+	if it.Error() != nil {
+		t.Fatalf("iteration failed: %v", it.Error())
+	}
+	if values != len(keys) {
+		t.Fatalf("iterated value count mismatch: have %d, want %d", values, len(keys))
+	}
+}
+
+// Tests that account updates are spread over the header leaves and that they
+// can be read back and deleted.
+func TestVerkleTrieAccounts(t *testing.T) {
+	tr, _ := NewVerkleTrie(common.Hash{}, NewDatabase(memorydb.New()))
+
+	addr := common.HexToAddress("0x1234")
+	acc := &types.StateAccount{
+		Nonce:    42,
+		Balance:  big.NewInt(1000000),
+		Root:     emptyRoot,
+		CodeHash: crypto.Keccak256([]byte{0x60, 0x00}),
+	}
+	if err := tr.TryUpdateAccount(addr[:], acc); err != nil {
+		t.Fatalf("failed to update account: %v", err)
+	}
+	nonce, err := tr.TryGet(utils.GetTreeKeyNonce(addr[:]))
+	if err != nil {
+		t.Fatalf("failed to retrieve nonce: %v", err)
+	}
+	if want := append([]byte{42}, make([]byte, 31)...); !bytes.Equal(nonce, want) {
+		t.Fatalf("nonce leaf mismatch: have %x, want %x", nonce, want)
+	}
+	blob, err := tr.TryGet(addr[:])
+	if err != nil {
+		t.Fatalf("failed to retrieve account: %v", err)
+	}
+	want, _ := rlp.EncodeToBytes(acc)
+	if !bytes.Equal(blob, want) {
+		t.Fatalf("account mismatch: have %x, want %x", blob, want)
+	}
+	slot := utils.GetTreeKeyStorageSlot(addr[:], uint256.NewInt(1))
+	if err := tr.TryUpdate(slot, []byte{0x01}); err != nil {
+		t.Fatalf("failed to update slot: %v", err)
+	}
+	if err := tr.TryDelete(addr[:]); err != nil {
+		t.Fatalf("failed to delete account: %v", err)
+	}
+	if blob, err := tr.TryGet(addr[:]); err != nil || blob != nil {
+		t.Fatalf("deleted account retrieved: %x, %v", blob, err)
+	}
+	if value, _ := tr.TryGet(slot); len(value) != 32 || value[0] != 0x01 {
+		t.Fatalf("storage slot mismatch: have %x", value)
+	}
+}
+
+// Tests that multiproofs of present and absent keys verify against the root and
+// that tampered values are rejected.
+func TestVerkleProof(t *testing.T) {
+	var (
+		keys   = makeVerkleKeys(100)
+		triedb = NewDatabase(memorydb.New())
+	)
+	tr, _ := NewVerkleTrie(common.Hash{}, triedb)
+	for _, key := range keys {
+		tr.TryUpdate(key, key)
+	}
+	root, _, err := tr.Commit(nil)
+	if err != nil {
+		t.Fatalf("failed to commit tree: %v", err)
+	}
+	// Prove from a reopened tree, with all the nodes to be resolved from disk
+	tr, _ = NewVerkleTrie(root, triedb)
+
+	absent := crypto.Keccak256([]byte("absent"))
+	proof, keyvals, err := tr.ProveKeys([][]byte{keys[0], keys[1], keys[42], absent})
+	if err != nil {
+		t.Fatalf("failed to create proof: %v", err)
+	}
+	if err := VerifyVerkleProof(root, proof, keyvals); err != nil {
+		t.Fatalf("failed to verify proof: %v", err)
+	}
+	for _, kv := range keyvals {
+		if bytes.Equal(kv.Key, absent) && kv.Value != nil {
+			t.Fatalf("absent key proven with value %x", kv.Value)
+		}
+	}
+	// Tamper with a proven value
+	tampered := make([]verkle.KeyValuePair, len(keyvals))
+	copy(tampered, keyvals)
+	for i, kv := range tampered {
+		if kv.Value != nil {
+			tampered[i].Value = keys[99]
+			break
+		}
+	}
+	if err := VerifyVerkleProof(root, proof, tampered); err == nil {
+		t.Fatalf("tampered proof verified")
+	}
+}
+
+func TestChunkifyCode(t *testing.T) {
+	// A PUSH32 in the last byte of the first chunk spills its data into the
+	// second chunk entirely and one byte into the third.
+	code := make([]byte, 70)
+	code[30] = 0x7f
+	code[62] = 0x01
+
+	chunks := utils.ChunkifyCode(code)
+	if len(chunks) != 3*32 {
+		t.Fatalf("chunk data length mismatch: have %d, want %d", len(chunks), 3*32)
+	}
+	if chunks[0] != 0 || chunks[32] != 31 || chunks[64] != 1 {
+		t.Fatalf("leading push data mismatch: have %d, %d, %d", chunks[0], chunks[32], chunks[64])
+	}
+	if !bytes.Equal(chunks[1:32], code[:31]) || !bytes.Equal(chunks[33:64], code[31:62]) {
+		t.Fatalf("chunk contents mismatch")
+	}
+}